@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/namely/broadway/pkg/cfg"
+	"github.com/namely/broadway/pkg/store/etcd3store"
+	"github.com/namely/broadway/pkg/store/etcdstore"
+)
+
+// MigrateCmd is executed by cli on `broadway migrate`. It copies the keys under
+// the etcd path from the etcd v2 API to the v3 API.
+var MigrateCmd = func(c *cli.Context) error {
+	etcdstore.Setup(cfg.GlobalCfg)
+	v3 := etcd3store.New(strings.Split(cfg.GlobalCfg.Etcd3Endpoints, ","), cfg.GlobalCfg.Etcd3Prefix)
+
+	ctx := context.Background()
+	copied := 0
+	err := etcdstore.Walk(ctx, cfg.GlobalCfg.EtcdPath, func(key, value string) error {
+		if err := v3.SetValue(ctx, key, value); err != nil {
+			return fmt.Errorf("copying %s: %s", key, err)
+		}
+		copied++
+		return nil
+	})
+	fmt.Printf("copied %d keys under %s to etcd v3\n", copied, cfg.GlobalCfg.EtcdPath)
+	return err
+}
@@ -1,30 +1,120 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"gopkg.in/urfave/cli.v1"
 
 	"github.com/namely/broadway/pkg/cfg"
 	"github.com/namely/broadway/pkg/deployment"
+	"github.com/namely/broadway/pkg/gitrepo"
+	"github.com/namely/broadway/pkg/secret"
 	"github.com/namely/broadway/pkg/server"
+	"github.com/namely/broadway/pkg/store"
+	"github.com/namely/broadway/pkg/store/etcd3store"
 	"github.com/namely/broadway/pkg/store/etcdstore"
+	"github.com/namely/broadway/pkg/store/sqlstore"
 )
 
 // ServerCmd is executed by cli on `broadway server`
 var ServerCmd = func(c *cli.Context) error {
-	etcdstore.Setup(cfg.GlobalCfg)  // configure etcd before using
+	st, err := newStore(cfg.GlobalCfg)
+	if err != nil {
+		return err
+	}
+	if err := checkoutPlaybooks(&cfg.GlobalCfg); err != nil {
+		return err
+	}
 	deployment.Setup(cfg.GlobalCfg) // configure kubernetes deployments before using
+	if err := secret.Setup(cfg.GlobalCfg); err != nil {
+		return err
+	}
 	fmt.Printf("starting server with config...\n%+v", cfg.GlobalCfg)
-	s := server.New(cfg.GlobalCfg, etcdstore.New())
+	s := server.New(cfg.GlobalCfg, st)
 	s.Init()
+
+	// SIGTERM is sent by Kubernetes to stop the pod
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		timeout := time.Duration(cfg.GlobalCfg.ShutdownTimeout) * time.Second
+		fmt.Printf("\nreceived %s, shutting down within %s...\n", sig, timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			fmt.Printf("shutdown interrupted: %s\n", err)
+		}
+	}()
+	// SIGHUP reloads the playbooks and manifests
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := s.Reload(); err != nil {
+				fmt.Printf("reload failed, keeping the loaded playbooks: %s\n", err)
+			}
+		}
+	}()
 	if err := s.Run(cfg.GlobalCfg.ServerHost); err != nil {
 		panic(err)
 	}
+	<-stopped
 	return nil
 }
 
+// checkoutPlaybooks checks out the git repository selected with
+// --playbooks-source=git and points the playbook and manifest folders at it
+func checkoutPlaybooks(c *cfg.Type) error {
+	switch c.PlaybooksSource {
+	case "", "dir":
+		return nil
+	case "git":
+		repo := gitrepo.New(*c)
+		commit, err := repo.Sync(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("checked out %s of %s at %s\n", repo.Ref, repo.URL, commit)
+		c.PlaybooksPath = repo.PlaybooksPath()
+		c.ManifestsPath = repo.ManifestsPath()
+		return nil
+	}
+	return fmt.Errorf("unknown playbooks source: %s", c.PlaybooksSource)
+}
+
+// newStore returns the store selected with --store
+func newStore(c cfg.Type) (store.Store, error) {
+	switch c.Store {
+	case "", "etcd":
+		etcdstore.Setup(c) // configure etcd before using
+		return etcdstore.New(), nil
+	case "etcd3":
+		return etcd3store.New(strings.Split(c.Etcd3Endpoints, ","), c.Etcd3Prefix), nil
+	case "memory":
+		if c.StoreFile == "" {
+			return store.NewMemory(), nil
+		}
+		return store.NewMemoryFile(c.StoreFile)
+	case "sqlite":
+		if c.StoreFile == "" {
+			return nil, fmt.Errorf("the sqlite store needs --store-file")
+		}
+		return sqlstore.Open(sqlstore.SQLite, c.StoreFile)
+	case "postgres":
+		return sqlstore.Open(sqlstore.Postgres, c.StoreDSN)
+	}
+	return nil, fmt.Errorf("unknown store: %s", c.Store)
+}
+
 // ServerCmdFlags declares what flags can be passed to the `server` subcommand
 var ServerCmdFlags = []cli.Flag{
 	cli.StringFlag{
@@ -54,6 +144,25 @@ var ServerCmdFlags = []cli.Flag{
 		EnvVar:      "SLACK_WEBHOOK",
 		Destination: &cfg.GlobalCfg.SlackWebhook,
 	},
+	cli.StringFlag{
+		Name:        "secret-key",
+		Usage:       "the base64 AES key encrypting secret vars",
+		EnvVar:      "BROADWAY_SECRET_KEY",
+		Destination: &cfg.GlobalCfg.SecretKey,
+	},
+	cli.StringFlag{
+		Name:        "secret-key-file",
+		Usage:       "a file holding the base64 AES key encrypting secret vars",
+		EnvVar:      "BROADWAY_SECRET_KEY_FILE",
+		Destination: &cfg.GlobalCfg.SecretKeyFile,
+	},
+	cli.IntFlag{
+		Name:        "shutdown-timeout",
+		Value:       25,
+		Usage:       "the amount of time in seconds to wait for requests and jobs to finish when stopping",
+		EnvVar:      "SHUTDOWN_TIMEOUT",
+		Destination: &cfg.GlobalCfg.ShutdownTimeout,
+	},
 }
 
 func main() {
@@ -73,6 +182,11 @@ func main() {
 			Action:  ServerCmd,
 			Flags:   ServerCmdFlags,
 		},
+		{
+			Name:   "migrate",
+			Usage:  "copy broadway's data from etcd v2 to etcd v3",
+			Action: MigrateCmd,
+		},
 	}
 	app.Run(os.Args)
 }
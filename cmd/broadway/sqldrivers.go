@@ -0,0 +1,8 @@
+package main
+
+// The SQL stores open their databases through these drivers. SQLite needs
+// cgo; binaries built with CGO_ENABLED=0 only support Postgres.
+import (
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
@@ -1,5 +1,7 @@
 package cfg
 
+import "fmt"
+
 // GlobalCfg is this deployment's global configuration object
 // Only touch this in main.go and cmd/*.go, inject cfg dependency into all other code
 var GlobalCfg Type
@@ -12,15 +14,50 @@ type Type struct {
 	K8sCertFile            string // the cert file setting for local development
 	K8sKeyFile             string // the key file setting for local development
 	K8sCAFile              string // the CA file setting for local development
+	K8sWaitTimeout         int    // the amount of time in seconds to wait for Kubernetes objects to be ready or deleted
+	Kubeconfig             string // kubeconfig files to load the Kubernetes configuration from, separated like $PATH
+	KubeContext            string // the kubeconfig context to use instead of the current one
+	ClustersPath           string // the file naming the Kubernetes clusters playbooks can deploy to
+	Store                  string // the store backend: etcd, etcd3, memory, sqlite or postgres
+	StoreFile              string // the file persisting the memory or sqlite store
+	StoreDSN               string // the data source name of the postgres store
 	EtcdEndpoints          string // the list Etcd hosts separated by comma
+	Etcd3Endpoints         string // the list of Etcd v3 hosts separated by comma
+	Etcd3Prefix            string // the path of the etcd v3 JSON gateway
 	EtcdPath               string // the root directory for Broadway objects
 	PlaybooksPath          string // the folder where playbooks are found
 	ManifestsPath          string // the folder where manifests are found
 	ManifestsExtension     string // .yml or .yaml
+	PlaybooksSource        string // where playbooks and manifests come from: dir or git
+	GitRepo                string // the repository holding playbooks/ and manifests/ with the git source
+	GitRef                 string // the branch or tag of the repository
+	GitDir                 string // where the repository is checked out
+	GitPullInterval        int    // the amount of time in seconds between pulls of the repository
 	AuthBearerToken        string // a global token required for all requests except GET/POST command/
 	SlackToken             string // the expected Slack custom command token.
 	ServerHost             string // passed to gin and configures the listen address of the server
 	SlackWebhook           string // your team's slack incoming message webhook URL
 	InstanceExpirationDays int    // the amount of time in days for expiring an Instance
 	InstanceCleanup        int    // the amount of time in seconds for doing the expired instances cleanup
+	JobWorkers             int    // the number of deployment jobs run at once
+	JobRetention           int    // the amount of time in hours finished jobs are kept
+	LockTTL                int    // the amount of time in seconds the locks of a stopped server are kept
+	ShutdownTimeout        int    // the amount of time in seconds to wait for requests and jobs when stopping
+	ReconcileInterval      int    // the amount of time in seconds between reconciliations of the instances with their clusters, 0 to turn them off
+	SecretKey              string // the base64 key encrypting secret vars
+	SecretKeyFile          string // the file holding the base64 key encrypting secret vars
+}
+
+// redacted replaces the values of secret settings when printing them
+const redacted = "[redacted]"
+
+// String prints the configuration without its tokens and keys
+func (c Type) String() string {
+	for _, s := range []*string{&c.AuthBearerToken, &c.SlackToken, &c.SlackWebhook, &c.StoreDSN, &c.SecretKey} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	type plain Type
+	return fmt.Sprintf("%+v", plain(c))
 }
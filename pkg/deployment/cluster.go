@@ -0,0 +1,29 @@
+package deployment
+
+import (
+	coreclient "k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3/typed/core/v1"
+	"k8s.io/kubernetes/pkg/client/restclient"
+)
+
+// Cluster is a Kubernetes cluster to deploy to. Its clients can be shared by
+// concurrent deployments.
+type Cluster struct {
+	Core      coreclient.CoreInterface
+	Resources ResourceClient
+	Namespace string // where objects go unless a playbook names a namespace
+
+	DefaultNamespace string // Broadway's namespace, when the cluster names another
+}
+
+// NewCluster creates the clients of the cluster configured by config
+func NewCluster(config *restclient.Config, namespace string) (*Cluster, error) {
+	core, err := coreclient.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := NewResourceClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{Core: core, Resources: resources, Namespace: namespace}, nil
+}
@@ -0,0 +1,139 @@
+package deployment
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/namely/broadway/pkg/cfg"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	clientcmdapi "k8s.io/kubernetes/pkg/client/unversioned/clientcmd/api"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ClusterConfig describes a Kubernetes cluster playbooks can deploy to. A
+// cluster is reached either through its host, CA and token, or through a
+// context of a kubeconfig file.
+type ClusterConfig struct {
+	Name       string `yaml:"name"`
+	Host       string `yaml:"host"`
+	CAFile     string `yaml:"ca_file"`
+	Token      string `yaml:"token"`
+	TokenFile  string `yaml:"token_file"`
+	Kubeconfig string `yaml:"kubeconfig"`
+	Context    string `yaml:"context"`
+	Namespace  string `yaml:"namespace"` // the namespace deployments default to
+}
+
+// AllClusters is a map of cluster names to clusters
+var AllClusters = map[string]*ClusterConfig{}
+
+// SetupClusters loads the clusters file of an injected configuration
+func SetupClusters(cfg cfg.Type) {
+	AllClusters = map[string]*ClusterConfig{}
+	if cfg.ClustersPath == "" {
+		return
+	}
+	var err error
+	AllClusters, err = LoadClusters(cfg.ClustersPath)
+	if err != nil {
+		glog.Fatal(err)
+	}
+}
+
+// Validate checks for a name and a way to reach the cluster
+func (c *ClusterConfig) Validate() error {
+	if len(c.Name) == 0 {
+		return errors.New("Cluster missing required name")
+	}
+	if c.Host == "" && c.Kubeconfig == "" {
+		return fmt.Errorf("Cluster %s requires a host or a kubeconfig", c.Name)
+	}
+	if c.Host != "" && c.Kubeconfig != "" {
+		return fmt.Errorf("Cluster %s can't have both a host and a kubeconfig", c.Name)
+	}
+	return nil
+}
+
+// Config returns the client configuration of the cluster, and the namespace
+// its deployments default to if it names one
+func (c *ClusterConfig) Config() (*restclient.Config, string, error) {
+	if c.Kubeconfig != "" {
+		config, namespace, err := KubeconfigConfig(c.Kubeconfig, c.Context)
+		if err != nil {
+			return nil, "", err
+		}
+		if c.Namespace != "" {
+			namespace = c.Namespace
+		}
+		return config, namespace, nil
+	}
+
+	token := c.Token
+	if c.TokenFile != "" {
+		data, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, "", err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	return &restclient.Config{
+		Host:            c.Host,
+		BearerToken:     token,
+		TLSClientConfig: restclient.TLSClientConfig{CAFile: c.CAFile},
+	}, c.Namespace, nil
+}
+
+// Connect creates the clients of the cluster. Deployments go into
+// defaultNamespace unless the cluster names a namespace.
+func (c *ClusterConfig) Connect(defaultNamespace string) (*Cluster, error) {
+	config, namespace, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	cluster, err := NewCluster(config, namespace)
+	if err != nil {
+		return nil, err
+	}
+	cluster.DefaultNamespace = defaultNamespace
+	return cluster, nil
+}
+
+// LoadClusters parses a clusters file, which lists clusters under a
+// `clusters` key. Relative paths are resolved against the directory of the
+// file.
+func LoadClusters(filename string) (map[string]*ClusterConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Clusters []*ClusterConfig `yaml:"clusters"`
+	}
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("Failed to parse clusters file %s: %s", filename, err)
+	}
+
+	dir := filepath.Dir(filename)
+	clusters := map[string]*ClusterConfig{}
+	for _, c := range f.Clusters {
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		c.CAFile = clientcmdapi.ResolvePath(c.CAFile, dir)
+		c.TokenFile = clientcmdapi.ResolvePath(c.TokenFile, dir)
+		c.Kubeconfig = clientcmdapi.ResolvePath(c.Kubeconfig, dir)
+		if _, ok := clusters[c.Name]; ok {
+			return nil, fmt.Errorf("Cluster %s is declared twice", c.Name)
+		}
+		clusters[c.Name] = c
+	}
+	return clusters, nil
+}
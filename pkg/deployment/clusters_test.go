@@ -0,0 +1,123 @@
+package deployment
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestFiles writes files named by their keys into a new directory
+func writeTestFiles(files map[string]string) string {
+	dir, err := ioutil.TempDir("", "clusters_test_")
+	if err != nil {
+		panic(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			panic(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadClusters(t *testing.T) {
+	dir := writeTestFiles(map[string]string{
+		"clusters.yml": clusterst1,
+		"qa.token":     "qatoken\n",
+		"kubeconfig":   kubeconfigt1,
+	})
+	defer os.RemoveAll(dir)
+
+	clusters, err := LoadClusters(filepath.Join(dir, "clusters.yml"))
+	assert.Nil(t, err)
+	assert.Len(t, clusters, 3)
+
+	config, ns, err := clusters["staging"].Config()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://staging.example.com", config.Host)
+	assert.Equal(t, "stagingtoken", config.BearerToken)
+	assert.Equal(t, "/etc/broadway/staging-ca.crt", config.CAFile)
+	assert.Equal(t, "", ns, "staging doesn't name a namespace")
+
+	config, ns, err = clusters["qa"].Config()
+	assert.Nil(t, err)
+	assert.Equal(t, "qatoken", config.BearerToken)
+	assert.Equal(t, "qa", ns)
+
+	config, ns, err = clusters["dev"].Config()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://dev.example.com", config.Host)
+	assert.Equal(t, "devtoken", config.BearerToken)
+	assert.Equal(t, "dev-apps", ns, "the context's namespace should be used")
+}
+
+func TestClusterValidate(t *testing.T) {
+	cases := []struct {
+		Scenario    string
+		Cluster     *ClusterConfig
+		ExpectedErr string
+	}{
+		{"Missing name", &ClusterConfig{Host: "https://k8s"}, "Cluster missing required name"},
+		{"Missing host", &ClusterConfig{Name: "qa"}, "Cluster qa requires a host or a kubeconfig"},
+		{"Host and kubeconfig", &ClusterConfig{Name: "qa", Host: "https://k8s", Kubeconfig: "kubeconfig"}, "Cluster qa can't have both a host and a kubeconfig"},
+	}
+
+	for _, c := range cases {
+		assert.EqualError(t, c.Cluster.Validate(), c.ExpectedErr, c.Scenario)
+	}
+}
+
+func TestPlaybookClusterName(t *testing.T) {
+	p := &Playbook{Cluster: `{{if eq .env "qa"}}qa{{else}}staging{{end}}`}
+	name, err := p.ClusterName(map[string]string{"env": "qa"})
+	assert.Nil(t, err)
+	assert.Equal(t, "qa", name)
+
+	name, err = (&Playbook{}).ClusterName(map[string]string{"env": "qa"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", name, "playbooks without a cluster use the default one")
+}
+
+var clusterst1 = `clusters:
+- name: staging
+  host: https://staging.example.com
+  ca_file: /etc/broadway/staging-ca.crt
+  token: stagingtoken
+- name: qa
+  host: https://qa.example.com
+  token_file: qa.token
+  namespace: qa
+- name: dev
+  kubeconfig: kubeconfig
+  context: dev
+`
+
+var kubeconfigt1 = `apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com
+    certificate-authority: dev-ca.crt
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: developer
+  user:
+    token: devtoken
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: developer
+    namespace: dev-apps
+- name: prod
+  context:
+    cluster: prod
+    user: developer
+`
@@ -41,8 +41,14 @@ func IsKubernetesEnv(cfg cfg.Type) bool {
 	return true
 }
 
-// Config returns a kubernetes configuration
+// Config returns a kubernetes configuration. A kubeconfig set in cfg is
+// preferred over the service account of a pod and the local flags.
 func Config(cfg cfg.Type) (*restclient.Config, error) {
+	if cfg.Kubeconfig != "" {
+		config, _, err := KubeconfigConfig(cfg.Kubeconfig, cfg.KubeContext)
+		return config, err
+	}
+
 	config := LocalConfig(cfg)
 	if IsKubernetesEnv(cfg) {
 		var err error
@@ -0,0 +1,125 @@
+package deployment
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+// ignoreNotFound lets deletions of objects that are already gone succeed
+func ignoreNotFound(err error) error {
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// deployPod replaces an existing pod if it differs from the manifest
+func deployPod(s *ManifestStep) error {
+	o := s.object.(*v1.Pod)
+	pod, err := s.cluster.Core.Pods(s.namespace).Get(o.ObjectMeta.Name)
+
+	if err == nil && pod != nil {
+		if comparePods(pod, o) {
+			glog.Info("Existing Pod is identical, skipping deployment")
+			return nil
+		}
+		glog.Info("Deleting old pod", o.ObjectMeta.Name)
+		err = s.cluster.Core.Pods(s.namespace).Delete(o.ObjectMeta.Name, nil)
+		if err == nil {
+			err = s.cluster.waitForPodDeleted(s.namespace, o.ObjectMeta.Name, s.progress)
+		}
+		if err != nil {
+			glog.Error("delete old pods: ", err)
+		}
+	}
+
+	glog.Info("Creating new pod: ", o.ObjectMeta.Name)
+	_, err = s.cluster.Core.Pods(s.namespace).Create(o)
+	if err != nil {
+		glog.Info("Create or Update failed: ", err)
+		return err
+	}
+	return nil
+}
+
+// waitPod waits until the pod is ready or has run to completion
+func waitPod(s *ManifestStep) error {
+	o := s.object.(*v1.Pod)
+	return s.cluster.waitForPodReady(s.namespace, o.ObjectMeta.Name, s.progress)
+}
+
+func destroyPod(s *ManifestStep, name string) error {
+	return ignoreNotFound(s.cluster.Core.Pods(s.namespace).Delete(name, nil))
+}
+
+// deployService updates an existing service in place, keeping its cluster IP
+func deployService(s *ManifestStep) error {
+	o := s.object.(*v1.Service)
+	service, err := s.cluster.Core.Services(s.namespace).Get(o.ObjectMeta.Name)
+
+	if err != nil {
+		glog.Info("Creating new service: ", o.ObjectMeta.Name)
+		_, err = s.cluster.Core.Services(s.namespace).Create(o)
+	} else {
+		glog.Info("Updating service", o.ObjectMeta.Name)
+		o.ObjectMeta.ResourceVersion = service.ObjectMeta.ResourceVersion
+		o.Spec.ClusterIP = service.Spec.ClusterIP
+		_, err = s.cluster.Core.Services(s.namespace).Update(o)
+	}
+	if err != nil {
+		glog.Info("Create or Update failed: ", err)
+		return err
+	}
+	return nil
+}
+
+func destroyService(s *ManifestStep, name string) error {
+	return ignoreNotFound(s.cluster.Core.Services(s.namespace).Delete(name, nil))
+}
+
+func deployConfigMap(s *ManifestStep) error {
+	o := s.object.(*v1.ConfigMap)
+	cm, err := s.cluster.Core.ConfigMaps(s.namespace).Get(o.ObjectMeta.Name)
+
+	if err != nil {
+		glog.Info("Creating new config map: ", o.ObjectMeta.Name)
+		_, err = s.cluster.Core.ConfigMaps(s.namespace).Create(o)
+	} else {
+		glog.Info("Updating config map: ", o.ObjectMeta.Name)
+		o.ObjectMeta.ResourceVersion = cm.ObjectMeta.ResourceVersion
+		_, err = s.cluster.Core.ConfigMaps(s.namespace).Update(o)
+	}
+	if err != nil {
+		glog.Info("Create or Update failed: ", err)
+		return err
+	}
+	return nil
+}
+
+func destroyConfigMap(s *ManifestStep, name string) error {
+	return ignoreNotFound(s.cluster.Core.ConfigMaps(s.namespace).Delete(name, nil))
+}
+
+func deploySecret(s *ManifestStep) error {
+	o := s.object.(*v1.Secret)
+	secret, err := s.cluster.Core.Secrets(s.namespace).Get(o.ObjectMeta.Name)
+
+	if err != nil {
+		glog.Info("Creating new secret: ", o.ObjectMeta.Name)
+		_, err = s.cluster.Core.Secrets(s.namespace).Create(o)
+	} else {
+		glog.Info("Updating secret: ", o.ObjectMeta.Name)
+		o.ObjectMeta.ResourceVersion = secret.ObjectMeta.ResourceVersion
+		_, err = s.cluster.Core.Secrets(s.namespace).Update(o)
+	}
+	if err != nil {
+		glog.Info("Create or Update failed: ", err)
+		return err
+	}
+	return nil
+}
+
+func destroySecret(s *ManifestStep, name string) error {
+	return ignoreNotFound(s.cluster.Core.Secrets(s.namespace).Delete(name, nil))
+}
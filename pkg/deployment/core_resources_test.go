@@ -0,0 +1,95 @@
+package deployment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/testing/core"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+func TestCoreResourceDeploy(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Object   runtime.Object
+		Existing []runtime.Object
+		Expected []string
+	}{
+		{
+			Name:     "ConfigMap create",
+			Object:   mustDeserialize(configmapt1),
+			Expected: []string{"get", "create"},
+		},
+		{
+			Name:     "ConfigMap update",
+			Object:   mustDeserialize(configmapt1),
+			Existing: []runtime.Object{mustDeserialize(configmapt1)},
+			Expected: []string{"get", "update"},
+		},
+		{
+			Name:     "Secret create",
+			Object:   mustDeserialize(secrett1),
+			Expected: []string{"get", "create"},
+		},
+		{
+			Name:     "Secret update",
+			Object:   mustDeserialize(secrett1),
+			Existing: []runtime.Object{mustDeserialize(secrett1)},
+			Expected: []string{"get", "update"},
+		},
+	}
+
+	for _, c := range cases {
+		f := &core.Fake{}
+		o := core.NewObjects(api.Scheme, api.Codecs.UniversalDecoder())
+		for _, e := range c.Existing {
+			if err := o.Add(e); err != nil {
+				panic(err)
+			}
+		}
+		f.AddReactor("get", "*", core.ObjectReaction(o, api.RESTMapper))
+
+		err := NewManifestStep(testCluster(f, nil), c.Object).Deploy()
+		assert.Nil(t, err, c.Name+" deploy should not return with error")
+
+		verbs := []string{}
+		for _, a := range f.Actions() {
+			verbs = append(verbs, a.GetVerb())
+		}
+		assert.Equal(t, c.Expected, verbs, c.Name+" fired unexpected actions")
+	}
+}
+
+func TestUnrecognizedKind(t *testing.T) {
+	step := NewManifestStep(testCluster(&core.Fake{}, nil), mustDeserialize(endpointst1))
+	err := step.Deploy()
+	assert.EqualError(t, err, "Kubernetes resource is not recognized: Endpoints")
+	err = step.Destroy()
+	assert.EqualError(t, err, "Kubernetes resource is not recognized: Endpoints")
+}
+
+var configmapt1 = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  log_level: debug
+`
+
+var secrett1 = `apiVersion: v1
+kind: Secret
+metadata:
+  name: credentials
+type: Opaque
+data:
+  password: c2VjcmV0
+`
+
+var endpointst1 = `apiVersion: v1
+kind: Endpoints
+metadata:
+  name: external
+subsets: []
+`
@@ -0,0 +1,144 @@
+package deployment
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+// unstructured returns the step's object along with its group version and
+// REST resource name
+func (s *ManifestStep) unstructured() (*runtime.Unstructured, unversioned.GroupVersion, string, error) {
+	o, ok := s.object.(*runtime.Unstructured)
+	if !ok {
+		return nil, unversioned.GroupVersion{}, "", fmt.Errorf("deployment: %T is not an unstructured object", s.object)
+	}
+	gvk := o.GroupVersionKind()
+	resource, ok := genericResources[gvk]
+	if !ok {
+		return nil, unversioned.GroupVersion{}, "", fmt.Errorf("deployment: no resource registered for %s", gvk)
+	}
+	return o, gvk.GroupVersion(), resource, nil
+}
+
+// deployGeneric creates the object or replaces an existing one, carrying over
+// its resource version
+func deployGeneric(s *ManifestStep) error {
+	o, gv, resource, err := s.unstructured()
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.cluster.Resources.Get(gv, resource, s.namespace, o.GetName())
+	if err != nil {
+		glog.Infof("Creating new %s: %s", o.GetKind(), o.GetName())
+		_, err = s.cluster.Resources.Create(gv, resource, s.namespace, o)
+	} else {
+		glog.Infof("Updating %s: %s", o.GetKind(), o.GetName())
+		o.SetResourceVersion(existing.GetResourceVersion())
+		_, err = s.cluster.Resources.Update(gv, resource, s.namespace, o)
+	}
+	if err != nil {
+		glog.Info("Create or Update failed: ", err)
+		return err
+	}
+	return nil
+}
+
+func destroyGeneric(s *ManifestStep, name string) error {
+	_, gv, resource, err := s.unstructured()
+	if err != nil {
+		return err
+	}
+	return ignoreNotFound(s.cluster.Resources.Delete(gv, resource, s.namespace, name))
+}
+
+// destroyDeployment scales the deployment down before deleting it so its
+// pods go away even on clusters without cascading deletion
+func destroyDeployment(s *ManifestStep, name string) error {
+	_, gv, resource, err := s.unstructured()
+	if err != nil {
+		return err
+	}
+	d, err := s.cluster.Resources.Get(gv, resource, s.namespace, name)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	if spec, ok := d.Object["spec"].(map[string]interface{}); ok {
+		spec["replicas"] = 0
+		if _, err := s.cluster.Resources.Update(gv, resource, s.namespace, d); err != nil {
+			glog.Errorf("Failed to scale down deployment %s: %s", name, err)
+		}
+	}
+	return ignoreNotFound(s.cluster.Resources.Delete(gv, resource, s.namespace, name))
+}
+
+// waitDeployment waits until the pods of the deployment are updated and
+// available
+func waitDeployment(s *ManifestStep) error {
+	o, gv, resource, err := s.unstructured()
+	if err != nil {
+		return err
+	}
+	return s.cluster.waitForDeployment(gv, resource, s.namespace, o.GetName(), s.progress)
+}
+
+// waitJob waits until the job completes or fails
+func waitJob(s *ManifestStep) error {
+	o, gv, resource, err := s.unstructured()
+	if err != nil {
+		return err
+	}
+	return s.cluster.waitForJob(gv, resource, s.namespace, o.GetName(), s.progress)
+}
+
+// deployJob runs the job again. The pod template of a job can't be updated,
+// so an existing job is deleted before it is recreated.
+func deployJob(s *ManifestStep) error {
+	o, gv, resource, err := s.unstructured()
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.cluster.Resources.Get(gv, resource, s.namespace, o.GetName()); err == nil {
+		glog.Info("Deleting old job: ", o.GetName())
+		if err := s.cluster.Resources.Delete(gv, resource, s.namespace, o.GetName()); err != nil {
+			glog.Error("Delete old job failed: ", err)
+			return err
+		}
+	}
+
+	glog.Info("Creating new job: ", o.GetName())
+	if _, err := s.cluster.Resources.Create(gv, resource, s.namespace, o); err != nil {
+		glog.Info("Create failed: ", err)
+		return err
+	}
+	return nil
+}
+
+// deployPVC creates a claim if it is missing. The spec of a bound claim is
+// immutable, so existing claims only get their labels and annotations updated.
+func deployPVC(s *ManifestStep) error {
+	o, gv, resource, err := s.unstructured()
+	if err != nil {
+		return err
+	}
+
+	pvc, err := s.cluster.Resources.Get(gv, resource, s.namespace, o.GetName())
+	if err != nil {
+		glog.Info("Creating new persistent volume claim: ", o.GetName())
+		_, err = s.cluster.Resources.Create(gv, resource, s.namespace, o)
+	} else {
+		glog.Info("Updating persistent volume claim metadata: ", o.GetName())
+		pvc.SetLabels(o.GetLabels())
+		pvc.SetAnnotations(o.GetAnnotations())
+		_, err = s.cluster.Resources.Update(gv, resource, s.namespace, pvc)
+	}
+	if err != nil {
+		glog.Info("Create or Update failed: ", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package deployment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// fakeResourceClient is an in-memory ResourceClient recording the verbs it
+// was called with. Its watches receive the events sent through watcher.
+type fakeResourceClient struct {
+	objects map[string]*runtime.Unstructured
+	verbs   []string
+	watcher *watch.FakeWatcher
+}
+
+func newFakeResourceClient() *fakeResourceClient {
+	return &fakeResourceClient{objects: map[string]*runtime.Unstructured{}, watcher: watch.NewFake()}
+}
+
+func (f *fakeResourceClient) key(gv unversioned.GroupVersion, resource, namespace, name string) string {
+	return gv.String() + "/" + namespace + "/" + resource + "/" + name
+}
+
+func (f *fakeResourceClient) Get(gv unversioned.GroupVersion, resource, namespace, name string) (*runtime.Unstructured, error) {
+	f.verbs = append(f.verbs, "get")
+	o, ok := f.objects[f.key(gv, resource, namespace, name)]
+	if !ok {
+		return nil, errors.NewNotFound(unversioned.GroupResource{Group: gv.Group, Resource: resource}, name)
+	}
+	return o, nil
+}
+
+func (f *fakeResourceClient) Create(gv unversioned.GroupVersion, resource, namespace string, o *runtime.Unstructured) (*runtime.Unstructured, error) {
+	f.verbs = append(f.verbs, "create")
+	o.SetResourceVersion("1")
+	f.objects[f.key(gv, resource, namespace, o.GetName())] = o
+	return o, nil
+}
+
+func (f *fakeResourceClient) Update(gv unversioned.GroupVersion, resource, namespace string, o *runtime.Unstructured) (*runtime.Unstructured, error) {
+	f.verbs = append(f.verbs, "update")
+	f.objects[f.key(gv, resource, namespace, o.GetName())] = o
+	return o, nil
+}
+
+func (f *fakeResourceClient) Delete(gv unversioned.GroupVersion, resource, namespace, name string) error {
+	f.verbs = append(f.verbs, "delete")
+	k := f.key(gv, resource, namespace, name)
+	if _, ok := f.objects[k]; !ok {
+		return errors.NewNotFound(unversioned.GroupResource{Group: gv.Group, Resource: resource}, name)
+	}
+	delete(f.objects, k)
+	return nil
+}
+
+func (f *fakeResourceClient) Watch(gv unversioned.GroupVersion, resource, namespace, name, resourceVersion string) (watch.Interface, error) {
+	f.verbs = append(f.verbs, "watch")
+	return f.watcher, nil
+}
+
+func TestDeserializeGenericResources(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Manifest string
+		Kind     string
+	}{
+		{"Deployment", deploymentt1, "Deployment"},
+		{"Ingress", ingresst1, "Ingress"},
+		{"Job", jobt1, "Job"},
+		{"PersistentVolumeClaim", pvct1, "PersistentVolumeClaim"},
+	}
+
+	for _, c := range cases {
+		o, err := deserialize(c.Manifest)
+		assert.Nil(t, err, c.Name+" should deserialize")
+		u, ok := o.(*runtime.Unstructured)
+		assert.True(t, ok, c.Name+" should be unstructured")
+		assert.Equal(t, c.Kind, u.GetKind(), c.Name)
+	}
+}
+
+func TestGenericResourceDeploy(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Manifest string
+		Before   func(f *fakeResourceClient)
+		Expected []string
+	}{
+		{
+			Name:     "Deployment create",
+			Manifest: deploymentt1,
+			Before:   func(f *fakeResourceClient) {},
+			Expected: []string{"get", "create"},
+		},
+		{
+			Name:     "Deployment update",
+			Manifest: deploymentt1,
+			Before: func(f *fakeResourceClient) {
+				NewManifestStep(testCluster(nil, f), mustDeserialize(deploymentt1)).Deploy()
+			},
+			Expected: []string{"get", "update"},
+		},
+		{
+			Name:     "Ingress create",
+			Manifest: ingresst1,
+			Before:   func(f *fakeResourceClient) {},
+			Expected: []string{"get", "create"},
+		},
+		{
+			Name:     "Job rerun",
+			Manifest: jobt1,
+			Before: func(f *fakeResourceClient) {
+				NewManifestStep(testCluster(nil, f), mustDeserialize(jobt1)).Deploy()
+			},
+			Expected: []string{"get", "delete", "create"},
+		},
+		{
+			Name:     "PersistentVolumeClaim update keeps spec",
+			Manifest: pvct1,
+			Before: func(f *fakeResourceClient) {
+				NewManifestStep(testCluster(nil, f), mustDeserialize(pvct1)).Deploy()
+			},
+			Expected: []string{"get", "update"},
+		},
+	}
+
+	for _, c := range cases {
+		f := newFakeResourceClient()
+		c.Before(f)
+		f.verbs = nil
+		err := NewManifestStep(testCluster(nil, f), mustDeserialize(c.Manifest)).Deploy()
+		assert.Nil(t, err, c.Name+" deploy should not return with error")
+		assert.Equal(t, c.Expected, f.verbs, c.Name+" fired unexpected actions")
+	}
+}
+
+func TestGenericResourceDestroy(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Manifest string
+		Deployed bool
+		Expected []string
+	}{
+		{"Deployment is scaled down and deleted", deploymentt1, true, []string{"get", "update", "delete"}},
+		{"Missing deployment", deploymentt1, false, []string{"get"}},
+		{"Ingress", ingresst1, true, []string{"delete"}},
+		{"Missing job", jobt1, false, []string{"delete"}},
+	}
+
+	for _, c := range cases {
+		f := newFakeResourceClient()
+		if c.Deployed {
+			NewManifestStep(testCluster(nil, f), mustDeserialize(c.Manifest)).Deploy()
+		}
+		f.verbs = nil
+		err := NewManifestStep(testCluster(nil, f), mustDeserialize(c.Manifest)).Destroy()
+		assert.Nil(t, err, c.Name+" destroy should not return with error")
+		assert.Equal(t, c.Expected, f.verbs, c.Name+" fired unexpected actions")
+	}
+}
+
+var deploymentt1 = `apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.11
+`
+
+var ingresst1 = `apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: web
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+`
+
+var jobt1 = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+spec:
+  template:
+    metadata:
+      name: migrate
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: migrate
+        image: app:v1
+        command: ["rake", "db:migrate"]
+`
+
+var pvct1 = `apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+spec:
+  accessModes:
+  - ReadWriteOnce
+  resources:
+    requests:
+      storage: 1Gi
+`
@@ -0,0 +1,176 @@
+package deployment
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// VarSet is a file of vars shared by the playbooks including it
+type VarSet struct {
+	Vars []Var `yaml:"vars"`
+}
+
+// resolver merges playbooks with the playbooks they extend and the var sets
+// they include
+type resolver struct {
+	declared map[string]*Playbook // the playbooks as parsed, by ID
+	resolved map[string]*Playbook
+	visiting map[string]bool // the playbooks being resolved, to detect cycles
+	varSets  map[string][]Var
+}
+
+func newResolver(declared map[string]*Playbook) *resolver {
+	return &resolver{
+		declared: declared,
+		resolved: map[string]*Playbook{},
+		visiting: map[string]bool{},
+		varSets:  map[string][]Var{},
+	}
+}
+
+// resolve returns the playbook with the given ID merged with what it
+// inherits. chain lists the playbooks extending it, for cycle errors.
+func (r *resolver) resolve(ID string, chain []string) (*Playbook, error) {
+	if p, ok := r.resolved[ID]; ok {
+		return p, nil
+	}
+	p := r.declared[ID]
+	chain = append(chain, ID)
+	if r.visiting[ID] {
+		return nil, fmt.Errorf("Playbook %s extends itself: %s", ID, strings.Join(chain, " -> "))
+	}
+	r.visiting[ID] = true
+	defer delete(r.visiting, ID)
+
+	merged := &Playbook{}
+	if p.Extends != "" {
+		if _, ok := r.declared[p.Extends]; !ok {
+			return nil, fmt.Errorf("Playbook %s extends a missing playbook: %s", ID, p.Extends)
+		}
+		base, err := r.resolve(p.Extends, chain)
+		if err != nil {
+			return nil, err
+		}
+		merged = base.clone()
+	}
+	for _, name := range p.IncludeVars {
+		vars, err := r.varSet(p.includePath(name))
+		if err != nil {
+			return nil, fmt.Errorf("Playbook %s failed to include vars from %s: %s", ID, name, err)
+		}
+		merged.Vars = mergeVars(merged.Vars, vars)
+	}
+	merged.inherit(p)
+	r.resolved[ID] = merged
+	return merged, nil
+}
+
+// varSet reads the vars of a var set file
+func (r *resolver) varSet(path string) ([]Var, error) {
+	if vars, ok := r.varSets[path]; ok {
+		return vars, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set VarSet
+	if err := yaml.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	r.varSets[path] = set.Vars
+	return set.Vars, nil
+}
+
+// includePath returns the path of a var set included by the playbook, which
+// is relative to the playbook's file
+func (p *Playbook) includePath(name string) string {
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name)
+	}
+	return filepath.Join(filepath.Dir(p.file), name)
+}
+
+// inherit overrides the settings of p with those the playbook declared sets:
+// settings, meta fields and messages it declares replace the inherited ones,
+// its manifests replace the inherited list, and its vars replace the
+// inherited vars of the same name or are appended to them.
+func (p *Playbook) inherit(declared *Playbook) {
+	p.ID = declared.ID
+	p.Extends = declared.Extends
+	p.IncludeVars = declared.IncludeVars
+	override(&p.Name, declared.Name)
+	override(&p.Meta.Team, declared.Meta.Team)
+	override(&p.Meta.Email, declared.Meta.Email)
+	override(&p.Meta.Slack, declared.Meta.Slack)
+	p.Vars = mergeVars(p.Vars, declared.Vars)
+	if len(declared.Manifests) > 0 {
+		p.Manifests = append([]string{}, declared.Manifests...)
+	}
+	for key, message := range declared.Messages {
+		if p.Messages == nil {
+			p.Messages = map[string]string{}
+		}
+		p.Messages[key] = message
+	}
+	override(&p.Strategy, declared.Strategy)
+	override(&p.Namespace, declared.Namespace)
+	override(&p.Cluster, declared.Cluster)
+	if len(declared.Clusters) > 0 {
+		p.Clusters = append([]string{}, declared.Clusters...)
+	}
+	p.file = declared.file
+	p.declared = declared
+}
+
+func override(setting *string, value string) {
+	if value != "" {
+		*setting = value
+	}
+}
+
+// mergeVars returns the inherited vars with those of vars replacing the ones
+// of the same name, in place, and the others appended
+func mergeVars(inherited, vars []Var) []Var {
+	merged := append([]Var{}, inherited...)
+	index := map[string]int{}
+	for n, v := range inherited {
+		index[v.Name] = n
+	}
+	for _, v := range vars {
+		if n, ok := index[v.Name]; ok {
+			merged[n] = v
+			continue
+		}
+		merged = append(merged, v)
+	}
+	return merged
+}
+
+// clone returns a copy of the playbook that can be changed without changing
+// the playbook
+func (p *Playbook) clone() *Playbook {
+	c := *p
+	c.Vars = append([]Var(nil), p.Vars...)
+	c.Manifests = append([]string(nil), p.Manifests...)
+	if p.Messages != nil {
+		c.Messages = map[string]string{}
+		for key, message := range p.Messages {
+			c.Messages[key] = message
+		}
+	}
+	return &c
+}
+
+// Declared returns the playbook as its file declares it, before it was merged
+// with the playbook it extends and the vars it includes
+func (p *Playbook) Declared() *Playbook {
+	if p.declared == nil {
+		return p
+	}
+	return p.declared
+}
@@ -0,0 +1,133 @@
+package deployment
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writePlaybooks writes files into a new folder and returns its path
+func writePlaybooks(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "broadway-playbooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadPlaybookFolderInheritance(t *testing.T) {
+	dir := writePlaybooks(t, map[string]string{
+		"base.yml": `
+id: base
+name: Base
+meta:
+  team: Platform
+  slack: platform
+vars:
+  - version
+  - name: replicas
+    type: int
+    default: "1"
+messages:
+  created: "created {{.instance_id}}"
+  deployed: "deployed {{.instance_id}}"
+strategy: rolling-update
+cluster: "{{.env}}"
+clusters: [staging, qa]
+`,
+		"web.yml": `
+id: web
+name: Web
+extends: base
+include_vars:
+  - shared/owners.yml
+meta:
+  slack: web
+vars:
+  - name: replicas
+    type: int
+    default: "2"
+  - assets_version
+messages:
+  deployed: "web {{.instance_id}} is up"
+manifests:
+  - hello
+`,
+		"shared/owners.yml": `
+vars:
+  - owner
+  - name: version
+    required: true
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	pbs, err := LoadPlaybookFolder(dir, testCfg.ManifestsPath, testCfg.ManifestsExtension)
+	assert.Nil(t, err)
+	assert.Len(t, pbs, 1, "a base without manifests isn't a playbook of its own")
+	web := pbs["web"]
+	if !assert.NotNil(t, web) {
+		return
+	}
+	assert.Equal(t, "Web", web.Name)
+	assert.Equal(t, Meta{Team: "Platform", Slack: "web"}, web.Meta)
+	assert.Equal(t, []Var{
+		{Name: "version", Required: true},
+		{Name: "replicas", Type: VarInt, Default: "2"},
+		{Name: "owner"},
+		{Name: "assets_version"},
+	}, web.Vars)
+	assert.Equal(t, []string{"hello"}, web.Manifests)
+	assert.Equal(t, map[string]string{
+		"created":  "created {{.instance_id}}",
+		"deployed": "web {{.instance_id}} is up",
+	}, web.Messages)
+	assert.Equal(t, StrategyRollingUpdate, web.Strategy)
+	assert.Equal(t, []string{"staging", "qa"}, web.Clusters)
+
+	declared := web.Declared()
+	assert.Equal(t, "base", declared.Extends)
+	assert.Equal(t, []Var{{Name: "replicas", Type: VarInt, Default: "2"}, {Name: "assets_version"}}, declared.Vars)
+	assert.Empty(t, declared.Strategy)
+}
+
+func TestLoadPlaybookFolderInheritanceFailures(t *testing.T) {
+	dir := writePlaybooks(t, map[string]string{
+		"a.yml":        "{id: a, name: A, extends: b, manifests: [hello]}",
+		"b.yml":        "{id: b, name: B, extends: a, manifests: [hello]}",
+		"self.yml":     "{id: self, name: Self, extends: self, manifests: [hello]}",
+		"orphan.yml":   "{id: orphan, name: Orphan, extends: missing, manifests: [hello]}",
+		"nofile.yml":   "{id: nofile, name: No File, include_vars: [missing.yml], manifests: [hello]}",
+		"bad.yml":      "{id: bad, name: Bad, include_vars: [bad-vars.yml], manifests: [hello]}",
+		"bad-vars.yml": "{vars: [{name: replicas, type: float}]}",
+		"child.yml":    "{id: child, name: Child, extends: a, manifests: [hello]}",
+	})
+	defer os.RemoveAll(dir)
+
+	pbs, err := LoadPlaybookFolder(dir, testCfg.ManifestsPath, testCfg.ManifestsExtension)
+	assert.Nil(t, err)
+	assert.Empty(t, pbs)
+
+	declared := map[string]*Playbook{
+		"a":    {ID: "a", Extends: "b"},
+		"b":    {ID: "b", Extends: "c"},
+		"c":    {ID: "c", Extends: "a"},
+		"self": {ID: "self", Extends: "self"},
+	}
+	_, err = newResolver(declared).resolve("a", nil)
+	assert.EqualError(t, err, "Playbook a extends itself: a -> b -> c -> a")
+	_, err = newResolver(declared).resolve("self", nil)
+	assert.EqualError(t, err, "Playbook self extends itself: self -> self")
+}
@@ -0,0 +1,173 @@
+package deployment
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	clientcmdapi "k8s.io/kubernetes/pkg/client/unversioned/clientcmd/api"
+)
+
+// kubeconfigFile is the layout of a kubeconfig file, which lists clusters,
+// users and contexts by name
+type kubeconfigFile struct {
+	Clusters []struct {
+		Name    string               `json:"name"`
+		Cluster clientcmdapi.Cluster `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string                `json:"name"`
+		User clientcmdapi.AuthInfo `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string               `json:"name"`
+		Context clientcmdapi.Context `json:"context"`
+	} `json:"contexts"`
+	CurrentContext string `json:"current-context"`
+}
+
+// LoadKubeconfig reads a kubeconfig file. Relative paths to certificates and
+// keys are resolved against the directory of the file.
+func LoadKubeconfig(filename string) (*clientcmdapi.Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	f := kubeconfigFile{}
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("deployment: can't parse kubeconfig %s: %s", filename, err)
+	}
+
+	dir := filepath.Dir(filename)
+	config := clientcmdapi.NewConfig()
+	config.CurrentContext = f.CurrentContext
+	for _, c := range f.Clusters {
+		cluster := c.Cluster
+		cluster.LocationOfOrigin = filename
+		cluster.CertificateAuthority = clientcmdapi.ResolvePath(cluster.CertificateAuthority, dir)
+		config.Clusters[c.Name] = &cluster
+	}
+	for _, u := range f.Users {
+		user := u.User
+		user.LocationOfOrigin = filename
+		user.ClientCertificate = clientcmdapi.ResolvePath(user.ClientCertificate, dir)
+		user.ClientKey = clientcmdapi.ResolvePath(user.ClientKey, dir)
+		config.AuthInfos[u.Name] = &user
+	}
+	for _, c := range f.Contexts {
+		context := c.Context
+		context.LocationOfOrigin = filename
+		config.Contexts[c.Name] = &context
+	}
+	return config, nil
+}
+
+// LoadKubeconfigs reads a list of kubeconfig files separated like $PATH, as
+// in $KUBECONFIG. The first file setting a cluster, user or context wins.
+func LoadKubeconfigs(paths string) (*clientcmdapi.Config, error) {
+	merged := clientcmdapi.NewConfig()
+	for _, filename := range filepath.SplitList(paths) {
+		if filename == "" {
+			continue
+		}
+		config, err := LoadKubeconfig(filename)
+		if err != nil {
+			return nil, err
+		}
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = config.CurrentContext
+		}
+		for name, c := range config.Clusters {
+			if _, ok := merged.Clusters[name]; !ok {
+				merged.Clusters[name] = c
+			}
+		}
+		for name, u := range config.AuthInfos {
+			if _, ok := merged.AuthInfos[name]; !ok {
+				merged.AuthInfos[name] = u
+			}
+		}
+		for name, c := range config.Contexts {
+			if _, ok := merged.Contexts[name]; !ok {
+				merged.Contexts[name] = c
+			}
+		}
+	}
+	return merged, nil
+}
+
+// authProviderTokens names where auth providers cache their token in a
+// kubeconfig. Broadway can't run the providers, so it uses the cached token
+// until it expires.
+var authProviderTokens = map[string]string{
+	"gcp":   "access-token",
+	"azure": "access-token",
+	"oidc":  "id-token",
+}
+
+// authProviderToken returns the token an auth provider cached in a kubeconfig
+func authProviderToken(p *clientcmdapi.AuthProviderConfig) (string, error) {
+	key, ok := authProviderTokens[p.Name]
+	if !ok {
+		return "", fmt.Errorf("deployment: auth provider \"%s\" is not supported", p.Name)
+	}
+	token := p.Config[key]
+	if token == "" {
+		return "", fmt.Errorf("deployment: auth provider \"%s\" has no %s, run kubectl to log in", p.Name, key)
+	}
+	if expiry, err := time.Parse(time.RFC3339, p.Config["expiry"]); err == nil && expiry.Before(time.Now()) {
+		return "", fmt.Errorf("deployment: the %s of auth provider \"%s\" expired at %s, run kubectl to refresh it", key, p.Name, p.Config["expiry"])
+	}
+	return token, nil
+}
+
+// KubeconfigConfig returns the configuration of a context of the kubeconfig
+// files in paths, and the namespace the context defaults to. An empty context
+// selects the current context.
+func KubeconfigConfig(paths, context string) (*restclient.Config, string, error) {
+	config, err := LoadKubeconfigs(paths)
+	if err != nil {
+		return nil, "", err
+	}
+	if context == "" {
+		context = config.CurrentContext
+	}
+	c, ok := config.Contexts[context]
+	if !ok {
+		return nil, "", fmt.Errorf("deployment: context \"%s\" is not in kubeconfig %s", context, paths)
+	}
+	cluster, ok := config.Clusters[c.Cluster]
+	if !ok {
+		return nil, "", fmt.Errorf("deployment: cluster \"%s\" is not in kubeconfig %s", c.Cluster, paths)
+	}
+	user, ok := config.AuthInfos[c.AuthInfo]
+	if !ok {
+		user = &clientcmdapi.AuthInfo{}
+	}
+	token := user.Token
+	if user.AuthProvider != nil {
+		if token, err = authProviderToken(user.AuthProvider); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return &restclient.Config{
+		Host:        cluster.Server,
+		Insecure:    cluster.InsecureSkipTLSVerify,
+		Username:    user.Username,
+		Password:    user.Password,
+		BearerToken: token,
+		Impersonate: user.Impersonate,
+		TLSClientConfig: restclient.TLSClientConfig{
+			CAFile:   cluster.CertificateAuthority,
+			CAData:   cluster.CertificateAuthorityData,
+			CertFile: user.ClientCertificate,
+			CertData: user.ClientCertificateData,
+			KeyFile:  user.ClientKey,
+			KeyData:  user.ClientKeyData,
+		},
+	}, c.Namespace, nil
+}
@@ -0,0 +1,115 @@
+package deployment
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/namely/broadway/pkg/cfg"
+	"github.com/stretchr/testify/assert"
+	clientcmdapi "k8s.io/kubernetes/pkg/client/unversioned/clientcmd/api"
+)
+
+func TestKubeconfigConfig(t *testing.T) {
+	dir := writeTestFiles(map[string]string{"kubeconfig": kubeconfigt1})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "kubeconfig")
+
+	config, ns, err := KubeconfigConfig(filename, "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://dev.example.com", config.Host)
+	assert.Equal(t, "devtoken", config.BearerToken)
+	assert.Equal(t, filepath.Join(dir, "dev-ca.crt"), config.CAFile, "paths should be relative to the kubeconfig")
+	assert.Equal(t, "dev-apps", ns)
+
+	config, ns, err = KubeconfigConfig(filename, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://prod.example.com", config.Host, "the current context should be used")
+	assert.Equal(t, "", ns)
+
+	_, _, err = KubeconfigConfig(filename, "qa")
+	assert.EqualError(t, err, `deployment: context "qa" is not in kubeconfig `+filename)
+}
+
+func TestKubeconfigMerge(t *testing.T) {
+	dir := writeTestFiles(map[string]string{"kubeconfig": kubeconfigt1, "gke": kubeconfigt2})
+	defer os.RemoveAll(dir)
+	paths := filepath.Join(dir, "gke") + string(filepath.ListSeparator) + filepath.Join(dir, "kubeconfig")
+
+	config, _, err := KubeconfigConfig(paths, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://gke.example.com", config.Host, "the first file's current context should be used")
+	assert.Equal(t, "gketoken", config.BearerToken, "the auth provider's token should be used")
+
+	config, _, err = KubeconfigConfig(paths, "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://dev.example.com", config.Host, "contexts of later files should be found")
+	assert.Equal(t, "devtoken", config.BearerToken)
+
+	c, err := Config(cfg.Type{Kubeconfig: paths, KubeContext: "dev"})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://dev.example.com", c.Host, "a kubeconfig should be preferred")
+}
+
+func TestAuthProviderToken(t *testing.T) {
+	cases := []struct {
+		Scenario    string
+		Provider    *clientcmdapi.AuthProviderConfig
+		Expected    string
+		ExpectedErr string
+	}{
+		{
+			Scenario: "OIDC",
+			Provider: &clientcmdapi.AuthProviderConfig{Name: "oidc", Config: map[string]string{"id-token": "idtoken"}},
+			Expected: "idtoken",
+		},
+		{
+			Scenario:    "Expired GCP token",
+			Provider:    &clientcmdapi.AuthProviderConfig{Name: "gcp", Config: map[string]string{"access-token": "gcptoken", "expiry": "2016-08-01T10:00:00Z"}},
+			ExpectedErr: `deployment: the access-token of auth provider "gcp" expired at 2016-08-01T10:00:00Z, run kubectl to refresh it`,
+		},
+		{
+			Scenario:    "GCP without a token",
+			Provider:    &clientcmdapi.AuthProviderConfig{Name: "gcp"},
+			ExpectedErr: `deployment: auth provider "gcp" has no access-token, run kubectl to log in`,
+		},
+		{
+			Scenario:    "Unknown provider",
+			Provider:    &clientcmdapi.AuthProviderConfig{Name: "keystone"},
+			ExpectedErr: `deployment: auth provider "keystone" is not supported`,
+		},
+	}
+
+	for _, c := range cases {
+		token, err := authProviderToken(c.Provider)
+		if c.ExpectedErr != "" {
+			assert.EqualError(t, err, c.ExpectedErr, c.Scenario)
+			continue
+		}
+		assert.Nil(t, err, c.Scenario)
+		assert.Equal(t, c.Expected, token, c.Scenario)
+	}
+}
+
+var kubeconfigt2 = `apiVersion: v1
+kind: Config
+current-context: gke
+clusters:
+- name: gke
+  cluster:
+    server: https://gke.example.com
+    certificate-authority-data: LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCg==
+users:
+- name: gke
+  user:
+    auth-provider:
+      name: gcp
+      config:
+        access-token: gketoken
+        expiry: 2099-01-01T00:00:00Z
+contexts:
+- name: gke
+  context:
+    cluster: gke
+    user: gke
+`
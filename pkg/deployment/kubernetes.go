@@ -1,16 +1,24 @@
 package deployment
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/golang/glog"
 	"github.com/namely/broadway/pkg/cfg"
 
 	"k8s.io/kubernetes/pkg/api/meta"
 	"k8s.io/kubernetes/pkg/api/unversioned"
 	"k8s.io/kubernetes/pkg/api/v1"
-	coreclient "k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3/typed/core/v1"
-	"k8s.io/kubernetes/pkg/client/restclient"
 	"k8s.io/kubernetes/pkg/runtime"
 	"k8s.io/kubernetes/pkg/runtime/serializer"
+	"k8s.io/kubernetes/pkg/util/yaml"
 
 	// Install API
 	_ "k8s.io/kubernetes/pkg/api/install"
@@ -22,68 +30,113 @@ var groupVersionKind = unversioned.GroupVersionKind{
 	Kind:    meta.AnyKind,
 }
 
-var client coreclient.CoreInterface
-var deserializer runtime.Decoder
-var namespace string
-var scheme *runtime.Scheme
+// genericResources lists the kinds Broadway deploys without a typed client.
+// They are decoded into runtime.Unstructured and managed through a
+// ResourceClient, which needs their REST resource name.
+var genericResources = map[unversioned.GroupVersionKind]string{
+	{Group: "", Version: "v1", Kind: "PersistentVolumeClaim"}:     "persistentvolumeclaims",
+	{Group: "extensions", Version: "v1beta1", Kind: "Deployment"}: "deployments",
+	{Group: "extensions", Version: "v1beta1", Kind: "Ingress"}:    "ingresses",
+	{Group: "batch", Version: "v1", Kind: "Job"}:                  "jobs",
+}
+
+// scheme and deserializer decode manifests. They are never changed once set
+// up, so concurrent deployments can share them.
+var scheme = newScheme()
+var deserializer = serializer.NewCodecFactory(scheme).UniversalDeserializer()
+
+func newScheme() *runtime.Scheme {
+	s := runtime.NewScheme()
+	v1.AddToScheme(s)
+	return s
+}
 
 // Step represents a deployment step
 type Step interface {
 	Deploy() error
+	Wait() error
+	Plan() ([]Change, error)
 	Destroy() error
 }
 
 // SetupKubernetes configures kubernetes with an injected configuration
 func SetupKubernetes(cfg cfg.Type) {
-	scheme = runtime.NewScheme()
-	v1.AddToScheme(scheme)
-	factory := serializer.NewCodecFactory(scheme)
-	deserializer = factory.UniversalDeserializer()
-
-	namespace = cfg.K8sNamespace
+	if cfg.K8sWaitTimeout > 0 {
+		WaitTimeout = time.Duration(cfg.K8sWaitTimeout) * time.Second
+	}
 }
 
 // KubernetesDeployment represents a deployment of an instance
 type KubernetesDeployment struct {
+	Cluster   *Cluster
 	Playbook  *Playbook
 	Variables map[string]string
 	Manifests map[string]*Manifest
+	Progress  ProgressFunc // receives what the deployment is waiting for
 }
 
-// NewKubernetesDeployment creates a new kuberentes deployment
-func NewKubernetesDeployment(config *restclient.Config, playbook *Playbook, variables map[string]string, manifests map[string]*Manifest) (*KubernetesDeployment, error) {
-	var err error
-	client, err = coreclient.NewForConfig(config)
-	if err != nil {
-		return nil, err
-	}
-
-	// Default all missing playbook variables to empty string
+// NewKubernetesDeployment creates a new kuberentes deployment to cluster
+func NewKubernetesDeployment(cluster *Cluster, playbook *Playbook, variables map[string]string, manifests map[string]*Manifest) (*KubernetesDeployment, error) {
+	// Default all missing playbook variables
 	for _, v := range playbook.Vars {
-		_, ok := variables[v]
+		_, ok := variables[v.Name]
 		if !ok {
-			variables[v] = ""
+			variables[v.Name] = v.Default
 		}
 	}
 
 	return &KubernetesDeployment{
+		Cluster:   cluster,
 		Playbook:  playbook,
 		Variables: variables,
 		Manifests: manifests,
 	}, nil
 }
 
-// Deploy executes the deployment
-func (d *KubernetesDeployment) Deploy() error {
+// Namespace returns the namespace the deployment's objects go into: the
+// playbook's namespace rendered with the variables, or the cluster's one
+func (d *KubernetesDeployment) Namespace() (string, error) {
+	if d.Playbook.Namespace == "" {
+		return d.Cluster.Namespace, nil
+	}
+	return renderNamespace(d.Playbook.Namespace, d.Variables)
+}
+
+// Deploy executes the deployment. It stops before its next step when ctx is
+// done.
+func (d *KubernetesDeployment) Deploy(ctx context.Context) error {
 	steps, err := d.steps()
 	if err != nil {
 		return err
 	}
+	if d.Playbook.Namespace != "" {
+		ns, _ := d.Namespace()
+		if err := d.Cluster.ensureNamespace(ns, d.namespaceLabels()); err != nil {
+			glog.Warningf("Failed to create namespace %s: %s", ns, err.Error())
+			return err
+		}
+	}
 
 	for i, step := range steps {
+		if err := stopped(ctx); err != nil {
+			return err
+		}
+		report(d.Progress, "Deploying step %d of %d: %v", i+1, len(steps), step)
 		err := step.Deploy()
 		if err != nil {
-			glog.Warning("%d. step failed: %s", i, err.Error())
+			glog.Warningf("%d. step failed: %s", i, err.Error())
+			return err
+		}
+	}
+
+	for i, step := range steps {
+		if err := stopped(ctx); err != nil {
+			return err
+		}
+		report(d.Progress, "Waiting for step %d of %d: %v", i+1, len(steps), step)
+		err := step.Wait()
+		if err != nil {
+			glog.Warningf("%d. step did not become ready: %s", i, err.Error())
 			return err
 		}
 	}
@@ -91,43 +144,198 @@ func (d *KubernetesDeployment) Deploy() error {
 	return nil
 }
 
-// Destroy deletes Kubernetes resourses
-func (d *KubernetesDeployment) Destroy() error {
+// Plan lists what Deploy would change in the cluster, without changing it
+func (d *KubernetesDeployment) Plan() ([]Change, error) {
+	steps, err := d.steps()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	for i, step := range steps {
+		c, err := step.Plan()
+		if err != nil {
+			glog.Warningf("%d. step could not be planned: %s", i, err.Error())
+			return nil, err
+		}
+		changes = append(changes, c...)
+	}
+	return changes, nil
+}
+
+// namespaceLabels returns the labels of the namespace created for the
+// deployment's instance
+func (d *KubernetesDeployment) namespaceLabels() map[string]string {
+	return map[string]string{
+		namespacePlaybookLabel: d.Playbook.ID,
+		namespaceInstanceLabel: d.Variables["instance_id"],
+	}
+}
+
+// Destroy deletes Kubernetes resourses. An instance with a namespace of its
+// own, created for it by Deploy, is destroyed by deleting the namespace. The
+// objects of an instance sharing its namespace are deleted one by one. It
+// stops before its next step when ctx is done.
+func (d *KubernetesDeployment) Destroy(ctx context.Context) error {
+	if d.Playbook.Namespace != "" {
+		ns, err := d.Namespace()
+		if err != nil {
+			return err
+		}
+		deleted, err := d.Cluster.deleteNamespace(ns, d.namespaceLabels())
+		if err != nil {
+			return err
+		}
+		if deleted {
+			glog.Infof("Deleted namespace %s.", ns)
+			return nil
+		}
+		glog.Infof("Namespace %s isn't the instance's own, deleting its objects.", ns)
+	}
+
 	steps, err := d.steps()
 	if err != nil {
 		return err
 	}
 
 	for i, step := range steps {
-		glog.Infof("%d. Destroying Resources.", i)
+		if err := stopped(ctx); err != nil {
+			return err
+		}
+		report(d.Progress, "Destroying step %d of %d: %v", i+1, len(steps), step)
 		err := step.Destroy()
 		if err != nil {
-			glog.Warning("%d. step failed: %s", i, err.Error())
+			glog.Warningf("%d. step failed: %s", i, err.Error())
 			return err
 		}
 	}
 	return nil
 }
 
+// stopped returns an error once ctx is done
+func stopped(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("deployment: stopped: %s", err)
+	}
+	return nil
+}
+
+// Digest hashes the manifests of the playbook rendered with the deployment's
+// variables, so deployments of the same objects can be recognized
+func (d *KubernetesDeployment) Digest() string {
+	h := sha256.New()
+	for _, name := range d.Playbook.Manifests {
+		m, ok := d.Manifests[name]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(h, "%s\n%s\n", name, m.Execute(d.Variables))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func (d *KubernetesDeployment) steps() ([]Step, error) {
 	var steps = []Step{}
+	ns, err := d.Namespace()
+	if err != nil {
+		return steps, err
+	}
 	for _, name := range d.Playbook.Manifests {
-		m := d.Manifests[name]
-		rendered := m.Execute(d.Variables)
-		object, err := deserialize(rendered)
+		m, ok := d.Manifests[name]
+		if !ok {
+			return steps, fmt.Errorf("deployment: manifest %s is missing", name)
+		}
+		rendered, err := m.Render(d.Variables)
+		if err != nil {
+			return steps, fmt.Errorf("deployment: manifest %s failed to render: %s", name, err)
+		}
+		objects, err := deserializeAll(rendered)
 		if err != nil {
 			glog.Warningf("Failed to parse manifest %s", name)
 			return steps, err
 		}
-		steps = append(steps, NewManifestStep(object))
+		for _, object := range objects {
+			steps = append(steps, &ManifestStep{cluster: d.Cluster, object: object, namespace: ns, strategy: d.Playbook.Strategy, progress: d.Progress})
+		}
 	}
 	return steps, nil
 }
 
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// deserializeAll decodes every YAML document of a rendered manifest, in file
+// order. The items of a `kind: List` document are returned as objects of
+// their own.
+func deserializeAll(manifest string) ([]runtime.Object, error) {
+	objects := []runtime.Object{}
+	for _, doc := range documentSeparator.Split(manifest, -1) {
+		if isEmptyDocument(doc) {
+			continue
+		}
+		if u, err := deserializeUnstructured(doc); err == nil && u.GetKind() == "List" {
+			items, err := listItems(u)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, items...)
+			continue
+		}
+		object, err := deserialize(doc)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// isEmptyDocument is true for documents holding only blank lines and comments
+func isEmptyDocument(doc string) bool {
+	for _, line := range strings.Split(doc, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+func listItems(list *runtime.Unstructured) ([]runtime.Object, error) {
+	items, _ := list.Object["items"].([]interface{})
+	objects := []runtime.Object{}
+	for _, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		object, err := deserialize(string(data))
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
 func deserialize(manifest string) (runtime.Object, error) {
+	if u, err := deserializeUnstructured(manifest); err == nil {
+		if _, ok := genericResources[u.GroupVersionKind()]; ok {
+			return u, nil
+		}
+	}
 	object, _, err := deserializer.Decode([]byte(manifest), &groupVersionKind, nil)
 	if err != nil {
 		return nil, err
 	}
 	return object, nil
 }
+
+// deserializeUnstructured decodes a manifest without looking up its kind in
+// the scheme
+func deserializeUnstructured(manifest string) (*runtime.Unstructured, error) {
+	data, err := yaml.ToJSON([]byte(manifest))
+	if err != nil {
+		return nil, err
+	}
+	return decodeUnstructured(data)
+}
@@ -1,21 +1,22 @@
 package deployment
 
 import (
+	"context"
+	"sync"
 	"testing"
 
 	"github.com/namely/broadway/pkg/testutils"
 	"github.com/stretchr/testify/assert"
-	"k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3/typed/core/v1/fake"
 	"k8s.io/kubernetes/pkg/client/testing/core"
 )
 
+var ctx = context.Background()
+
 func init() {
-	client = &fake.FakeCore{&core.Fake{}}
 	Setup(testutils.TestCfg)
 }
 
 func TestDeploy(t *testing.T) {
-	// TODO sideways dependency injection?  make it stop
 	cases := []struct {
 		Name      string
 		Manifests []string
@@ -48,24 +49,26 @@ func TestDeploy(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		// Reset client
-		client.(*fake.FakeCore).Fake.ClearActions()
+		// The pods of deployed RCs are ready right away
+		f := &core.Fake{}
+		f.AddReactor("list", "pods", readyPodsReaction(map[string]string{"name": "redis"}, 1))
 
 		p := &Playbook{
 			ID:        "test",
 			Name:      "Test deployment",
 			Meta:      Meta{},
-			Vars:      []string{"test"},
+			Vars:      []Var{{Name: "test"}},
 			Manifests: c.Manifests,
 		}
 
 		d := &KubernetesDeployment{
+			Cluster:   testCluster(f, nil),
 			Playbook:  p,
 			Variables: vars,
 			Manifests: manifests,
 		}
 
-		err := d.Deploy()
+		err := d.Deploy(ctx)
 		assert.Nil(t, err, c.Name+" deployment should not return with error")
 	}
 }
@@ -103,30 +106,171 @@ func TestDestroy(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		// Reset client
-		client.(*fake.FakeCore).Fake.ClearActions()
+		f := &core.Fake{}
 
 		p := &Playbook{
 			ID:        "test",
 			Name:      "Test deployment",
 			Meta:      Meta{},
-			Vars:      []string{"test"},
+			Vars:      []Var{{Name: "test"}},
 			Manifests: c.Manifests,
 		}
 
 		d := &KubernetesDeployment{
+			Cluster:   testCluster(f, nil),
 			Playbook:  p,
 			Variables: vars,
 			Manifests: manifests,
 		}
 
-		err := d.Destroy()
+		err := d.Destroy(ctx)
 		assert.Nil(t, err, c.Name+" deployment should not return with error")
-		f := client.(*fake.FakeCore).Fake
 		assert.Equal(t, c.Expected, len(f.Actions()), c.Name+" should trigger actions.")
 	}
 }
 
+func TestDeployStopped(t *testing.T) {
+	f := &core.Fake{}
+	m, _ := NewManifest("test", mtemplate)
+	d := &KubernetesDeployment{
+		Cluster:   testCluster(f, nil),
+		Playbook:  &Playbook{ID: "test", Name: "Test deployment", Manifests: []string{"test"}},
+		Variables: map[string]string{"test": "ok"},
+		Manifests: map[string]*Manifest{"test": m},
+	}
+	stoppedCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	assert.EqualError(t, d.Deploy(stoppedCtx), "deployment: stopped: context canceled")
+	assert.EqualError(t, d.Destroy(stoppedCtx), "deployment: stopped: context canceled")
+	assert.Empty(t, f.Actions(), "a stopped deployment shouldn't change the cluster")
+}
+
+func TestConcurrentDeployments(t *testing.T) {
+	m, _ := NewManifest("test", mtemplate)
+	deployments := []*KubernetesDeployment{}
+	fakes := []*core.Fake{}
+	for _, ns := range []string{"staging", "qa"} {
+		f := &core.Fake{}
+		f.AddReactor("list", "pods", readyPodsReaction(map[string]string{"name": "redis"}, 1))
+		fakes = append(fakes, f)
+		cluster := testCluster(f, nil)
+		cluster.Namespace = ns
+		deployments = append(deployments, &KubernetesDeployment{
+			Cluster:   cluster,
+			Playbook:  &Playbook{ID: "test", Name: "Test deployment", Manifests: []string{"test"}},
+			Variables: map[string]string{"test": "ok"},
+			Manifests: map[string]*Manifest{"test": m},
+		})
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range deployments {
+		wg.Add(1)
+		go func(d *KubernetesDeployment) {
+			defer wg.Done()
+			assert.Nil(t, d.Deploy(ctx), "deployment should not return with error")
+		}(d)
+	}
+	wg.Wait()
+
+	for i, f := range fakes {
+		assert.NotEmpty(t, f.Actions())
+		for _, a := range f.Actions() {
+			assert.Equal(t, deployments[i].Cluster.Namespace, a.GetNamespace(), "each deployment should use its own cluster")
+		}
+	}
+}
+
+func TestStepsFromMultiDocumentManifests(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Template string
+		Expected []string
+	}{
+		{
+			Name:     "Single document",
+			Template: mtemplate,
+			Expected: []string{"ReplicationController"},
+		},
+		{
+			Name:     "Documents separated by ---",
+			Template: "---\n" + servicetemplate + "---\n# the replication controller\n" + mtemplate + "---\n",
+			Expected: []string{"Service", "ReplicationController"},
+		},
+		{
+			Name:     "List",
+			Template: listtemplate,
+			Expected: []string{"Service", "ReplicationController"},
+		},
+		{
+			Name:     "List after a document",
+			Template: configmapt1 + "---\n" + listtemplate,
+			Expected: []string{"ConfigMap", "Service", "ReplicationController"},
+		},
+	}
+
+	for _, c := range cases {
+		m, err := NewManifest("test", c.Template)
+		assert.Nil(t, err, c.Name)
+		d := &KubernetesDeployment{
+			Cluster:   testCluster(&core.Fake{}, nil),
+			Playbook:  &Playbook{ID: "test", Name: "Test", Manifests: []string{"test"}},
+			Variables: map[string]string{"test": "ok"},
+			Manifests: map[string]*Manifest{"test": m},
+		}
+
+		steps, err := d.steps()
+		assert.Nil(t, err, c.Name+" steps should not return with error")
+		kinds := []string{}
+		for _, step := range steps {
+			kinds = append(kinds, step.(*ManifestStep).object.GetObjectKind().GroupVersionKind().Kind)
+		}
+		assert.Equal(t, c.Expected, kinds, c.Name)
+	}
+}
+
+var servicetemplate = `apiVersion: v1
+kind: Service
+metadata:
+  name: test
+spec:
+  ports:
+  - port: 6379
+  selector:
+    name: redis
+`
+
+var listtemplate = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: test
+  spec:
+    ports:
+    - port: 6379
+    selector:
+      name: redis
+- apiVersion: v1
+  kind: ReplicationController
+  metadata:
+    name: test
+  spec:
+    replicas: 1
+    selector:
+      name: redis
+    template:
+      metadata:
+        labels:
+          name: redis
+      spec:
+        containers:
+        - name: redis
+          image: kubernetes/redis:v1
+`
+
 var mtemplate = `apiVersion: v1
 kind: ReplicationController
 metadata:
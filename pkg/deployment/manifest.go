@@ -39,13 +39,22 @@ func NewManifest(id, content string) (*Manifest, error) {
 	return &Manifest{ID: id, Template: t}, nil
 }
 
-// Execute executes template with variables
+// Execute executes template with variables. A template that fails is logged
+// and rendered empty.
 func (m *Manifest) Execute(vars map[string]string) string {
-	var b bytes.Buffer
-	err := m.Template.Execute(&b, vars)
+	out, err := m.Render(vars)
 	if err != nil {
 		glog.Errorf("%s template errored, ignoring: %s", m.ID, err.Error())
 		return ""
 	}
-	return b.String()
+	return out
+}
+
+// Render executes the template with variables, and returns its error
+func (m *Manifest) Render(vars map[string]string) (string, error) {
+	var b bytes.Buffer
+	if err := m.Template.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
 }
@@ -3,7 +3,6 @@ package deployment
 import (
 	"errors"
 	"reflect"
-	"time"
 
 	"github.com/golang/glog"
 	"k8s.io/kubernetes/pkg/api/meta"
@@ -13,45 +12,72 @@ import (
 
 // ManifestStep implements a deployment step
 type ManifestStep struct {
-	object runtime.Object
+	cluster   *Cluster
+	object    runtime.Object
+	namespace string       // where the object is deployed
+	strategy  string       // how replication controllers are updated
+	progress  ProgressFunc // receives what the step is waiting for
 }
 
 var _ Step = &ManifestStep{}
 
-// NewManifestStep creates a default step
-func NewManifestStep(object runtime.Object) Step {
+// NewManifestStep creates a default step deploying object to the cluster's
+// namespace
+func NewManifestStep(cluster *Cluster, object runtime.Object) Step {
 	return &ManifestStep{
-		object: object,
+		cluster:   cluster,
+		object:    object,
+		namespace: cluster.Namespace,
 	}
 }
 
-func check(name string, r bool) bool {
+// differences collects the names of the fields a comparison found to differ.
+// Comparing through a nil *differences only logs them.
+type differences []string
+
+func (d *differences) check(name string, r bool) bool {
 	if r == false {
 		glog.Info("Found difference: " + name)
+		if d != nil {
+			*d = append(*d, name)
+		}
 	}
 	return r
 }
 
-func compareI(name string, a, b interface{}) bool {
-	return check(name, reflect.DeepEqual(a, b))
+func (d *differences) compareI(name string, a, b interface{}) bool {
+	return d.check(name, reflect.DeepEqual(a, b))
 }
 
-func compareS(name, a, b string) bool {
-	return check(name, a == b)
+func (d *differences) compareS(name, a, b string) bool {
+	return d.check(name, a == b)
 }
 
-func compareContainers(a, b v1.Container) bool {
-	return a.Name == b.Name && a.Image == b.Image &&
-		compareI("container command", a.Command, b.Command) &&
-		compareI("container args", a.Args, b.Args) &&
-		compareS("container workdir", a.WorkingDir, b.WorkingDir) &&
-		compareI("container ports", a.Ports, b.Ports) &&
-		compareI("container env", a.Env, b.Env) &&
-		compareI("container resources", a.Resources, b.Resources) &&
-		check("container pull policy", a.ImagePullPolicy == b.ImagePullPolicy)
+// all reports whether every comparison held. It takes the results rather than
+// short-circuiting so that all differences are collected.
+func all(results ...bool) bool {
+	for _, r := range results {
+		if !r {
+			return false
+		}
+	}
+	return true
 }
 
-func compareContainerLists(a, b []v1.Container) bool {
+func (d *differences) containers(a, b v1.Container) bool {
+	return all(
+		d.compareS("container "+a.Name+" image", a.Image, b.Image),
+		d.compareI("container "+a.Name+" command", a.Command, b.Command),
+		d.compareI("container "+a.Name+" args", a.Args, b.Args),
+		d.compareS("container "+a.Name+" workdir", a.WorkingDir, b.WorkingDir),
+		d.compareI("container "+a.Name+" ports", a.Ports, b.Ports),
+		d.compareI("container "+a.Name+" env", a.Env, b.Env),
+		d.compareI("container "+a.Name+" resources", a.Resources, b.Resources),
+		d.check("container "+a.Name+" pull policy", a.ImagePullPolicy == b.ImagePullPolicy),
+	)
+}
+
+func (d *differences) containerLists(a, b []v1.Container) bool {
 	aMap := map[string]v1.Container{}
 	bMap := map[string]v1.Container{}
 
@@ -62,123 +88,143 @@ func compareContainerLists(a, b []v1.Container) bool {
 		bMap[c.Name] = c
 	}
 
-	if !check("conainer list len", len(aMap) == len(bMap)) {
+	if !d.check("conainer list len", len(aMap) == len(bMap)) {
 		return false
 	}
 
+	r := true
 	for name, ac := range aMap {
 		bc, ok := bMap[name]
-		if !ok {
-			return false
-		}
-		if !compareContainers(ac, bc) {
-			return false
+		if !d.check("container "+name, ok) {
+			r = false
+			continue
 		}
+		r = d.containers(ac, bc) && r
 	}
-	return true
+	return r
 }
 
-func comparePodSpecs(a, b v1.PodSpec) bool {
-	if !check("pod spec containers len", len(a.Containers) == len(b.Containers)) {
+func (d *differences) podSpecs(a, b v1.PodSpec) bool {
+	if !d.check("pod spec containers len", len(a.Containers) == len(b.Containers)) {
 		return false
 	}
-	if !compareContainerLists(a.Containers, b.Containers) {
+	return all(
+		d.containerLists(a.Containers, b.Containers),
+		d.compareI("pod spec image pull secrets", a.ImagePullSecrets, b.ImagePullSecrets),
+	)
+}
+
+func (d *differences) rcs(a, b *v1.ReplicationController) bool {
+	if a.ObjectMeta.Name == "" {
 		return false
 	}
-	return compareI("pod spec image pull secrets", a.ImagePullSecrets, b.ImagePullSecrets)
+	return all(
+		d.compareS("rc object meta name", a.ObjectMeta.Name, b.ObjectMeta.Name),
+		d.compareI("rc object meta labels", a.ObjectMeta.Labels, b.ObjectMeta.Labels),
+		d.compareI("rc spec replicas", a.Spec.Replicas, b.Spec.Replicas),
+		len(a.Spec.Selector) == 0 || len(b.Spec.Selector) == 0 || d.compareI("rc spec selector", a.Spec.Selector, b.Spec.Selector),
+		d.compareI("rc spec template object meta labels", a.Spec.Template.ObjectMeta.Labels, b.Spec.Template.ObjectMeta.Labels),
+		d.compareS("rc spec template object meta name", a.Spec.Template.ObjectMeta.Name, b.Spec.Template.ObjectMeta.Name),
+		d.podSpecs(a.Spec.Template.Spec, b.Spec.Template.Spec),
+	)
+}
+
+func (d *differences) pods(a, b *v1.Pod) bool {
+	return all(
+		d.compareS("pod object meta name", a.ObjectMeta.Name, b.ObjectMeta.Name),
+		d.compareI("pod object meta labels", a.ObjectMeta.Labels, b.ObjectMeta.Labels),
+		d.podSpecs(a.Spec, b.Spec),
+	)
 }
 
 // compareRCs compares RC a to RC b. If a == b the return is true
 func compareRCs(a, b *v1.ReplicationController) bool {
-	if a.ObjectMeta.Name == "" {
-		return false
-	}
-	return compareS("rc object meta name", a.ObjectMeta.Name, b.ObjectMeta.Name) &&
-		compareI("rc object meta labels", a.ObjectMeta.Labels, b.ObjectMeta.Labels) &&
-		compareI("rc spec replicas", a.Spec.Replicas, b.Spec.Replicas) &&
-		(len(a.Spec.Selector) == 0 || len(b.Spec.Selector) == 0 || compareI("rc spec selector", a.Spec.Selector, b.Spec.Selector)) &&
-		compareI("rc spec template object meta labels", a.Spec.Template.ObjectMeta.Labels, b.Spec.Template.ObjectMeta.Labels) &&
-		compareS("rc spec template object meta name", a.Spec.Template.ObjectMeta.Name, b.Spec.Template.ObjectMeta.Name) &&
-		comparePodSpecs(a.Spec.Template.Spec, b.Spec.Template.Spec)
+	return (*differences)(nil).rcs(a, b)
 }
 
 func comparePods(a, b *v1.Pod) bool {
-	return compareS("pod object meta name", a.ObjectMeta.Name, b.ObjectMeta.Name) &&
-		compareI("pod object meta labels", a.ObjectMeta.Labels, b.ObjectMeta.Labels) &&
-		comparePodSpecs(a.Spec, b.Spec)
+	return (*differences)(nil).pods(a, b)
+}
+
+// kindHandler knows how to create-or-update and delete one kind of
+// Kubernetes object, and how to wait for a deployed one to be ready
+type kindHandler struct {
+	deploy  func(s *ManifestStep) error
+	destroy func(s *ManifestStep, name string) error
+	wait    func(s *ManifestStep) error // nil for kinds that are ready once created
+	plan    func(s *ManifestStep) ([]Change, error)
+}
+
+// kindHandlers maps object kinds to their handlers
+var kindHandlers = map[string]kindHandler{
+	"ReplicationController": {deploy: deployRC, destroy: destroyRC, wait: waitRC, plan: planRC},
+	"Pod":                   {deploy: deployPod, destroy: destroyPod, wait: waitPod, plan: planPod},
+	"Service":               {deploy: deployService, destroy: destroyService, plan: planService},
+	"ConfigMap":             {deploy: deployConfigMap, destroy: destroyConfigMap, plan: planConfigMap},
+	"Secret":                {deploy: deploySecret, destroy: destroySecret, plan: planSecret},
+	"PersistentVolumeClaim": {deploy: deployPVC, destroy: destroyGeneric, plan: planGeneric},
+	"Deployment":            {deploy: deployGeneric, destroy: destroyDeployment, wait: waitDeployment, plan: planGeneric},
+	"Ingress":               {deploy: deployGeneric, destroy: destroyGeneric, plan: planGeneric},
+	"Job":                   {deploy: deployJob, destroy: destroyGeneric, wait: waitJob, plan: planGeneric},
+}
+
+func (s *ManifestStep) handler() (kindHandler, error) {
+	kind := s.object.GetObjectKind().GroupVersionKind().Kind
+	h, ok := kindHandlers[kind]
+	if !ok {
+		return h, errors.New("Kubernetes resource is not recognized: " + kind)
+	}
+	return h, nil
+}
+
+// String names the kind and the name of the step's object
+func (s *ManifestStep) String() string {
+	kind := s.object.GetObjectKind().GroupVersionKind().Kind
+	if meta, err := meta.Accessor(s.object); err == nil {
+		return kind + " " + meta.GetName()
+	}
+	return kind
 }
 
 // Deploy executes the deployment of a step
 func (s *ManifestStep) Deploy() error {
-	oGVK := s.object.GetObjectKind().GroupVersionKind()
-	switch oGVK.Kind {
-	case "ReplicationController":
-		return deployRC(s)
-	case "Pod":
-		o := s.object.(*v1.Pod)
-		pod, err := client.Pods(namespace).Get(o.ObjectMeta.Name)
-
-		if err == nil && pod != nil {
-			if comparePods(pod, o) {
-				glog.Info("Existing Pod is identical, skipping deployment")
-				return nil
-			}
-			glog.Info("Deleting old pod", o.ObjectMeta.Name)
-			err = client.Pods(namespace).Delete(o.ObjectMeta.Name, nil)
-
-			for k := 1; err == nil && k < 20; k++ {
-				time.Sleep(200 * time.Millisecond) // Wait for Kubernetes to delete the resource
-				_, err = client.Pods(namespace).Get(o.ObjectMeta.Name)
-			}
-			if err != nil {
-				glog.Error("delete old pods: ", err)
-			}
-		}
+	h, err := s.handler()
+	if err != nil {
+		return err
+	}
+	return h.deploy(s)
+}
 
-		glog.Info("Creating new pod: ", o.ObjectMeta.Name)
-		_, err = client.Pods(namespace).Create(o)
-		if err != nil {
-			glog.Info("Create or Update failed: ", err)
-			return err
-		}
-	case "Service":
-		o := s.object.(*v1.Service)
-		service, err := client.Services(namespace).Get(o.ObjectMeta.Name)
-
-		if err != nil {
-			glog.Info("Creating new service: ", o.ObjectMeta.Name)
-			_, err = client.Services(namespace).Create(o)
-		} else {
-			glog.Info("Updating service", o.ObjectMeta.Name)
-			o.ObjectMeta.ResourceVersion = service.ObjectMeta.ResourceVersion
-			o.Spec.ClusterIP = service.Spec.ClusterIP
-			_, err = client.Services(namespace).Update(o)
-		}
-		if err != nil {
-			glog.Info("Create or Update failed: ", err)
-			return err
-		}
-	default:
-		return errors.New("Kubernetes resource is not recognized: " + oGVK.Kind)
+// Wait blocks until the deployed object is ready
+func (s *ManifestStep) Wait() error {
+	h, err := s.handler()
+	if err != nil {
+		return err
+	}
+	if h.wait == nil {
+		return nil
+	}
+	return h.wait(s)
+}
+
+// Plan compares the step's object to the live one without changing anything
+func (s *ManifestStep) Plan() ([]Change, error) {
+	h, err := s.handler()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return h.plan(s)
 }
 
 // Destroy deletes kubernetes resource
 func (s *ManifestStep) Destroy() error {
-	var err error
-	oGVK := s.object.GetObjectKind().GroupVersionKind()
-	meta, err := meta.Accessor(s.object)
+	h, err := s.handler()
 	if err != nil {
 		return err
 	}
-	switch oGVK.Kind {
-	case "ReplicationController":
-		deleteRC(namespace, meta.GetName())
-	case "Service":
-		client.Services(namespace).Delete(meta.GetName(), nil)
-	case "Pod":
-		client.Pods(namespace).Delete(meta.GetName(), nil)
+	meta, err := meta.Accessor(s.object)
+	if err != nil {
+		return err
 	}
-	return err
+	return h.destroy(s, meta.GetName())
 }
@@ -12,8 +12,10 @@ import (
 	"k8s.io/kubernetes/pkg/runtime"
 )
 
-func init() {
-	namespace = "test"
+// testCluster returns a cluster in the "test" namespace whose core client is f
+// and whose other resources are kept by r
+func testCluster(f *core.Fake, r ResourceClient) *Cluster {
+	return &Cluster{Core: &fake.FakeCore{Fake: f}, Resources: r, Namespace: "test"}
 }
 
 func mustDeserialize(manifest string) runtime.Object {
@@ -78,10 +80,8 @@ func TestManifestStepDeploy(t *testing.T) {
 
 	for _, c := range cases {
 		// Reset client
-		client = &fake.FakeCore{&core.Fake{}}
-		f := client.(*fake.FakeCore).Fake
-		step := NewManifestStep(c.Object)
-		f.ReactionChain = nil
+		f := &core.Fake{}
+		step := NewManifestStep(testCluster(f, nil), c.Object)
 		c.Before(f)
 		f.ClearActions()
 		assert.Equal(t, 0, len(f.Actions()), c.Name+" action count did not reset")
@@ -125,11 +125,10 @@ func TestManifestStepDestroy(t *testing.T) {
 
 	for _, c := range cases {
 		// Reset client
-		client = &fake.FakeCore{&core.Fake{}}
-		f := client.(*fake.FakeCore).Fake
-		step := NewManifestStep(c.Object)
+		f := &core.Fake{}
+		step := NewManifestStep(testCluster(f, nil), c.Object)
 		c.Before()
-		client.(*fake.FakeCore).Fake.ClearActions()
+		f.ClearActions()
 		assert.Equal(t, 0, len(f.Actions()), c.Name+" action count did not reset")
 		err := step.Destroy()
 		assert.Nil(t, err, c.Name+" deploy returned with nil")
@@ -1,9 +1,11 @@
 package deployment
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"regexp"
+	"sort"
 )
 
 var extExp = regexp.MustCompile(`\.[^.]+$`)
@@ -27,6 +29,59 @@ func LoadManifestFolder(root, ext string) (map[string]*Manifest, error) {
 	return mm, nil
 }
 
+// LoadManifests loads a folder like LoadManifestFolder, but fails with
+// PlaybookErrors unless every manifest parses, and every manifest of playbooks
+// exists and renders with the default vars of the playbook
+func LoadManifests(root, ext string, playbooks map[string]*Playbook) (map[string]*Manifest, error) {
+	mm := make(map[string]*Manifest)
+	var problems PlaybookErrors
+	invalid := map[string]bool{} // the manifests reported already
+	paths, err := filepath.Glob(filepath.Join(root, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		name := extExp.ReplaceAllString(filepath.Base(p), "")
+		m, err := load(root, name+ext)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Manifest %s invalid: %s", p, err))
+			invalid[name] = true
+			continue
+		}
+		mm[name] = m
+	}
+
+	ids := make([]string, 0, len(playbooks))
+	for id := range playbooks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		pb := playbooks[id]
+		vars := map[string]string{}
+		for _, v := range pb.Vars {
+			vars[v.Name] = v.Default
+		}
+		for _, name := range pb.Manifests {
+			m, ok := mm[name]
+			if !ok && invalid[name] {
+				continue
+			}
+			if !ok {
+				problems = append(problems, fmt.Sprintf("Playbook %s names the missing manifest %s", id, name))
+				continue
+			}
+			if _, err := m.Render(vars); err != nil {
+				problems = append(problems, fmt.Sprintf("Manifest %s of playbook %s failed to render: %s", name, id, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return mm, nil
+}
+
 func load(root, name string) (*Manifest, error) {
 	path := filepath.Join(root, name)
 	bytes, err := ioutil.ReadFile(path)
@@ -36,6 +36,33 @@ func TestLoadManifestFolder(t *testing.T) {
 	assert.Equal(t, ms["test"].ID, "test.yml")
 }
 
+func TestLoadManifests(t *testing.T) {
+	setupFolder()
+	defer os.RemoveAll(tmpDir)
+	playbooks := map[string]*Playbook{
+		"web": {ID: "web", Manifests: []string{"test"}, Vars: []Var{{Name: "cities", Default: "a,b"}}},
+	}
+
+	ms, err := LoadManifests(tmpDir, testutils.TestCfg.ManifestsExtension, playbooks)
+	assert.Nil(t, err)
+	assert.Len(t, ms, 1)
+
+	write := func(name, content string) {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0666))
+	}
+	write("broken.yml", "{{ .test ")
+	write("failing.yml", `{{ index (split .cities ",") 5 }}`)
+	playbooks["api"] = &Playbook{ID: "api", Manifests: []string{"broken", "failing", "missing"}, Vars: []Var{{Name: "cities", Default: "a,b"}}}
+	_, err = LoadManifests(tmpDir, testutils.TestCfg.ManifestsExtension, playbooks)
+	if assert.IsType(t, PlaybookErrors{}, err) {
+		problems := err.(PlaybookErrors)
+		assert.Len(t, problems, 3)
+		assert.Contains(t, problems[0], "broken.yml invalid")
+		assert.Contains(t, problems[1], "Manifest failing of playbook api failed to render")
+		assert.Equal(t, "Playbook api names the missing manifest missing", problems[2])
+	}
+}
+
 const testManifest = `apiVersion: v1
 kind: ReplicationController
 metadata:
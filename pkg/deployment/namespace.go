@@ -0,0 +1,82 @@
+package deployment
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+// namespaceName matches the names Kubernetes accepts for a namespace
+var namespaceName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// renderNamespace executes a namespace template with vars. The result is
+// lowercased and must be a valid namespace name.
+func renderNamespace(text string, vars map[string]string) (string, error) {
+	name, err := renderVarTemplate("namespace", text, vars)
+	if err != nil {
+		return "", err
+	}
+	name = strings.ToLower(name)
+	if len(name) > 63 || !namespaceName.MatchString(name) {
+		return "", fmt.Errorf("deployment: \"%s\" is not a valid namespace name", name)
+	}
+	return name, nil
+}
+
+const (
+	// namespacePlaybookLabel and namespaceInstanceLabel name the instance a
+	// namespace was created for. Only that instance deletes the namespace.
+	namespacePlaybookLabel = "broadway-playbook"
+	namespaceInstanceLabel = "broadway-instance"
+)
+
+// ensureNamespace creates the namespace name with labels unless it exists
+// already
+func (c *Cluster) ensureNamespace(name string, labels map[string]string) error {
+	_, err := c.Core.Namespaces().Get(name)
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+	_, err = c.Core.Namespaces().Create(&v1.Namespace{ObjectMeta: v1.ObjectMeta{Name: name, Labels: labels}})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// deleteNamespace deletes the namespace name and every object in it if it
+// carries labels. The default namespaces of the cluster are never deleted.
+// It returns whether the namespace is gone.
+func (c *Cluster) deleteNamespace(name string, labels map[string]string) (bool, error) {
+	if name == c.Namespace || name == c.DefaultNamespace || len(labels) == 0 {
+		return false, nil
+	}
+	for _, v := range labels {
+		if v == "" {
+			return false, nil
+		}
+	}
+	ns, err := c.Core.Namespaces().Get(name)
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for k, v := range labels {
+		if ns.ObjectMeta.Labels[k] != v {
+			return false, nil
+		}
+	}
+	// The namespace deleted must be the one checked
+	uid := ns.ObjectMeta.UID
+	err = c.Core.Namespaces().Delete(name, &api.DeleteOptions{Preconditions: &api.Preconditions{UID: &uid}})
+	if err = ignoreNotFound(err); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,177 @@
+package deployment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/client/testing/core"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/types"
+)
+
+func TestRenderNamespace(t *testing.T) {
+	vars := map[string]string{"playbook_id": "Web", "instance_id": "pr-12"}
+	cases := []struct {
+		Name        string
+		Template    string
+		Expected    string
+		ExpectedErr string
+	}{
+		{
+			Name:     "Playbook and instance",
+			Template: "{{.playbook_id}}-{{.instance_id}}",
+			Expected: "web-pr-12",
+		},
+		{
+			Name:        "Invalid name",
+			Template:    "{{.playbook_id}}_{{.instance_id}}",
+			ExpectedErr: `deployment: "web_pr-12" is not a valid namespace name`,
+		},
+		{
+			Name:        "Missing variable",
+			Template:    "{{.branch}}",
+			ExpectedErr: `template: namespace:1:2: executing "namespace" at <.branch>: map has no entry for key "branch"`,
+		},
+	}
+
+	for _, c := range cases {
+		ns, err := renderNamespace(c.Template, vars)
+		if c.ExpectedErr != "" {
+			assert.EqualError(t, err, c.ExpectedErr, c.Name)
+			continue
+		}
+		assert.Nil(t, err, c.Name)
+		assert.Equal(t, c.Expected, ns, c.Name)
+	}
+}
+
+// namespacesReaction keeps the namespaces of a fake cluster in namespaces
+func namespacesReaction(namespaces map[string]*v1.Namespace) core.ReactionFunc {
+	return func(a core.Action) (bool, runtime.Object, error) {
+		switch a.GetVerb() {
+		case "create":
+			ns := a.(core.CreateAction).GetObject().(*v1.Namespace)
+			ns.ObjectMeta.UID = types.UID("uid-" + ns.ObjectMeta.Name)
+			namespaces[ns.ObjectMeta.Name] = ns
+			return true, ns, nil
+		case "delete":
+			delete(namespaces, a.(core.DeleteAction).GetName())
+			return true, nil, nil
+		case "get":
+			name := a.(core.GetAction).GetName()
+			if ns, ok := namespaces[name]; ok {
+				return true, ns, nil
+			}
+			return true, nil, errors.NewNotFound(unversioned.GroupResource{Resource: "namespaces"}, name)
+		}
+		return false, nil, nil
+	}
+}
+
+func TestNamespacePerInstance(t *testing.T) {
+	namespaces := map[string]*v1.Namespace{}
+	f := &core.Fake{}
+	f.AddReactor("*", "namespaces", namespacesReaction(namespaces))
+	f.AddReactor("list", "pods", readyPodsReaction(map[string]string{"name": "redis"}, 1))
+
+	m, _ := NewManifest("test", mtemplate)
+	d := &KubernetesDeployment{
+		Cluster: testCluster(f, nil),
+		Playbook: &Playbook{
+			ID:        "test",
+			Name:      "Test deployment",
+			Manifests: []string{"test"},
+			Namespace: "{{.playbook_id}}-{{.instance_id}}",
+		},
+		Variables: map[string]string{"playbook_id": "test", "instance_id": "pr-12"},
+		Manifests: map[string]*Manifest{"test": m},
+	}
+
+	assert.Nil(t, d.Deploy(ctx), "deployment should not return with error")
+	created := f.Actions()[1].(core.CreateAction)
+	assert.Equal(t, "namespaces", created.GetResource().Resource)
+	ns := created.GetObject().(*v1.Namespace)
+	assert.Equal(t, "test-pr-12", ns.ObjectMeta.Name)
+	assert.Equal(t, map[string]string{"broadway-playbook": "test", "broadway-instance": "pr-12"}, ns.ObjectMeta.Labels)
+	for _, a := range f.Actions()[2:] {
+		assert.Equal(t, "test-pr-12", a.GetNamespace(), a.GetVerb()+" should use the instance's namespace")
+	}
+
+	f.ClearActions()
+	assert.Nil(t, d.Destroy(ctx), "destroy should not return with error")
+	assert.Len(t, f.Actions(), 2, "destroy should only delete the namespace")
+	deleted := f.Actions()[1].(core.DeleteAction)
+	assert.Equal(t, "delete", deleted.GetVerb())
+	assert.Equal(t, "namespaces", deleted.GetResource().Resource)
+	assert.Equal(t, "test-pr-12", deleted.GetName())
+	assert.Empty(t, namespaces)
+}
+
+func TestDestroyForeignNamespace(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Namespace string
+		Labels    map[string]string
+	}{
+		{
+			Name:      "Namespace shared with another instance",
+			Namespace: "shared",
+			Labels:    map[string]string{"broadway-playbook": "test", "broadway-instance": "pr-11"},
+		},
+		{
+			Name:      "Namespace of another playbook",
+			Namespace: "pr-12",
+			Labels:    map[string]string{"broadway-playbook": "other", "broadway-instance": "pr-12"},
+		},
+		{
+			Name:      "Namespace created outside of Broadway",
+			Namespace: "existing",
+		},
+		{
+			Name:      "Namespace of the cluster",
+			Namespace: "test",
+			Labels:    map[string]string{"broadway-playbook": "test", "broadway-instance": "pr-12"},
+		},
+		{
+			Name:      "Namespace of Broadway",
+			Namespace: "broadway",
+			Labels:    map[string]string{"broadway-playbook": "test", "broadway-instance": "pr-12"},
+		},
+	}
+
+	m, _ := NewManifest("test", mtemplate)
+	for _, c := range cases {
+		namespaces := map[string]*v1.Namespace{
+			c.Namespace: {ObjectMeta: v1.ObjectMeta{Name: c.Namespace, Labels: c.Labels}},
+		}
+		f := &core.Fake{}
+		f.AddReactor("*", "namespaces", namespacesReaction(namespaces))
+		cluster := testCluster(f, nil)
+		cluster.DefaultNamespace = "broadway"
+		d := &KubernetesDeployment{
+			Cluster: cluster,
+			Playbook: &Playbook{
+				ID:        "test",
+				Name:      "Test deployment",
+				Manifests: []string{"test"},
+				Namespace: c.Namespace,
+			},
+			Variables: map[string]string{"playbook_id": "test", "instance_id": "pr-12"},
+			Manifests: map[string]*Manifest{"test": m},
+		}
+
+		assert.Nil(t, d.Destroy(ctx), c.Name+": destroy should not return with error")
+		assert.Contains(t, namespaces, c.Namespace, c.Name+": the namespace should be kept")
+		for _, a := range f.Actions() {
+			if a.GetResource().Resource == "namespaces" {
+				assert.NotEqual(t, "delete", a.GetVerb(), c.Name+": the namespace should not be deleted")
+				continue
+			}
+			assert.Equal(t, c.Namespace, a.GetNamespace(), c.Name+": "+a.GetVerb()+" should use the namespace")
+		}
+		assert.Contains(t, f.Actions(), core.NewDeleteAction(unversioned.GroupVersionResource{Version: "v1", Resource: "replicationcontrollers"}, c.Namespace, "test"), c.Name+": the instance's objects should be deleted")
+	}
+}
@@ -0,0 +1,252 @@
+package deployment
+
+import (
+	"reflect"
+
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+// ChangeAction says what a deployment would do to an object
+type ChangeAction string
+
+const (
+	// ChangeCreate means the object doesn't exist yet
+	ChangeCreate ChangeAction = "create"
+	// ChangeUpdate means the live object differs from the manifest
+	ChangeUpdate ChangeAction = "update"
+	// ChangeUnchanged means the live object matches the manifest
+	ChangeUnchanged ChangeAction = "unchanged"
+	// ChangeDelete means the object would be removed
+	ChangeDelete ChangeAction = "delete"
+)
+
+// Change describes what a deployment would do to one object
+type Change struct {
+	Kind        string       `json:"kind"`
+	Name        string       `json:"name"`
+	Action      ChangeAction `json:"action"`
+	Differences []string     `json:"differences,omitempty"`
+}
+
+// missing tells whether err means the live object doesn't exist. Other errors
+// are returned.
+func missing(err error) (bool, error) {
+	if err == nil {
+		return false, nil
+	}
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// changed turns the result of a comparison into a change
+func changed(kind, name string, d differences, same bool) []Change {
+	c := Change{Kind: kind, Name: name, Action: ChangeUnchanged}
+	if !same {
+		c.Action = ChangeUpdate
+		c.Differences = []string(d)
+	}
+	return []Change{c}
+}
+
+func created(kind, name string) []Change {
+	return []Change{{Kind: kind, Name: name, Action: ChangeCreate}}
+}
+
+func planRC(s *ManifestStep) ([]Change, error) {
+	o, ok := s.object.(*v1.ReplicationController)
+	if !ok {
+		return nil, nil
+	}
+	if s.strategy == StrategyRollingUpdate {
+		return planRollingUpdateRC(s, o)
+	}
+
+	rc, err := s.cluster.Core.ReplicationControllers(s.namespace).Get(o.ObjectMeta.Name)
+	if gone, err := missing(err); err != nil || gone {
+		return created("ReplicationController", o.ObjectMeta.Name), err
+	}
+	d := differences{}
+	return changed("ReplicationController", o.ObjectMeta.Name, d, d.rcs(rc, o)), nil
+}
+
+// planRollingUpdateRC lists the controller a rolling update would create and
+// the ones it would delete
+func planRollingUpdateRC(s *ManifestStep, o *v1.ReplicationController) ([]Change, error) {
+	next, err := versionedRC(o)
+	if err != nil {
+		return nil, err
+	}
+	olds, err := s.cluster.previousRCs(s.namespace, o.ObjectMeta.Name, next.ObjectMeta.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	rc, err := s.cluster.Core.ReplicationControllers(s.namespace).Get(next.ObjectMeta.Name)
+	if gone, err := missing(err); err != nil {
+		return nil, err
+	} else if gone {
+		changes = append(changes, created("ReplicationController", next.ObjectMeta.Name)...)
+	} else {
+		d := differences{}
+		same := d.compareI("rc spec replicas", replicas(rc), replicas(o)) && len(olds) == 0
+		changes = append(changes, changed("ReplicationController", next.ObjectMeta.Name, d, same)...)
+	}
+	for _, old := range olds {
+		changes = append(changes, Change{Kind: "ReplicationController", Name: old.ObjectMeta.Name, Action: ChangeDelete})
+	}
+	return changes, nil
+}
+
+func planPod(s *ManifestStep) ([]Change, error) {
+	o := s.object.(*v1.Pod)
+	pod, err := s.cluster.Core.Pods(s.namespace).Get(o.ObjectMeta.Name)
+	if gone, err := missing(err); err != nil || gone {
+		return created("Pod", o.ObjectMeta.Name), err
+	}
+	d := differences{}
+	return changed("Pod", o.ObjectMeta.Name, d, d.pods(pod, o)), nil
+}
+
+// servicePorts drops the fields Kubernetes fills in from a service's ports
+func servicePorts(ports []v1.ServicePort) []v1.ServicePort {
+	ps := []v1.ServicePort{}
+	for _, p := range ports {
+		ps = append(ps, v1.ServicePort{Name: p.Name, Protocol: p.Protocol, Port: p.Port})
+	}
+	return ps
+}
+
+func planService(s *ManifestStep) ([]Change, error) {
+	o := s.object.(*v1.Service)
+	service, err := s.cluster.Core.Services(s.namespace).Get(o.ObjectMeta.Name)
+	if gone, err := missing(err); err != nil || gone {
+		return created("Service", o.ObjectMeta.Name), err
+	}
+	d := differences{}
+	same := all(
+		d.compareI("service object meta labels", service.ObjectMeta.Labels, o.ObjectMeta.Labels),
+		d.compareI("service spec selector", service.Spec.Selector, o.Spec.Selector),
+		d.compareI("service spec ports", servicePorts(service.Spec.Ports), servicePorts(o.Spec.Ports)),
+		o.Spec.Type == "" || d.check("service spec type", service.Spec.Type == o.Spec.Type),
+	)
+	return changed("Service", o.ObjectMeta.Name, d, same), nil
+}
+
+func planConfigMap(s *ManifestStep) ([]Change, error) {
+	o := s.object.(*v1.ConfigMap)
+	cm, err := s.cluster.Core.ConfigMaps(s.namespace).Get(o.ObjectMeta.Name)
+	if gone, err := missing(err); err != nil || gone {
+		return created("ConfigMap", o.ObjectMeta.Name), err
+	}
+	d := differences{}
+	same := all(
+		d.compareI("config map object meta labels", cm.ObjectMeta.Labels, o.ObjectMeta.Labels),
+		d.compareI("config map data", cm.Data, o.Data),
+	)
+	return changed("ConfigMap", o.ObjectMeta.Name, d, same), nil
+}
+
+func planSecret(s *ManifestStep) ([]Change, error) {
+	o := s.object.(*v1.Secret)
+	secret, err := s.cluster.Core.Secrets(s.namespace).Get(o.ObjectMeta.Name)
+	if gone, err := missing(err); err != nil || gone {
+		return created("Secret", o.ObjectMeta.Name), err
+	}
+	d := differences{}
+	same := all(
+		d.compareI("secret object meta labels", secret.ObjectMeta.Labels, o.ObjectMeta.Labels),
+		d.compareI("secret data", secret.Data, o.Data),
+	)
+	return changed("Secret", o.ObjectMeta.Name, d, same), nil
+}
+
+// planGeneric compares the metadata and spec of objects without a typed
+// client. Kubernetes fills in defaults the manifest may leave out, so a spec
+// only counts as changed if a field set in the manifest differs.
+func planGeneric(s *ManifestStep) ([]Change, error) {
+	o, gv, resource, err := s.unstructured()
+	if err != nil {
+		return nil, err
+	}
+	live, err := s.cluster.Resources.Get(gv, resource, s.namespace, o.GetName())
+	if gone, err := missing(err); err != nil || gone {
+		return created(o.GetKind(), o.GetName()), err
+	}
+
+	d := differences{}
+	same := all(
+		d.compareI("object meta labels", live.GetLabels(), o.GetLabels()),
+		d.compareI("object meta annotations", subset(live.GetAnnotations(), o.GetAnnotations()), o.GetAnnotations()),
+	)
+	switch o.GetKind() {
+	case "PersistentVolumeClaim":
+		// Only the metadata of a claim is updated
+	case "Job":
+		// Jobs are always run again
+		same = d.check("job is recreated", false) && same
+	default:
+		same = d.check("spec", contains(live.Object["spec"], o.Object["spec"])) && same
+	}
+	return changed(o.GetKind(), o.GetName(), d, same), nil
+}
+
+// subset returns the entries of live whose keys are in wanted
+func subset(live, wanted map[string]string) map[string]string {
+	if len(wanted) == 0 {
+		return wanted
+	}
+	s := map[string]string{}
+	for k := range wanted {
+		if v, ok := live[k]; ok {
+			s[k] = v
+		}
+	}
+	return s
+}
+
+// contains tells whether every field set in wanted has the same value in live
+func contains(live, wanted interface{}) bool {
+	switch w := wanted.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range w {
+			if !contains(l[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !contains(l[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	case float64, int64, int:
+		return numeric(live) == numeric(wanted)
+	default:
+		return reflect.DeepEqual(live, wanted)
+	}
+}
+
+// numeric lets numbers decoded as different types compare equal
+func numeric(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case int:
+		return float64(n)
+	}
+	return v
+}
@@ -0,0 +1,153 @@
+package deployment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/testing/core"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+func TestManifestStepPlan(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Object   runtime.Object
+		Existing []runtime.Object
+		Expected []Change
+	}{
+		{
+			Name:     "Missing RC",
+			Object:   mustDeserialize(rct1),
+			Expected: []Change{{Kind: "ReplicationController", Name: "test2", Action: ChangeCreate}},
+		},
+		{
+			Name:     "Identical RC",
+			Object:   mustDeserialize(rct1),
+			Existing: []runtime.Object{mustDeserialize(rct1)},
+			Expected: []Change{{Kind: "ReplicationController", Name: "test2", Action: ChangeUnchanged}},
+		},
+		{
+			Name:     "Changed RC",
+			Object:   mustDeserialize(rct1),
+			Existing: []runtime.Object{mustDeserialize(rct2)},
+			Expected: []Change{{
+				Kind:        "ReplicationController",
+				Name:        "test2",
+				Action:      ChangeUpdate,
+				Differences: []string{"rc spec selector"},
+			}},
+		},
+		{
+			Name:     "Changed ConfigMap",
+			Object:   mustDeserialize(configmapt1),
+			Existing: []runtime.Object{mustDeserialize(configmapt2)},
+			Expected: []Change{{
+				Kind:        "ConfigMap",
+				Name:        "settings",
+				Action:      ChangeUpdate,
+				Differences: []string{"config map data"},
+			}},
+		},
+		{
+			Name:     "Identical Secret",
+			Object:   mustDeserialize(secrett1),
+			Existing: []runtime.Object{mustDeserialize(secrett1)},
+			Expected: []Change{{Kind: "Secret", Name: "credentials", Action: ChangeUnchanged}},
+		},
+	}
+
+	for _, c := range cases {
+		f := &core.Fake{}
+		o := core.NewObjects(api.Scheme, api.Codecs.UniversalDecoder())
+		for _, e := range c.Existing {
+			if err := o.Add(e); err != nil {
+				panic(err)
+			}
+		}
+		f.AddReactor("get", "*", core.ObjectReaction(o, api.RESTMapper))
+
+		changes, err := NewManifestStep(testCluster(f, nil), c.Object).Plan()
+		assert.Nil(t, err, c.Name+" plan should not return with error")
+		assert.Equal(t, c.Expected, changes, c.Name)
+		for _, a := range f.Actions() {
+			assert.Equal(t, "get", a.GetVerb(), c.Name+" plan should only read")
+		}
+	}
+}
+
+func TestGenericResourcePlan(t *testing.T) {
+	f := newFakeResourceClient()
+	cluster := testCluster(nil, f)
+
+	changes, err := NewManifestStep(cluster, mustDeserialize(deploymentt1)).Plan()
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Kind: "Deployment", Name: "web", Action: ChangeCreate}}, changes)
+
+	NewManifestStep(cluster, mustDeserialize(deploymentt1)).Deploy()
+	live, _ := f.Get(unversioned.GroupVersion{Group: "extensions", Version: "v1beta1"}, "deployments", cluster.Namespace, "web")
+	live.Object["spec"].(map[string]interface{})["minReadySeconds"] = int64(0) // defaulted by Kubernetes
+	f.verbs = nil
+	changes, err = NewManifestStep(cluster, mustDeserialize(deploymentt1)).Plan()
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Kind: "Deployment", Name: "web", Action: ChangeUnchanged}}, changes)
+
+	changes, err = NewManifestStep(cluster, mustDeserialize(deploymentt2)).Plan()
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Kind: "Deployment", Name: "web", Action: ChangeUpdate, Differences: []string{"spec"}}}, changes)
+	assert.Equal(t, []string{"get", "get"}, f.verbs, "plan should only read")
+}
+
+func TestPlanRollingUpdate(t *testing.T) {
+	cluster := newFakeCluster()
+	target := &Cluster{Core: cluster.client(), Namespace: "test"}
+	recreated := rcWithImage("web:v1")
+	cluster.rcs["web"] = recreated
+	cluster.sync(recreated)
+
+	step := &ManifestStep{cluster: target, object: rcWithImage("web:v2"), strategy: StrategyRollingUpdate}
+	next, _ := versionedRC(rcWithImage("web:v2"))
+	changes, err := step.Plan()
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{
+		{Kind: "ReplicationController", Name: next.ObjectMeta.Name, Action: ChangeCreate},
+		{Kind: "ReplicationController", Name: "web", Action: ChangeDelete},
+	}, changes)
+}
+
+func TestContains(t *testing.T) {
+	live := map[string]interface{}{
+		"replicas": int64(2),
+		"ports":    []interface{}{map[string]interface{}{"port": float64(80), "protocol": "TCP"}},
+	}
+	assert.True(t, contains(live, map[string]interface{}{"replicas": float64(2)}))
+	assert.True(t, contains(live, map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(80)}}}))
+	assert.False(t, contains(live, map[string]interface{}{"replicas": int64(3)}))
+	assert.False(t, contains(live, map[string]interface{}{"paused": true}))
+}
+
+var configmapt2 = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  log_level: info
+`
+
+var deploymentt2 = `apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.11
+`
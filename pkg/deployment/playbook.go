@@ -1,11 +1,14 @@
 package deployment
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/golang/glog"
@@ -16,39 +19,58 @@ import (
 
 // Meta contains optional metadata keys associated with this playbook
 type Meta struct {
-	Team  string `yaml:"team"`
-	Email string `yaml:"email"`
-	Slack string `yaml:"slack"`
+	Team  string `yaml:"team" json:"team,omitempty"`
+	Email string `yaml:"email" json:"email,omitempty"`
+	Slack string `yaml:"slack" json:"slack,omitempty"`
 }
 
 // Playbook configures a set of tasks to be automated
 type Playbook struct {
-	ID        string            `yaml:"id"`
-	Name      string            `yaml:"name"`
-	Meta      Meta              `yaml:"meta"`
-	Vars      []string          `yaml:"vars"`
-	Manifests []string          `yaml:"manifests"`
-	Messages  map[string]string `yaml:"messages"`
+	ID          string            `yaml:"id" json:"id"`
+	Name        string            `yaml:"name" json:"name"`
+	Extends     string            `yaml:"extends" json:"extends,omitempty"`           // the ID of the playbook this one inherits from
+	IncludeVars []string          `yaml:"include_vars" json:"include_vars,omitempty"` // var set files, relative to the playbook
+	Meta        Meta              `yaml:"meta" json:"meta"`
+	Vars        []Var             `yaml:"vars" json:"vars"`
+	Manifests   []string          `yaml:"manifests" json:"manifests"`
+	Messages    map[string]string `yaml:"messages" json:"messages,omitempty"`
+	Strategy    string            `yaml:"strategy" json:"strategy,omitempty"`   // how replication controllers are updated
+	Namespace   string            `yaml:"namespace" json:"namespace,omitempty"` // template naming a namespace of its own for each instance
+	Cluster     string            `yaml:"cluster" json:"cluster,omitempty"`     // template naming the cluster instances are deployed to
+	Clusters    []string          `yaml:"clusters" json:"clusters,omitempty"`   // the clusters the template may name, any when empty
+
+	file     string    // the file declaring the playbook
+	declared *Playbook // the playbook before inheritance, nil when it wasn't loaded from a folder
 }
 
-// AllPlaybooks is a map of playbook id's to playbooks
+// AllPlaybooks is a map of playbook id's to playbooks. Read it with Playbooks
+// and swap it with SetPlaybooks once the server runs.
 var AllPlaybooks map[string]*Playbook
-var playbooksPath string
-var manifestsPath string
-var manifestsExtension string
+var playbooksMu sync.RWMutex
 
 // SetupPlaybook configures playbook with an injected configuration
 func SetupPlaybook(cfg cfg.Type) {
-	playbooksPath = cfg.PlaybooksPath
-	manifestsPath = cfg.ManifestsPath
-	manifestsExtension = cfg.ManifestsExtension
 	var err error
-	AllPlaybooks, err = LoadPlaybookFolder(cfg.PlaybooksPath)
+	AllPlaybooks, err = LoadPlaybookFolder(cfg.PlaybooksPath, cfg.ManifestsPath, cfg.ManifestsExtension)
 	if err != nil {
 		glog.Fatal(err)
 	}
 }
 
+// Playbooks returns the playbooks loaded last. The map must not be changed.
+func Playbooks() map[string]*Playbook {
+	playbooksMu.RLock()
+	defer playbooksMu.RUnlock()
+	return AllPlaybooks
+}
+
+// SetPlaybooks replaces the loaded playbooks
+func SetPlaybooks(playbooks map[string]*Playbook) {
+	playbooksMu.Lock()
+	defer playbooksMu.Unlock()
+	AllPlaybooks = playbooks
+}
+
 // Validate checks for ID, Name, and Tasks on a playbook
 func (p *Playbook) Validate() error {
 	if len(p.ID) == 0 {
@@ -60,20 +82,79 @@ func (p *Playbook) Validate() error {
 	if len(p.Manifests) == 0 {
 		return errors.New("Playbook requires at least 1 manifest")
 	}
+	switch p.Strategy {
+	case "", StrategyRecreate, StrategyRollingUpdate:
+	default:
+		return fmt.Errorf("Playbook has an unknown strategy: \"%s\"", p.Strategy)
+	}
+	declared := map[string]bool{}
+	for n := range p.Vars {
+		if err := p.Vars[n].validate(); err != nil {
+			return err
+		}
+		if declared[p.Vars[n].Name] {
+			return fmt.Errorf("Playbook declares the var %s twice", p.Vars[n].Name)
+		}
+		declared[p.Vars[n].Name] = true
+	}
+	if _, err := parseVarTemplate("namespace", p.Namespace); err != nil {
+		return fmt.Errorf("Playbook had an invalid namespace template: \"%s\"", p.Namespace)
+	}
+	if _, err := parseVarTemplate("cluster", p.Cluster); err != nil {
+		return fmt.Errorf("Playbook had an invalid cluster template: \"%s\"", p.Cluster)
+	}
 	for key, value := range p.Messages {
 		_, err := template.New(key).Parse(value)
 		if err != nil {
 			return fmt.Errorf("Playbook had an invalid message template: \"%s\"", value)
 		}
 	}
-	return p.ValidateManifests()
+	return nil
 }
 
-// ValidateManifests checks manifests
-func (p *Playbook) ValidateManifests() error {
+// ClusterName renders the playbook's cluster with the variables of an
+// instance. It is empty when instances go to the default cluster. Users
+// setting the vars of an instance pick its cluster among those the playbook
+// lists, or any configured cluster when it lists none.
+func (p *Playbook) ClusterName(vars map[string]string) (string, error) {
+	if p.Cluster == "" {
+		return "", nil
+	}
+	name, err := renderVarTemplate("cluster", p.Cluster, vars)
+	if err != nil || len(p.Clusters) == 0 {
+		return name, err
+	}
+	for _, allowed := range p.Clusters {
+		if name == allowed {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Playbook %s can't deploy to cluster %s", p.ID, name)
+}
+
+// parseVarTemplate parses a playbook setting rendered with an instance's
+// variables. Missing variables are errors rather than empty strings.
+func parseVarTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+func renderVarTemplate(name, text string, vars map[string]string) (string, error) {
+	t, err := parseVarTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// ValidateManifests checks that the manifests of the playbook are in the
+// folder dir, as files with the extension ext
+func (p *Playbook) ValidateManifests(dir, ext string) error {
 	for _, name := range p.Manifests {
-		filename := name + manifestsExtension
-		path := filepath.Join(manifestsPath, filename)
+		path := filepath.Join(dir, name+ext)
 		if _, err := os.Stat(path); err != nil {
 			return err
 		}
@@ -94,34 +175,103 @@ func ReadPlaybookFromDisk(fd string) ([]byte, error) {
 	return ioutil.ReadFile(fd)
 }
 
+// PlaybookErrors lists the problems of the files of a playbooks folder
+type PlaybookErrors []string
+
+func (e PlaybookErrors) Error() string {
+	return "Invalid playbooks: " + strings.Join(e, "; ")
+}
+
 // LoadPlaybookFolder takes a directory and attempts to parse every file in that
-// directory into a Playbook struct
-func LoadPlaybookFolder(dir string) (map[string]*Playbook, error) {
+// directory into a Playbook struct. Playbooks are merged with the playbooks
+// they extend and the var sets they include, which aren't playbooks
+// themselves. Their manifests must be files with the extension ext in
+// manifestsDir. Invalid playbooks are skipped with a warning.
+func LoadPlaybookFolder(dir, manifestsDir, ext string) (map[string]*Playbook, error) {
+	playbooks, problems, err := loadPlaybookFolder(dir, manifestsDir, ext)
+	for _, problem := range problems {
+		fmt.Printf("Warning: %s\n", problem)
+	}
+	return playbooks, err
+}
+
+// LoadPlaybooks loads a directory like LoadPlaybookFolder, but fails with
+// PlaybookErrors unless every playbook is valid
+func LoadPlaybooks(dir, manifestsDir, ext string) (map[string]*Playbook, error) {
+	playbooks, problems, err := loadPlaybookFolder(dir, manifestsDir, ext)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return playbooks, nil
+}
+
+func loadPlaybookFolder(dir, manifestsDir, ext string) (map[string]*Playbook, PlaybookErrors, error) {
 	var playbooks = make(map[string]*Playbook)
+	var problems PlaybookErrors
 	paths, err := filepath.Glob(dir + "/*")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if len(paths) == 0 {
-		return nil, errors.New("Found zero files in directory " + dir)
+		return nil, nil, errors.New("Found zero files in directory " + dir)
 	}
+	declared := map[string]*Playbook{}
+	files := []*Playbook{}
 	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			continue
+		}
 		playbookBytes, err := ReadPlaybookFromDisk(path)
 		if err != nil {
-			fmt.Printf("Warning: Failed to read %s\n", path)
+			problems = append(problems, fmt.Sprintf("Failed to read %s", path))
 			continue
 		}
 		parsed, err := ParsePlaybook(playbookBytes)
 		if err != nil {
-			fmt.Printf("Warning: Failed to parse %s\n", path)
+			problems = append(problems, fmt.Sprintf("Failed to parse %s: %s", path, err))
 			continue
 		}
-		err = parsed.Validate()
+		parsed.file = path
+		files = append(files, parsed)
+		declared[parsed.ID] = parsed
+	}
+
+	included := map[string]bool{}
+	extended := map[string]bool{}
+	for _, p := range files {
+		for _, name := range p.IncludeVars {
+			included[p.includePath(name)] = true
+		}
+		if p.Extends != "" {
+			extended[p.Extends] = true
+		}
+	}
+	r := newResolver(declared)
+	for _, p := range files {
+		if included[filepath.Clean(p.file)] {
+			continue
+		}
+		resolved, err := r.resolve(p.ID, nil)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Playbook %s invalid: %s", p.file, err))
+			continue
+		}
+		err = resolved.Validate()
+		if err == nil {
+			err = resolved.ValidateManifests(manifestsDir, ext)
+		}
 		if err != nil {
-			fmt.Printf("Warning: Playbook %s invalid: %s\n", path, err)
+			if extended[p.ID] {
+				fmt.Printf("Playbook %s is only used as a base: %s\n", p.file, err)
+			} else {
+				problems = append(problems, fmt.Sprintf("Playbook %s invalid: %s", p.file, err))
+			}
 			continue
 		}
-		playbooks[parsed.ID] = parsed
+		playbooks[resolved.ID] = resolved
 	}
-	return playbooks, nil
+	return playbooks, problems, nil
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/namely/broadway/pkg/cfg"
+	"github.com/stretchr/testify/assert"
 )
 
 const MockPlaybookContents string = `---
@@ -202,6 +203,26 @@ func TestValidatePlaybookFailures(t *testing.T) {
 			},
 			"Playbook missing required Name",
 		},
+		{
+			"Validate Playbook With Unknown Strategy",
+			&Playbook{
+				ID:        "playbook id 1",
+				Name:      "playbook name 1",
+				Manifests: []string{"web-rc"},
+				Strategy:  "blue-green",
+			},
+			`Playbook has an unknown strategy: "blue-green"`,
+		},
+		{
+			"Validate Playbook With Bad Namespace Template",
+			&Playbook{
+				ID:        "playbook id 1",
+				Name:      "playbook name 1",
+				Manifests: []string{"web-rc"},
+				Namespace: "{{.instance_id",
+			},
+			`Playbook had an invalid namespace template: "{{.instance_id"`,
+		},
 	}
 
 	for _, testcase := range testcases {
@@ -214,7 +235,7 @@ func TestValidatePlaybookFailures(t *testing.T) {
 }
 
 func TestLoadPlaybookFolder(t *testing.T) {
-	pbs, err := LoadPlaybookFolder(testCfg.PlaybooksPath)
+	pbs, err := LoadPlaybookFolder(testCfg.PlaybooksPath, testCfg.ManifestsPath, testCfg.ManifestsExtension)
 	if err != nil {
 		t.Errorf("LoadPlaybookFolder failed to load playbooks: %s\n", err)
 	}
@@ -222,3 +243,26 @@ func TestLoadPlaybookFolder(t *testing.T) {
 		t.Error("LoadPlaybookFolder failed to load")
 	}
 }
+
+func TestLoadPlaybooks(t *testing.T) {
+	dir := writePlaybooks(t, map[string]string{
+		"web.yml":    "{id: web, name: Web, manifests: [hello]}",
+		"worker.yml": "{id: worker, name: Worker, manifests: [missing]}",
+	})
+	defer os.RemoveAll(dir)
+
+	pbs, err := LoadPlaybookFolder(dir, testCfg.ManifestsPath, testCfg.ManifestsExtension)
+	assert.Nil(t, err)
+	assert.Len(t, pbs, 1, "invalid playbooks should be skipped")
+
+	_, err = LoadPlaybooks(dir, testCfg.ManifestsPath, testCfg.ManifestsExtension)
+	if assert.IsType(t, PlaybookErrors{}, err) {
+		assert.Len(t, err.(PlaybookErrors), 1)
+		assert.Contains(t, err.Error(), "worker.yml invalid")
+	}
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, "worker.yml")))
+	pbs, err = LoadPlaybooks(dir, testCfg.ManifestsPath, testCfg.ManifestsExtension)
+	assert.Nil(t, err)
+	assert.Contains(t, pbs, "web")
+}
@@ -1,16 +1,14 @@
 package deployment
 
 import (
-	"errors"
-	"time"
-
 	"github.com/golang/glog"
 
 	"k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/api/v1"
 )
 
-// deployRC deploys the RC after it calls deleteRC
+// deployRC deploys the RC with the strategy of the step. The default strategy
+// calls deleteRC before creating the RC again.
 func deployRC(s *ManifestStep) error {
 	var o *v1.ReplicationController
 	switch s.object.(type) {
@@ -24,19 +22,23 @@ func deployRC(s *ManifestStep) error {
 		}
 	}
 
-	if rc, err := client.ReplicationControllers(namespace).Get(o.ObjectMeta.Name); err == nil && rc != nil {
+	if s.strategy == StrategyRollingUpdate {
+		return s.cluster.rollingUpdateRC(s.namespace, o, s.progress)
+	}
+
+	if rc, err := s.cluster.Core.ReplicationControllers(s.namespace).Get(o.ObjectMeta.Name); err == nil && rc != nil {
 		if compareRCs(rc, o) {
 			glog.Info("Existing RC is identical, skipping deployment")
 			return nil
 		}
 
-		if err := deleteRC(namespace, o.ObjectMeta.Name); err != nil {
+		if err := s.cluster.deleteRC(s.namespace, o.ObjectMeta.Name, s.progress); err != nil {
 			glog.Error(err)
 		}
 	}
 
 	glog.Info("Creating new replication controller: ", o.ObjectMeta.Name)
-	if _, err := client.ReplicationControllers(namespace).Create(o); err != nil {
+	if _, err := s.cluster.Core.ReplicationControllers(s.namespace).Create(o); err != nil {
 		glog.Error("Create or Update failed: ", err)
 		return err
 	}
@@ -44,56 +46,42 @@ func deployRC(s *ManifestStep) error {
 	return nil
 }
 
-// deleteRC scales down an RC and then deletes it
-func deleteRC(namespace, metaName string) error {
-	// SCALE RC DOWN TO 0
-	rc, err := client.ReplicationControllers(namespace).Get(metaName)
+func destroyRC(s *ManifestStep, name string) error {
+	if s.strategy == StrategyRollingUpdate {
+		if err := s.cluster.destroyRolledRCs(s.namespace, name, s.progress); err != nil {
+			return err
+		}
+	}
+	return ignoreNotFound(s.cluster.deleteRC(s.namespace, name, s.progress))
+}
+
+// waitRC waits until the pods of the RC are ready
+func waitRC(s *ManifestStep) error {
+	o, ok := s.object.(*v1.ReplicationController)
+	if !ok {
+		return nil
+	}
+	selector := o.Spec.Selector
+	if len(selector) == 0 {
+		selector = o.Spec.Template.ObjectMeta.Labels
+	}
+	return s.cluster.waitForPodsReady(s.namespace, selector, replicas(o), s.progress)
+}
+
+// deleteRC scales down an RC, waits for its pods to go away and then deletes it
+func (c *Cluster) deleteRC(ns, metaName string, progress ProgressFunc) error {
+	rc, err := c.Core.ReplicationControllers(ns).Get(metaName)
 	if err != nil {
 		return err
 	}
 	// The i variable needs to be declared as a int32 for the Replicas type
 	var i int32
 	rc.Spec.Replicas = &i // Replicas type is *int32 ... so this is *int32(0)
-	client.ReplicationControllers(namespace).Update(rc)
-	time.Sleep(15 * time.Second) // Wait for Kubernetes to delete pods
-	rc, err = client.ReplicationControllers(namespace).Get(metaName)
-	if err != nil {
+	if _, err := c.Core.ReplicationControllers(ns).Update(rc); err != nil {
 		return err
 	}
-	if rc.Status.Replicas != 0 {
-		return errors.New("deployment: RC did not scale successfully")
+	if err := c.waitForRCReplicas(ns, metaName, 0, progress); err != nil {
+		return err
 	}
-	// WATCH REPLICATION CONTROLLER
-	// selector := fields.Set{"metadata.name": meta.Name}.AsSelector()
-	// lo := api.ListOptions{Watch: true, FieldSelector: selector}
-	// watcher, err := client.ReplicationControllers(namespace).Watch(lo)
-	// defer watcher.Stop()
-	//
-	// var rc1 *v1.ReplicationController
-	// var attempt int
-	// for {
-	// 	var ok bool
-	// 	event := <-watcher.ResultChan()
-	// 	rc1, ok = event.Object.(*v1.ReplicationController)
-	// 	if !ok {
-	// 		rcv := v1.ReplicationController{}
-	// 		apirc := event.Object.(*api.ReplicationController)
-	// 		if err = api.Scheme.Convert(apirc, &rcv); err != nil {
-	// 			glog.Errorln("API Object conversion failed: ", err)
-	// 			return err
-	// 		}
-	// 		rc1 = &rcv
-	// 	}
-	//
-	// 	if rc1.Status.Replicas == 0 {
-	// 		break
-	// 	}
-	// 	if attempt > 20 {
-	// 		return errors.New("deployment: RC deletion timed out")
-	// 	}
-	// 	time.Sleep(200 * time.Millisecond)
-	// 	attempt++
-	// }
-	// DELETE RC
-	return client.ReplicationControllers(namespace).Delete(metaName, nil)
+	return c.Core.ReplicationControllers(ns).Delete(metaName, nil)
 }
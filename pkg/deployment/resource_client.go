@@ -0,0 +1,170 @@
+package deployment
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/runtime/serializer"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// ResourceClient manages objects that have no typed client vendored, such as
+// the extensions/v1beta1 and batch/v1 groups or persistent volume claims.
+// Objects are handled as runtime.Unstructured.
+type ResourceClient interface {
+	Get(gv unversioned.GroupVersion, resource, namespace, name string) (*runtime.Unstructured, error)
+	Create(gv unversioned.GroupVersion, resource, namespace string, o *runtime.Unstructured) (*runtime.Unstructured, error)
+	Update(gv unversioned.GroupVersion, resource, namespace string, o *runtime.Unstructured) (*runtime.Unstructured, error)
+	Delete(gv unversioned.GroupVersion, resource, namespace, name string) error
+	Watch(gv unversioned.GroupVersion, resource, namespace, name, resourceVersion string) (watch.Interface, error)
+}
+
+type restResourceClient struct {
+	client *restclient.RESTClient
+}
+
+var _ ResourceClient = &restResourceClient{}
+
+// NewResourceClient creates a ResourceClient for the cluster described by config
+func NewResourceClient(config *restclient.Config) (ResourceClient, error) {
+	c := *config
+	c.APIPath = "/"
+	c.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: api.Codecs}
+	if c.UserAgent == "" {
+		c.UserAgent = restclient.DefaultKubernetesUserAgent()
+	}
+	client, err := restclient.UnversionedRESTClientFor(&c)
+	if err != nil {
+		return nil, err
+	}
+	return &restResourceClient{client: client}, nil
+}
+
+func resourcePath(gv unversioned.GroupVersion, resource, namespace string, name ...string) []string {
+	p := []string{"/apis", gv.Group, gv.Version}
+	if gv.Group == "" {
+		p = []string{"/api", gv.Version} // the legacy core group
+	}
+	p = append(p, "namespaces", namespace, resource)
+	return append(p, name...)
+}
+
+func decodeUnstructured(data []byte) (*runtime.Unstructured, error) {
+	u := &runtime.Unstructured{}
+	if _, _, err := runtime.UnstructuredJSONScheme.Decode(data, nil, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func encodeUnstructured(o runtime.Object) ([]byte, error) {
+	var b bytes.Buffer
+	if err := runtime.UnstructuredJSONScheme.Encode(o, &b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c *restResourceClient) Get(gv unversioned.GroupVersion, resource, namespace, name string) (*runtime.Unstructured, error) {
+	data, err := c.client.Get().AbsPath(resourcePath(gv, resource, namespace, name)...).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	return decodeUnstructured(data)
+}
+
+func (c *restResourceClient) Create(gv unversioned.GroupVersion, resource, namespace string, o *runtime.Unstructured) (*runtime.Unstructured, error) {
+	body, err := encodeUnstructured(o)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.client.Post().
+		AbsPath(resourcePath(gv, resource, namespace)...).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	return decodeUnstructured(data)
+}
+
+func (c *restResourceClient) Update(gv unversioned.GroupVersion, resource, namespace string, o *runtime.Unstructured) (*runtime.Unstructured, error) {
+	body, err := encodeUnstructured(o)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.client.Put().
+		AbsPath(resourcePath(gv, resource, namespace, o.GetName())...).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	return decodeUnstructured(data)
+}
+
+// Delete removes the object and asks the API server to remove its dependents
+// (replica sets, pods) as well
+func (c *restResourceClient) Delete(gv unversioned.GroupVersion, resource, namespace, name string) error {
+	body := []byte(`{"kind":"DeleteOptions","apiVersion":"v1","orphanDependents":false}`)
+	_, err := c.client.Delete().
+		AbsPath(resourcePath(gv, resource, namespace, name)...).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		DoRaw()
+	return err
+}
+
+// Watch streams the changes of the object name made after resourceVersion
+func (c *restResourceClient) Watch(gv unversioned.GroupVersion, resource, namespace, name, resourceVersion string) (watch.Interface, error) {
+	body, err := c.client.Get().
+		AbsPath(resourcePath(gv, resource, namespace)...).
+		Param("watch", "true").
+		Param("fieldSelector", nameSelector(name).String()).
+		Param("resourceVersion", resourceVersion).
+		Stream()
+	if err != nil {
+		return nil, err
+	}
+	return watch.NewStreamWatcher(&unstructuredDecoder{body: body, decoder: json.NewDecoder(body)}), nil
+}
+
+// unstructuredDecoder decodes the events of a watch stream, with their
+// objects as runtime.Unstructured and errors as unversioned.Status
+type unstructuredDecoder struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (d *unstructuredDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); err != nil {
+		return "", nil, err
+	}
+	if event.Type == watch.Error {
+		status := &unversioned.Status{}
+		if err := json.Unmarshal(event.Object, status); err != nil {
+			return "", nil, err
+		}
+		return event.Type, status, nil
+	}
+	o, err := decodeUnstructured(event.Object)
+	if err != nil {
+		return "", nil, err
+	}
+	return event.Type, o, nil
+}
+
+func (d *unstructuredDecoder) Close() {
+	d.body.Close()
+}
@@ -0,0 +1,278 @@
+package deployment
+
+import (
+	"fmt"
+	"hash/adler32"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/labels"
+	hashutil "k8s.io/kubernetes/pkg/util/hash"
+)
+
+const (
+	// StrategyRecreate scales an outdated replication controller down to zero
+	// and creates it again. This is the default strategy.
+	StrategyRecreate = "recreate"
+	// StrategyRollingUpdate creates a replication controller next to the
+	// outdated ones and moves replicas over one at a time
+	StrategyRollingUpdate = "rolling-update"
+)
+
+const (
+	// rcNameLabel ties the replication controllers of a rolling update to the
+	// name used in the manifest
+	rcNameLabel = "broadway-rc"
+	// rcHashLabel tells apart the pods of replication controllers with
+	// different pod templates
+	rcHashLabel = "broadway-rc-hash"
+)
+
+// podTemplateHash identifies a pod template the same way Kubernetes
+// deployments do
+func podTemplateHash(template *v1.PodTemplateSpec) string {
+	hasher := adler32.New()
+	hashutil.DeepHashObject(hasher, template)
+	return fmt.Sprintf("%d", hasher.Sum32())
+}
+
+func replicas(rc *v1.ReplicationController) int32 {
+	if rc.Spec.Replicas == nil {
+		return 1
+	}
+	return *rc.Spec.Replicas
+}
+
+func copyLabels(ls map[string]string) map[string]string {
+	c := map[string]string{}
+	for k, v := range ls {
+		c[k] = v
+	}
+	return c
+}
+
+// versionedRC returns a copy of o named and labelled after the hash of its
+// pod template
+func versionedRC(o *v1.ReplicationController) (*v1.ReplicationController, error) {
+	hash := podTemplateHash(o.Spec.Template)
+	c, err := api.Scheme.DeepCopy(o)
+	if err != nil {
+		return nil, err
+	}
+	rc := c.(*v1.ReplicationController)
+	rc.ObjectMeta.Name = o.ObjectMeta.Name + "-" + hash
+	rc.ObjectMeta.ResourceVersion = ""
+	rc.ObjectMeta.Labels = copyLabels(o.ObjectMeta.Labels)
+	rc.ObjectMeta.Labels[rcNameLabel] = o.ObjectMeta.Name
+	rc.Spec.Template.ObjectMeta.Labels = copyLabels(o.Spec.Template.ObjectMeta.Labels)
+	rc.Spec.Template.ObjectMeta.Labels[rcHashLabel] = hash
+	if len(rc.Spec.Selector) == 0 {
+		rc.Spec.Selector = copyLabels(o.Spec.Template.ObjectMeta.Labels)
+	} else {
+		rc.Spec.Selector = copyLabels(o.Spec.Selector)
+	}
+	rc.Spec.Selector[rcHashLabel] = hash
+	return rc, nil
+}
+
+// previousRCs finds the replication controllers a rolling update of name
+// replaces: those of earlier rolling updates and one created by the recreate
+// strategy
+func (c *Cluster) previousRCs(ns, name, except string) ([]*v1.ReplicationController, error) {
+	olds := []*v1.ReplicationController{}
+	if rc, err := c.Core.ReplicationControllers(ns).Get(name); err == nil && rc != nil && rc.ObjectMeta.Name == name {
+		olds = append(olds, rc)
+	}
+	selector := labels.SelectorFromSet(labels.Set{rcNameLabel: name})
+	list, err := c.Core.ReplicationControllers(ns).List(api.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		if list.Items[i].ObjectMeta.Name != except {
+			olds = append(olds, &list.Items[i])
+		}
+	}
+	return olds, nil
+}
+
+// adoptRC makes the selector of a replication controller created by the
+// recreate strategy specific enough not to match the pods of the new
+// controller, the same way `kubectl rolling-update` does: its template, its
+// existing pods and finally its selector get the hash label.
+func (c *Cluster) adoptRC(ns string, rc *v1.ReplicationController) (*v1.ReplicationController, error) {
+	if _, ok := rc.Spec.Selector[rcHashLabel]; ok {
+		return rc, nil
+	}
+	hash := podTemplateHash(rc.Spec.Template)
+	selector := labels.SelectorFromSet(labels.Set(rc.Spec.Selector))
+
+	rc.Spec.Template.ObjectMeta.Labels = copyLabels(rc.Spec.Template.ObjectMeta.Labels)
+	rc.Spec.Template.ObjectMeta.Labels[rcHashLabel] = hash
+	rc, err := c.Core.ReplicationControllers(ns).Update(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := c.Core.Pods(ns).List(api.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		pod.ObjectMeta.Labels = copyLabels(pod.ObjectMeta.Labels)
+		pod.ObjectMeta.Labels[rcHashLabel] = hash
+		if _, err := c.Core.Pods(ns).Update(pod); err != nil {
+			return nil, err
+		}
+	}
+
+	rc.Spec.Selector = copyLabels(rc.Spec.Selector)
+	rc.Spec.Selector[rcHashLabel] = hash
+	return c.Core.ReplicationControllers(ns).Update(rc)
+}
+
+func (c *Cluster) scaleRC(ns string, rc *v1.ReplicationController, n int32) (*v1.ReplicationController, error) {
+	rc.Spec.Replicas = &n
+	return c.Core.ReplicationControllers(ns).Update(rc)
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// rollingUpdateRC deploys o like `kubectl rolling-update`. A replication
+// controller with a hash suffix is created next to the previous ones, then
+// replicas are stepped up on the new controller and down on the old ones, one
+// ready pod at a time. If a new pod doesn't become ready the old controllers
+// are scaled back up and the new one is removed.
+func (c *Cluster) rollingUpdateRC(ns string, o *v1.ReplicationController, progress ProgressFunc) error {
+	next, err := versionedRC(o)
+	if err != nil {
+		return err
+	}
+	desired := replicas(o)
+
+	olds, err := c.previousRCs(ns, o.ObjectMeta.Name, next.ObjectMeta.Name)
+	if err != nil {
+		return err
+	}
+
+	originals := map[string]int32{}
+	for i, old := range olds {
+		if olds[i], err = c.adoptRC(ns, old); err != nil {
+			glog.Errorf("Failed to relabel %s: %s", old.ObjectMeta.Name, err)
+			return err
+		}
+		originals[old.ObjectMeta.Name] = replicas(old)
+	}
+
+	if rc, err := c.Core.ReplicationControllers(ns).Get(next.ObjectMeta.Name); err == nil && rc != nil && rc.ObjectMeta.Name == next.ObjectMeta.Name {
+		if len(olds) == 0 && replicas(rc) == desired {
+			glog.Info("Existing RC is identical, skipping deployment")
+			return nil
+		}
+		next = rc
+	} else {
+		glog.Info("Creating new replication controller: ", next.ObjectMeta.Name)
+		var zero int32
+		next.Spec.Replicas = &zero
+		if next, err = c.Core.ReplicationControllers(ns).Create(next); err != nil {
+			glog.Error("Create failed: ", err)
+			return err
+		}
+	}
+
+	for {
+		up := replicas(next) < desired
+		var old *v1.ReplicationController
+		for _, rc := range olds {
+			if replicas(rc) > 0 {
+				old = rc
+				break
+			}
+		}
+		if !up && old == nil {
+			break
+		}
+
+		if up {
+			n := replicas(next) + 1
+			report(progress, "Scaling %s up to %d", next.ObjectMeta.Name, n)
+			scaled, err := c.scaleRC(ns, next, n)
+			if err == nil {
+				next = scaled
+				err = c.waitForPodsReady(ns, next.Spec.Selector, n, progress)
+			}
+			if err != nil {
+				glog.Errorf("Rolling update of %s failed, rolling back: %s", o.ObjectMeta.Name, err)
+				c.rollbackRC(ns, next, olds, originals)
+				return err
+			}
+		}
+
+		if old != nil {
+			n := replicas(old) - 1
+			report(progress, "Scaling %s down to %d", old.ObjectMeta.Name, n)
+			scaled, err := c.scaleRC(ns, old, n)
+			if err != nil {
+				glog.Errorf("Rolling update of %s failed, rolling back: %s", o.ObjectMeta.Name, err)
+				c.rollbackRC(ns, next, olds, originals)
+				return err
+			}
+			*old = *scaled
+		}
+	}
+
+	if replicas(next) > desired {
+		if _, err := c.scaleRC(ns, next, desired); err != nil {
+			return err
+		}
+	}
+
+	for _, old := range olds {
+		glog.Info("Deleting old replication controller: ", old.ObjectMeta.Name)
+		if err := c.Core.ReplicationControllers(ns).Delete(old.ObjectMeta.Name, nil); err != nil {
+			glog.Error(err)
+		}
+	}
+	return nil
+}
+
+// rollbackRC restores the replica counts of the old replication controllers
+// and removes the new one
+func (c *Cluster) rollbackRC(ns string, next *v1.ReplicationController, olds []*v1.ReplicationController, originals map[string]int32) {
+	for _, old := range olds {
+		if _, err := c.scaleRC(ns, old, originals[old.ObjectMeta.Name]); err != nil {
+			glog.Errorf("Rollback of %s failed: %s", old.ObjectMeta.Name, err)
+		}
+	}
+	if _, err := c.scaleRC(ns, next, 0); err != nil {
+		glog.Errorf("Rollback of %s failed: %s", next.ObjectMeta.Name, err)
+	}
+	if err := c.Core.ReplicationControllers(ns).Delete(next.ObjectMeta.Name, nil); err != nil {
+		glog.Errorf("Rollback of %s failed: %s", next.ObjectMeta.Name, err)
+	}
+}
+
+// destroyRolledRCs deletes the replication controllers created by rolling
+// updates of name
+func (c *Cluster) destroyRolledRCs(ns, name string, progress ProgressFunc) error {
+	selector := labels.SelectorFromSet(labels.Set{rcNameLabel: name})
+	list, err := c.Core.ReplicationControllers(ns).List(api.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	for _, rc := range list.Items {
+		if err := ignoreNotFound(c.deleteRC(ns, rc.ObjectMeta.Name, progress)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package deployment
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/api/v1"
+	coreclient "k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3/typed/core/v1"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3/typed/core/v1/fake"
+	"k8s.io/kubernetes/pkg/client/testing/core"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// fakeCluster keeps replication controllers and runs their pods. Pods of an
+// image listed in broken never become ready.
+type fakeCluster struct {
+	rcs    map[string]*v1.ReplicationController
+	pods   []*v1.Pod
+	broken map[string]bool
+	seq    int
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{rcs: map[string]*v1.ReplicationController{}, broken: map[string]bool{}}
+}
+
+func (c *fakeCluster) sync(rc *v1.ReplicationController) {
+	selector := labels.SelectorFromSet(labels.Set(rc.Spec.Selector))
+	kept := []*v1.Pod{}
+	var running int32
+	for _, pod := range c.pods {
+		if selector.Matches(labels.Set(pod.ObjectMeta.Labels)) {
+			if running >= replicas(rc) {
+				continue
+			}
+			running++
+		}
+		kept = append(kept, pod)
+	}
+	for ; running < replicas(rc); running++ {
+		c.seq++
+		status := v1.ConditionTrue
+		if c.broken[rc.Spec.Template.Spec.Containers[0].Image] {
+			status = v1.ConditionFalse
+		}
+		kept = append(kept, &v1.Pod{
+			ObjectMeta: v1.ObjectMeta{
+				Name:   fmt.Sprintf("%s-%d", rc.ObjectMeta.Name, c.seq),
+				Labels: copyLabels(rc.Spec.Template.ObjectMeta.Labels),
+			},
+			Status: v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}}},
+		})
+	}
+	c.pods = kept
+}
+
+func (c *fakeCluster) notFound(name string) error {
+	return errors.NewNotFound(unversioned.GroupResource{Resource: "replicationcontrollers"}, name)
+}
+
+func (c *fakeCluster) client() coreclient.CoreInterface {
+	f := &core.Fake{}
+	f.AddReactor("get", "replicationcontrollers", func(a core.Action) (bool, runtime.Object, error) {
+		name := a.(core.GetAction).GetName()
+		if rc, ok := c.rcs[name]; ok {
+			return true, rc, nil
+		}
+		return true, nil, c.notFound(name)
+	})
+	f.AddReactor("list", "replicationcontrollers", func(a core.Action) (bool, runtime.Object, error) {
+		selector := a.(core.ListAction).GetListRestrictions().Labels
+		list := &v1.ReplicationControllerList{}
+		for _, rc := range c.rcs {
+			if selector.Matches(labels.Set(rc.ObjectMeta.Labels)) {
+				list.Items = append(list.Items, *rc)
+			}
+		}
+		return true, list, nil
+	})
+	save := func(a core.Action) (bool, runtime.Object, error) {
+		var rc *v1.ReplicationController
+		if create, ok := a.(core.CreateAction); ok {
+			rc = create.GetObject().(*v1.ReplicationController)
+		} else {
+			rc = a.(core.UpdateAction).GetObject().(*v1.ReplicationController)
+		}
+		c.rcs[rc.ObjectMeta.Name] = rc
+		c.sync(rc)
+		return true, rc, nil
+	}
+	f.AddReactor("create", "replicationcontrollers", save)
+	f.AddReactor("update", "replicationcontrollers", save)
+	f.AddReactor("delete", "replicationcontrollers", func(a core.Action) (bool, runtime.Object, error) {
+		name := a.(core.DeleteAction).GetName()
+		if _, ok := c.rcs[name]; !ok {
+			return true, nil, c.notFound(name)
+		}
+		delete(c.rcs, name)
+		return true, nil, nil
+	})
+	f.AddReactor("list", "pods", func(a core.Action) (bool, runtime.Object, error) {
+		selector := a.(core.ListAction).GetListRestrictions().Labels
+		list := &v1.PodList{}
+		for _, pod := range c.pods {
+			if selector.Matches(labels.Set(pod.ObjectMeta.Labels)) {
+				list.Items = append(list.Items, *pod)
+			}
+		}
+		return true, list, nil
+	})
+	f.AddReactor("update", "pods", func(a core.Action) (bool, runtime.Object, error) {
+		pod := a.(core.UpdateAction).GetObject().(*v1.Pod)
+		for i := range c.pods {
+			if c.pods[i].ObjectMeta.Name == pod.ObjectMeta.Name {
+				c.pods[i] = pod
+			}
+		}
+		return true, pod, nil
+	})
+	// Pods only change when replication controllers are saved
+	f.AddWatchReactor("*", func(a core.Action) (bool, watch.Interface, error) {
+		return true, watch.NewFake(), nil
+	})
+	return &fake.FakeCore{Fake: f}
+}
+
+// images returns the image of every pod in the cluster
+func (c *fakeCluster) images() map[string]int {
+	images := map[string]int{}
+	for _, pod := range c.pods {
+		for _, rc := range c.rcs {
+			if labels.SelectorFromSet(labels.Set(rc.Spec.Selector)).Matches(labels.Set(pod.ObjectMeta.Labels)) {
+				images[rc.Spec.Template.Spec.Containers[0].Image]++
+			}
+		}
+	}
+	return images
+}
+
+func rcWithImage(image string) *v1.ReplicationController {
+	rc := mustDeserialize(rollingrct1).(*v1.ReplicationController)
+	rc.Spec.Template.Spec.Containers[0].Image = image
+	return rc
+}
+
+func TestRollingUpdate(t *testing.T) {
+	defer func(t time.Duration) { WaitTimeout = t }(WaitTimeout)
+	WaitTimeout = 50 * time.Millisecond
+
+	cluster := newFakeCluster()
+	client := cluster.client()
+	target := &Cluster{Core: client, Namespace: "test"}
+
+	// An RC from the recreate strategy is adopted and replaced
+	recreated := rcWithImage("web:v1")
+	cluster.rcs["web"] = recreated
+	cluster.sync(recreated)
+
+	step := &ManifestStep{cluster: target, object: rcWithImage("web:v2"), strategy: StrategyRollingUpdate}
+	assert.Nil(t, step.Deploy(), "rolling update should succeed")
+	assert.Len(t, cluster.rcs, 1, "old RC should be deleted")
+	assert.Equal(t, map[string]int{"web:v2": 3}, cluster.images())
+
+	// A new version whose pods never become ready is rolled back
+	cluster.broken["web:v3"] = true
+	step = &ManifestStep{cluster: target, object: rcWithImage("web:v3"), strategy: StrategyRollingUpdate}
+	assert.NotNil(t, step.Deploy(), "rolling update should fail")
+	assert.Len(t, cluster.rcs, 1, "new RC should be deleted")
+	assert.Equal(t, map[string]int{"web:v2": 3}, cluster.images())
+
+	// Deploying the same version again does nothing
+	client.(*fake.FakeCore).Fake.ClearActions()
+	step = &ManifestStep{cluster: target, object: rcWithImage("web:v2"), strategy: StrategyRollingUpdate}
+	assert.Nil(t, step.Deploy(), "redeploy should succeed")
+	for _, a := range client.(*fake.FakeCore).Fake.Actions() {
+		assert.NotEqual(t, "update", a.GetVerb(), "identical RC should not be updated")
+	}
+
+	step = &ManifestStep{cluster: target, object: rcWithImage("web:v2"), strategy: StrategyRollingUpdate}
+	assert.Nil(t, step.Destroy(), "destroy should succeed")
+	assert.Len(t, cluster.rcs, 0, "rolled RCs should be deleted")
+}
+
+var rollingrct1 = `apiVersion: v1
+kind: ReplicationController
+metadata:
+  name: web
+spec:
+  replicas: 3
+  selector:
+    app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: web:v1
+`
@@ -6,4 +6,5 @@ import "github.com/namely/broadway/pkg/cfg"
 func Setup(cfg cfg.Type) {
 	SetupPlaybook(cfg)
 	SetupKubernetes(cfg)
+	SetupClusters(cfg)
 }
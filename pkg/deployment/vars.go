@@ -0,0 +1,192 @@
+package deployment
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/namely/broadway/pkg/secret"
+)
+
+// VarType is the kind of value a playbook var holds
+type VarType string
+
+const (
+	// VarString accepts any value
+	VarString VarType = "string"
+	// VarInt accepts integers
+	VarInt VarType = "int"
+	// VarBool accepts true and false, like strconv.ParseBool
+	VarBool VarType = "bool"
+	// VarEnum accepts the values listed by the var
+	VarEnum VarType = "enum"
+)
+
+// Var declares a variable of a playbook. In a playbook, a var is either its
+// name or an object with these fields.
+type Var struct {
+	Name        string   `yaml:"name" json:"name"`
+	Default     string   `yaml:"default" json:"default,omitempty"`
+	Required    bool     `yaml:"required" json:"required,omitempty"`
+	Type        VarType  `yaml:"type" json:"type,omitempty"`       // string when empty
+	Values      []string `yaml:"values" json:"values,omitempty"`   // the values of an enum
+	Pattern     string   `yaml:"pattern" json:"pattern,omitempty"` // a regexp matching whole values
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Secret      bool     `yaml:"secret" json:"secret,omitempty"` // stored encrypted and masked in output
+}
+
+// UnmarshalYAML reads a var from its name or from an object
+func (v *Var) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*v = Var{Name: name}
+		return nil
+	}
+	type plain Var
+	return unmarshal((*plain)(v))
+}
+
+// validate checks the declaration of a var
+func (v *Var) validate() error {
+	if v.Name == "" {
+		return fmt.Errorf("Playbook has a var without name")
+	}
+	switch v.Type {
+	case "", VarString, VarInt, VarBool:
+	case VarEnum:
+		if len(v.Values) == 0 {
+			return fmt.Errorf("Playbook var %s is an enum without values", v.Name)
+		}
+	default:
+		return fmt.Errorf("Playbook var %s has an unknown type: \"%s\"", v.Name, v.Type)
+	}
+	if _, err := v.pattern(); err != nil {
+		return fmt.Errorf("Playbook var %s has an invalid pattern: \"%s\"", v.Name, v.Pattern)
+	}
+	if v.Default != "" {
+		if msg := v.check(v.Default); msg != "" {
+			return fmt.Errorf("Playbook var %s has an invalid default: %s", v.Name, msg)
+		}
+	}
+	return nil
+}
+
+func (v *Var) pattern() (*regexp.Regexp, error) {
+	if v.Pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + v.Pattern + ")$")
+}
+
+// check returns what is wrong with a value of the var, or "" when it's valid.
+// Empty values are only checked by required.
+func (v *Var) check(value string) string {
+	if value == "" {
+		if v.Required {
+			return "is required"
+		}
+		return ""
+	}
+	switch v.Type {
+	case VarInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return "must be an int"
+		}
+	case VarBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be a bool"
+		}
+	case VarEnum:
+		found := false
+		for _, allowed := range v.Values {
+			found = found || value == allowed
+		}
+		if !found {
+			return "must be one of " + strings.Join(v.Values, ", ")
+		}
+	}
+	if re, err := v.pattern(); err == nil && re != nil && !re.MatchString(value) {
+		return "must match " + v.Pattern
+	}
+	return ""
+}
+
+// SecretVars returns the names of the secret vars of the playbook
+func (p *Playbook) SecretVars() map[string]bool {
+	secrets := map[string]bool{}
+	for _, v := range p.Vars {
+		if v.Secret {
+			secrets[v.Name] = true
+		}
+	}
+	return secrets
+}
+
+// Redacted returns a copy of the playbook with the defaults of its secret vars
+// masked
+func (p *Playbook) Redacted() *Playbook {
+	c := p.clone()
+	for n := range c.Vars {
+		if c.Vars[n].Secret && c.Vars[n].Default != "" {
+			c.Vars[n].Default = secret.Mask
+		}
+	}
+	return c
+}
+
+// Violation is a var value rejected by a playbook
+type Violation struct {
+	Var     string `json:"var"`
+	Value   string `json:"value"`
+	Message string `json:"message"`
+}
+
+// VarsError lists the var values rejected by a playbook
+type VarsError struct {
+	PlaybookID string      `json:"playbook_id"`
+	Violations []Violation `json:"violations"`
+}
+
+func (e *VarsError) Error() string {
+	messages := []string{}
+	for _, v := range e.Violations {
+		messages = append(messages, v.Var+" "+v.Message)
+	}
+	return fmt.Sprintf("Invalid vars for playbook %s: %s", e.PlaybookID, strings.Join(messages, "; "))
+}
+
+// Var returns the declaration of a var of the playbook
+func (p *Playbook) Var(name string) (*Var, bool) {
+	for n := range p.Vars {
+		if p.Vars[n].Name == name {
+			return &p.Vars[n], true
+		}
+	}
+	return nil, false
+}
+
+// ValidateVars checks the values of the vars declared by the playbook, in the
+// order they are declared. Missing vars have their default value. It returns
+// a *VarsError listing the values the playbook rejects, with the values of
+// secret vars masked.
+func (p *Playbook) ValidateVars(vars map[string]string) error {
+	e := &VarsError{PlaybookID: p.ID}
+	for n := range p.Vars {
+		v := &p.Vars[n]
+		value, ok := vars[v.Name]
+		if !ok {
+			value = v.Default
+		}
+		if msg := v.check(value); msg != "" {
+			if v.Secret && value != "" {
+				value = secret.Mask
+			}
+			e.Violations = append(e.Violations, Violation{Var: v.Name, Value: value, Message: msg})
+		}
+	}
+	if len(e.Violations) > 0 {
+		return e
+	}
+	return nil
+}
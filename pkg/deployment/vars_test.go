@@ -0,0 +1,92 @@
+package deployment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVars(t *testing.T) {
+	p, err := ParsePlaybook([]byte(`---
+id: web
+name: Web
+vars:
+  - version
+  - name: replicas
+    type: int
+    default: "1"
+    required: true
+  - name: tier
+    type: enum
+    values: [small, large]
+    description: The size of the instance
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, []Var{
+		{Name: "version"},
+		{Name: "replicas", Type: VarInt, Default: "1", Required: true},
+		{Name: "tier", Type: VarEnum, Values: []string{"small", "large"}, Description: "The size of the instance"},
+	}, p.Vars)
+}
+
+func TestValidateVarDeclarations(t *testing.T) {
+	cases := []struct {
+		Scenario string
+		Vars     []Var
+		Expected string
+	}{
+		{"unknown type", []Var{{Name: "a", Type: "float"}}, `Playbook var a has an unknown type: "float"`},
+		{"enum without values", []Var{{Name: "a", Type: VarEnum}}, "Playbook var a is an enum without values"},
+		{"bad pattern", []Var{{Name: "a", Pattern: "[a-"}}, `Playbook var a has an invalid pattern: "[a-"`},
+		{"bad default", []Var{{Name: "a", Type: VarInt, Default: "one"}}, "Playbook var a has an invalid default: must be an int"},
+		{"no name", []Var{{Type: VarInt}}, "Playbook has a var without name"},
+		{"duplicate", []Var{{Name: "a"}, {Name: "a"}}, "Playbook declares the var a twice"},
+	}
+	for _, c := range cases {
+		p := &Playbook{ID: "web", Name: "Web", Manifests: []string{"hello"}, Vars: c.Vars}
+		err := p.Validate()
+		if assert.NotNil(t, err, c.Scenario) {
+			assert.Equal(t, c.Expected, err.Error(), c.Scenario)
+		}
+	}
+}
+
+func TestValidateVars(t *testing.T) {
+	p := &Playbook{ID: "web", Vars: []Var{
+		{Name: "version", Required: true},
+		{Name: "replicas", Type: VarInt, Default: "1"},
+		{Name: "debug", Type: VarBool},
+		{Name: "tier", Type: VarEnum, Values: []string{"small", "large"}},
+		{Name: "branch", Pattern: "[a-z][a-z0-9-]*"},
+	}}
+	cases := []struct {
+		Scenario string
+		Vars     map[string]string
+		Expected []Violation
+	}{
+		{"valid", map[string]string{"version": "v1", "replicas": "3", "debug": "true", "tier": "large", "branch": "feature-1"}, nil},
+		{"defaults", map[string]string{"version": "v1"}, nil},
+		{"empty optional values", map[string]string{"version": "v1", "replicas": "", "tier": ""}, nil},
+		{"missing required", map[string]string{}, []Violation{{Var: "version", Message: "is required"}}},
+		{"empty required", map[string]string{"version": ""}, []Violation{{Var: "version", Message: "is required"}}},
+		{
+			"bad values",
+			map[string]string{"version": "v1", "replicas": "many", "debug": "maybe", "tier": "medium", "branch": "Feature"},
+			[]Violation{
+				{Var: "replicas", Value: "many", Message: "must be an int"},
+				{Var: "debug", Value: "maybe", Message: "must be a bool"},
+				{Var: "tier", Value: "medium", Message: "must be one of small, large"},
+				{Var: "branch", Value: "Feature", Message: "must match [a-z][a-z0-9-]*"},
+			},
+		},
+	}
+	for _, c := range cases {
+		err := p.ValidateVars(c.Vars)
+		if c.Expected == nil {
+			assert.Nil(t, err, c.Scenario)
+			continue
+		}
+		assert.Equal(t, &VarsError{PlaybookID: "web", Violations: c.Expected}, err, c.Scenario)
+	}
+	assert.Equal(t, "Invalid vars for playbook web: version is required", p.ValidateVars(nil).Error())
+}
@@ -0,0 +1,281 @@
+package deployment
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// WaitTimeout bounds how long a step waits for Kubernetes to scale, start or
+// remove its objects
+var WaitTimeout = 5 * time.Minute
+
+// ProgressFunc receives messages about what a deployment is waiting for
+type ProgressFunc func(message string)
+
+func logProgress(message string) {
+	glog.Info(message)
+}
+
+// report sends a message to progress, or logs it if progress is nil
+func report(progress ProgressFunc, format string, args ...interface{}) {
+	if progress == nil {
+		progress = logProgress
+	}
+	progress(fmt.Sprintf(format, args...))
+}
+
+// timeoutError turns the error of an expired wait into a readable one
+func timeoutError(err error, what string) error {
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("deployment: timed out after %s waiting for %s", WaitTimeout, what)
+	}
+	return err
+}
+
+func nameSelector(name string) fields.Selector {
+	return fields.OneTermEqualSelector("metadata.name", name)
+}
+
+// waitForRCReplicas waits until the replication controller name observed its
+// latest spec and runs n replicas
+func (c *Cluster) waitForRCReplicas(ns, name string, n int32, progress ProgressFunc) error {
+	done := func(rc *v1.ReplicationController) bool {
+		return rc.Status.ObservedGeneration >= rc.ObjectMeta.Generation && rc.Status.Replicas == n
+	}
+	rc, err := c.Core.ReplicationControllers(ns).Get(name)
+	if err != nil {
+		return err
+	}
+	if done(rc) {
+		return nil
+	}
+
+	report(progress, "Waiting for replication controller %s to have %d replicas", name, n)
+	w, err := c.Core.ReplicationControllers(ns).Watch(api.ListOptions{
+		FieldSelector:   nameSelector(name),
+		ResourceVersion: rc.ObjectMeta.ResourceVersion,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = watch.Until(WaitTimeout, w, func(event watch.Event) (bool, error) {
+		switch event.Type {
+		case watch.Deleted:
+			return false, fmt.Errorf("deployment: replication controller %s was deleted", name)
+		case watch.Error:
+			return false, errors.FromObject(event.Object)
+		}
+		rc, ok := event.Object.(*v1.ReplicationController)
+		return ok && done(rc), nil
+	})
+	return timeoutError(err, "replication controller "+name)
+}
+
+// isPodDone tells whether a pod is ready, or has run to completion
+func isPodDone(pod *v1.Pod) bool {
+	return isPodReady(pod) || pod.Status.Phase == v1.PodSucceeded
+}
+
+// waitForPods waits until n of the pods listed with opts are ready
+func (c *Cluster) waitForPods(ns string, opts api.ListOptions, n int32, what string, progress ProgressFunc) error {
+	pods, err := c.Core.Pods(ns).List(opts)
+	if err != nil {
+		return err
+	}
+	ready := map[string]bool{}
+	for i := range pods.Items {
+		ready[pods.Items[i].ObjectMeta.Name] = isPodDone(&pods.Items[i])
+	}
+	count := func() int32 {
+		var c int32
+		for _, r := range ready {
+			if r {
+				c++
+			}
+		}
+		return c
+	}
+	if count() >= n {
+		return nil
+	}
+
+	report(progress, "Waiting for %s: %d of %d pods ready", what, count(), n)
+	opts.ResourceVersion = pods.ListMeta.ResourceVersion
+	w, err := c.Core.Pods(ns).Watch(opts)
+	if err != nil {
+		return err
+	}
+	_, err = watch.Until(WaitTimeout, w, func(event watch.Event) (bool, error) {
+		if event.Type == watch.Error {
+			return false, errors.FromObject(event.Object)
+		}
+		pod, ok := event.Object.(*v1.Pod)
+		if !ok {
+			return false, nil
+		}
+		before := count()
+		if event.Type == watch.Deleted {
+			delete(ready, pod.ObjectMeta.Name)
+		} else {
+			ready[pod.ObjectMeta.Name] = isPodDone(pod)
+		}
+		if r := count(); r != before && r < n {
+			report(progress, "Waiting for %s: %d of %d pods ready", what, r, n)
+		}
+		return count() >= n, nil
+	})
+	return timeoutError(err, what)
+}
+
+// waitForPodsReady waits until n pods matching selector are ready
+func (c *Cluster) waitForPodsReady(ns string, selector map[string]string, n int32, progress ProgressFunc) error {
+	opts := api.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set(selector))}
+	return c.waitForPods(ns, opts, n, fmt.Sprintf("pods of %s", labels.Set(selector)), progress)
+}
+
+// waitForPodReady waits until the pod name is ready or has completed
+func (c *Cluster) waitForPodReady(ns, name string, progress ProgressFunc) error {
+	return c.waitForPods(ns, api.ListOptions{FieldSelector: nameSelector(name)}, 1, "pod "+name, progress)
+}
+
+// waitForPodDeleted waits until the pod name is gone
+func (c *Cluster) waitForPodDeleted(ns, name string, progress ProgressFunc) error {
+	pod, err := c.Core.Pods(ns).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	report(progress, "Waiting for pod %s to be deleted", name)
+	w, err := c.Core.Pods(ns).Watch(api.ListOptions{
+		FieldSelector:   nameSelector(name),
+		ResourceVersion: pod.ObjectMeta.ResourceVersion,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = watch.Until(WaitTimeout, w, func(event watch.Event) (bool, error) {
+		if event.Type == watch.Error {
+			return false, errors.FromObject(event.Object)
+		}
+		return event.Type == watch.Deleted, nil
+	})
+	return timeoutError(err, "deletion of pod "+name)
+}
+
+// waitForUnstructured waits until done holds for the object name of the
+// resource client. what describes the wait in messages and errors.
+func (c *Cluster) waitForUnstructured(gv unversioned.GroupVersion, resource, ns, name, what string, done func(o *runtime.Unstructured) (bool, error), progress ProgressFunc) error {
+	o, err := c.Resources.Get(gv, resource, ns, name)
+	if err != nil {
+		return err
+	}
+	if ok, err := done(o); ok || err != nil {
+		return err
+	}
+
+	report(progress, "Waiting for %s", what)
+	w, err := c.Resources.Watch(gv, resource, ns, name, o.GetResourceVersion())
+	if err != nil {
+		return err
+	}
+	_, err = watch.Until(WaitTimeout, w, func(event watch.Event) (bool, error) {
+		switch event.Type {
+		case watch.Deleted:
+			return false, fmt.Errorf("deployment: %s %s was deleted", strings.ToLower(o.GetKind()), name)
+		case watch.Error:
+			return false, errors.FromObject(event.Object)
+		}
+		o, ok := event.Object.(*runtime.Unstructured)
+		if !ok {
+			return false, nil
+		}
+		return done(o)
+	})
+	return timeoutError(err, what)
+}
+
+// nestedInt returns the number at the path of fields in an unstructured
+// object, or def if it isn't set
+func nestedInt(o map[string]interface{}, def int64, fields ...string) int64 {
+	var v interface{} = o
+	for _, field := range fields {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return def
+		}
+		if v, ok = m[field]; !ok {
+			return def
+		}
+	}
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+	return def
+}
+
+// isDeploymentRolledOut tells whether a deployment observed its latest spec
+// and all its replicas are updated and available
+func isDeploymentRolledOut(d *runtime.Unstructured) bool {
+	replicas := nestedInt(d.Object, 1, "spec", "replicas")
+	return nestedInt(d.Object, 0, "status", "observedGeneration") >= nestedInt(d.Object, 0, "metadata", "generation") &&
+		nestedInt(d.Object, 0, "status", "updatedReplicas") >= replicas &&
+		nestedInt(d.Object, 0, "status", "availableReplicas") >= replicas
+}
+
+// waitForDeployment waits until the deployment name is rolled out
+func (c *Cluster) waitForDeployment(gv unversioned.GroupVersion, resource, ns, name string, progress ProgressFunc) error {
+	done := func(d *runtime.Unstructured) (bool, error) {
+		return isDeploymentRolledOut(d), nil
+	}
+	return c.waitForUnstructured(gv, resource, ns, name, "rollout of deployment "+name, done, progress)
+}
+
+// jobCondition returns the Complete or Failed condition of a job, and the
+// message of a failure
+func jobCondition(j *runtime.Unstructured) (string, string) {
+	status, _ := j.Object["status"].(map[string]interface{})
+	conditions, _ := status["conditions"].([]interface{})
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		kind, _ := condition["type"].(string)
+		if (kind == "Complete" || kind == "Failed") && condition["status"] == "True" {
+			message, _ := condition["message"].(string)
+			return kind, message
+		}
+	}
+	return "", ""
+}
+
+// waitForJob waits until the job name completes, and fails if the job does
+func (c *Cluster) waitForJob(gv unversioned.GroupVersion, resource, ns, name string, progress ProgressFunc) error {
+	done := func(j *runtime.Unstructured) (bool, error) {
+		switch condition, message := jobCondition(j); condition {
+		case "Complete":
+			return true, nil
+		case "Failed":
+			return false, fmt.Errorf("deployment: job %s failed: %s", name, message)
+		}
+		return false, nil
+	}
+	return c.waitForUnstructured(gv, resource, ns, name, "completion of job "+name, done, progress)
+}
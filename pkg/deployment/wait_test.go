@@ -0,0 +1,208 @@
+package deployment
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/client/testing/core"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+var webLabels = map[string]string{"app": "web"}
+
+func testPod(name string, ls map[string]string, ready bool) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Labels: ls},
+		Status:     v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}}},
+	}
+}
+
+// readyPodsReaction lists n ready pods with the labels ls
+func readyPodsReaction(ls map[string]string, n int) core.ReactionFunc {
+	return func(a core.Action) (bool, runtime.Object, error) {
+		list := &v1.PodList{}
+		for i := 0; i < n; i++ {
+			list.Items = append(list.Items, *testPod(fmt.Sprintf("pod-%d", i), ls, true))
+		}
+		return true, list, nil
+	}
+}
+
+// watchingClient returns a client whose watches receive the events sent
+// through the returned watcher
+func watchingClient() (*core.Fake, *watch.FakeWatcher) {
+	f := &core.Fake{}
+	w := watch.NewFake()
+	f.AddWatchReactor("*", core.DefaultWatchReactor(w, nil))
+	return f, w
+}
+
+func TestWaitForPodsReady(t *testing.T) {
+	defer func(t time.Duration) { WaitTimeout = t }(WaitTimeout)
+	WaitTimeout = time.Second
+
+	f, w := watchingClient()
+	f.AddReactor("list", "pods", func(a core.Action) (bool, runtime.Object, error) {
+		return true, &v1.PodList{Items: []v1.Pod{*testPod("web-1", webLabels, true), *testPod("web-2", webLabels, false)}}, nil
+	})
+	c := testCluster(f, nil)
+
+	messages := []string{}
+	progress := func(message string) { messages = append(messages, message) }
+	go func() {
+		w.Modify(testPod("web-2", webLabels, false))
+		w.Add(testPod("web-3", webLabels, true))
+	}()
+	err := c.waitForPodsReady(c.Namespace, webLabels, 2, progress)
+	assert.Nil(t, err, "the second pod should become ready")
+	assert.Equal(t, []string{"Waiting for pods of app=web: 1 of 2 pods ready"}, messages)
+
+	f, w = watchingClient()
+	f.AddReactor("list", "pods", readyPodsReaction(webLabels, 0))
+	c = testCluster(f, nil)
+	WaitTimeout = 10 * time.Millisecond
+	err = c.waitForPodReady(c.Namespace, "web-1", progress)
+	assert.EqualError(t, err, "deployment: timed out after 10ms waiting for pod web-1")
+}
+
+func TestWaitForRCReplicas(t *testing.T) {
+	defer func(t time.Duration) { WaitTimeout = t }(WaitTimeout)
+	WaitTimeout = time.Second
+
+	rc := func(generation, observed int64, n int32) *v1.ReplicationController {
+		return &v1.ReplicationController{
+			ObjectMeta: v1.ObjectMeta{Name: "web", Generation: generation},
+			Status:     v1.ReplicationControllerStatus{ObservedGeneration: observed, Replicas: n},
+		}
+	}
+
+	f, w := watchingClient()
+	f.AddReactor("get", "replicationcontrollers", func(a core.Action) (bool, runtime.Object, error) {
+		return true, rc(2, 1, 3), nil
+	})
+	c := testCluster(f, nil)
+	go func() {
+		w.Modify(rc(2, 2, 3))
+		w.Modify(rc(2, 2, 0))
+	}()
+	assert.Nil(t, c.waitForRCReplicas(c.Namespace, "web", 0, nil), "the RC should scale down")
+
+	f, w = watchingClient()
+	f.AddReactor("get", "replicationcontrollers", func(a core.Action) (bool, runtime.Object, error) {
+		return true, rc(2, 1, 3), nil
+	})
+	c = testCluster(f, nil)
+	go w.Delete(rc(2, 2, 3))
+	assert.EqualError(t, c.waitForRCReplicas(c.Namespace, "web", 0, nil), "deployment: replication controller web was deleted")
+}
+
+func TestWaitForPodDeleted(t *testing.T) {
+	defer func(t time.Duration) { WaitTimeout = t }(WaitTimeout)
+	WaitTimeout = time.Second
+
+	f, w := watchingClient()
+	f.AddReactor("get", "pods", func(a core.Action) (bool, runtime.Object, error) {
+		return true, testPod("web", webLabels, true), nil
+	})
+	c := testCluster(f, nil)
+	go func() {
+		w.Modify(testPod("web", webLabels, false))
+		w.Delete(testPod("web", webLabels, false))
+	}()
+	assert.Nil(t, c.waitForPodDeleted(c.Namespace, "web", nil), "the pod should be deleted")
+
+	f, _ = watchingClient()
+	f.AddReactor("get", "pods", func(a core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewNotFound(unversioned.GroupResource{Resource: "pods"}, "web")
+	})
+	c = testCluster(f, nil)
+	assert.Nil(t, c.waitForPodDeleted(c.Namespace, "web", nil), "a missing pod is deleted already")
+	assert.Len(t, f.Actions(), 1, "a missing pod should not be watched")
+}
+
+func TestWaitForDeployment(t *testing.T) {
+	defer func(t time.Duration) { WaitTimeout = t }(WaitTimeout)
+	WaitTimeout = time.Second
+
+	deployment := func(generation, observed, updated, available int64) *runtime.Unstructured {
+		d := mustDeserialize(deploymentt1).(*runtime.Unstructured)
+		d.Object["metadata"].(map[string]interface{})["generation"] = generation
+		d.Object["status"] = map[string]interface{}{
+			"observedGeneration": observed,
+			"updatedReplicas":    updated,
+			"availableReplicas":  available,
+		}
+		return d
+	}
+	gv := unversioned.GroupVersion{Group: "extensions", Version: "v1beta1"}
+
+	f := newFakeResourceClient()
+	f.objects[f.key(gv, "deployments", "test", "web")] = deployment(2, 1, 2, 2)
+	c := testCluster(nil, f)
+	messages := []string{}
+	progress := func(message string) { messages = append(messages, message) }
+	go func() {
+		f.watcher.Modify(deployment(2, 2, 1, 2))
+		f.watcher.Modify(deployment(2, 2, 2, 1))
+		f.watcher.Modify(deployment(2, 2, 2, 2))
+	}()
+	step := &ManifestStep{cluster: c, object: mustDeserialize(deploymentt1), namespace: "test", progress: progress}
+	assert.Nil(t, step.Wait(), "the deployment should roll out")
+	assert.Equal(t, []string{"Waiting for rollout of deployment web"}, messages)
+
+	f = newFakeResourceClient()
+	f.objects[f.key(gv, "deployments", "test", "web")] = deployment(1, 1, 2, 2)
+	step = &ManifestStep{cluster: testCluster(nil, f), object: mustDeserialize(deploymentt1), namespace: "test"}
+	assert.Nil(t, step.Wait())
+	assert.Equal(t, []string{"get"}, f.verbs, "a rolled out deployment should not be watched")
+
+	f = newFakeResourceClient()
+	f.objects[f.key(gv, "deployments", "test", "web")] = deployment(1, 1, 0, 0)
+	WaitTimeout = 10 * time.Millisecond
+	step = &ManifestStep{cluster: testCluster(nil, f), object: mustDeserialize(deploymentt1), namespace: "test"}
+	assert.EqualError(t, step.Wait(), "deployment: timed out after 10ms waiting for rollout of deployment web")
+}
+
+func TestWaitForJob(t *testing.T) {
+	defer func(t time.Duration) { WaitTimeout = t }(WaitTimeout)
+	WaitTimeout = time.Second
+
+	job := func(conditions ...interface{}) *runtime.Unstructured {
+		j := mustDeserialize(jobt1).(*runtime.Unstructured)
+		j.Object["status"] = map[string]interface{}{"conditions": conditions}
+		return j
+	}
+	condition := func(kind, message string) map[string]interface{} {
+		return map[string]interface{}{"type": kind, "status": "True", "message": message}
+	}
+	gv := unversioned.GroupVersion{Group: "batch", Version: "v1"}
+
+	f := newFakeResourceClient()
+	f.objects[f.key(gv, "jobs", "test", "migrate")] = job()
+	go f.watcher.Modify(job(condition("Complete", "")))
+	step := &ManifestStep{cluster: testCluster(nil, f), object: mustDeserialize(jobt1), namespace: "test"}
+	assert.Nil(t, step.Wait(), "the job should complete")
+
+	f = newFakeResourceClient()
+	f.objects[f.key(gv, "jobs", "test", "migrate")] = job()
+	go f.watcher.Modify(job(condition("Failed", "Job has reached the specified backoff limit")))
+	step = &ManifestStep{cluster: testCluster(nil, f), object: mustDeserialize(jobt1), namespace: "test"}
+	assert.EqualError(t, step.Wait(), "deployment: job migrate failed: Job has reached the specified backoff limit")
+
+	f = newFakeResourceClient()
+	f.objects[f.key(gv, "jobs", "test", "migrate")] = job()
+	go f.watcher.Delete(job())
+	step = &ManifestStep{cluster: testCluster(nil, f), object: mustDeserialize(jobt1), namespace: "test"}
+	assert.EqualError(t, step.Wait(), "deployment: job migrate was deleted")
+}
@@ -0,0 +1,202 @@
+// Package gitrepo checks out the git repository Broadway loads its playbooks
+// and manifests from
+package gitrepo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/namely/broadway/pkg/cfg"
+)
+
+// Repo is a checkout of a branch or tag of a git repository, holding
+// playbooks in playbooks/ and manifests in manifests/. The repository is
+// cloned into repo/ under Dir, and each commit is checked out into a folder of
+// its own under checkouts/. The folder in use is linked from current/, so that
+// a commit is only used once it was checked out completely.
+type Repo struct {
+	URL string // a URL or a local path git can clone
+	Ref string // the branch or tag checked out
+	Dir string // where the repository is checked out
+
+	mu sync.Mutex // serializes the git commands and the changes to Dir
+}
+
+// Checkout is a commit of the repository checked out into a folder
+type Checkout struct {
+	Commit string // the SHA of the commit
+	Dir    string // the folder holding the files of the commit
+}
+
+// PlaybooksPath is the folder of the playbooks in the checkout
+func (c *Checkout) PlaybooksPath() string {
+	return filepath.Join(c.Dir, "playbooks")
+}
+
+// ManifestsPath is the folder of the manifests in the checkout
+func (c *Checkout) ManifestsPath() string {
+	return filepath.Join(c.Dir, "manifests")
+}
+
+// New returns the repository configured by the git flags
+func New(c cfg.Type) *Repo {
+	r := &Repo{URL: c.GitRepo, Ref: c.GitRef, Dir: c.GitDir}
+	if _, err := os.Stat(r.URL); err == nil {
+		// git runs in the clone, so local paths must be absolute
+		if abs, err := filepath.Abs(r.URL); err == nil {
+			r.URL = abs
+		}
+	}
+	if r.Ref == "" {
+		r.Ref = "master"
+	}
+	if r.Dir == "" {
+		r.Dir = filepath.Join(os.TempDir(), "broadway-playbooks")
+	}
+	return r
+}
+
+// PlaybooksPath is the folder of the playbooks of the checkout in use
+func (r *Repo) PlaybooksPath() string {
+	return filepath.Join(r.Dir, "current", "playbooks")
+}
+
+// ManifestsPath is the folder of the manifests of the checkout in use
+func (r *Repo) ManifestsPath() string {
+	return filepath.Join(r.Dir, "current", "manifests")
+}
+
+// Sync checks out the head of the ref and uses it, and returns the SHA of its
+// commit
+func (r *Repo) Sync(ctx context.Context) (string, error) {
+	c, err := r.Fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := r.Use(c); err != nil {
+		return "", err
+	}
+	return c.Commit, nil
+}
+
+// Fetch checks out the head of the ref into a folder of its own, cloning the
+// repository the first time. The checkout in use is left as it is until the
+// new one is passed to Use.
+func (r *Repo) Fetch(ctx context.Context) (*Checkout, error) {
+	if r.URL == "" {
+		return nil, fmt.Errorf("broadway/gitrepo: no repository is configured")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(r.clone(), ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(r.clone(), 0755); err != nil {
+			return nil, err
+		}
+		if _, err := r.git(ctx, "init", "--quiet"); err != nil {
+			return nil, err
+		}
+		if _, err := r.git(ctx, "remote", "add", "origin", r.URL); err != nil {
+			return nil, err
+		}
+	}
+	// The URL may have changed since the repository was cloned
+	if _, err := r.git(ctx, "remote", "set-url", "origin", r.URL); err != nil {
+		return nil, err
+	}
+	if _, err := r.git(ctx, "fetch", "--quiet", "--force", "--depth=1", "origin", r.Ref); err != nil {
+		return nil, err
+	}
+	commit, err := r.git(ctx, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Checkout{Commit: commit, Dir: filepath.Join(r.Dir, "checkouts", commit)}
+	if _, err := os.Stat(c.Dir); err == nil {
+		return c, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Dir), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(c.Dir), ".checkout-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if _, err := r.git(ctx, "read-tree", "FETCH_HEAD"); err != nil {
+		return nil, err
+	}
+	if _, err := r.git(ctx, "checkout-index", "--all", "--force", "--prefix="+tmp+"/"); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, c.Dir); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Use links the playbook and manifest folders to a checkout made by Fetch,
+// and deletes the other checkouts
+func (r *Repo) Use(c *Checkout) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	target, err := filepath.Rel(r.Dir, c.Dir)
+	if err != nil {
+		return err
+	}
+	// Renaming a new link over current/ switches to the checkout at once
+	link := filepath.Join(r.Dir, ".current")
+	os.Remove(link)
+	if err := os.Symlink(target, link); err != nil {
+		return err
+	}
+	if err := os.Rename(link, filepath.Join(r.Dir, "current")); err != nil {
+		return err
+	}
+
+	others, err := filepath.Glob(filepath.Join(r.Dir, "checkouts", "*"))
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other != c.Dir {
+			os.RemoveAll(other)
+		}
+	}
+	return nil
+}
+
+// Head returns the SHA of the commit of the checkout in use
+func (r *Repo) Head(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	target, err := os.Readlink(filepath.Join(r.Dir, "current"))
+	if err != nil {
+		return "", fmt.Errorf("broadway/gitrepo: nothing is checked out: %s", err)
+	}
+	return filepath.Base(target), nil
+}
+
+// clone is where the repository is cloned
+func (r *Repo) clone() string {
+	return filepath.Join(r.Dir, "repo")
+}
+
+// git runs a git command in the clone and returns its output
+func (r *Repo) git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.clone()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("broadway/gitrepo: git %s failed: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
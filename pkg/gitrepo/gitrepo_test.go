@@ -0,0 +1,194 @@
+package gitrepo
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/namely/broadway/pkg/cfg"
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+// origin is a git repository the tests check out
+type origin struct {
+	t   *testing.T
+	dir string
+}
+
+func newOrigin(t *testing.T) *origin {
+	dir, err := ioutil.TempDir("", "broadway-origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &origin{t: t, dir: dir}
+	o.git("init", "--quiet")
+	o.git("config", "user.email", "broadway@example.com")
+	o.git("config", "user.name", "Broadway")
+	o.git("checkout", "--quiet", "-b", "master")
+	return o
+}
+
+func (o *origin) git(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = o.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		o.t.Fatalf("git %v: %s: %s", args, err, out)
+	}
+	return string(out)
+}
+
+// commit writes files and commits them, returning the SHA of the commit
+func (o *origin) commit(files map[string]string) string {
+	for name, contents := range files {
+		path := filepath.Join(o.dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			o.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			o.t.Fatal(err)
+		}
+	}
+	o.git("add", "-A")
+	o.git("commit", "--quiet", "-m", "update")
+	return o.git("rev-parse", "HEAD")[:40]
+}
+
+func TestSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	o := newOrigin(t)
+	defer os.RemoveAll(o.dir)
+	first := o.commit(map[string]string{
+		"playbooks/web.yml": "{id: web, name: Web, manifests: [web]}",
+		"manifests/web.yml": "kind: Pod",
+	})
+	o.git("tag", "v1")
+
+	testcases := []struct {
+		scenario string
+		url      string
+	}{
+		{"a local path", o.dir},
+		{"a file URL", "file://" + o.dir},
+	}
+	for _, testcase := range testcases {
+		dir, err := ioutil.TempDir("", "broadway-playbooks")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+		r := New(cfg.Type{GitRepo: testcase.url, GitDir: filepath.Join(dir, "checkout")})
+		assert.Equal(t, "master", r.Ref, testcase.scenario)
+
+		commit, err := r.Sync(ctx)
+		assert.Nil(t, err, testcase.scenario)
+		assert.Equal(t, first, commit, testcase.scenario)
+		b, err := ioutil.ReadFile(filepath.Join(r.PlaybooksPath(), "web.yml"))
+		assert.Nil(t, err, testcase.scenario)
+		assert.Contains(t, string(b), "id: web", testcase.scenario)
+		_, err = os.Stat(filepath.Join(r.ManifestsPath(), "web.yml"))
+		assert.Nil(t, err, testcase.scenario)
+	}
+
+	dir, err := ioutil.TempDir("", "broadway-playbooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	master := New(cfg.Type{GitRepo: o.dir, GitRef: "master", GitDir: filepath.Join(dir, "master")})
+	tag := New(cfg.Type{GitRepo: o.dir, GitRef: "v1", GitDir: filepath.Join(dir, "tag")})
+	_, err = master.Sync(ctx)
+	assert.Nil(t, err)
+
+	second := o.commit(map[string]string{"playbooks/api.yml": "{id: api, name: API, manifests: [web]}"})
+	assert.Nil(t, os.Remove(filepath.Join(o.dir, "manifests", "web.yml")))
+	third := o.commit(nil)
+	assert.NotEqual(t, second, third)
+
+	commit, err := master.Sync(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, third, commit, "a sync should pull the head of the branch")
+	head, err := master.Head(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, third, head)
+	_, err = os.Stat(filepath.Join(master.PlaybooksPath(), "api.yml"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(master.ManifestsPath(), "web.yml"))
+	assert.True(t, os.IsNotExist(err), "removed files should be removed from the checkout")
+
+	commit, err = tag.Sync(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, first, commit, "a sync should check out the tag")
+	_, err = os.Stat(filepath.Join(tag.PlaybooksPath(), "api.yml"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	o := newOrigin(t)
+	defer os.RemoveAll(o.dir)
+	first := o.commit(map[string]string{"playbooks/web.yml": "{id: web}"})
+	dir, err := ioutil.TempDir("", "broadway-playbooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	r := New(cfg.Type{GitRepo: o.dir, GitDir: dir})
+	_, err = r.Sync(ctx)
+	assert.Nil(t, err)
+
+	second := o.commit(map[string]string{"playbooks/web.yml": "{id: web, name: Web}"})
+	c, err := r.Fetch(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, second, c.Commit)
+	b, err := ioutil.ReadFile(filepath.Join(c.PlaybooksPath(), "web.yml"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "name: Web")
+	b, err = ioutil.ReadFile(filepath.Join(r.PlaybooksPath(), "web.yml"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), "name: Web", "a fetched commit shouldn't be used before Use")
+	head, err := r.Head(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, first, head)
+
+	assert.Nil(t, r.Use(c))
+	b, err = ioutil.ReadFile(filepath.Join(r.PlaybooksPath(), "web.yml"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "name: Web")
+	head, err = r.Head(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, second, head)
+	checkouts, err := filepath.Glob(filepath.Join(dir, "checkouts", "*"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{c.Dir}, checkouts, "the unused checkouts should be deleted")
+
+	moved := newOrigin(t)
+	defer os.RemoveAll(moved.dir)
+	third := moved.commit(map[string]string{"playbooks/api.yml": "{id: api}"})
+	r.URL = moved.dir
+	commit, err := r.Sync(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, third, commit, "a sync should follow the URL of the repository")
+}
+
+func TestSyncFailures(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	_, err := New(cfg.Type{}).Sync(ctx)
+	assert.EqualError(t, err, "broadway/gitrepo: no repository is configured")
+
+	o := newOrigin(t)
+	defer os.RemoveAll(o.dir)
+	o.commit(map[string]string{"playbooks/web.yml": "{id: web}"})
+	dir, err := ioutil.TempDir("", "broadway-playbooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, err = New(cfg.Type{GitRepo: o.dir, GitRef: "missing", GitDir: dir}).Sync(ctx)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "broadway/gitrepo: git fetch failed")
+	}
+}
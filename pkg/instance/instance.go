@@ -1,6 +1,7 @@
 package instance
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -78,11 +79,14 @@ const (
 )
 
 // FindByPath find an instance based on it's path
-func FindByPath(store store.Store, path Path) (*Instance, error) {
-	i := store.Value(path.String())
-	if i == "" {
+func FindByPath(ctx context.Context, s store.Store, path Path) (*Instance, error) {
+	i, err := s.Value(ctx, path.String())
+	if err == store.ErrNotFound {
 		return nil, NotFoundError(path.String())
 	}
+	if err != nil {
+		return nil, err
+	}
 	instance, err := fromJSON(i)
 	if err != nil {
 		return nil, err
@@ -91,39 +95,127 @@ func FindByPath(store store.Store, path Path) (*Instance, error) {
 }
 
 // FindByPlaybookPath find all the instances for an specified playbook path
-func FindByPlaybookPath(store store.Store, playbookPath PlaybookPath) ([]*Instance, error) {
-	return retrieveInstancesByKey(store, playbookPath.String())
+func FindByPlaybookPath(ctx context.Context, store store.Store, playbookPath PlaybookPath) ([]*Instance, error) {
+	return Find(ctx, store, Query{Path: playbookPath.String()})
 }
 
 // AllDeployedAndExpired find all instances from in the store
-func AllDeployedAndExpired(store store.Store, path string, expirationDate time.Time) ([]*Instance, error) {
-	var expiredInstances []*Instance
-	instances, err := retrieveInstancesByKey(store, path)
+func AllDeployedAndExpired(ctx context.Context, store store.Store, path string, expirationDate time.Time) ([]*Instance, error) {
+	return Find(ctx, store, Query{
+		Path:          path,
+		Statuses:      []Status{StatusDeployed},
+		ExpiredBefore: expirationDate.Unix(),
+	})
+}
+
+// Query selects instances under a path. The zero value of a field matches any
+// instance.
+type Query struct {
+	Path          string            // the key holding the instances, like a PlaybookPath
+	Statuses      []Status          // the statuses the instances may have
+	ExpiredBefore int64             // instances expiring at or before this unix time
+	CreatedAfter  int64             // instances created at or after this unix time
+	CreatedBefore int64             // instances created at or before this unix time
+	Vars          map[string]string // var values the instances must have
+}
+
+// Match returns whether an instance is selected by the query
+func (q Query) Match(i *Instance) bool {
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, s := range q.Statuses {
+			found = found || i.Status == s
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.ExpiredBefore != 0 && (i.ExpiredAt == 0 || i.ExpiredAt > q.ExpiredBefore) {
+		return false
+	}
+	if q.CreatedAfter != 0 && i.Created < q.CreatedAfter {
+		return false
+	}
+	if q.CreatedBefore != 0 && i.Created > q.CreatedBefore {
+		return false
+	}
+	for name, value := range q.Vars {
+		if v, ok := i.Vars[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Finder is implemented by stores selecting instances themselves, instead of
+// Find decoding every instance under the query's path
+type Finder interface {
+	FindInstances(ctx context.Context, q Query) ([]*Instance, error)
+}
+
+// Find returns the instances selected by a query
+func Find(ctx context.Context, s store.Store, q Query) ([]*Instance, error) {
+	if f, ok := s.(Finder); ok {
+		return f.FindInstances(ctx, q)
+	}
+	instances, err := retrieveInstancesByKey(ctx, s, q.Path)
 	if err != nil {
 		return nil, err
 	}
+	found := []*Instance{}
 	for _, i := range instances {
-		if i.Status == StatusDeployed {
-			if i.ExpiredAt != 0 && i.ExpiredAt <= expirationDate.Unix() {
-				expiredInstances = append(expiredInstances, i)
-			}
+		if q.Match(i) {
+			found = append(found, i)
 		}
 	}
-	return expiredInstances, nil
+	return found, nil
 }
 
 // Save an instance into the Store
-func Save(store store.Store, instance *Instance) error {
+func Save(ctx context.Context, store store.Store, instance *Instance) error {
 	encoded, err := toJSON(instance)
 	if err != nil {
 		return err
 	}
-	return store.SetValue(instance.Path.String(), encoded)
+	return store.SetValue(ctx, instance.Path.String(), encoded)
+}
+
+// ChangeStatus saves an instance with a new status if check accepts the status
+// it has in the store. The status is read and written atomically, so that two
+// callers cannot both move an instance out of the same status.
+func ChangeStatus(ctx context.Context, s store.Store, instance *Instance, status Status, check func(Status) error) error {
+	for {
+		current := instance.Status
+		value, version, err := s.VersionedValue(ctx, instance.Path.String())
+		if err != nil {
+			return err
+		}
+		if value != "" {
+			stored, err := fromJSON(value)
+			if err != nil {
+				return err
+			}
+			current = stored.Status
+		}
+		if err := check(current); err != nil {
+			return err
+		}
+
+		instance.Status = status
+		encoded, err := toJSON(instance)
+		if err != nil {
+			return err
+		}
+		err = s.CompareAndSwap(ctx, instance.Path.String(), encoded, version)
+		if err != store.ErrConflict {
+			return err
+		}
+	}
 }
 
 // Delete an instance from the store
-func Delete(store store.Store, path Path) error {
-	return store.Delete(path.String())
+func Delete(ctx context.Context, store store.Store, path Path) error {
+	return store.Delete(ctx, path.String())
 }
 
 func fromJSON(jsonData string) (*Instance, error) {
@@ -143,8 +235,11 @@ func toJSON(instance *Instance) (string, error) {
 	return string(encoded), nil
 }
 
-func retrieveInstancesByKey(store store.Store, key string) ([]*Instance, error) {
-	data := store.Values(key)
+func retrieveInstancesByKey(ctx context.Context, store store.Store, key string) ([]*Instance, error) {
+	data, err := store.Values(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	instances := []*Instance{}
 	for _, value := range data {
 		instance, err := fromJSON(value)
@@ -1,6 +1,11 @@
 package instance
 
 import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -8,6 +13,11 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+var (
+	ctx         = context.Background()
+	unavailable = &store.UnavailableError{Err: errors.New("connection refused")}
+)
+
 func TestNewExpiredAt(t *testing.T) {
 	testcases := []struct {
 		Scenario     string
@@ -49,8 +59,8 @@ func TestFindByPath(t *testing.T) {
 			Scenario: "When the instance is properly save",
 			Path:     Path{"etcdPath", "test", "id"},
 			Store: &store.FakeStore{
-				MockValue: func(path string) string {
-					return `{"playbook_id":"test", "id": "id", "status": "deployed"}`
+				MockValue: func(path string) (string, error) {
+					return `{"playbook_id":"test", "id": "id", "status": "deployed"}`, nil
 				},
 			},
 			ExpectedPlaybookID: "test",
@@ -60,8 +70,8 @@ func TestFindByPath(t *testing.T) {
 			Scenario: "When the instance was not properly save",
 			Path:     Path{"etcdPath", "test", "id"},
 			Store: &store.FakeStore{
-				MockValue: func(path string) string {
-					return `{"playbook_id":}`
+				MockValue: func(path string) (string, error) {
+					return `{"playbook_id":}`, nil
 				},
 			},
 			ExpectedPlaybookID: "",
@@ -71,17 +81,28 @@ func TestFindByPath(t *testing.T) {
 			Scenario: "When the instance does not exist",
 			Path:     Path{"etcdPath", "test", "id"},
 			Store: &store.FakeStore{
-				MockValue: func(path string) string {
-					return ""
+				MockValue: func(path string) (string, error) {
+					return "", store.ErrNotFound
 				},
 			},
 			ExpectedPlaybookID: "",
 			ExpectedError:      NotFoundError("etcdPath/instances/test/id"),
 		},
+		{
+			Scenario: "When the store is unavailable",
+			Path:     Path{"etcdPath", "test", "id"},
+			Store: &store.FakeStore{
+				MockValue: func(path string) (string, error) {
+					return "", unavailable
+				},
+			},
+			ExpectedPlaybookID: "",
+			ExpectedError:      unavailable,
+		},
 	}
 
 	for _, tc := range testcases {
-		returnedInstance, err := FindByPath(tc.Store, tc.Path)
+		returnedInstance, err := FindByPath(ctx, tc.Store, tc.Path)
 		assert.Equal(t, tc.ExpectedError, err, tc.Scenario)
 		if err == nil {
 			assert.Equal(t, tc.ExpectedPlaybookID, returnedInstance.PlaybookID)
@@ -100,11 +121,11 @@ func TestFindByPlaybookID(t *testing.T) {
 		{
 			Scenario: "When instances exist in the store",
 			Store: &store.FakeStore{
-				MockValues: func(string) map[string]string {
+				MockValues: func(string) (map[string]string, error) {
 					return map[string]string{
 						"rootPath/instances/test":  `{"playbook_id": "test", "id": "id", "status": "deployed"}`,
 						"rootPath/instances/test1": `{"playbook_id": "test1", "id": "id", "status": "deployed"}`,
-					}
+					}, nil
 				},
 			},
 			PlaybookPath: PlaybookPath{"rootPath", "test"},
@@ -117,22 +138,33 @@ func TestFindByPlaybookID(t *testing.T) {
 		{
 			Scenario: "When instances does not exist in the store",
 			Store: &store.FakeStore{
-				MockValues: func(string) map[string]string {
-					return nil
+				MockValues: func(string) (map[string]string, error) {
+					return nil, nil
 				},
 			},
 			PlaybookPath:      PlaybookPath{"rootPath", "test"},
 			ExpectedInstances: map[string]Instance{},
 			ExpectedError:     nil,
 		},
+		{
+			Scenario: "When the store is unavailable",
+			Store: &store.FakeStore{
+				MockValues: func(string) (map[string]string, error) {
+					return nil, unavailable
+				},
+			},
+			PlaybookPath:      PlaybookPath{"rootPath", "test"},
+			ExpectedInstances: nil,
+			ExpectedError:     unavailable,
+		},
 		{
 			Scenario: "When the data is malformed",
 			Store: &store.FakeStore{
-				MockValues: func(string) map[string]string {
+				MockValues: func(string) (map[string]string, error) {
 					return map[string]string{
 						"rootPath/instances/test":  `{"playbook_id": "test", "id": "id", "status": "deployed"}`,
 						"rootPath/instances/test1": `{"playbook_id":`,
-					}
+					}, nil
 				},
 			},
 			PlaybookPath:      PlaybookPath{"rootPath", "test"},
@@ -142,7 +174,7 @@ func TestFindByPlaybookID(t *testing.T) {
 	}
 
 	for _, tc := range testcases {
-		instances, err := FindByPlaybookPath(tc.Store, tc.PlaybookPath)
+		instances, err := FindByPlaybookPath(ctx, tc.Store, tc.PlaybookPath)
 		assert.Equal(t, tc.ExpectedError, err, tc.Scenario)
 		if err == nil {
 			actual := map[string]Instance{}
@@ -183,7 +215,7 @@ func TestSave(t *testing.T) {
 		},
 	}
 	for _, tc := range testcases {
-		err := Save(tc.Store, tc.Instance)
+		err := Save(ctx, tc.Store, tc.Instance)
 		assert.Equal(t, tc.ExpectedError, err, tc.Scenario)
 	}
 }
@@ -208,7 +240,7 @@ func TestDelete(t *testing.T) {
 	}
 
 	for _, tc := range testcases {
-		err := Delete(tc.Store, tc.Path)
+		err := Delete(ctx, tc.Store, tc.Path)
 		assert.Equal(t, tc.ExpectedError, err, tc.Scenario)
 	}
 }
@@ -227,10 +259,10 @@ func TestAllDeployedAndExpired(t *testing.T) {
 			Path:           "broadwaytest/instances",
 			ExpirationDate: time.Date(2016, 8, 5, 00, 00, 00, 651387237, time.UTC),
 			Store: &store.FakeStore{
-				MockValues: func(path string) map[string]string {
+				MockValues: func(path string) (map[string]string, error) {
 					return map[string]string{
 						"etcdPath/instances": `{"playbook_id":"test", "id": "id", "status": "deployed", "expired_at": 10}`,
-					}
+					}, nil
 				},
 			},
 			ExpectedInstances: []*Instance{
@@ -243,10 +275,10 @@ func TestAllDeployedAndExpired(t *testing.T) {
 			Path:           "broadwaytest/instances",
 			ExpirationDate: time.Date(2016, 8, 5, 00, 00, 00, 651387237, time.UTC),
 			Store: &store.FakeStore{
-				MockValues: func(path string) map[string]string {
+				MockValues: func(path string) (map[string]string, error) {
 					return map[string]string{
 						"etcdPath/instances": `{"playbook_id":"test", "id": "id", "status": "deployed", "expired_at": 1470355200}`,
-					}
+					}, nil
 				},
 			},
 			ExpectedInstances: []*Instance{
@@ -257,8 +289,95 @@ func TestAllDeployedAndExpired(t *testing.T) {
 	}
 
 	for _, tc := range testcases {
-		instances, err := AllDeployedAndExpired(tc.Store, tc.Path, tc.ExpirationDate)
+		instances, err := AllDeployedAndExpired(ctx, tc.Store, tc.Path, tc.ExpirationDate)
 		assert.Equal(t, tc.ExpectedError, err, tc.Scenario)
 		assert.Equal(t, tc.ExpectedInstances, instances, tc.Scenario)
 	}
 }
+
+func TestChangeStatus(t *testing.T) {
+	deploying := func(s Status) error {
+		if s == StatusDeploying {
+			return errors.New("deploying already")
+		}
+		return nil
+	}
+	s := store.NewMemory()
+	i := &Instance{PlaybookID: "playbookID", ID: "id", Path: Path{"/root", "playbookID", "id"}}
+
+	assert.Nil(t, ChangeStatus(ctx, s, i, StatusDeploying, deploying), "a new instance should be saved")
+	assert.Equal(t, StatusDeploying, i.Status)
+	stored, err := FindByPath(ctx, s, i.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusDeploying, stored.Status)
+
+	stale := &Instance{PlaybookID: "playbookID", ID: "id", Path: i.Path, Status: StatusDeployed}
+	assert.EqualError(t, ChangeStatus(ctx, s, stale, StatusDeploying, deploying), "deploying already",
+		"the stored status should be checked, not the one in memory")
+	assert.Equal(t, StatusDeployed, stale.Status)
+}
+
+func TestChangeStatusConcurrently(t *testing.T) {
+	s := store.NewMemory()
+	path := Path{"/root", "playbookID", "id"}
+	assert.Nil(t, Save(ctx, s, &Instance{PlaybookID: "playbookID", ID: "id", Path: path, Status: StatusDeployed}))
+
+	var wg sync.WaitGroup
+	var started int32
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i := &Instance{PlaybookID: "playbookID", ID: "id", Path: path, Status: StatusDeployed}
+			err := ChangeStatus(ctx, s, i, StatusDeploying, func(s Status) error {
+				if s == StatusDeploying {
+					return errors.New("deploying already")
+				}
+				return nil
+			})
+			if err == nil {
+				atomic.AddInt32(&started, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), started, "only one deploy should start")
+}
+
+func TestFind(t *testing.T) {
+	s := store.NewMemory()
+	instances := []*Instance{
+		{PlaybookID: "hello", ID: "1", Status: StatusDeployed, Created: 10, ExpiredAt: 20,
+			Vars: map[string]string{"owner": "ann"}},
+		{PlaybookID: "hello", ID: "2", Status: StatusDeployed, Created: 20,
+			Vars: map[string]string{"owner": "bob"}},
+		{PlaybookID: "hello", ID: "3", Status: StatusError, Created: 30, ExpiredAt: 20,
+			Vars: map[string]string{"owner": "ann"}},
+	}
+	for _, i := range instances {
+		i.Path = Path{"/root", i.PlaybookID, i.ID}
+		assert.Nil(t, Save(ctx, s, i))
+	}
+
+	cases := []struct {
+		Scenario string
+		Query    Query
+		IDs      []string
+	}{
+		{"Find: every instance", Query{Path: "/root/instances"}, []string{"1", "2", "3"}},
+		{"Find: by status", Query{Path: "/root/instances", Statuses: []Status{StatusError, StatusNew}}, []string{"3"}},
+		{"Find: expired", Query{Path: "/root/instances", ExpiredBefore: 20}, []string{"1", "3"}},
+		{"Find: by creation time", Query{Path: "/root/instances", CreatedAfter: 20, CreatedBefore: 30}, []string{"2", "3"}},
+		{"Find: by var", Query{Path: "/root/instances", Vars: map[string]string{"owner": "ann"}}, []string{"1", "3"}},
+	}
+	for _, c := range cases {
+		found, err := Find(ctx, s, c.Query)
+		assert.Nil(t, err, c.Scenario)
+		ids := []string{}
+		for _, i := range found {
+			ids = append(ids, i.ID)
+		}
+		sort.Strings(ids)
+		assert.Equal(t, c.IDs, ids, c.Scenario)
+	}
+}
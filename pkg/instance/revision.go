@@ -0,0 +1,138 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/namely/broadway/pkg/store"
+)
+
+// RevisionNotFoundError revision not found error
+type RevisionNotFoundError string
+
+func (e RevisionNotFoundError) Error() string {
+	return fmt.Sprintf("broadway/instance: revision %s was not found", string(e))
+}
+
+// HistoryPath represents the path holding the revisions of an instance
+type HistoryPath struct {
+	RootPath   string
+	PlaybookID string
+	ID         string
+}
+
+func (hp HistoryPath) String() string {
+	return fmt.Sprintf("%s/revisions/%s/%s", hp.RootPath, hp.PlaybookID, hp.ID)
+}
+
+// RevisionPath represents a path for a revision
+type RevisionPath struct {
+	HistoryPath
+	Number int
+}
+
+func (rp RevisionPath) String() string {
+	return fmt.Sprintf("%s/%d", rp.HistoryPath.String(), rp.Number)
+}
+
+// Revision records one deployment of an instance
+type Revision struct {
+	PlaybookID    string            `json:"playbook_id"`
+	InstanceID    string            `json:"instance_id"`
+	Number        int               `json:"revision"`
+	Vars          map[string]string `json:"vars"`
+	ManifestsHash string            `json:"manifests_hash"`
+	Commit        string            `json:"playbooks_commit,omitempty"` // the git commit the playbooks were loaded from
+	Author        string            `json:"author"`
+	RollbackOf    int               `json:"rollback_of,omitempty"` // the revision redeployed by a rollback
+	Started       int64             `json:"started_time"`
+	Finished      int64             `json:"finished_time,omitempty"`
+	Status        `json:"status"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Path returns where the revision is stored under rootPath
+func (r *Revision) Path(rootPath string) RevisionPath {
+	return RevisionPath{HistoryPath{rootPath, r.PlaybookID, r.InstanceID}, r.Number}
+}
+
+// NewRevision numbers a revision of i after the latest one in the store
+func NewRevision(ctx context.Context, store store.Store, rootPath string, i *Instance) (*Revision, error) {
+	revisions, err := History(ctx, store, HistoryPath{rootPath, i.PlaybookID, i.ID})
+	if err != nil {
+		return nil, err
+	}
+	number := 1
+	if len(revisions) > 0 {
+		number = revisions[len(revisions)-1].Number + 1
+	}
+	vars := map[string]string{}
+	for k, v := range i.Vars {
+		vars[k] = v
+	}
+	return &Revision{
+		PlaybookID: i.PlaybookID,
+		InstanceID: i.ID,
+		Number:     number,
+		Vars:       vars,
+	}, nil
+}
+
+// SaveRevision writes a revision into the Store
+func SaveRevision(ctx context.Context, store store.Store, rootPath string, r *Revision) error {
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return store.SetValue(ctx, r.Path(rootPath).String(), string(encoded))
+}
+
+// FindRevision finds a revision based on its path
+func FindRevision(ctx context.Context, s store.Store, path RevisionPath) (*Revision, error) {
+	data, err := s.Value(ctx, path.String())
+	if err == store.ErrNotFound {
+		return nil, RevisionNotFoundError(path.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &Revision{}
+	if err := json.Unmarshal([]byte(data), r); err != nil {
+		return nil, ErrMalformedSaveData
+	}
+	return r, nil
+}
+
+type byNumber []*Revision
+
+func (rs byNumber) Len() int           { return len(rs) }
+func (rs byNumber) Less(i, j int) bool { return rs[i].Number < rs[j].Number }
+func (rs byNumber) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+
+// History returns the revisions of an instance, oldest first
+func History(ctx context.Context, store store.Store, hp HistoryPath) ([]*Revision, error) {
+	values, err := store.Values(ctx, hp.String())
+	if err != nil {
+		return nil, err
+	}
+	revisions := []*Revision{}
+	for key, value := range values {
+		if _, err := strconv.Atoi(path.Base(key)); err != nil {
+			continue
+		}
+		r := &Revision{}
+		if err := json.Unmarshal([]byte(value), r); err != nil {
+			return nil, ErrMalformedSaveData
+		}
+		if r.PlaybookID != hp.PlaybookID || r.InstanceID != hp.ID {
+			continue
+		}
+		revisions = append(revisions, r)
+	}
+	sort.Sort(byNumber(revisions))
+	return revisions, nil
+}
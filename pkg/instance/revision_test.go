@@ -0,0 +1,107 @@
+package instance
+
+import (
+	"testing"
+
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevisionPath(t *testing.T) {
+	r := &Revision{PlaybookID: "test", InstanceID: "id", Number: 3}
+	assert.Equal(t, "root/revisions/test/id/3", r.Path("root").String())
+}
+
+func TestHistory(t *testing.T) {
+	testcases := []struct {
+		Scenario        string
+		Values          map[string]string
+		ExpectedNumbers []int
+		ExpectedError   error
+	}{
+		{
+			Scenario: "Revisions are sorted by number",
+			Values: map[string]string{
+				"10": `{"playbook_id": "test", "instance_id": "id", "revision": 10}`,
+				"2":  `{"playbook_id": "test", "instance_id": "id", "revision": 2}`,
+				"1":  `{"playbook_id": "test", "instance_id": "id", "revision": 1}`,
+			},
+			ExpectedNumbers: []int{1, 2, 10},
+		},
+		{
+			Scenario: "Other keys and other instances are skipped",
+			Values: map[string]string{
+				"root/revisions/test/id/1":    `{"playbook_id": "test", "instance_id": "id", "revision": 1}`,
+				"root/revisions/test/other/1": `{"playbook_id": "test", "instance_id": "other", "revision": 1}`,
+				"id":                          `{"playbook_id": "test", "id": "id"}`,
+			},
+			ExpectedNumbers: []int{1},
+		},
+		{
+			Scenario:        "No revisions",
+			Values:          nil,
+			ExpectedNumbers: []int{},
+		},
+		{
+			Scenario:      "Malformed revision",
+			Values:        map[string]string{"1": `{"playbook_id":`},
+			ExpectedError: ErrMalformedSaveData,
+		},
+	}
+
+	for _, tc := range testcases {
+		values := tc.Values
+		s := &store.FakeStore{
+			MockValues: func(string) (map[string]string, error) { return values, nil },
+		}
+		revisions, err := History(ctx, s, HistoryPath{"root", "test", "id"})
+		assert.Equal(t, tc.ExpectedError, err, tc.Scenario)
+		if err != nil {
+			continue
+		}
+		numbers := []int{}
+		for _, r := range revisions {
+			numbers = append(numbers, r.Number)
+		}
+		assert.Equal(t, tc.ExpectedNumbers, numbers, tc.Scenario)
+	}
+
+	s := &store.FakeStore{
+		MockValues: func(string) (map[string]string, error) { return nil, unavailable },
+	}
+	_, err := History(ctx, s, HistoryPath{"root", "test", "id"})
+	assert.Equal(t, unavailable, err, "store errors should be returned")
+}
+
+func TestNewRevision(t *testing.T) {
+	saved := map[string]string{}
+	s := &store.FakeStore{
+		MockValues: func(string) (map[string]string, error) { return saved, nil },
+		MockSetValue: func(path, value string) error {
+			saved[path] = value
+			return nil
+		},
+		MockValue: func(path string) (string, error) {
+			if v, ok := saved[path]; ok {
+				return v, nil
+			}
+			return "", store.ErrNotFound
+		},
+	}
+	i := &Instance{PlaybookID: "test", ID: "id", Vars: map[string]string{"version": "1"}}
+
+	for n := 1; n <= 2; n++ {
+		r, err := NewRevision(ctx, s, "root", i)
+		assert.Nil(t, err)
+		assert.Equal(t, n, r.Number, "revisions should be numbered in sequence")
+		assert.Nil(t, SaveRevision(ctx, s, "root", r))
+	}
+
+	i.Vars["version"] = "2"
+	r, err := FindRevision(ctx, s, RevisionPath{HistoryPath{"root", "test", "id"}, 1})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"version": "1"}, r.Vars, "revisions should keep a copy of the vars")
+
+	_, err = FindRevision(ctx, s, RevisionPath{HistoryPath{"root", "test", "id"}, 3})
+	assert.Equal(t, RevisionNotFoundError("root/revisions/test/id/3"), err)
+}
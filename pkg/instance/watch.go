@@ -0,0 +1,74 @@
+package instance
+
+import (
+	"context"
+
+	"github.com/namely/broadway/pkg/store"
+)
+
+// EventType tells how an instance changed
+type EventType string
+
+const (
+	// EventCreated reports a new instance
+	EventCreated EventType = "created"
+	// EventUpdated reports an instance saved without changing its status
+	EventUpdated EventType = "updated"
+	// EventStatus reports an instance whose status changed
+	EventStatus EventType = "status"
+	// EventDeleted reports a deleted instance
+	EventDeleted EventType = "deleted"
+)
+
+// Event is a change to an instance
+type Event struct {
+	Type     EventType `json:"type"`
+	Instance *Instance `json:"instance"`
+}
+
+// Watch reports the changes made to the instances under path, like a
+// PlaybookPath, until ctx is done. The channel is closed when the watch of the
+// store ends.
+func Watch(ctx context.Context, s store.Store, path string) (<-chan Event, error) {
+	changes, err := s.Watch(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for change := range changes {
+			e, ok := event(change)
+			if !ok {
+				continue
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// event returns the event for a change to a key, if the key holds an instance
+func event(change store.Event) (Event, bool) {
+	value := change.Value
+	if change.Type == store.EventDelete {
+		value = change.PrevValue
+	}
+	i, err := fromJSON(value)
+	if err != nil {
+		return Event{}, false
+	}
+	e := Event{Type: EventUpdated, Instance: i}
+	if change.Type == store.EventDelete {
+		e.Type = EventDeleted
+	} else if change.PrevValue == "" {
+		e.Type = EventCreated
+	} else if prev, err := fromJSON(change.PrevValue); err == nil && prev.Status != i.Status {
+		e.Type = EventStatus
+	}
+	return e, true
+}
@@ -0,0 +1,38 @@
+package instance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	s := store.NewMemory()
+	pp := PlaybookPath{RootPath: "/broadwaytest", PlaybookID: "web"}
+	events, err := Watch(ctx, s, pp.String())
+	assert.Nil(t, err)
+
+	i := &Instance{PlaybookID: "web", ID: "master", Path: Path{"/broadwaytest", "web", "master"}}
+	assert.Nil(t, Save(ctx, s, i))
+	s.SetValue(ctx, pp.String()+"/broken", "{")
+	other := &Instance{PlaybookID: "api", ID: "master", Path: Path{"/broadwaytest", "api", "master"}}
+	assert.Nil(t, Save(ctx, s, other))
+	i.Vars = map[string]string{"version": "2"}
+	assert.Nil(t, Save(ctx, s, i))
+	assert.Nil(t, ChangeStatus(ctx, s, i, StatusDeploying, func(Status) error { return nil }))
+	assert.Nil(t, Delete(ctx, s, i.Path))
+
+	expected := []EventType{EventCreated, EventUpdated, EventStatus, EventDeleted}
+	for _, typ := range expected {
+		select {
+		case e := <-events:
+			assert.Equal(t, typ, e.Type, "malformed instances and other playbooks should be skipped")
+			assert.Equal(t, "master", e.Instance.ID)
+			assert.Equal(t, "web", e.Instance.PlaybookID)
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event was received", typ)
+		}
+	}
+}
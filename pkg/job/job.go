@@ -0,0 +1,222 @@
+// Package job keeps the deployment jobs run in the background by Broadway
+package job
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/namely/broadway/pkg/store"
+)
+
+// NotFoundError job not found error
+type NotFoundError string
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("broadway/job: %s was not found", string(e))
+}
+
+// ErrMalformedSaveData in case a job cannot be unmarshalled
+var ErrMalformedSaveData = errors.New("broadway/job: saved data for this job is malformed")
+
+// Type is what a job does to an instance
+type Type string
+
+const (
+	// TypeDeploy deploys an instance
+	TypeDeploy Type = "deploy"
+	// TypeRollback deploys an instance with the vars of an earlier revision
+	TypeRollback Type = "rollback"
+	// TypeStop deletes the objects of an instance from Kubernetes
+	TypeStop Type = "stop"
+	// TypeDelete stops an instance, then deletes it from the store
+	TypeDelete Type = "delete"
+)
+
+// State of a job
+type State string
+
+const (
+	// StateQueued represents a job waiting for a worker
+	StateQueued State = "queued"
+	// StateRunning represents a job run by a worker
+	StateRunning State = "running"
+	// StateSucceeded represents a job that finished successfully
+	StateSucceeded State = "succeeded"
+	// StateFailed represents a job that finished with an error
+	StateFailed State = "failed"
+)
+
+// MaxProgress is the number of progress messages kept by a job
+const MaxProgress = 20
+
+// Path represents a path for a job
+type Path struct {
+	RootPath string
+	ID       string
+}
+
+func (p Path) String() string {
+	return fmt.Sprintf("%s/jobs/%s", p.RootPath, p.ID)
+}
+
+// Job is a deployment run in the background
+type Job struct {
+	ID         string   `json:"id"`
+	Type       Type     `json:"type"`
+	PlaybookID string   `json:"playbook_id"`
+	InstanceID string   `json:"instance_id"`
+	Revision   int      `json:"revision,omitempty"` // the revision a rollback returns to
+	Author     string   `json:"author"`
+	State      State    `json:"state"`
+	Progress   []string `json:"progress"` // the latest steps of the job
+	Error      string   `json:"error,omitempty"`
+	Created    int64    `json:"created_time"`
+	Started    int64    `json:"started_time,omitempty"`
+	Finished   int64    `json:"finished_time,omitempty"`
+}
+
+// New returns a queued job with a new ID. IDs sort in the order the jobs were
+// created.
+func New(t Type, playbookID, instanceID, author string) *Job {
+	b := make([]byte, 4)
+	rand.Read(b)
+	now := time.Now()
+	return &Job{
+		ID:         fmt.Sprintf("%016x%s", now.UnixNano(), hex.EncodeToString(b)),
+		Type:       t,
+		PlaybookID: playbookID,
+		InstanceID: instanceID,
+		Author:     author,
+		State:      StateQueued,
+		Created:    now.Unix(),
+	}
+}
+
+// Report adds a progress message to the job, dropping the oldest ones beyond
+// MaxProgress
+func (j *Job) Report(message string) {
+	j.Progress = append(j.Progress, message)
+	if len(j.Progress) > MaxProgress {
+		j.Progress = j.Progress[len(j.Progress)-MaxProgress:]
+	}
+}
+
+// Done tells whether the job finished
+func (j *Job) Done() bool {
+	return j.State == StateSucceeded || j.State == StateFailed
+}
+
+// FindByPath finds a job based on its path
+func FindByPath(ctx context.Context, s store.Store, path Path) (*Job, error) {
+	value, err := s.Value(ctx, path.String())
+	if err == store.ErrNotFound {
+		return nil, NotFoundError(path.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fromJSON(value)
+}
+
+// List returns the jobs under rootPath in a state, oldest first. Malformed
+// jobs are skipped so that they don't hold up the queue.
+func List(ctx context.Context, s store.Store, rootPath string, state State) ([]*Job, error) {
+	values, err := s.Values(ctx, rootPath+"/jobs")
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*Job{}
+	for _, value := range values {
+		j, err := fromJSON(value)
+		if err != nil {
+			glog.Warningf("Skipping a malformed job: %s", value)
+			continue
+		}
+		if j.State == state {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].ID < jobs[b].ID })
+	return jobs, nil
+}
+
+// Save a job into the store
+func Save(ctx context.Context, s store.Store, rootPath string, j *Job) error {
+	encoded, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return s.SetValue(ctx, Path{rootPath, j.ID}.String(), string(encoded))
+}
+
+// Expire deletes the jobs under rootPath that finished before t, and returns
+// how many were deleted. Queued and running jobs are kept.
+func Expire(ctx context.Context, s store.Store, rootPath string, t time.Time) (int, error) {
+	values, err := s.Values(ctx, rootPath+"/jobs")
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, value := range values {
+		j, err := fromJSON(value)
+		if err != nil || !j.Done() || j.Finished >= t.Unix() {
+			continue
+		}
+		if err := s.Delete(ctx, Path{rootPath, j.ID}.String()); err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// ErrClaimed is returned by Claim when another worker took the job
+var ErrClaimed = errors.New("broadway/job: the job was claimed by another worker")
+
+// Claim marks a queued job as running. The state is read and written
+// atomically, so that a job is run by one worker only.
+func Claim(ctx context.Context, s store.Store, rootPath string, j *Job) error {
+	path := Path{rootPath, j.ID}.String()
+	value, version, err := s.VersionedValue(ctx, path)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return NotFoundError(j.ID)
+	}
+	stored, err := fromJSON(value)
+	if err != nil {
+		return err
+	}
+	if stored.State != StateQueued {
+		return ErrClaimed
+	}
+
+	*j = *stored
+	j.State = StateRunning
+	j.Started = time.Now().Unix()
+	encoded, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	err = s.CompareAndSwap(ctx, path, string(encoded), version)
+	if err == store.ErrConflict {
+		return ErrClaimed
+	}
+	return err
+}
+
+func fromJSON(value string) (*Job, error) {
+	j := &Job{}
+	if err := json.Unmarshal([]byte(value), j); err != nil {
+		return nil, ErrMalformedSaveData
+	}
+	return j, nil
+}
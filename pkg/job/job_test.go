@@ -0,0 +1,104 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+const root = "/broadwaytest"
+
+func TestNew(t *testing.T) {
+	a := New(TypeDeploy, "web", "master", "api")
+	b := New(TypeStop, "web", "master", "api")
+	assert.True(t, a.ID < b.ID, "jobs should sort in the order they were created")
+	assert.Equal(t, StateQueued, a.State)
+}
+
+func TestReport(t *testing.T) {
+	j := New(TypeDeploy, "web", "master", "api")
+	for n := 0; n < MaxProgress+5; n++ {
+		j.Report(fmt.Sprintf("step %d", n))
+	}
+	assert.Len(t, j.Progress, MaxProgress)
+	assert.Equal(t, "step 5", j.Progress[0], "the oldest messages should be dropped")
+}
+
+func TestFindByPath(t *testing.T) {
+	s := store.NewMemory()
+	j := New(TypeDeploy, "web", "master", "api")
+	assert.Nil(t, Save(ctx, s, root, j))
+
+	found, err := FindByPath(ctx, s, Path{root, j.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, j, found)
+
+	_, err = FindByPath(ctx, s, Path{root, "missing"})
+	assert.Equal(t, NotFoundError("missing"), err)
+}
+
+func TestList(t *testing.T) {
+	s := store.NewMemory()
+	first := New(TypeDeploy, "web", "master", "api")
+	running := New(TypeDeploy, "web", "staging", "api")
+	running.State = StateRunning
+	second := New(TypeStop, "web", "master", "api")
+	for _, j := range []*Job{second, running, first} {
+		assert.Nil(t, Save(ctx, s, root, j))
+	}
+	s.SetValue(ctx, root+"/jobs/broken", "{")
+
+	jobs, err := List(ctx, s, root, StateQueued)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Job{first, second}, jobs)
+	jobs, err = List(ctx, s, root, StateRunning)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Job{running}, jobs)
+}
+
+func TestExpire(t *testing.T) {
+	s := store.NewMemory()
+	now := time.Now()
+	old := New(TypeDeploy, "web", "master", "api")
+	old.State, old.Finished = StateSucceeded, now.Add(-2*time.Hour).Unix()
+	failed := New(TypeDeploy, "web", "master", "api")
+	failed.State, failed.Finished = StateFailed, now.Add(-2*time.Hour).Unix()
+	recent := New(TypeDeploy, "web", "master", "api")
+	recent.State, recent.Finished = StateSucceeded, now.Unix()
+	queued := New(TypeDeploy, "web", "master", "api")
+	for _, j := range []*Job{old, failed, recent, queued} {
+		assert.Nil(t, Save(ctx, s, root, j))
+	}
+
+	expired, err := Expire(ctx, s, root, now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, expired)
+	for _, j := range []*Job{old, failed} {
+		_, err := FindByPath(ctx, s, Path{root, j.ID})
+		assert.Equal(t, NotFoundError(j.ID), err, "jobs finished before the time should be deleted")
+	}
+	for _, j := range []*Job{recent, queued} {
+		_, err := FindByPath(ctx, s, Path{root, j.ID})
+		assert.Nil(t, err, "recent and unfinished jobs should be kept")
+	}
+}
+
+func TestClaim(t *testing.T) {
+	s := store.NewMemory()
+	j := New(TypeDeploy, "web", "master", "api")
+	assert.Nil(t, Save(ctx, s, root, j))
+
+	claimed := &Job{ID: j.ID}
+	assert.Nil(t, Claim(ctx, s, root, claimed))
+	assert.Equal(t, StateRunning, claimed.State)
+	assert.Equal(t, "master", claimed.InstanceID, "the job should be read from the store")
+
+	assert.Equal(t, ErrClaimed, Claim(ctx, s, root, j), "a job should be claimed once")
+	assert.Equal(t, NotFoundError("missing"), Claim(ctx, s, root, &Job{ID: "missing"}))
+}
@@ -0,0 +1,81 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Leader elects one of the Broadway servers sharing a store: the leader is
+// the server holding the lock
+type Leader struct {
+	lock  *Lock
+	mu    sync.Mutex
+	until time.Time // when the lock expires, unless it's refreshed
+}
+
+// NewLeader returns a Leader campaigning with l
+func NewLeader(l *Lock) *Leader {
+	return &Leader{lock: l}
+}
+
+// Campaign tries to take the lock, and keeps it once taken, every third of
+// its ttl until ctx is done. The lock is released then.
+func (e *Leader) Campaign(ctx context.Context) {
+	ticker := time.NewTicker(e.lock.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.mu.Lock()
+			leading := time.Now().Before(e.until)
+			e.until = time.Time{}
+			e.mu.Unlock()
+			if leading {
+				if err := e.lock.Release(context.Background()); err != nil {
+					glog.Errorf("Failed to release the leader lock: %s", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Leader) campaign(ctx context.Context) {
+	start := time.Now()
+	leading := e.IsLeader()
+	var err error
+	if leading {
+		err = e.lock.Refresh(ctx)
+	} else {
+		err = e.lock.Acquire(ctx)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch err.(type) {
+	case nil:
+		if !leading {
+			glog.Infof("Became the leader as %s", e.lock.owner)
+		}
+		e.until = start.Add(e.lock.ttl)
+	case *HeldError:
+	default:
+		if leading {
+			glog.Errorf("Failed to keep the leader lock: %s", err)
+		}
+		// The lock may still be ours, but its expiry can't be trusted
+		e.until = time.Time{}
+	}
+}
+
+// IsLeader tells whether this server holds the lock
+func (e *Leader) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().Before(e.until)
+}
@@ -0,0 +1,237 @@
+// Package lock keeps locks in the store, so that the Broadway servers sharing
+// a store don't deploy the same instance at once, and elects the server
+// running the background work
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/namely/broadway/pkg/store"
+)
+
+// HeldError is returned by Acquire when another owner holds the lock
+type HeldError struct {
+	Path  string
+	Owner string
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("broadway/lock: %s is held by %s", e.Path, e.Owner)
+}
+
+// ErrLost is returned when the lock was taken by another owner after it
+// expired
+var ErrLost = errors.New("broadway/lock: the lock was lost")
+
+// Expirer is implemented by stores whose keys can expire, like etcd. Their
+// locks are released by the store when their owner stops refreshing them.
+// Other stores keep the expiry time in the lock, and rely on the clocks of the
+// servers.
+type Expirer interface {
+	// CompareAndSwapTTL is CompareAndSwap for a key deleted after ttl
+	// unless it's swapped again
+	CompareAndSwapTTL(ctx context.Context, path, value string, version uint64, ttl time.Duration) error
+}
+
+// NewOwner returns a name for the locks of this process, unique among the
+// Broadway servers
+func NewOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "broadway"
+	}
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+// record is the value of a lock. A lock without owner is free.
+type record struct {
+	Owner   string `json:"owner"`
+	Expires int64  `json:"expires"` // unix time in nanoseconds
+}
+
+// Lock is a lock kept in a store, held by one owner at a time for up to ttl
+// unless it's refreshed
+type Lock struct {
+	store   store.Store
+	path    string
+	owner   string
+	ttl     time.Duration
+	mu      sync.Mutex
+	version uint64 // the version of the lock when it was last written by us
+}
+
+// New returns a lock kept at path, taken by owner for ttl
+func New(s store.Store, path, owner string, ttl time.Duration) *Lock {
+	return &Lock{store: s, path: path, owner: owner, ttl: ttl}
+}
+
+// Acquire takes the lock, and returns a *HeldError if another owner holds it
+func (l *Lock) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		value, version, err := l.store.VersionedValue(ctx, l.path)
+		if err != nil {
+			return err
+		}
+		r := record{}
+		if value != "" && json.Unmarshal([]byte(value), &r) != nil {
+			glog.Warningf("Taking over the malformed lock %s: %s", l.path, value)
+		}
+		if r.Owner != "" && r.Owner != l.owner && !l.expired(r) {
+			return &HeldError{Path: l.path, Owner: r.Owner}
+		}
+		err = l.swap(ctx, l.owner, version)
+		if err != store.ErrConflict {
+			return err
+		}
+		// Another owner changed the lock since we read it
+	}
+}
+
+// Check returns a *HeldError if another owner holds the lock, without taking
+// it
+func (l *Lock) Check(ctx context.Context) error {
+	value, _, err := l.store.VersionedValue(ctx, l.path)
+	if err != nil || value == "" {
+		return err
+	}
+	r := record{}
+	if json.Unmarshal([]byte(value), &r) != nil {
+		return nil
+	}
+	if r.Owner != "" && r.Owner != l.owner && !l.expired(r) {
+		return &HeldError{Path: l.path, Owner: r.Owner}
+	}
+	return nil
+}
+
+// Break frees the lock whoever holds it. It is meant for locks left by a
+// server that is known to be gone: their owner finds out that the lock was
+// lost at its next refresh.
+func (l *Lock) Break(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		_, version, err := l.store.VersionedValue(ctx, l.path)
+		if err != nil {
+			return err
+		}
+		err = l.swap(ctx, "", version)
+		if err != store.ErrConflict {
+			return err
+		}
+	}
+}
+
+// Refresh extends the lock by its ttl, and returns ErrLost if it was taken
+// by another owner
+func (l *Lock) Refresh(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.swap(ctx, l.owner, l.version)
+	if err == store.ErrConflict {
+		return ErrLost
+	}
+	return err
+}
+
+// Release frees the lock, unless it was taken by another owner already
+func (l *Lock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.swap(ctx, "", l.version)
+	if err == store.ErrConflict {
+		return nil
+	}
+	return err
+}
+
+// Hold acquires the lock and refreshes it until release is called. The
+// returned context is canceled when the lock is lost, or when it couldn't be
+// refreshed for its ttl, since another owner may have taken it by then. The
+// work done under the lock should stop when it is.
+func (l *Lock) Hold(ctx context.Context) (held context.Context, release func(), err error) {
+	if err := l.Acquire(ctx); err != nil {
+		return nil, nil, err
+	}
+	held, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		refreshed := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := l.Refresh(context.Background())
+				if err == nil {
+					refreshed = time.Now()
+					continue
+				}
+				glog.Errorf("Failed to refresh the lock %s: %s", l.path, err)
+				if err == ErrLost || time.Since(refreshed) >= l.ttl {
+					glog.Errorf("Giving up the lock %s", l.path)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return held, func() {
+		close(done)
+		<-stopped
+		cancel()
+		if err := l.Release(context.Background()); err != nil {
+			glog.Errorf("Failed to release the lock %s: %s", l.path, err)
+		}
+	}, nil
+}
+
+// expired tells whether the owner of r stopped refreshing it. Stores expiring
+// their keys delete such locks themselves.
+func (l *Lock) expired(r record) bool {
+	if _, ok := l.store.(Expirer); ok {
+		return false
+	}
+	return time.Now().UnixNano() > r.Expires
+}
+
+// swap writes the lock for owner if its version is still version, and
+// remembers the version written. The caller holds l.mu.
+func (l *Lock) swap(ctx context.Context, owner string, version uint64) error {
+	encoded, err := json.Marshal(record{Owner: owner, Expires: time.Now().Add(l.ttl).UnixNano()})
+	if err != nil {
+		return err
+	}
+	if e, ok := l.store.(Expirer); ok {
+		err = e.CompareAndSwapTTL(ctx, l.path, string(encoded), version, l.ttl)
+	} else {
+		err = l.store.CompareAndSwap(ctx, l.path, string(encoded), version)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The lock can't be taken before it expires, so it still holds our value
+	value, version, err := l.store.VersionedValue(ctx, l.path)
+	if err != nil {
+		return err
+	}
+	if value != string(encoded) {
+		return store.ErrConflict
+	}
+	l.version = version
+	return nil
+}
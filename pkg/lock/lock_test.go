@@ -0,0 +1,124 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+func TestAcquire(t *testing.T) {
+	s := store.NewMemory()
+	a := New(s, "/locks/web/master", "a", time.Minute)
+	b := New(s, "/locks/web/master", "b", time.Minute)
+
+	assert.Nil(t, a.Acquire(ctx))
+	assert.Nil(t, a.Acquire(ctx), "the owner should take its lock again")
+	assert.Equal(t, &HeldError{Path: "/locks/web/master", Owner: "a"}, b.Acquire(ctx))
+	assert.Nil(t, a.Refresh(ctx))
+
+	assert.Nil(t, a.Release(ctx))
+	assert.Nil(t, b.Acquire(ctx), "a released lock should be free")
+	assert.IsType(t, &HeldError{}, a.Acquire(ctx))
+}
+
+func TestExpiry(t *testing.T) {
+	s := store.NewMemory()
+	a := New(s, "/locks/web/master", "a", 10*time.Millisecond)
+	b := New(s, "/locks/web/master", "b", time.Minute)
+
+	assert.Nil(t, a.Acquire(ctx))
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, b.Acquire(ctx), "an expired lock should be free")
+	assert.Equal(t, ErrLost, a.Refresh(ctx))
+	assert.Nil(t, a.Release(ctx), "releasing a lost lock should leave it alone")
+	assert.IsType(t, &HeldError{}, a.Acquire(ctx))
+}
+
+func TestCheckAndBreak(t *testing.T) {
+	s := store.NewMemory()
+	a := New(s, "/locks/web/master", "a", time.Minute)
+	b := New(s, "/locks/web/master", "b", time.Minute)
+	assert.Nil(t, b.Check(ctx), "a free lock shouldn't be held")
+
+	assert.Nil(t, a.Acquire(ctx))
+	assert.Nil(t, a.Check(ctx), "a lock shouldn't be held from its owner")
+	assert.Equal(t, &HeldError{Path: "/locks/web/master", Owner: "a"}, b.Check(ctx))
+	assert.Nil(t, a.Refresh(ctx), "checking shouldn't take the lock")
+
+	assert.Nil(t, b.Break(ctx))
+	assert.Nil(t, b.Check(ctx))
+	assert.Equal(t, ErrLost, a.Refresh(ctx), "the owner of a broken lock should lose it")
+	assert.Nil(t, b.Acquire(ctx))
+}
+
+func TestHold(t *testing.T) {
+	s := store.NewMemory()
+	a := New(s, "/locks/web/master", "a", 30*time.Millisecond)
+	b := New(s, "/locks/web/master", "b", time.Minute)
+
+	held, release, err := a.Hold(ctx)
+	assert.Nil(t, err)
+	time.Sleep(60 * time.Millisecond)
+	assert.IsType(t, &HeldError{}, b.Acquire(ctx), "a held lock should be refreshed")
+	assert.Nil(t, held.Err())
+	release()
+	assert.NotNil(t, held.Err(), "the context should end with the hold")
+	assert.Nil(t, b.Acquire(ctx))
+}
+
+func TestHoldLost(t *testing.T) {
+	s := store.NewMemory()
+	a := New(s, "/locks/web/master", "a", 30*time.Millisecond)
+	held, release, err := a.Hold(ctx)
+	assert.Nil(t, err)
+	defer release()
+
+	// Another owner takes the lock, as if a had stopped refreshing it
+	assert.Nil(t, s.SetValue(ctx, "/locks/web/master", `{"owner":"b","expires":0}`))
+	select {
+	case <-held.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context should be canceled when the lock is lost")
+	}
+}
+
+func TestLeader(t *testing.T) {
+	s := store.NewMemory()
+	a := NewLeader(New(s, "/leader", "a", 30*time.Millisecond))
+	b := NewLeader(New(s, "/leader", "b", 30*time.Millisecond))
+
+	actx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		a.Campaign(actx)
+		close(done)
+	}()
+	waitFor(t, "a to lead", a.IsLeader)
+
+	bctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go b.Campaign(bctx)
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader(), "one server should lead at a time")
+
+	stop()
+	<-done
+	assert.False(t, a.IsLeader())
+	waitFor(t, "b to lead", b.IsLeader)
+}
+
+// waitFor polls cond until it holds, for up to 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
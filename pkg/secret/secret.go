@@ -0,0 +1,164 @@
+// Package secret encrypts the values of secret vars with AES-GCM
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/namely/broadway/pkg/cfg"
+)
+
+// prefix marks the values sealed by a Box
+const prefix = "secret:v1:"
+
+// Mask replaces the values of secret vars in the output of Broadway
+const Mask = "********"
+
+// ErrNoKey is returned when a secret is sealed or opened without a key
+var ErrNoKey = errors.New("broadway/secret: no secret key is configured")
+
+// ErrMalformed is returned when a sealed value can't be opened with the key
+var ErrMalformed = errors.New("broadway/secret: the secret is malformed or was sealed with another key")
+
+// Box seals and opens values with a key
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox returns a Box using an AES key of 16, 24 or 32 bytes
+func NewBox(key []byte) (*Box, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("broadway/secret: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts a value. Empty values are left empty.
+func (b *Box) Seal(value string) (string, error) {
+	if value == "" || IsSealed(value) {
+		return value, nil
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(value), nil)
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a sealed value. Other values are returned as they are.
+func (b *Box) Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil || len(sealed) < b.aead.NonceSize() {
+		return "", ErrMalformed
+	}
+	n := b.aead.NonceSize()
+	opened, err := b.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	return string(opened), nil
+}
+
+// IsSealed tells whether a value was sealed by a Box
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Redact returns a copy of vars with sealed values masked
+func Redact(vars map[string]string) map[string]string {
+	if vars == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(vars))
+	for k, v := range vars {
+		if IsSealed(v) {
+			v = Mask
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// LoadKey reads the key set with --secret-key, or else from the file set with
+// --secret-key-file. Both hold the key encoded in base64. It returns nil when
+// neither is set.
+func LoadKey(c cfg.Type) ([]byte, error) {
+	encoded := c.SecretKey
+	if encoded == "" && c.SecretKeyFile != "" {
+		b, err := ioutil.ReadFile(c.SecretKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("broadway/secret: the secret key isn't valid base64: %s", err)
+	}
+	return key, nil
+}
+
+// box is the Box configured by Setup, nil without a key
+var box *Box
+
+// Setup configures the key used by Seal and Open
+func Setup(c cfg.Type) error {
+	key, err := LoadKey(c)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		box = nil
+		return nil
+	}
+	b, err := NewBox(key)
+	if err != nil {
+		return err
+	}
+	box = b
+	return nil
+}
+
+// Seal encrypts a value with the configured key. Empty values are left
+// empty.
+func Seal(value string) (string, error) {
+	if value == "" || IsSealed(value) {
+		return value, nil
+	}
+	if box == nil {
+		return "", ErrNoKey
+	}
+	return box.Seal(value)
+}
+
+// Open decrypts a sealed value with the configured key. Other values are
+// returned as they are.
+func Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	if box == nil {
+		return "", ErrNoKey
+	}
+	return box.Open(value)
+}
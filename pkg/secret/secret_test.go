@@ -0,0 +1,93 @@
+package secret
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/namely/broadway/pkg/cfg"
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestBox(t *testing.T) {
+	b, err := NewBox(testKey)
+	assert.Nil(t, err)
+
+	sealed, err := b.Seal("hunter2")
+	assert.Nil(t, err)
+	assert.True(t, IsSealed(sealed))
+	assert.False(t, strings.Contains(sealed, "hunter2"))
+	again, err := b.Seal("hunter2")
+	assert.Nil(t, err)
+	assert.NotEqual(t, sealed, again, "every seal should use a new nonce")
+	resealed, err := b.Seal(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, sealed, resealed, "a sealed value shouldn't be sealed twice")
+
+	opened, err := b.Open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", opened)
+	opened, err = b.Open("plain")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", opened)
+
+	empty, err := b.Seal("")
+	assert.Nil(t, err)
+	assert.Equal(t, "", empty)
+
+	other, err := NewBox([]byte("fedcba9876543210"))
+	assert.Nil(t, err)
+	_, err = other.Open(sealed)
+	assert.Equal(t, ErrMalformed, err)
+	_, err = b.Open(prefix + "not base64")
+	assert.Equal(t, ErrMalformed, err)
+
+	_, err = NewBox([]byte("short"))
+	assert.NotNil(t, err)
+}
+
+func TestRedact(t *testing.T) {
+	b, err := NewBox(testKey)
+	assert.Nil(t, err)
+	sealed, err := b.Seal("hunter2")
+	assert.Nil(t, err)
+
+	vars := map[string]string{"password": sealed, "version": "v1"}
+	assert.Equal(t, map[string]string{"password": Mask, "version": "v1"}, Redact(vars))
+	assert.Equal(t, sealed, vars["password"], "the vars should be left alone")
+	assert.Nil(t, Redact(nil))
+}
+
+func TestSetup(t *testing.T) {
+	defer Setup(cfg.Type{})
+	encoded := base64.StdEncoding.EncodeToString(testKey)
+
+	assert.Nil(t, Setup(cfg.Type{}))
+	_, err := Seal("hunter2")
+	assert.Equal(t, ErrNoKey, err)
+	v, err := Open("plain")
+	assert.Nil(t, err, "values that aren't sealed don't need a key")
+	assert.Equal(t, "plain", v)
+
+	f, err := ioutil.TempFile("", "broadway-key")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(encoded + "\n")
+	assert.Nil(t, err)
+	f.Close()
+	assert.Nil(t, Setup(cfg.Type{SecretKeyFile: f.Name()}))
+	sealed, err := Seal("hunter2")
+	assert.Nil(t, err)
+
+	assert.Nil(t, Setup(cfg.Type{SecretKey: encoded}))
+	opened, err := Open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", opened, "the key from the env should match the key file")
+
+	assert.NotNil(t, Setup(cfg.Type{SecretKey: "not base64!"}))
+	assert.NotNil(t, Setup(cfg.Type{SecretKey: base64.StdEncoding.EncodeToString([]byte("short"))}))
+}
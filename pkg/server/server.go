@@ -1,18 +1,27 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/namely/broadway/pkg/cfg"
 	"github.com/namely/broadway/pkg/deployment"
+	"github.com/namely/broadway/pkg/gitrepo"
 	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/job"
+	"github.com/namely/broadway/pkg/lock"
 	"github.com/namely/broadway/pkg/notification"
 	"github.com/namely/broadway/pkg/services"
 	"github.com/namely/broadway/pkg/store"
-	"github.com/namely/broadway/pkg/store/etcdstore"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
@@ -22,10 +31,20 @@ import (
 type Server struct {
 	store      store.Store
 	slackToken string
+	mu         sync.RWMutex // guards playbooks, manifests and commit, swapped by Reload
 	playbooks  map[string]*deployment.Playbook
 	manifests  map[string]*deployment.Manifest
+	commit     string        // the commit of repo the playbooks were loaded from
+	repo       *gitrepo.Repo // the repository of the playbooks with the git source
+	loading    sync.Mutex    // serializes the loads of the playbooks
 	deployer   deployment.Deployer
+	jobs       *services.JobService
+	leader     *lock.Leader
 	engine     *gin.Engine
+	http       *http.Server
+	ctx        context.Context    // done when the server shuts down
+	stop       context.CancelFunc // shuts the background work down
+	workers    sync.WaitGroup     // the background work
 	Cfg        cfg.Type
 }
 
@@ -41,8 +60,39 @@ var (
 	NotFoundError = ErrorResponse{"error": "Not Found"}
 	// InternalError represents a JSON response for status 500
 	InternalError = ErrorResponse{"error": "Internal Server Error"}
+	// UnavailableError represents a JSON response for status 503
+	UnavailableError = ErrorResponse{"error": "Service Unavailable"}
+	// TimeoutError represents a JSON response for status 504
+	TimeoutError = ErrorResponse{"error": "Gateway Timeout"}
 )
 
+// VarsErrorResponse represents a JSON response for vars rejected by a playbook
+type VarsErrorResponse struct {
+	Error      string                 `json:"error"`
+	Violations []deployment.Violation `json:"violations"`
+}
+
+// abortWithError responds with the status matching err: 400 when vars were
+// rejected by their playbook, 404 when something wasn't found, 409 when an
+// instance is locked by another deployment, 503 when the store is unavailable
+// and 504 when it timed out
+func abortWithError(c *gin.Context, err error) {
+	switch e := err.(type) {
+	case *deployment.VarsError:
+		c.JSON(http.StatusBadRequest, VarsErrorResponse{Error: e.Error(), Violations: e.Violations})
+	case instance.NotFoundError, instance.RevisionNotFoundError, job.NotFoundError:
+		c.JSON(http.StatusNotFound, NotFoundError)
+	case *lock.HeldError:
+		c.JSON(http.StatusConflict, CustomError(err.Error()))
+	case *store.UnavailableError:
+		c.JSON(http.StatusServiceUnavailable, UnavailableError)
+	case *store.TimeoutError:
+		c.JSON(http.StatusGatewayTimeout, TimeoutError)
+	default:
+		c.JSON(http.StatusInternalServerError, InternalError)
+	}
+}
+
 // CustomError creates an ErrorResponse with a custom message
 func CustomError(message string) ErrorResponse {
 	return ErrorResponse{"error": message}
@@ -56,10 +106,36 @@ func New(cfg cfg.Type, s store.Store) *Server {
 		store:      s,
 		slackToken: cfg.SlackToken, // TODO: refactor out
 	}
+	if cfg.PlaybooksSource == "git" {
+		srvr.repo = gitrepo.New(cfg)
+		srvr.Cfg.PlaybooksPath = srvr.repo.PlaybooksPath()
+		srvr.Cfg.ManifestsPath = srvr.repo.ManifestsPath()
+	}
+	srvr.jobs = services.NewJobService(cfg, s, srvr.deployments)
+	srvr.leader = services.NewLeader(cfg, s)
+	srvr.ctx, srvr.stop = context.WithCancel(context.Background())
 	srvr.setupHandlers()
+	srvr.http = &http.Server{Handler: srvr.engine}
 	return srvr
 }
 
+// deployments makes a deployment service with the playbooks and manifests
+// loaded by Init or Reload
+func (s *Server) deployments() *services.DeploymentService {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ds := services.NewDeploymentService(s.Cfg, s.store, s.playbooks, s.manifests)
+	ds.Commit = s.commit
+	return ds
+}
+
+// loadedPlaybooks returns the playbooks loaded by Init or Reload
+func (s *Server) loadedPlaybooks() map[string]*deployment.Playbook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.playbooks
+}
+
 // Init initializes manifests and playbooks for the server.
 func (s *Server) Init() {
 	var err error
@@ -68,19 +144,166 @@ func (s *Server) Init() {
 		glog.Fatal(err)
 	}
 
-	s.playbooks = deployment.AllPlaybooks
+	s.playbooks = deployment.Playbooks()
 	glog.Infof("Server Playbooks: %+v", s.playbooks)
+	if s.repo != nil {
+		if s.commit, err = s.repo.Head(s.ctx); err != nil {
+			glog.Errorf("Failed to read the commit of the playbooks: %s", err)
+		}
+		glog.Infof("Loaded the playbooks of %s at %s", s.repo.URL, s.commit)
+	}
 
+	glog.Info("Recovering the jobs of stopped servers")
+	if err := s.jobs.Recover(s.ctx); err != nil {
+		glog.Errorf("Failed to recover the jobs of stopped servers: %s", err)
+	}
+	glog.Infof("Initialize %d job workers", s.Cfg.JobWorkers)
+	s.work(func(ctx context.Context) { s.jobs.Run(ctx, s.Cfg.JobWorkers) })
+
+	// Only the leader of the Broadway servers sharing the store removes the
+	// expired instances
+	s.work(s.leader.Campaign)
 	glog.Info("Initialize deployed instances cleanup worker")
-	ds := services.NewDeploymentService(s.Cfg, s.store, s.playbooks, s.manifests)
-	go func() {
-		for {
-			time.Sleep(time.Second * time.Duration(s.Cfg.InstanceCleanup))
-			ds.RemoveExpiredInstances(time.Now())
+	s.work(s.removeExpiredInstances)
+	if s.Cfg.ReconcileInterval > 0 {
+		glog.Info("Initialize instances reconciliation worker")
+		s.work(s.reconcileInstances)
+	}
+	if s.repo != nil && s.Cfg.GitPullInterval > 0 {
+		glog.Info("Initialize playbooks pull worker")
+		s.work(s.pullPlaybooks)
+	}
+}
+
+// Reload loads the playbooks and manifests again, from the head of the ref
+// of their repository with the git source. They replace the loaded ones only
+// if every playbook is valid, otherwise the loaded ones are kept and the
+// problems are returned, as deployment.PlaybookErrors when playbooks or
+// manifests are invalid.
+func (s *Server) Reload() error {
+	return s.loadPlaybooks(true)
+}
+
+// loadPlaybooks loads the playbooks and manifests like Reload. Unless force
+// is set, nothing is loaded when their repository didn't change.
+func (s *Server) loadPlaybooks(force bool) error {
+	s.loading.Lock()
+	defer s.loading.Unlock()
+	var commit string
+	var checkout *gitrepo.Checkout
+	playbooksPath, manifestsPath := s.Cfg.PlaybooksPath, s.Cfg.ManifestsPath
+	if s.repo != nil {
+		var err error
+		if checkout, err = s.repo.Fetch(s.ctx); err != nil {
+			return err
+		}
+		commit = checkout.Commit
+		s.mu.RLock()
+		changed := commit != s.commit
+		s.mu.RUnlock()
+		if !force && !changed {
+			return nil
+		}
+		// The commit is loaded from its own checkout, which is only used
+		// once it's valid
+		playbooksPath, manifestsPath = checkout.PlaybooksPath(), checkout.ManifestsPath()
+	}
+	playbooks, err := deployment.LoadPlaybooks(playbooksPath, manifestsPath, s.Cfg.ManifestsExtension)
+	problems, invalid := err.(deployment.PlaybookErrors)
+	if err != nil && !invalid {
+		return err
+	}
+	manifests, err := deployment.LoadManifests(manifestsPath, s.Cfg.ManifestsExtension, playbooks)
+	if e, ok := err.(deployment.PlaybookErrors); ok {
+		problems = append(problems, e...)
+	} else if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	if checkout != nil {
+		if err := s.repo.Use(checkout); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deployment.SetPlaybooks(playbooks)
+	s.playbooks, s.manifests, s.commit = playbooks, manifests, commit
+	glog.Infof("Reloaded %d playbooks and %d manifests", len(playbooks), len(manifests))
+	return nil
+}
+
+// pullPlaybooks pulls the repository of the playbooks every GitPullInterval
+// seconds, and reloads them when it changed, until ctx is done
+func (s *Server) pullPlaybooks(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * time.Duration(s.Cfg.GitPullInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
+		if err := s.loadPlaybooks(false); err != nil {
+			glog.Errorf("Failed to reload the playbooks of %s: %s", s.repo.URL, err)
+		}
+	}
+}
+
+// work runs fn in the background. Shutdown ends its context and waits for it.
+func (s *Server) work(fn func(ctx context.Context)) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn(s.ctx)
 	}()
 }
 
+// reconcileInstances fixes the status of the instances from their cluster
+// every ReconcileInterval seconds while this server leads, until ctx is done
+func (s *Server) reconcileInstances(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * time.Duration(s.Cfg.ReconcileInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.leader.IsLeader() {
+			if err := s.deployments().ReconcileInstances(ctx); err != nil {
+				glog.Errorf("Failed to reconcile the instances: %s", err)
+			}
+		}
+	}
+}
+
+// removeExpiredInstances stops the expired instances every InstanceCleanup
+// seconds while this server leads, until ctx is done
+func (s *Server) removeExpiredInstances(ctx context.Context) {
+	interval := time.Second * time.Duration(s.Cfg.InstanceCleanup)
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.leader.IsLeader() {
+			// The playbooks and manifests may have been reloaded since the
+			// last cleanup
+			s.deployments().RemoveExpiredInstances(ctx, time.Now())
+		}
+	}
+}
+
 func (s *Server) setupHandlers() {
 	s.engine = gin.Default()
 	gin.SetMode(gin.ReleaseMode) // Comment this to use debug mode for more verbose output
@@ -90,12 +313,20 @@ func (s *Server) setupHandlers() {
 	// Protect subsequent routes with middleware:
 	s.engine.Use(s.genAuthMiddleware())
 	s.engine.GET("/", s.home)
+	s.engine.GET("/playbooks/:playbookID", s.getPlaybook)
 	s.engine.POST("/instances", s.createInstance)
 	s.engine.GET("/instance/:playbookID/:instanceID", s.getInstance)
 	s.engine.GET("/instances/:playbookID", s.getInstances)
 	s.engine.GET("/status/:playbookID/:instanceID", s.getStatus)
+	s.engine.GET("/events", s.getEvents)
 	s.engine.POST("/deploy/:playbookID/:instanceID", s.deployInstance)
 	s.engine.DELETE("/instances/:playbookID/:instanceID", s.deleteInstance)
+	s.engine.POST("/instances/:playbookID/:instanceID/reset", s.resetInstance)
+	s.engine.GET("/history/:playbookID/:instanceID", s.getHistory)
+	s.engine.GET("/plan/:playbookID/:instanceID", s.getPlan)
+	s.engine.POST("/rollback/:playbookID/:instanceID/:revision", s.rollbackInstance)
+	s.engine.GET("/jobs/:id", s.getJob)
+	s.engine.POST("/admin/reload", s.reload)
 }
 
 // Handler returns a reference to the Gin engine that powers Server
@@ -103,9 +334,36 @@ func (s *Server) Handler() http.Handler {
 	return s.engine
 }
 
-// Run starts the server on the specified address
-func (s *Server) Run(addr ...string) error {
-	return s.engine.Run(addr...)
+// Run serves requests on the specified address until Shutdown is called
+func (s *Server) Run(addr string) error {
+	s.http.Addr = addr
+	err := s.http.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and the background work, and waits for
+// the requests and the jobs being run to finish, or for ctx to be done. Jobs
+// still running then are requeued by the next server starting.
+func (s *Server) Shutdown(ctx context.Context) error {
+	// Event streams end with the background work, so that they don't hold
+	// the HTTP server up
+	s.stop()
+	err := s.http.Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (s *Server) genAuthMiddleware() func(c *gin.Context) {
@@ -126,6 +384,20 @@ func (s *Server) home(c *gin.Context) {
 	c.String(http.StatusOK, "Welcome to Broadway!")
 }
 
+// getPlaybook answers a playbook as its file declares it, or merged with the
+// playbook it extends and the vars it includes with resolved=true
+func (s *Server) getPlaybook(c *gin.Context) {
+	p, ok := s.loadedPlaybooks()[c.Param("playbookID")]
+	if !ok {
+		c.JSON(http.StatusNotFound, NotFoundError)
+		return
+	}
+	if resolved, _ := strconv.ParseBool(c.Query("resolved")); !resolved {
+		p = p.Declared()
+	}
+	c.JSON(http.StatusOK, p.Redacted())
+}
+
 func (s *Server) createInstance(c *gin.Context) {
 	i := new(instance.Instance)
 	if err := c.BindJSON(i); err != nil {
@@ -134,65 +406,132 @@ func (s *Server) createInstance(c *gin.Context) {
 		return
 	}
 
-	service := services.NewInstanceService(s.Cfg, etcdstore.New())
-	i, err := service.CreateOrUpdate(i)
+	service := services.NewInstanceService(s.Cfg, s.store, s.loadedPlaybooks())
+	i, err := service.CreateOrUpdate(c.Request.Context(), i)
 
 	if err != nil {
 		glog.Error(err)
-		c.JSON(http.StatusInternalServerError, InternalError)
+		abortWithError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, i)
+	c.JSON(http.StatusCreated, services.Redact(s.loadedPlaybooks(), i))
 }
 
 func (s *Server) getInstance(c *gin.Context) {
-	service := services.NewInstanceService(s.Cfg, s.store)
-	i, err := service.Show(c.Param("playbookID"), c.Param("instanceID"))
+	service := services.NewInstanceService(s.Cfg, s.store, s.loadedPlaybooks())
+	i, err := service.Show(c.Request.Context(), c.Param("playbookID"), c.Param("instanceID"))
 
 	if err != nil {
-		switch err.(type) {
-		case instance.NotFoundError:
-			c.JSON(http.StatusNotFound, NotFoundError)
-			return
-		default:
-			c.JSON(http.StatusInternalServerError, InternalError)
-			return
-		}
+		abortWithError(c, err)
+		return
 	}
-	c.JSON(http.StatusOK, i)
+	c.JSON(http.StatusOK, services.Redact(s.loadedPlaybooks(), i))
 }
 
 func (s *Server) getInstances(c *gin.Context) {
-	service := services.NewInstanceService(s.Cfg, s.store)
-	instances, err := service.AllWithPlaybookID(c.Param("playbookID"))
+	q, err := instanceQuery(c.Request.URL.Query())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, InternalError)
+		c.JSON(http.StatusBadRequest, CustomError(err.Error()))
 		return
 	}
+	service := services.NewInstanceService(s.Cfg, s.store, s.loadedPlaybooks())
+	instances, err := service.Find(c.Request.Context(), c.Param("playbookID"), q)
+	if err != nil {
+		glog.Error(err)
+		abortWithError(c, err)
+		return
+	}
+	for n, i := range instances {
+		instances[n] = services.Redact(s.loadedPlaybooks(), i)
+	}
 	c.JSON(http.StatusOK, instances)
 	return
 }
 
+// instanceQuery reads the filters of GET /instances/:playbookID: status (may be
+// repeated, "new" for new instances), created_after, created_before and expired_before as unix times,
+// and var.<name> for var values like var.owner=ann
+func instanceQuery(params url.Values) (instance.Query, error) {
+	q := instance.Query{Vars: map[string]string{}}
+	for _, status := range params["status"] {
+		if status == "new" {
+			status = string(instance.StatusNew)
+		}
+		q.Statuses = append(q.Statuses, instance.Status(status))
+	}
+	times := map[string]*int64{
+		"created_after":  &q.CreatedAfter,
+		"created_before": &q.CreatedBefore,
+		"expired_before": &q.ExpiredBefore,
+	}
+	for name, t := range times {
+		if v := params.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return q, fmt.Errorf("%s must be a unix time", name)
+			}
+			*t = n
+		}
+	}
+	for name := range params {
+		if strings.HasPrefix(name, "var.") {
+			q.Vars[strings.TrimPrefix(name, "var.")] = params.Get(name)
+		}
+	}
+	return q, nil
+}
+
 func (s *Server) getStatus(c *gin.Context) {
-	service := services.NewInstanceService(s.Cfg, s.store)
-	i, err := service.Show(c.Param("playbookID"), c.Param("instanceID"))
+	service := services.NewInstanceService(s.Cfg, s.store, s.loadedPlaybooks())
+	i, err := service.Show(c.Request.Context(), c.Param("playbookID"), c.Param("instanceID"))
 
 	if err != nil {
-		switch err.(type) {
-		case instance.NotFoundError:
-			c.JSON(http.StatusNotFound, NotFoundError)
-			return
-		default:
-			c.JSON(http.StatusInternalServerError, InternalError)
-			return
-		}
+		abortWithError(c, err)
+		return
 	}
 	c.JSON(http.StatusOK, map[string]string{
 		"status": string(i.Status),
 	})
 }
 
+// getEvents streams the changes made to instances as server-sent events named
+// by the type of the change. The playbook_id parameter selects the instances
+// of one playbook.
+func (s *Server) getEvents(c *gin.Context) {
+	// The stream ends when the client leaves or the server shuts down
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	service := services.NewInstanceService(s.Cfg, s.store, s.loadedPlaybooks())
+	events, err := service.Watch(ctx, c.Query("playbook_id"))
+	if err != nil {
+		glog.Error(err)
+		abortWithError(c, err)
+		return
+	}
+
+	// Answer right away, so that clients know they are subscribed
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		e, ok := <-events
+		if ok {
+			c.SSEvent(string(e.Type), services.Redact(s.loadedPlaybooks(), e.Instance))
+		}
+		return ok
+	})
+}
+
 func (s *Server) getCommand(c *gin.Context) {
 	ssl := c.Query("ssl_check")
 	glog.Info(ssl)
@@ -231,12 +570,12 @@ func (s *Server) postCommand(c *gin.Context) {
 		return
 	}
 
-	is := services.NewInstanceService(s.Cfg, s.store)
-	ds := services.NewDeploymentService(s.Cfg, etcdstore.New(), s.playbooks, s.manifests)
+	is := services.NewInstanceService(s.Cfg, s.store, s.loadedPlaybooks())
+	ds := s.deployments()
 
-	slackCommand := services.BuildSlackCommand(s.Cfg, form.Text, ds, is, s.playbooks)
+	slackCommand := services.BuildSlackCommand(s.Cfg, form.Text, form.UserName, ds, is, s.jobs, s.loadedPlaybooks())
 	glog.Infof("Running command: %s", form.Text)
-	msg, err := slackCommand.Execute()
+	msg, err := slackCommand.Execute(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusOK, err)
 		return
@@ -248,61 +587,122 @@ func (s *Server) postCommand(c *gin.Context) {
 	return
 }
 
-func deploy(s *Server, pID string, ID string) (*instance.Instance, error) {
-	is := services.NewInstanceService(s.Cfg, s.store)
-	i, err := is.Show(pID, ID)
-	if err != nil {
-		return nil, err
+// apiAuthor is recorded as the author of revisions deployed through the API
+const apiAuthor = "api"
+
+// enqueue queues a job and answers with it. The job can be followed at the
+// Location of the response.
+func (s *Server) enqueue(c *gin.Context, j *job.Job) {
+	if err := s.jobs.Enqueue(c.Request.Context(), j); err != nil {
+		glog.Error(err)
+		abortWithError(c, err)
+		return
 	}
+	c.Header("Location", "/jobs/"+j.ID)
+	c.JSON(http.StatusAccepted, j)
+}
 
-	ds := services.NewDeploymentService(s.Cfg, s.store, s.playbooks, s.manifests)
+func (s *Server) deployInstance(c *gin.Context) {
+	s.enqueue(c, job.New(job.TypeDeploy, c.Param("playbookID"), c.Param("instanceID"), apiAuthor))
+}
 
-	err = ds.DeployAndNotify(i)
+// ReloadErrorResponse represents a JSON response for a reload that kept the
+// loaded playbooks
+type ReloadErrorResponse struct {
+	Error  string   `json:"error"`
+	Errors []string `json:"errors"`
+}
+
+func (s *Server) reload(c *gin.Context) {
+	if err := s.Reload(); err != nil {
+		glog.Error(err)
+		problems, ok := err.(deployment.PlaybookErrors)
+		if !ok {
+			problems = deployment.PlaybookErrors{err.Error()}
+		}
+		c.JSON(http.StatusUnprocessableEntity, ReloadErrorResponse{Error: "The playbooks were not reloaded", Errors: problems})
+		return
+	}
+	playbooks := s.loadedPlaybooks()
+	ids := make([]string, 0, len(playbooks))
+	for id := range playbooks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	c.JSON(http.StatusOK, map[string][]string{"playbooks": ids})
+}
+
+func (s *Server) getJob(c *gin.Context) {
+	j, err := s.jobs.Show(c.Request.Context(), c.Param("id"))
 	if err != nil {
-		return nil, err
+		abortWithError(c, err)
+		return
 	}
-	return i, nil
+	c.JSON(http.StatusOK, j)
 }
 
-func (s *Server) deployInstance(c *gin.Context) {
-	i, err := deploy(s, c.Param("playbookID"), c.Param("instanceID"))
+func (s *Server) deleteInstance(c *gin.Context) {
+	s.enqueue(c, job.New(job.TypeDelete, c.Param("playbookID"), c.Param("instanceID"), apiAuthor))
+}
+
+func (s *Server) resetInstance(c *gin.Context) {
+	force, _ := strconv.ParseBool(c.Query("force"))
+	i, err := s.deployments().Reset(c.Request.Context(), c.Param("playbookID"), c.Param("instanceID"), force)
 	if err != nil {
 		glog.Error(err)
-		switch err.(type) {
-		case instance.NotFoundError:
-			c.JSON(http.StatusNotFound, NotFoundError)
-			return
-		default:
-			c.JSON(http.StatusInternalServerError, InternalError)
-			return
-		}
+		abortWithError(c, err)
+		return
 	}
-	c.JSON(http.StatusOK, i)
+	c.JSON(http.StatusOK, services.Redact(s.loadedPlaybooks(), i))
 }
 
-func (s *Server) deleteInstance(c *gin.Context) {
-	is := services.NewInstanceService(s.Cfg, s.store)
+func (s *Server) getHistory(c *gin.Context) {
+	is := services.NewInstanceService(s.Cfg, s.store, s.loadedPlaybooks())
+	i, err := is.Show(c.Request.Context(), c.Param("playbookID"), c.Param("instanceID"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-	i, err := is.Show(c.Param("playbookID"), c.Param("instanceID"))
+	ds := s.deployments()
+	revisions, err := ds.History(c.Request.Context(), i.PlaybookID, i.ID)
 	if err != nil {
-		glog.Errorf("Failed to get instance %s/%s:\n%s\n", i.PlaybookID, i.ID, err)
-		c.JSON(http.StatusNotFound, NotFoundError)
+		glog.Error(err)
+		abortWithError(c, err)
 		return
 	}
+	for n, r := range revisions {
+		revisions[n] = services.RedactRevision(s.loadedPlaybooks(), r)
+	}
+	c.JSON(http.StatusOK, revisions)
+}
 
-	ds := services.NewDeploymentService(s.Cfg, s.store, s.playbooks, s.manifests)
+func (s *Server) getPlan(c *gin.Context) {
+	is := services.NewInstanceService(s.Cfg, s.store, s.loadedPlaybooks())
+	i, err := is.Show(c.Request.Context(), c.Param("playbookID"), c.Param("instanceID"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-	if err := ds.StopAndNotify(i); err != nil {
-		glog.Errorf("Failed to delete instance %s/%s:\n%s\n", i.PlaybookID, i.ID, err)
+	ds := s.deployments()
+	changes, err := ds.Plan(i)
+	if err != nil {
+		glog.Error(err)
 		c.JSON(http.StatusInternalServerError, InternalError)
 		return
 	}
+	c.JSON(http.StatusOK, changes)
+}
 
-	if err := is.Delete(i); err != nil {
-		glog.Errorf("Failed to delete instance %s/%s:\n%s\n", i.PlaybookID, i.ID, err)
-		c.JSON(http.StatusInternalServerError, InternalError)
+func (s *Server) rollbackInstance(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("revision"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, CustomError("Revision must be a positive number"))
 		return
 	}
 
-	c.JSON(http.StatusOK, map[string]string{"message": "Instance successfully deleted"})
+	j := job.New(job.TypeRollback, c.Param("playbookID"), c.Param("instanceID"), apiAuthor)
+	j.Revision = number
+	s.enqueue(c, j)
 }
@@ -1,25 +1,39 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/namely/broadway/pkg/cfg"
 	"github.com/namely/broadway/pkg/deployment"
 	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/job"
+	"github.com/namely/broadway/pkg/lock"
 	"github.com/namely/broadway/pkg/services"
+	"github.com/namely/broadway/pkg/store"
 	"github.com/namely/broadway/pkg/store/etcdstore"
 	"github.com/namely/broadway/pkg/testutils"
 
 	"github.com/stretchr/testify/assert"
 )
 
+var ctx = context.Background()
+
 var testToken = "BroadwayTestToken"
 var testCfg = cfg.Type{
 	K8sNamespace:       "broadway",
@@ -107,11 +121,32 @@ func TestCreateInstanceWithInvalidAttributes(t *testing.T) {
 	}
 }
 
+func TestCreateInstanceWithInvalidVars(t *testing.T) {
+	i := map[string]interface{}{
+		"playbook_id": "goodbye",
+		"id":          "TestCreateInstanceWithInvalidVars",
+		"vars": map[string]string{
+			"version": "latest",
+		},
+	}
+	req, w := testutils.PostRequest(t, "/instances", testutils.JSONFromMap(t, i))
+	req = auth(testCfg, req)
+	server := New(testCfg, store.NewMemory())
+	makeRequest(server, req, w)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response VarsErrorResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []deployment.Violation{
+		{Var: "version", Value: "latest", Message: `must match v[0-9]+(\.[0-9]+)*`},
+	}, response.Violations)
+}
+
 func TestGetInstanceWithValidPath(t *testing.T) {
 	st := etcdstore.New()
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestGetInstanceWithValidPath"}
-	service := services.NewInstanceService(testutils.TestCfg, st)
-	_, err := service.CreateOrUpdate(i)
+	service := services.NewInstanceService(testutils.TestCfg, st, deployment.AllPlaybooks)
+	_, err := service.CreateOrUpdate(ctx, i)
 	if err != nil {
 		t.Log(err.Error())
 	}
@@ -127,7 +162,7 @@ func TestGetInstanceWithValidPath(t *testing.T) {
 func TestGetInstanceWithInvalidPath(t *testing.T) {
 	req, w := testutils.GetRequest(t, "/instance/vanished/TestGetInstanceWithInvalidPath")
 	req = auth(testCfg, req)
-	server := New(testCfg, etcdstore.New())
+	server := New(testCfg, store.NewMemory())
 	makeRequest(server, req, w)
 
 	assert.Equal(t, http.StatusNotFound, w.Code)
@@ -136,9 +171,9 @@ func TestGetInstanceWithInvalidPath(t *testing.T) {
 func TestGetInstancesWithFullPlaybook(t *testing.T) {
 	testInstance1 := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestGetInstancesWithFullPlaybook1"}
 	testInstance2 := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestGetInstancesWithFullPlaybook2"}
-	service := services.NewInstanceService(testutils.TestCfg, etcdstore.New())
-	_, err := service.CreateOrUpdate(testInstance1)
-	_, err = service.CreateOrUpdate(testInstance2)
+	service := services.NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
+	_, err := service.CreateOrUpdate(ctx, testInstance1)
+	_, err = service.CreateOrUpdate(ctx, testInstance2)
 	if err != nil {
 		t.Log(err.Error())
 	}
@@ -151,6 +186,31 @@ func TestGetInstancesWithFullPlaybook(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200 OK")
 }
 
+func TestGetInstancesWithQuery(t *testing.T) {
+	mem := store.NewMemory()
+	service := services.NewInstanceService(testCfg, mem, deployment.AllPlaybooks)
+	for _, i := range []*instance.Instance{
+		{PlaybookID: "helloplaybook", ID: "ann", Vars: map[string]string{"word": "ann"}},
+		{PlaybookID: "helloplaybook", ID: "bob", Vars: map[string]string{"word": "bob"}},
+	} {
+		_, err := service.CreateOrUpdate(ctx, i)
+		assert.Nil(t, err)
+	}
+
+	req, w := testutils.GetRequest(t, "/instances/helloplaybook?var.word=ann&status=new")
+	makeRequest(New(testCfg, mem), auth(testCfg, req), w)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var instances []*instance.Instance
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &instances))
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, "ann", instances[0].ID)
+	}
+
+	req, w = testutils.GetRequest(t, "/instances/helloplaybook?created_after=yesterday")
+	makeRequest(New(testCfg, mem), auth(testCfg, req), w)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestGetStatusFailures(t *testing.T) {
 	invalidRequests := []struct {
 		method  string
@@ -169,7 +229,7 @@ func TestGetStatusFailures(t *testing.T) {
 	for _, i := range invalidRequests {
 		req, w := testutils.GetRequest(t, i.path)
 		req = auth(testCfg, req)
-		server := New(testCfg, etcdstore.New())
+		server := New(testCfg, store.NewMemory())
 		makeRequest(server, req, w)
 
 		assert.Equal(t, i.errCode, w.Code)
@@ -182,13 +242,59 @@ func TestGetStatusFailures(t *testing.T) {
 	}
 
 }
+func TestStoreFailures(t *testing.T) {
+	cases := []struct {
+		Scenario string
+		Err      error
+		Code     int
+		Message  string
+	}{
+		{
+			Scenario: "When the store is unavailable",
+			Err:      &store.UnavailableError{Err: errors.New("connection refused")},
+			Code:     http.StatusServiceUnavailable,
+			Message:  "Service Unavailable",
+		},
+		{
+			Scenario: "When the store timed out",
+			Err:      &store.TimeoutError{Err: context.DeadlineExceeded},
+			Code:     http.StatusGatewayTimeout,
+			Message:  "Gateway Timeout",
+		},
+		{
+			Scenario: "When the store failed otherwise",
+			Err:      errors.New("broken"),
+			Code:     http.StatusInternalServerError,
+			Message:  "Internal Server Error",
+		},
+	}
+
+	for _, c := range cases {
+		fs := &store.FakeStore{
+			MockValue: func(path string) (string, error) {
+				return "", c.Err
+			},
+		}
+		for _, path := range []string{"/instance/helloplaybook/foo", "/status/helloplaybook/foo"} {
+			req, w := testutils.GetRequest(t, path)
+			req = auth(testCfg, req)
+			New(testCfg, fs).Handler().ServeHTTP(w, req)
+
+			assert.Equal(t, c.Code, w.Code, c.Scenario+": "+path)
+			var errorResponse map[string]string
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &errorResponse), c.Scenario)
+			assert.Equal(t, c.Message, errorResponse["error"], c.Scenario)
+		}
+	}
+}
+
 func TestGetStatusWithGoodPath(t *testing.T) {
 	testInstance1 := &instance.Instance{
 		PlaybookID: "helloplaybook",
 		ID:         "TestGetStatusWithGoodPath",
 		Status:     instance.StatusDeployed}
-	is := services.NewInstanceService(testutils.TestCfg, etcdstore.New())
-	_, err := is.CreateOrUpdate(testInstance1)
+	is := services.NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
+	_, err := is.CreateOrUpdate(ctx, testInstance1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -208,11 +314,61 @@ func TestGetStatusWithGoodPath(t *testing.T) {
 
 func helperSetupServer(cfg cfg.Type) (*httptest.ResponseRecorder, *Server, http.Handler) {
 	w := httptest.NewRecorder()
-	mem := etcdstore.New()
+	mem := store.NewMemory()
 	s := New(cfg, mem)
 	return w, s, s.Handler()
 }
 
+func TestGetEvents(t *testing.T) {
+	mem := store.NewMemory()
+	ts := httptest.NewServer(New(testCfg, mem).Handler())
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/events?playbook_id=helloplaybook", nil)
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(auth(testCfg, req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	service := services.NewInstanceService(testCfg, mem, deployment.AllPlaybooks)
+	_, err = service.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "helloplaybook", ID: "TestGetEvents"})
+	assert.Nil(t, err)
+
+	body := bufio.NewReader(resp.Body)
+	event, err := body.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "event:created\n", event)
+	data, err := body.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Contains(t, data, `"id":"TestGetEvents"`)
+}
+
+func TestShutdown(t *testing.T) {
+	s := New(testCfg, store.NewMemory())
+	s.Init()
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/events", nil)
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(auth(testCfg, req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	shutdown, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	assert.Nil(t, s.Shutdown(shutdown), "the background work should stop")
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "event streams should end")
+	assert.False(t, s.leader.IsLeader(), "the leader lock should be released")
+}
+
 func TestGetCommand400(t *testing.T) {
 	w, _, e := helperSetupServer(testCfg)
 	req, err := http.NewRequest("GET", "/command", nil)
@@ -278,8 +434,8 @@ func TestSlackCommandSetvar(t *testing.T) {
 	req.PostForm = form
 
 	i := &instance.Instance{PlaybookID: "boing", ID: "bar", Vars: map[string]string{"var1": "val2"}}
-	is := services.NewInstanceService(testutils.TestCfg, etcdstore.New())
-	_, err := is.CreateOrUpdate(i)
+	is := services.NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
+	_, err := is.CreateOrUpdate(ctx, i)
 	if err != nil {
 		t.Log(err)
 	}
@@ -298,8 +454,8 @@ func TestSlackCommandDelete(t *testing.T) {
 	req.PostForm = form
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "forserver"}
-	is := services.NewInstanceService(testCfg, etcdstore.New())
-	_, err := is.CreateOrUpdate(i)
+	is := services.NewInstanceService(testCfg, etcdstore.New(), deployment.AllPlaybooks)
+	_, err := is.CreateOrUpdate(ctx, i)
 	if err != nil {
 		t.Log(err)
 	}
@@ -337,14 +493,74 @@ func TestDeployMissing(t *testing.T) {
 	assert.Contains(t, errorResponse["error"], "Not Found")
 }
 
+func TestDeployQueuesJob(t *testing.T) {
+	w, s, e := helperSetupServer(testCfg)
+	service := services.NewInstanceService(testCfg, s.store, deployment.AllPlaybooks)
+	_, err := service.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "helloplaybook", ID: "TestDeployQueuesJob"})
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", "/deploy/helloplaybook/TestDeployQueuesJob", nil)
+	assert.Nil(t, err)
+	e.ServeHTTP(w, auth(testCfg, req))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var queued job.Job
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &queued))
+	assert.NotEmpty(t, queued.ID)
+	assert.Equal(t, job.TypeDeploy, queued.Type)
+	assert.Equal(t, "/jobs/"+queued.ID, w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/jobs/"+queued.ID, nil)
+	assert.Nil(t, err)
+	e.ServeHTTP(w, auth(testCfg, req))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var found job.Job
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &found))
+	assert.Equal(t, job.StateQueued, found.State, "no workers run before Init")
+	assert.Equal(t, "TestDeployQueuesJob", found.InstanceID)
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/jobs/missing", nil)
+	assert.Nil(t, err)
+	e.ServeHTTP(w, auth(testCfg, req))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPlanMissing(t *testing.T) {
+	req, err := http.NewRequest("GET", "/plan/missingPlaybook/missingInstance", nil)
+	assert.Nil(t, err)
+	req = auth(testCfg, req)
+	w, _, e := helperSetupServer(testCfg)
+	e.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRollbackBadRevision(t *testing.T) {
+	req, err := http.NewRequest("POST", "/rollback/helloplaybook/forserver/latest", nil)
+	assert.Nil(t, err)
+	req = auth(testCfg, req)
+	w, _, e := helperSetupServer(testCfg)
+	e.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHistoryMissing(t *testing.T) {
+	req, err := http.NewRequest("GET", "/history/missingPlaybook/missingInstance", nil)
+	assert.Nil(t, err)
+	req = auth(testCfg, req)
+	w, _, e := helperSetupServer(testCfg)
+	e.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
 func TestDeleteExisting(t *testing.T) {
 	ets := etcdstore.New()
 	testInstance1 := &instance.Instance{
 		PlaybookID: "helloplaybook",
 		ID:         "TestDeleteInstance",
 		Status:     instance.StatusDeployed}
-	is := services.NewInstanceService(testutils.TestCfg, ets)
-	_, err := is.CreateOrUpdate(testInstance1)
+	is := services.NewInstanceService(testutils.TestCfg, ets, deployment.AllPlaybooks)
+	_, err := is.CreateOrUpdate(ctx, testInstance1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -360,8 +576,8 @@ func TestDeleteExisting(t *testing.T) {
 	e := s.Handler()
 	e.ServeHTTP(w, req)
 
-	assert.Equal(t, http.StatusOK, w.Code, "Expected DELETE /instances to return 200")
-	assert.Contains(t, w.Body.String(), "Instance successfully deleted")
+	assert.Equal(t, http.StatusAccepted, w.Code, "Expected DELETE /instances to return 202")
+	assert.Contains(t, w.Body.String(), `"type":"delete"`)
 }
 
 func TestDeleteWhenNonExistantInstance(t *testing.T) {
@@ -373,3 +589,202 @@ func TestDeleteWhenNonExistantInstance(t *testing.T) {
 
 	assert.Equal(t, http.StatusNotFound, w.Code, "Expected DELETE /instances to return 404 when missing instance")
 }
+
+func TestDeleteQueuesJob(t *testing.T) {
+	w, s, e := helperSetupServer(testCfg)
+	service := services.NewInstanceService(testCfg, s.store, deployment.AllPlaybooks)
+	_, err := service.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "helloplaybook", ID: "TestDeleteQueuesJob"})
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("DELETE", "/instances/helloplaybook/TestDeleteQueuesJob", nil)
+	assert.Nil(t, err)
+	e.ServeHTTP(w, auth(testCfg, req))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var queued job.Job
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &queued))
+	assert.Equal(t, job.TypeDelete, queued.Type)
+	assert.Equal(t, "/jobs/"+queued.ID, w.Header().Get("Location"))
+
+	_, err = service.Show(ctx, "helloplaybook", "TestDeleteQueuesJob")
+	assert.Nil(t, err, "the instance should be deleted by the job, not the request")
+}
+
+func TestGetPlaybook(t *testing.T) {
+	w, s, e := helperSetupServer(testCfg)
+	s.playbooks = deployment.AllPlaybooks
+
+	get := func(path string) (int, map[string]interface{}) {
+		w = httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		assert.Nil(t, err)
+		e.ServeHTTP(w, auth(testCfg, req))
+		var p map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &p)
+		return w.Code, p
+	}
+	code, p := get("/playbooks/goodbye")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "hello", p["extends"])
+	assert.Nil(t, p["manifests"], "the declared playbook inherits its manifests")
+
+	code, p = get("/playbooks/goodbye?resolved=true")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"hello"}, p["manifests"])
+	assert.Equal(t, map[string]interface{}{"team": "goodbye team"}, p["meta"])
+
+	code, _ = get("/playbooks/missing")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestReload(t *testing.T) {
+	defer deployment.SetPlaybooks(deployment.Playbooks())
+	dir, err := ioutil.TempDir("", "broadway-playbooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name, contents string) {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+	write("web.yml", "{id: web, name: Web, manifests: [hello]}")
+	manifests, err := ioutil.TempDir("", "broadway-manifests")
+	assert.Nil(t, err)
+	defer os.RemoveAll(manifests)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(manifests, "hello.yml"), []byte("kind: Pod"), 0644))
+
+	cfg := testCfg
+	cfg.PlaybooksPath = dir
+	cfg.ManifestsPath = manifests
+	w, s, e := helperSetupServer(cfg)
+	reload := func() int {
+		w = httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/admin/reload", nil)
+		assert.Nil(t, err)
+		e.ServeHTTP(w, auth(cfg, req))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, reload())
+	assert.JSONEq(t, `{"playbooks": ["web"]}`, w.Body.String())
+	assert.Contains(t, s.loadedPlaybooks(), "web")
+	assert.Contains(t, deployment.Playbooks(), "web", "the services should see the reloaded playbooks")
+
+	write("api.yml", "{id: api, name: API, manifests: [hello]}")
+	write("worker.yml", "{id: worker, name: Worker, manifests: [missing]}")
+	assert.Equal(t, http.StatusUnprocessableEntity, reload())
+	var response ReloadErrorResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	if assert.Len(t, response.Errors, 1) {
+		assert.Contains(t, response.Errors[0], "worker.yml")
+	}
+	assert.NotContains(t, s.loadedPlaybooks(), "api", "the playbooks should be kept when one is invalid")
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, "worker.yml")))
+	assert.Equal(t, http.StatusOK, reload())
+	assert.Contains(t, s.loadedPlaybooks(), "api")
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(manifests, "hello.yml"), []byte("kind: {{ .kind "), 0644))
+	write("worker.yml", "{id: worker, name: Worker, manifests: [hello]}")
+	assert.Equal(t, http.StatusUnprocessableEntity, reload())
+	response = ReloadErrorResponse{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	if assert.Len(t, response.Errors, 1) {
+		assert.Contains(t, response.Errors[0], "hello.yml invalid")
+	}
+	assert.NotContains(t, s.loadedPlaybooks(), "worker", "the playbooks should be kept when a manifest is invalid")
+}
+
+func TestReloadFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	defer deployment.SetPlaybooks(deployment.Playbooks())
+	origin, err := ioutil.TempDir("", "broadway-origin")
+	assert.Nil(t, err)
+	defer os.RemoveAll(origin)
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = origin
+		out, err := cmd.CombinedOutput()
+		assert.Nil(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(name, contents string) string {
+		path := filepath.Join(origin, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+		git("add", "-A")
+		git("commit", "--quiet", "-m", "update "+name)
+		return git("rev-parse", "HEAD")
+	}
+	git("init", "--quiet")
+	git("config", "user.email", "broadway@example.com")
+	git("config", "user.name", "Broadway")
+	git("checkout", "--quiet", "-b", "master")
+	commit("manifests/hello.yml", "kind: Pod")
+	first := commit("playbooks/web.yml", "{id: web, name: Web, manifests: [hello]}")
+
+	checkout, err := ioutil.TempDir("", "broadway-playbooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(checkout)
+	cfg := testCfg
+	cfg.PlaybooksSource = "git"
+	cfg.GitRepo = "file://" + origin
+	cfg.GitDir = checkout
+	_, s, _ := helperSetupServer(cfg)
+	assert.Equal(t, filepath.Join(checkout, "current", "playbooks"), s.Cfg.PlaybooksPath)
+
+	assert.Nil(t, s.Reload())
+	assert.Contains(t, s.loadedPlaybooks(), "web")
+	assert.Equal(t, first, s.deployments().Commit, "deployments should record the loaded commit")
+
+	commit("playbooks/api.yml", "{id: api, name: API, manifests: [missing]}")
+	assert.NotNil(t, s.loadPlaybooks(false))
+	assert.Equal(t, first, s.deployments().Commit, "an invalid commit shouldn't be loaded")
+	_, err = os.Stat(filepath.Join(s.Cfg.PlaybooksPath, "api.yml"))
+	assert.True(t, os.IsNotExist(err), "an invalid commit shouldn't replace the playbooks folder")
+
+	second := commit("playbooks/api.yml", "{id: api, name: API, manifests: [hello]}")
+	assert.Nil(t, s.loadPlaybooks(false))
+	assert.Contains(t, s.loadedPlaybooks(), "api")
+	assert.Equal(t, second, s.deployments().Commit)
+	// A commit adding a manifest along with the playbook using it is
+	// validated against its own manifests
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(origin, "manifests", "brandnew.yml"), []byte("kind: Pod"), 0644))
+	third := commit("playbooks/worker.yml", "{id: worker, name: Worker, manifests: [brandnew]}")
+	assert.Nil(t, s.loadPlaybooks(false))
+	assert.Contains(t, s.loadedPlaybooks(), "worker")
+	assert.Contains(t, s.manifests, "brandnew")
+	assert.Equal(t, third, s.deployments().Commit)
+}
+
+func TestResetInstance(t *testing.T) {
+	w, s, e := helperSetupServer(testCfg)
+	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestResetInstance", Status: instance.StatusDeploying}
+	i.Path = instance.Path{RootPath: testCfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
+	assert.Nil(t, instance.Save(ctx, s.store, i))
+
+	req, err := http.NewRequest("POST", "/instances/helloplaybook/TestResetInstance/reset", nil)
+	assert.Nil(t, err)
+	e.ServeHTTP(w, auth(testCfg, req))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reset instance.Instance
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &reset))
+	assert.Equal(t, instance.StatusError, reset.Status, "the status should be cleared without a cluster")
+
+	l := lock.New(s.store, testCfg.EtcdPath+"/locks/helloplaybook/TestResetInstance", "other", time.Minute)
+	assert.Nil(t, l.Acquire(ctx))
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", "/instances/helloplaybook/TestResetInstance/reset", nil)
+	assert.Nil(t, err)
+	e.ServeHTTP(w, auth(testCfg, req))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", "/instances/helloplaybook/TestResetInstance/reset?force=true", nil)
+	assert.Nil(t, err)
+	e.ServeHTTP(w, auth(testCfg, req))
+	assert.Equal(t, http.StatusOK, w.Code, "a forced reset should break the lock")
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", "/instances/helloplaybook/missing/reset", nil)
+	assert.Nil(t, err)
+	e.ServeHTTP(w, auth(testCfg, req))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
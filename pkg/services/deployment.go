@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"text/template"
@@ -11,6 +12,7 @@ import (
 	"github.com/namely/broadway/pkg/cfg"
 	"github.com/namely/broadway/pkg/deployment"
 	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/lock"
 	"github.com/namely/broadway/pkg/notification"
 	"github.com/namely/broadway/pkg/store"
 )
@@ -21,24 +23,82 @@ type DeploymentService struct {
 	store     store.Store
 	playbooks map[string]*deployment.Playbook
 	manifests map[string]*deployment.Manifest
+	Progress  deployment.ProgressFunc // also receives the progress of deployments when set
+	Commit    string                  // the git commit the playbooks were loaded from, recorded on revisions
+	plan      func(i *instance.Instance) ([]deployment.Change, error)
 }
 
 // NewDeploymentService creates a new DeploymentService
 func NewDeploymentService(cfg cfg.Type, s store.Store, ps map[string]*deployment.Playbook, ms map[string]*deployment.Manifest) *DeploymentService {
-	return &DeploymentService{
+	d := &DeploymentService{
 		Cfg:       cfg,
 		store:     s,
 		playbooks: ps,
 		manifests: ms,
 	}
+	d.plan = d.Plan
+	return d
 }
 
-func varMap(i *instance.Instance) map[string]string {
-	vs := map[string]string{}
-	for k, v := range i.Vars {
-		vs[k] = v
+// ClusterNotFound indicates a playbook names a cluster missing from the
+// clusters file
+type ClusterNotFound struct {
+	name string
+}
+
+func (e *ClusterNotFound) Error() string {
+	return fmt.Sprintf("Cluster %s is not configured", e.name)
+}
+
+// cluster connects to the Kubernetes cluster the playbook deploys i to. The
+// cluster configured by the Kubernetes flags is used unless the playbook
+// names one of the clusters file. The name is rendered with the vars the
+// manifests see, so a secret var routes the same way it renders.
+func (d *DeploymentService) cluster(p *deployment.Playbook, i *instance.Instance) (*deployment.Cluster, error) {
+	vars, err := manifestVars(p, i)
+	if err != nil {
+		return nil, err
+	}
+	name, err := p.ClusterName(vars)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		config, err := deployment.Config(d.Cfg)
+		if err != nil {
+			return nil, err
+		}
+		return deployment.NewCluster(config, d.Cfg.K8sNamespace)
 	}
 
+	c, ok := deployment.AllClusters[name]
+	if !ok {
+		return nil, &ClusterNotFound{name}
+	}
+	return c.Connect(d.Cfg.K8sNamespace)
+}
+
+// varMap returns the vars of an instance of a playbook for templates shown to
+// users, with the values of secret vars masked
+func varMap(pb *deployment.Playbook, i *instance.Instance) map[string]string {
+	return withInstanceVars(i, redactVars(pb, i.Vars))
+}
+
+// manifestVars returns the vars rendering the manifests of an instance of a
+// playbook. It's the only place the values of secret vars are decrypted.
+func manifestVars(pb *deployment.Playbook, i *instance.Instance) (map[string]string, error) {
+	vs, err := openVars(pb, i.Vars)
+	if err != nil {
+		return nil, err
+	}
+	return withInstanceVars(i, vs), nil
+}
+
+// withInstanceVars adds the vars describing an instance to its own vars
+func withInstanceVars(i *instance.Instance, vs map[string]string) map[string]string {
+	if vs == nil {
+		vs = map[string]string{}
+	}
 	vs["playbook_id"] = i.PlaybookID
 	vs["instance_id"] = i.ID
 	vs["id"] = i.ID
@@ -47,53 +107,147 @@ func varMap(i *instance.Instance) map[string]string {
 	return vs
 }
 
+// lockTTL is how long the locks of a Broadway server outlive it
+func lockTTL(cfg cfg.Type) time.Duration {
+	if cfg.LockTTL > 0 {
+		return time.Duration(cfg.LockTTL) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// NewLeader returns the election of the server running the background work
+// of the Broadway servers sharing s
+func NewLeader(cfg cfg.Type, s store.Store) *lock.Leader {
+	return lock.NewLeader(lock.New(s, cfg.EtcdPath+"/leader", lock.NewOwner(), lockTTL(cfg)))
+}
+
+// instanceLock returns the lock held while an instance is deployed or stopped
+func instanceLock(cfg cfg.Type, s store.Store, i *instance.Instance) *lock.Lock {
+	path := fmt.Sprintf("%s/locks/%s/%s", cfg.EtcdPath, i.PlaybookID, i.ID)
+	return lock.New(s, path, lock.NewOwner(), lockTTL(cfg))
+}
+
+// hold takes the lock of an instance, so that no other deployment or stop of
+// it runs until release is called. The work on the instance runs under the
+// returned context, which ends if the lock is lost. A *lock.HeldError is
+// notified and returned when the instance is locked.
+func (d *DeploymentService) hold(ctx context.Context, i *instance.Instance, action string) (held context.Context, release func(), err error) {
+	held, release, err = instanceLock(d.Cfg, d.store, i).Hold(ctx)
+	if e, ok := err.(*lock.HeldError); ok {
+		notify(d.Cfg, i, fmt.Sprintf("Can't %s %s/%s: Instance is locked by %s.", action, i.PlaybookID, i.ID, e.Owner))
+	}
+	return held, release, err
+}
+
 // DeployAndNotify attempts to deploy an instance. It reports success or failure
-// through the notification service as well as returning an error.
-func (d *DeploymentService) DeployAndNotify(i *instance.Instance) error {
+// through the notification service as well as returning an error. The
+// deployment is recorded as a revision of the instance, triggered by author.
+func (d *DeploymentService) DeployAndNotify(ctx context.Context, i *instance.Instance, author string) error {
+	ctx, release, err := d.hold(ctx, i, "deploy")
+	if err != nil {
+		return err
+	}
+	defer release()
+	return d.deployAndNotify(ctx, i, author, 0)
+}
+
+// Rollback sets the vars of an instance back to those of an earlier revision
+// and deploys it again. The vars are saved along with the deploying status,
+// so a rollback that is refused leaves the instance as it was.
+func (d *DeploymentService) Rollback(ctx context.Context, i *instance.Instance, number int, author string) error {
+	ctx, release, err := d.hold(ctx, i, "roll back")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	path := instance.RevisionPath{
+		HistoryPath: instance.HistoryPath{RootPath: d.Cfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID},
+		Number:      number,
+	}
+	r, err := instance.FindRevision(ctx, d.store, path)
+	if err != nil {
+		return err
+	}
+
+	i.Vars = map[string]string{}
+	for k, v := range r.Vars {
+		i.Vars[k] = v
+	}
+	return d.deployAndNotify(ctx, i, author, number)
+}
+
+func (d *DeploymentService) deployAndNotify(ctx context.Context, i *instance.Instance, author string, rollbackOf int) error {
 	playbook, ok := d.playbooks[i.PlaybookID]
 	if !ok {
 		msg := fmt.Sprintf("Can't deploy %s/%s: Playbook missing", i.PlaybookID, i.ID)
 		notify(d.Cfg, i, msg)
 		return errors.New(msg)
 	}
-
-	config, err := deployment.Config(d.Cfg)
+	vars, err := manifestVars(playbook, i)
+	if err == nil {
+		err = playbook.ValidateVars(vars)
+	}
 	if err != nil {
-		msg := fmt.Sprintf("Can't deploy %s/%s: Internal error", i.PlaybookID, i.ID)
-		notify(d.Cfg, i, msg)
+		notify(d.Cfg, i, fmt.Sprintf("Can't deploy %s/%s: %s", i.PlaybookID, i.ID, err))
 		return err
 	}
 
-	deployer, err := deployment.NewKubernetesDeployment(config, playbook, varMap(i), d.manifests)
+	cluster, err := d.cluster(playbook, i)
 	if err != nil {
 		msg := fmt.Sprintf("Can't deploy %s/%s: Internal error", i.PlaybookID, i.ID)
 		notify(d.Cfg, i, msg)
 		return err
 	}
 
-	if i.Status == instance.StatusDeploying {
-		msg := fmt.Sprintf("Can't deploy %s/%s: Instance is being deployed already.", i.PlaybookID, i.ID)
+	deployer, err := deployment.NewKubernetesDeployment(cluster, playbook, vars, d.manifests)
+	if err != nil {
+		msg := fmt.Sprintf("Can't deploy %s/%s: Internal error", i.PlaybookID, i.ID)
 		notify(d.Cfg, i, msg)
-		return errors.New(msg)
+		return err
 	}
-
-	if i.Status == instance.StatusDeleting {
-		msg := fmt.Sprintf("Can't deploy %s/%s: Instance is being deleted already.", i.PlaybookID, i.ID)
-		notify(d.Cfg, i, msg)
-		return errors.New(msg)
+	deployer.Progress = d.progress(i)
+
+	err = instance.ChangeStatus(ctx, d.store, i, instance.StatusDeploying, func(s instance.Status) error {
+		switch s {
+		case instance.StatusDeploying:
+			return fmt.Errorf("Can't deploy %s/%s: Instance is being deployed already.", i.PlaybookID, i.ID)
+		case instance.StatusDeleting:
+			return fmt.Errorf("Can't deploy %s/%s: Instance is being deleted already.", i.PlaybookID, i.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Errorf("Failed to save instance status Deploying for %s/%s: %s\n", i.PlaybookID, i.ID, err.Error())
+		notify(d.Cfg, i, err.Error())
+		return err
 	}
 
-	i.Status = instance.StatusDeploying
-	err = instance.Save(d.store, i)
+	r, err := instance.NewRevision(ctx, d.store, d.Cfg.EtcdPath, i)
 	if err != nil {
-		glog.Errorf("Failed to save instance status Deploying for %s/%s, continuing deployment. Error: %s\n", i.PlaybookID, i.ID, err.Error())
+		glog.Errorf("Failed to number a revision for %s/%s, continuing deployment. Error: %s\n", i.PlaybookID, i.ID, err.Error())
+		r = &instance.Revision{PlaybookID: i.PlaybookID, InstanceID: i.ID, Vars: i.Vars}
 	}
-
-	errD := deployer.Deploy()
+	r.ManifestsHash = deployer.Digest()
+	r.Commit = d.Commit
+	r.Author = author
+	r.RollbackOf = rollbackOf
+	r.Started = time.Now().Unix()
+	r.Status = instance.StatusDeploying
+	d.saveRevision(ctx, r)
+
+	errD := deployer.Deploy(ctx)
+	// The outcome is saved even if ctx ended while deploying
+	ctx = context.Background()
+	r.Finished = time.Now().Unix()
 	if errD != nil {
+		r.Status = instance.StatusError
+		r.Error = errD.Error()
+		d.saveRevision(ctx, r)
+
 		// Mark the instance as problematic:
 		i.Status = instance.StatusError
-		err := instance.Save(d.store, i)
+		err := instance.Save(ctx, d.store, i)
 		if err != nil {
 			glog.Errorf("Failed to save instance.StatusError for %s/%s; not sending notification:\n%s\n", i.PlaybookID, i.ID, err.Error())
 			return err
@@ -111,14 +265,17 @@ func (d *DeploymentService) DeployAndNotify(i *instance.Instance) error {
 		return errD
 	}
 
+	r.Status = instance.StatusDeployed
+	d.saveRevision(ctx, r)
+
 	// It worked, notify success:
-	err = sendDeploymentNotification(d.Cfg, i)
+	err = sendDeploymentNotification(d.Cfg, playbook, i)
 	if err != nil {
 		glog.Error(err)
 	}
 
 	i.Status = instance.StatusDeployed
-	err = instance.Save(d.store, i)
+	err = instance.Save(ctx, d.store, i)
 	if err != nil {
 		glog.Errorf("DeploymentService failed to save instance status Deployed for %s/%s:\n%s\n", i.PlaybookID, i.ID, err.Error())
 		return err
@@ -127,11 +284,57 @@ func (d *DeploymentService) DeployAndNotify(i *instance.Instance) error {
 	return nil
 }
 
-func sendDeploymentNotification(cfg cfg.Type, i *instance.Instance) error {
-	pb, ok := deployment.AllPlaybooks[i.PlaybookID]
+// Plan lists what deploying an instance would change in the cluster
+func (d *DeploymentService) Plan(i *instance.Instance) ([]deployment.Change, error) {
+	playbook, ok := d.playbooks[i.PlaybookID]
 	if !ok {
-		return fmt.Errorf("Failed to lookup playbook for instance %+v", *i)
+		return nil, &PlaybookNotFound{i.PlaybookID}
+	}
+
+	cluster, err := d.cluster(playbook, i)
+	if err != nil {
+		return nil, err
+	}
+
+	vars, err := manifestVars(playbook, i)
+	if err != nil {
+		return nil, err
+	}
+	deployer, err := deployment.NewKubernetesDeployment(cluster, playbook, vars, d.manifests)
+	if err != nil {
+		return nil, err
+	}
+	return deployer.Plan()
+}
+
+// saveRevision records a revision, logging failures since they shouldn't stop
+// a deployment
+func (d *DeploymentService) saveRevision(ctx context.Context, r *instance.Revision) {
+	if r.Number == 0 {
+		return
 	}
+	if err := instance.SaveRevision(ctx, d.store, d.Cfg.EtcdPath, r); err != nil {
+		glog.Errorf("Failed to save revision %d of %s/%s: %s\n", r.Number, r.PlaybookID, r.InstanceID, err.Error())
+	}
+}
+
+// History returns the revisions of an instance, oldest first
+func (d *DeploymentService) History(ctx context.Context, playbookID, ID string) ([]*instance.Revision, error) {
+	return instance.History(ctx, d.store, instance.HistoryPath{RootPath: d.Cfg.EtcdPath, PlaybookID: playbookID, ID: ID})
+}
+
+// progress logs what a deployment of i is waiting for, and reports it to
+// d.Progress
+func (d *DeploymentService) progress(i *instance.Instance) deployment.ProgressFunc {
+	return func(message string) {
+		glog.Infof("%s/%s: %s", i.PlaybookID, i.ID, message)
+		if d.Progress != nil {
+			d.Progress(message)
+		}
+	}
+}
+
+func sendDeploymentNotification(cfg cfg.Type, pb *deployment.Playbook, i *instance.Instance) error {
 
 	atts := []notification.Attachment{
 		{
@@ -141,7 +344,7 @@ func sendDeploymentNotification(cfg cfg.Type, i *instance.Instance) error {
 	tp, ok := pb.Messages["deployed"]
 	if ok {
 		b := new(bytes.Buffer)
-		err := template.Must(template.New("deployed").Parse(tp)).Execute(b, varMap(i))
+		err := template.Must(template.New("deployed").Parse(tp)).Execute(b, varMap(pb, i))
 		if err != nil {
 			return err
 		}
@@ -160,7 +363,13 @@ func sendDeploymentNotification(cfg cfg.Type, i *instance.Instance) error {
 }
 
 // StopAndNotify deletes resources created by deployment
-func (d *DeploymentService) StopAndNotify(i *instance.Instance) error {
+func (d *DeploymentService) StopAndNotify(ctx context.Context, i *instance.Instance) error {
+	ctx, release, err := d.hold(ctx, i, "stop")
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	playbook, ok := d.playbooks[i.PlaybookID]
 	if !ok {
 		msg := fmt.Sprintf("Can't stop %s/%s: Playbook missing", i.PlaybookID, i.ID)
@@ -168,38 +377,43 @@ func (d *DeploymentService) StopAndNotify(i *instance.Instance) error {
 		return errors.New(msg)
 	}
 
-	if i.Status == instance.StatusDeleting {
-		msg := fmt.Sprintf("Can't stop %s/%s: Instance is being stopped already.", i.PlaybookID, i.ID)
-		notify(d.Cfg, i, msg)
-		return errors.New(msg)
-	}
-
-	config, err := deployment.Config(d.Cfg)
+	cluster, err := d.cluster(playbook, i)
 	if err != nil {
 		msg := fmt.Sprintf("Can't stop %s/%s: Internal error", i.PlaybookID, i.ID)
 		notify(d.Cfg, i, msg)
 		return err
 	}
 
-	i.Status = instance.StatusDeleting
-	err = instance.Save(d.store, i)
+	err = instance.ChangeStatus(ctx, d.store, i, instance.StatusDeleting, func(s instance.Status) error {
+		if s == instance.StatusDeleting {
+			return fmt.Errorf("Can't stop %s/%s: Instance is being stopped already.", i.PlaybookID, i.ID)
+		}
+		return nil
+	})
 	if err != nil {
 		glog.Errorf("Failed to save instance status for %s/%s. Error: %s\n", i.PlaybookID, i.ID, err.Error())
+		notify(d.Cfg, i, err.Error())
 		return err
 	}
 
-	deployer, err := deployment.NewKubernetesDeployment(config, playbook, varMap(i), d.manifests)
+	vars, err := manifestVars(playbook, i)
+	if err != nil {
+		notify(d.Cfg, i, fmt.Sprintf("Can't stop %s/%s: %s", i.PlaybookID, i.ID, err))
+		return err
+	}
+	deployer, err := deployment.NewKubernetesDeployment(cluster, playbook, vars, d.manifests)
 	if err != nil {
 		msg := fmt.Sprintf("Can't stop %s/%s: Internal error", i.PlaybookID, i.ID)
 		notify(d.Cfg, i, msg)
 		return err
 	}
+	deployer.Progress = d.progress(i)
 
-	errD := deployer.Destroy()
+	errD := deployer.Destroy(ctx)
 	if errD != nil {
-		// Mark the instance as problematic:
+		// Mark the instance as problematic, even if ctx ended while stopping:
 		i.Status = instance.StatusError
-		err := instance.Save(d.store, i)
+		err := instance.Save(context.Background(), d.store, i)
 		if err != nil {
 			glog.Errorf("Failed to save instance.StatusError for %s/%s; not sending notification:\n%s\n", i.PlaybookID, i.ID, err.Error())
 			return err
@@ -222,16 +436,19 @@ func (d *DeploymentService) StopAndNotify(i *instance.Instance) error {
 }
 
 // RemoveExpiredInstances remove expired instances from the deployment
-func (d *DeploymentService) RemoveExpiredInstances(expirationDate time.Time) error {
+func (d *DeploymentService) RemoveExpiredInstances(ctx context.Context, expirationDate time.Time) error {
 	glog.Info("Starting expired instances cleanup")
 	globalPath := fmt.Sprintf("%s/instances", d.Cfg.EtcdPath)
-	instances, err := instance.AllDeployedAndExpired(d.store, globalPath, expirationDate)
+	instances, err := instance.AllDeployedAndExpired(ctx, d.store, globalPath, expirationDate)
 	if err != nil {
 		return err
 	}
 	glog.Infof("Removing %d instances from kubernetes", len(instances))
 	for _, i := range instances {
-		if err = d.StopAndNotify(i); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err = d.StopAndNotify(ctx, i); err != nil {
 			glog.Error(err)
 		}
 	}
@@ -10,6 +10,8 @@ import (
 
 	"github.com/namely/broadway/pkg/deployment"
 	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/lock"
+	"github.com/namely/broadway/pkg/store"
 )
 
 func init() {
@@ -25,7 +27,7 @@ func TestRemoveExpiredInstancest(t *testing.T) {
 		panic(err)
 	}
 
-	playbooks, err := deployment.LoadPlaybookFolder(ServicesTestCfg.PlaybooksPath)
+	playbooks, err := deployment.LoadPlaybookFolder(ServicesTestCfg.PlaybooksPath, ServicesTestCfg.ManifestsPath, ServicesTestCfg.ManifestsExtension)
 	if err != nil {
 		panic(err)
 	}
@@ -59,15 +61,15 @@ func TestRemoveExpiredInstancest(t *testing.T) {
 	s := etcdstore.New()
 	for _, c := range cases {
 		c.Instance.ExpiredAt = instance.NewExpiredAt(ServicesTestCfg.InstanceExpirationDays, c.CurrentDate).Unix()
-		err := instance.Save(s, c.Instance)
+		err := instance.Save(ctx, s, c.Instance)
 		assert.Nil(t, err, c.Scenario)
 
-		err = ds.DeployAndNotify(c.Instance)
+		err = ds.DeployAndNotify(ctx, c.Instance, "test")
 		assert.Nil(t, err, c.Scenario)
 
-		err = ds.RemoveExpiredInstances(c.ExpirationDate)
+		err = ds.RemoveExpiredInstances(ctx, c.ExpirationDate)
 
-		ii, err := instance.FindByPath(s, c.Instance.Path)
+		ii, err := instance.FindByPath(ctx, s, c.Instance.Path)
 		assert.Equal(t, c.Error, err, c.Scenario)
 		assert.Equal(t, instance.StatusDeleting, ii.Status, c.Scenario)
 	}
@@ -81,7 +83,7 @@ func TestDeployment(t *testing.T) {
 		panic(err)
 	}
 
-	playbooks, err := deployment.LoadPlaybookFolder(ServicesTestCfg.PlaybooksPath)
+	playbooks, err := deployment.LoadPlaybookFolder(ServicesTestCfg.PlaybooksPath, ServicesTestCfg.ManifestsPath, ServicesTestCfg.ManifestsExtension)
 	if err != nil {
 		panic(err)
 	}
@@ -109,12 +111,50 @@ func TestDeployment(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err = ds.DeployAndNotify(c.Instance)
+		err = ds.DeployAndNotify(ctx, c.Instance, "test")
 		assert.Equal(t, c.Error, err)
 		assert.EqualValues(t, c.Expected, c.Instance.Status)
 	}
 }
 
+func TestDeploymentLocked(t *testing.T) {
+	nt := newNotificationTestHelper()
+	defer nt.Close()
+	mem := store.NewMemory()
+	i := &instance.Instance{PlaybookID: "hello", ID: "TestDeploymentLocked"}
+	l := lock.New(mem, ServicesTestCfg.EtcdPath+"/locks/hello/TestDeploymentLocked", "other", time.Minute)
+	assert.Nil(t, l.Acquire(ctx))
+
+	ds := NewDeploymentService(ServicesTestCfg, mem, nil, nil)
+	held := &lock.HeldError{Path: ServicesTestCfg.EtcdPath + "/locks/hello/TestDeploymentLocked", Owner: "other"}
+	assert.Equal(t, held, ds.DeployAndNotify(ctx, i, "test"))
+	assert.Contains(t, nt.requestBody, "locked by other")
+	assert.Equal(t, held, ds.Rollback(ctx, i, 1, "test"))
+	assert.Equal(t, held, ds.StopAndNotify(ctx, i))
+
+	assert.Nil(t, l.Release(ctx))
+	err := ds.DeployAndNotify(ctx, i, "test")
+	assert.EqualError(t, err, "Can't deploy hello/TestDeploymentLocked: Playbook missing", "a released instance should be deployed")
+}
+
+func TestRollbackRefused(t *testing.T) {
+	nt := newNotificationTestHelper()
+	defer nt.Close()
+	mem := store.NewMemory()
+	i := &instance.Instance{PlaybookID: "hello", ID: "TestRollbackRefused", Status: instance.StatusDeleting, Vars: map[string]string{"version": "v2"}}
+	i.Path = instance.Path{RootPath: ServicesTestCfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
+	assert.Nil(t, instance.Save(ctx, mem, i))
+	r := &instance.Revision{PlaybookID: i.PlaybookID, InstanceID: i.ID, Number: 1, Vars: map[string]string{"version": "v1"}}
+	assert.Nil(t, instance.SaveRevision(ctx, mem, ServicesTestCfg.EtcdPath, r))
+
+	ds := NewDeploymentService(ServicesTestCfg, mem, map[string]*deployment.Playbook{"hello": {ID: "hello"}}, nil)
+	err := ds.Rollback(ctx, i, 1, "test")
+	assert.EqualError(t, err, "Can't deploy hello/TestRollbackRefused: Instance is being deleted already.")
+	stored, err := instance.FindByPath(ctx, mem, i.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"version": "v2"}, stored.Vars, "a refused rollback should keep the vars")
+}
+
 func TestCustomDeploymentNotification(t *testing.T) {
 	nt := newNotificationTestHelper()
 	defer nt.Close()
@@ -123,7 +163,7 @@ func TestCustomDeploymentNotification(t *testing.T) {
 		panic(err)
 	}
 
-	playbooks, err := deployment.LoadPlaybookFolder(ServicesTestCfg.PlaybooksPath)
+	playbooks, err := deployment.LoadPlaybookFolder(ServicesTestCfg.PlaybooksPath, ServicesTestCfg.ManifestsPath, ServicesTestCfg.ManifestsExtension)
 	if err != nil {
 		panic(err)
 	}
@@ -137,8 +177,28 @@ func TestCustomDeploymentNotification(t *testing.T) {
 		},
 	}
 
-	err = service.DeployAndNotify(i)
+	err = service.DeployAndNotify(ctx, i, "test")
 	assert.Equal(t, nil, err)
 	assert.Contains(t, nt.requestBody, "custom deployed")
 	assert.Contains(t, nt.requestBody, "messagesplaybook/test")
 }
+
+func TestClusterRouting(t *testing.T) {
+	defer func(cs map[string]*deployment.ClusterConfig) { deployment.AllClusters = cs }(deployment.AllClusters)
+	deployment.AllClusters = map[string]*deployment.ClusterConfig{
+		"staging": {Name: "staging", Host: "https://staging.example.com"},
+	}
+	ds := NewDeploymentService(ServicesTestCfg, nil, nil, nil)
+	p := &deployment.Playbook{ID: "web", Cluster: "{{.env}}"}
+
+	cluster, err := ds.cluster(p, &instance.Instance{PlaybookID: "web", ID: "1", Vars: map[string]string{"env": "staging"}})
+	assert.Nil(t, err)
+	assert.Equal(t, ServicesTestCfg.K8sNamespace, cluster.Namespace)
+
+	_, err = ds.cluster(p, &instance.Instance{PlaybookID: "web", ID: "2", Vars: map[string]string{"env": "qa"}})
+	assert.EqualError(t, err, "Cluster qa is not configured")
+
+	p.Clusters = []string{"qa"}
+	_, err = ds.cluster(p, &instance.Instance{PlaybookID: "web", ID: "1", Vars: map[string]string{"env": "staging"}})
+	assert.EqualError(t, err, "Playbook web can't deploy to cluster staging", "a cluster the playbook doesn't list should be refused")
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -9,9 +10,17 @@ import (
 	"github.com/namely/broadway/pkg/testutils"
 )
 
+var ctx = context.Background()
+
 // ServicesTestCfg is a config created for services tests that can be safely modified
 var ServicesTestCfg = testutils.TestCfg
 
+// newTestJobService returns a JobService running its jobs with ds. Its
+// workers aren't started.
+func newTestJobService(ds *DeploymentService) *JobService {
+	return NewJobService(ServicesTestCfg, ds.store, func() *DeploymentService { return ds })
+}
+
 type notificationTestHelper struct {
 	requestBody string
 	ts          *httptest.Server
@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"regexp"
 	"text/template"
@@ -12,6 +13,7 @@ import (
 	"github.com/namely/broadway/pkg/deployment"
 	"github.com/namely/broadway/pkg/instance"
 	"github.com/namely/broadway/pkg/notification"
+	"github.com/namely/broadway/pkg/secret"
 	"github.com/namely/broadway/pkg/store"
 )
 
@@ -20,15 +22,18 @@ var validator = regexp.MustCompile(`^[a-zA-Z0-9\-]{1,253}$`)
 
 // InstanceService definition
 type InstanceService struct {
-	Cfg   cfg.Type
-	store store.Store
+	Cfg       cfg.Type
+	store     store.Store
+	playbooks map[string]*deployment.Playbook
 }
 
-// NewInstanceService creates a new instance service
-func NewInstanceService(cfg cfg.Type, s store.Store) *InstanceService {
+// NewInstanceService creates a new instance service for instances of the
+// playbooks ps
+func NewInstanceService(cfg cfg.Type, s store.Store, ps map[string]*deployment.Playbook) *InstanceService {
 	return &InstanceService{
-		Cfg:   cfg,
-		store: s,
+		Cfg:       cfg,
+		store:     s,
+		playbooks: ps,
 	}
 }
 
@@ -78,16 +83,16 @@ func validateID(id string) error {
 }
 
 // CreateOrUpdate a new instance
-func (is *InstanceService) CreateOrUpdate(i *instance.Instance) (*instance.Instance, error) {
+func (is *InstanceService) CreateOrUpdate(ctx context.Context, i *instance.Instance) (*instance.Instance, error) {
 	path := instance.Path{RootPath: is.Cfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
 	i.Path = path
 	if err := validateID(i.ID); err != nil {
 		return nil, err
 	}
 
-	existing, err := instance.FindByPath(is.store, path)
+	existing, err := instance.FindByPath(ctx, is.store, path)
 	if err != nil {
-		if err == instance.ErrMalformedSaveData {
+		if _, ok := err.(instance.NotFoundError); !ok {
 			return nil, err
 		}
 		now := time.Now()
@@ -100,46 +105,50 @@ func (is *InstanceService) CreateOrUpdate(i *instance.Instance) (*instance.Insta
 		i.Status = existing.Status
 	}
 
-	pb, ok := deployment.AllPlaybooks[i.PlaybookID]
+	pb, ok := is.playbooks[i.PlaybookID]
 	if !ok {
 		return nil, &PlaybookNotFound{i.PlaybookID}
 	}
 
-	// Create lookup map for playbok variables
-	vs := make(map[string]bool)
-	for _, v := range pb.Vars {
-		vs[v] = true
-	}
-
 	// Validate vars
 	for k := range i.Vars {
-		if vs[k] != true {
+		if _, ok := pb.Var(k); !ok {
 			return nil, &InvalidVar{i.PlaybookID, k}
 		}
 	}
 
 	vars := make(map[string]string)
 	for _, pv := range pb.Vars {
-		vars[pv] = "" // default to empty string
+		vars[pv.Name] = pv.Default
 		if existing != nil {
-			v, ok := existing.Vars[pv]
+			v, ok := existing.Vars[pv.Name]
 			if ok {
-				vars[pv] = v // use existing value
+				vars[pv.Name] = v // use existing value
 			}
 		}
-		v, ok := i.Vars[pv]
+		v, ok := i.Vars[pv.Name]
+		if ok && pv.Secret && v == secret.Mask {
+			ok = false // the masked value was sent back unchanged
+		}
 		if ok == true {
-			vars[pv] = v
+			vars[pv.Name] = v
 		}
 	}
+	var stored map[string]string
+	if existing != nil {
+		stored = existing.Vars
+	}
+	if err := prepareVars(pb, vars, stored); err != nil {
+		return nil, err
+	}
 	i.Vars = vars
 
-	err = instance.Save(is.store, i)
+	err = instance.Save(ctx, is.store, i)
 	if err != nil {
 		return nil, err
 	}
 
-	err = sendNotification(is.Cfg, existing != nil, i)
+	err = sendNotification(is.Cfg, pb, existing != nil, i)
 	if err != nil {
 		return nil, err
 	}
@@ -147,11 +156,11 @@ func (is *InstanceService) CreateOrUpdate(i *instance.Instance) (*instance.Insta
 }
 
 // Update an instance
-func (is *InstanceService) Update(i *instance.Instance) (*instance.Instance, error) {
+func (is *InstanceService) Update(ctx context.Context, i *instance.Instance) (*instance.Instance, error) {
 	glog.Info("Instance Service: Update")
-	path := instance.Path{is.Cfg.EtcdPath, i.PlaybookID, i.ID}
+	path := instance.Path{RootPath: is.Cfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
 	i.Path = path
-	err := instance.Save(is.store, i)
+	err := instance.Save(ctx, is.store, i)
 	if err != nil {
 		return nil, err
 	}
@@ -160,9 +169,9 @@ func (is *InstanceService) Update(i *instance.Instance) (*instance.Instance, err
 
 // Show takes playbookID and instanceID and returns the matching Instance, if
 // any
-func (is *InstanceService) Show(playbookID, ID string) (*instance.Instance, error) {
-	path := instance.Path{is.Cfg.EtcdPath, playbookID, ID}
-	instance, err := instance.FindByPath(is.store, path)
+func (is *InstanceService) Show(ctx context.Context, playbookID, ID string) (*instance.Instance, error) {
+	path := instance.Path{RootPath: is.Cfg.EtcdPath, PlaybookID: playbookID, ID: ID}
+	instance, err := instance.FindByPath(ctx, is.store, path)
 	if err != nil {
 		return instance, err
 	}
@@ -170,28 +179,39 @@ func (is *InstanceService) Show(playbookID, ID string) (*instance.Instance, erro
 }
 
 // AllWithPlaybookID returns all the instances for an specified playbook id
-func (is *InstanceService) AllWithPlaybookID(playbookID string) ([]*instance.Instance, error) {
-	playbookPath := instance.PlaybookPath{is.Cfg.EtcdPath, playbookID}
-	return instance.FindByPlaybookPath(is.store, playbookPath)
+func (is *InstanceService) AllWithPlaybookID(ctx context.Context, playbookID string) ([]*instance.Instance, error) {
+	playbookPath := instance.PlaybookPath{RootPath: is.Cfg.EtcdPath, PlaybookID: playbookID}
+	return instance.FindByPlaybookPath(ctx, is.store, playbookPath)
+}
+
+// Find returns the instances of a playbook selected by a query
+func (is *InstanceService) Find(ctx context.Context, playbookID string, q instance.Query) ([]*instance.Instance, error) {
+	q.Path = instance.PlaybookPath{RootPath: is.Cfg.EtcdPath, PlaybookID: playbookID}.String()
+	return instance.Find(ctx, is.store, q)
+}
+
+// Watch reports the changes made to the instances of a playbook, or to every
+// instance when playbookID is empty, until ctx is done
+func (is *InstanceService) Watch(ctx context.Context, playbookID string) (<-chan instance.Event, error) {
+	path := is.Cfg.EtcdPath + "/instances"
+	if playbookID != "" {
+		path = instance.PlaybookPath{RootPath: is.Cfg.EtcdPath, PlaybookID: playbookID}.String()
+	}
+	return instance.Watch(ctx, is.store, path)
 }
 
 // Delete removes an instance
-func (is *InstanceService) Delete(i *instance.Instance) error {
-	_, err := is.Show(i.PlaybookID, i.ID)
+func (is *InstanceService) Delete(ctx context.Context, i *instance.Instance) error {
+	_, err := is.Show(ctx, i.PlaybookID, i.ID)
 	if err != nil {
 		return err
 	}
 
-	path := instance.Path{is.Cfg.EtcdPath, i.PlaybookID, i.ID}
-	return instance.Delete(is.store, path)
+	path := instance.Path{RootPath: is.Cfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
+	return instance.Delete(ctx, is.store, path)
 }
 
-func sendNotification(cfg cfg.Type, update bool, i *instance.Instance) error {
-	pb, ok := deployment.AllPlaybooks[i.PlaybookID]
-	if !ok {
-		return fmt.Errorf("Failed to lookup playbook for instance %+v", *i)
-	}
-
+func sendNotification(cfg cfg.Type, pb *deployment.Playbook, update bool, i *instance.Instance) error {
 	s := "created"
 	if update == true {
 		s = "updated"
@@ -208,7 +228,7 @@ func sendNotification(cfg cfg.Type, update bool, i *instance.Instance) error {
 	}
 	if ok {
 		b := new(bytes.Buffer)
-		err := template.Must(template.New("created").Parse(tp)).Execute(b, varMap(i))
+		err := template.Must(template.New("created").Parse(tp)).Execute(b, varMap(pb, i))
 		if err != nil {
 			return err
 		}
@@ -4,22 +4,23 @@ import (
 	"testing"
 	"time"
 
+	"github.com/namely/broadway/pkg/deployment"
 	"github.com/namely/broadway/pkg/instance"
 	"github.com/namely/broadway/pkg/store/etcdstore"
 	"github.com/stretchr/testify/assert"
 )
 
 func cleanup() {
-	etcdstore.New().Delete(ServicesTestCfg.EtcdPath + "/instances")
+	etcdstore.New().Delete(ctx, ServicesTestCfg.EtcdPath+"/instances")
 }
 
 func TestCreateInstanceFromMissingPlaybook(t *testing.T) {
 	nt := newNotificationTestHelper()
 	defer nt.Close()
-	is := NewInstanceService(ServicesTestCfg, etcdstore.New())
+	is := NewInstanceService(ServicesTestCfg, etcdstore.New(), deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "vanishing-pb", ID: "gone"}
-	_, err := is.CreateOrUpdate(i)
+	_, err := is.CreateOrUpdate(ctx, i)
 
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "playbook vanishing-pb is missing")
@@ -28,10 +29,10 @@ func TestCreateInstanceFromMissingPlaybook(t *testing.T) {
 func TestCreateInstanceWithoutExpiredAt(t *testing.T) {
 	nt := newNotificationTestHelper()
 	defer nt.Close()
-	is := NewInstanceService(ServicesTestCfg, etcdstore.New())
+	is := NewInstanceService(ServicesTestCfg, etcdstore.New(), deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestCreateInstancegone"}
-	ii, err := is.CreateOrUpdate(i)
+	ii, err := is.CreateOrUpdate(ctx, i)
 
 	assert.Nil(t, err)
 	assert.NotEmpty(t, ii.ExpiredAt)
@@ -42,10 +43,10 @@ func TestCreateInstanceWithIncorrectVars(t *testing.T) {
 	nt := newNotificationTestHelper()
 	defer nt.Close()
 	store := etcdstore.New()
-	is := NewInstanceService(ServicesTestCfg, store)
+	is := NewInstanceService(ServicesTestCfg, store, deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestCreateInstanceWithIncorrectVars", Vars: map[string]string{"metal": "plutonium"}}
-	ii, err := is.CreateOrUpdate(i)
+	ii, err := is.CreateOrUpdate(ctx, i)
 	assert.Nil(t, ii)
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "does not declare a var named metal")
@@ -57,9 +58,9 @@ func TestCreateInstanceNotification(t *testing.T) {
 	defer nt.Close()
 
 	store := etcdstore.New()
-	is := NewInstanceService(ServicesTestCfg, store)
+	is := NewInstanceService(ServicesTestCfg, store, deployment.AllPlaybooks)
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestCreateInstanceNotification"}
-	_, err := is.CreateOrUpdate(i)
+	_, err := is.CreateOrUpdate(ctx, i)
 	assert.Nil(t, err)
 
 	assert.Contains(t, nt.requestBody, "created")
@@ -73,9 +74,9 @@ func TestCreateInstanceCustomNotification(t *testing.T) {
 	defer nt.Close()
 
 	store := etcdstore.New()
-	is := NewInstanceService(ServicesTestCfg, store)
+	is := NewInstanceService(ServicesTestCfg, store, deployment.AllPlaybooks)
 	i := &instance.Instance{PlaybookID: "messagesplaybook", ID: "TestCreateInstanceCustomNotification"}
-	_, err := is.CreateOrUpdate(i)
+	_, err := is.CreateOrUpdate(ctx, i)
 	assert.Nil(t, err)
 
 	assert.Contains(t, nt.requestBody, "custom created")
@@ -87,10 +88,10 @@ func TestCreateInstanceWithInvalidId(t *testing.T) {
 	nt := newNotificationTestHelper()
 	defer nt.Close()
 	store := etcdstore.New()
-	is := NewInstanceService(ServicesTestCfg, store)
+	is := NewInstanceService(ServicesTestCfg, store, deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "Test*Create_Instance"}
-	ii, err := is.CreateOrUpdate(i)
+	ii, err := is.CreateOrUpdate(ctx, i)
 	assert.Nil(t, ii)
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "Test*Create_Instance")
@@ -102,10 +103,10 @@ func TestCreateInstance(t *testing.T) {
 	nt := newNotificationTestHelper()
 	defer nt.Close()
 	store := etcdstore.New()
-	is := NewInstanceService(ServicesTestCfg, store)
+	is := NewInstanceService(ServicesTestCfg, store, deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestCreateInstance"}
-	ii, err := is.CreateOrUpdate(i)
+	ii, err := is.CreateOrUpdate(ctx, i)
 	assert.Nil(t, err)
 	assert.Equal(t, "helloplaybook", ii.PlaybookID)
 	assert.Equal(t, instance.StatusNew, ii.Status)
@@ -126,14 +127,14 @@ func TestUpdateInstance(t *testing.T) {
 	nt := newNotificationTestHelper()
 	defer nt.Close()
 	store := etcdstore.New()
-	is := NewInstanceService(ServicesTestCfg, store)
+	is := NewInstanceService(ServicesTestCfg, store, deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestUpdateInstance", Status: instance.StatusDeployed}
-	ii, err := is.CreateOrUpdate(i)
+	ii, err := is.CreateOrUpdate(ctx, i)
 	assert.Nil(t, err)
 
 	ii.Vars["word"] = "test"
-	iii, err := is.CreateOrUpdate(ii)
+	iii, err := is.CreateOrUpdate(ctx, ii)
 
 	assert.Nil(t, err)
 	assert.Equal(t, "helloplaybook", iii.PlaybookID)
@@ -148,10 +149,10 @@ func TestShow(t *testing.T) {
 	defer nt.Close()
 
 	store := etcdstore.New()
-	is := NewInstanceService(ServicesTestCfg, store)
+	is := NewInstanceService(ServicesTestCfg, store, deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestShow"}
-	ii, err := is.CreateOrUpdate(i)
+	ii, err := is.CreateOrUpdate(ctx, i)
 	assert.Nil(t, err)
 	assert.Equal(t, "helloplaybook", ii.PlaybookID)
 	assert.Equal(t, "TestShow", ii.ID)
@@ -159,10 +160,10 @@ func TestShow(t *testing.T) {
 
 func TestShowMissingInstance(t *testing.T) {
 	store := etcdstore.New()
-	is := NewInstanceService(ServicesTestCfg, store)
+	is := NewInstanceService(ServicesTestCfg, store, deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "broken"}
-	i, err := is.Show(i.PlaybookID, i.ID)
+	i, err := is.Show(ctx, i.PlaybookID, i.ID)
 	assert.NotNil(t, err)
 	assert.Nil(t, i, "Instance should be nil")
 }
@@ -171,15 +172,15 @@ func TestAllWithPlaybookID(t *testing.T) {
 	cleanup()
 	nt := newNotificationTestHelper()
 	defer nt.Close()
-	is := NewInstanceService(ServicesTestCfg, etcdstore.New())
+	is := NewInstanceService(ServicesTestCfg, etcdstore.New(), deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestAllWithPlaybookID"}
-	_, err := is.CreateOrUpdate(i)
+	_, err := is.CreateOrUpdate(ctx, i)
 	if err != nil {
 		t.Fatal("TestAllWithPlaybookID: ", err)
 	}
 
-	instances, err := is.AllWithPlaybookID(i.PlaybookID)
+	instances, err := is.AllWithPlaybookID(ctx, i.PlaybookID)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, instances)
 	assert.Contains(t, nt.requestBody, "created")
@@ -189,7 +190,7 @@ func TestUpdate(t *testing.T) {
 	cleanup()
 	nt := newNotificationTestHelper()
 	defer nt.Close()
-	instanceService := NewInstanceService(ServicesTestCfg, etcdstore.New())
+	instanceService := NewInstanceService(ServicesTestCfg, etcdstore.New(), deployment.AllPlaybooks)
 	testcases := []struct {
 		Scenario           string
 		Instance           *instance.Instance
@@ -209,14 +210,14 @@ func TestUpdate(t *testing.T) {
 	}
 
 	for _, testcase := range testcases {
-		createdInstance, err := instanceService.CreateOrUpdate(testcase.Instance)
+		createdInstance, err := instanceService.CreateOrUpdate(ctx, testcase.Instance)
 		if err != nil {
 			t.Fatal(testcase.Scenario, err)
 		}
 		createdInstance.PlaybookID = testcase.ExpectedPlaybookID
 		createdInstance.ID = testcase.ExpectedID
 		createdInstance.Vars = testcase.ExpectedVars
-		updatedInstance, err := instanceService.Update(createdInstance)
+		updatedInstance, err := instanceService.Update(ctx, createdInstance)
 
 		assert.Equal(t, testcase.ExpectedPlaybookID, updatedInstance.PlaybookID)
 		assert.Equal(t, testcase.E, err, testcase.Scenario)
@@ -227,24 +228,24 @@ func TestDeleteWhenExistentInstance(t *testing.T) {
 	cleanup()
 	nt := newNotificationTestHelper()
 	defer nt.Close()
-	is := NewInstanceService(ServicesTestCfg, etcdstore.New())
+	is := NewInstanceService(ServicesTestCfg, etcdstore.New(), deployment.AllPlaybooks)
 
 	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "new"}
 
-	createdInstance, err := is.CreateOrUpdate(i)
+	createdInstance, err := is.CreateOrUpdate(ctx, i)
 	if err != nil {
 		t.Log(err)
 	}
-	err = is.Delete(createdInstance)
+	err = is.Delete(ctx, createdInstance)
 	assert.Nil(t, err, "When instance exists")
 }
 
 func TestDeleteWhenNonExistantInstance(t *testing.T) {
 	cleanup()
-	is := NewInstanceService(ServicesTestCfg, etcdstore.New())
+	is := NewInstanceService(ServicesTestCfg, etcdstore.New(), deployment.AllPlaybooks)
 	i := &instance.Instance{PlaybookID: "random", ID: "bar"}
 
-	err := is.Delete(i)
+	err := is.Delete(ctx, i)
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "was not found", "When non-existent instance")
 }
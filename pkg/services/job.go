@@ -0,0 +1,307 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/namely/broadway/pkg/cfg"
+	"github.com/namely/broadway/pkg/deployment"
+	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/job"
+	"github.com/namely/broadway/pkg/lock"
+	"github.com/namely/broadway/pkg/store"
+)
+
+// jobPoll is how often workers look for jobs queued by other Broadway servers
+var jobPoll = 10 * time.Second
+
+// jobExpiry is how often workers delete the jobs finished before the
+// retention time
+var jobExpiry = time.Hour
+
+// jobRetention is how long finished jobs are kept
+func jobRetention(cfg cfg.Type) time.Duration {
+	if cfg.JobRetention > 0 {
+		return time.Duration(cfg.JobRetention) * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// JobService queues deployment jobs in the store and runs them in the
+// background
+type JobService struct {
+	Cfg         cfg.Type
+	store       store.Store
+	deployments func() *DeploymentService // makes the service running a job
+	queued      chan struct{}             // wakes the workers up
+	run         func(ctx context.Context, j *job.Job, progress deployment.ProgressFunc) error
+}
+
+// NewJobService creates a new JobService running jobs with the deployment
+// services made by deployments
+func NewJobService(cfg cfg.Type, s store.Store, deployments func() *DeploymentService) *JobService {
+	js := &JobService{
+		Cfg:         cfg,
+		store:       s,
+		deployments: deployments,
+		queued:      make(chan struct{}, 1),
+	}
+	js.run = js.execute
+	return js
+}
+
+// Enqueue saves a job for an existing instance, to be run by a worker
+func (js *JobService) Enqueue(ctx context.Context, j *job.Job) error {
+	path := instance.Path{RootPath: js.Cfg.EtcdPath, PlaybookID: j.PlaybookID, ID: j.InstanceID}
+	if _, err := instance.FindByPath(ctx, js.store, path); err != nil {
+		return err
+	}
+	if err := job.Save(ctx, js.store, js.Cfg.EtcdPath, j); err != nil {
+		return err
+	}
+	glog.Infof("Queued job %s: %s %s/%s", j.ID, j.Type, j.PlaybookID, j.InstanceID)
+	js.wake()
+	return nil
+}
+
+// Show returns a job
+func (js *JobService) Show(ctx context.Context, ID string) (*job.Job, error) {
+	return job.FindByPath(ctx, js.store, job.Path{RootPath: js.Cfg.EtcdPath, ID: ID})
+}
+
+func (js *JobService) wake() {
+	select {
+	case js.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs the queued jobs, oldest first and at most workers at a time, until
+// ctx is done. It then waits for the running jobs to finish: they aren't
+// canceled with ctx, since a deployment stopped halfway leaves its instance
+// broken. The jobs of a server killed before they finished are requeued by
+// Recover. Finished jobs are deleted once they are older than the retention
+// time, so that the queue doesn't grow with them.
+func (js *JobService) Run(ctx context.Context, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+	var running sync.WaitGroup
+	defer running.Wait()
+	ticker := time.NewTicker(jobPoll)
+	defer ticker.Stop()
+	expiry := time.NewTicker(jobExpiry)
+	defer expiry.Stop()
+	js.expire(ctx)
+	for {
+		js.runQueued(ctx, slots, &running)
+		select {
+		case <-ctx.Done():
+			return
+		case <-js.queued:
+		case <-ticker.C:
+		case <-expiry.C:
+			js.expire(ctx)
+		}
+	}
+}
+
+// expire deletes the jobs finished before the retention time
+func (js *JobService) expire(ctx context.Context) {
+	expired, err := job.Expire(ctx, js.store, js.Cfg.EtcdPath, time.Now().Add(-jobRetention(js.Cfg)))
+	if err != nil {
+		glog.Errorf("Failed to delete the finished jobs: %s", err)
+		return
+	}
+	if expired > 0 {
+		glog.Infof("Deleted %d finished jobs", expired)
+	}
+}
+
+// runQueued claims the queued jobs as slots free up, and runs them
+func (js *JobService) runQueued(ctx context.Context, slots chan struct{}, running *sync.WaitGroup) {
+	jobs, err := job.List(ctx, js.store, js.Cfg.EtcdPath, job.StateQueued)
+	if err != nil {
+		glog.Errorf("Failed to list the queued jobs: %s", err)
+		return
+	}
+	for _, j := range jobs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		if err := job.Claim(ctx, js.store, js.Cfg.EtcdPath, j); err != nil {
+			if err != job.ErrClaimed {
+				glog.Errorf("Failed to claim job %s: %s", j.ID, err)
+			}
+			<-slots
+			continue
+		}
+		running.Add(1)
+		go func(j *job.Job) {
+			defer running.Done()
+			js.runJob(context.Background(), j)
+			<-slots
+			js.wake()
+		}(j)
+	}
+}
+
+// runJob runs a claimed job, saving its progress and its outcome
+func (js *JobService) runJob(ctx context.Context, j *job.Job) {
+	glog.Infof("Running job %s: %s %s/%s", j.ID, j.Type, j.PlaybookID, j.InstanceID)
+	var mu sync.Mutex
+	save := func() {
+		// The job is saved even if ctx ended while it ran
+		if err := job.Save(context.Background(), js.store, js.Cfg.EtcdPath, j); err != nil {
+			glog.Errorf("Failed to save job %s: %s", j.ID, err)
+		}
+	}
+	progress := func(message string) {
+		mu.Lock()
+		defer mu.Unlock()
+		j.Report(message)
+		save()
+	}
+
+	err := js.run(ctx, j, progress)
+
+	mu.Lock()
+	defer mu.Unlock()
+	j.Finished = time.Now().Unix()
+	j.State = job.StateSucceeded
+	if err != nil {
+		glog.Errorf("Job %s failed: %s", j.ID, err)
+		j.State = job.StateFailed
+		j.Error = err.Error()
+	}
+	save()
+}
+
+// recoveryAuthor is recorded as the author of the jobs queued by Recover
+const recoveryAuthor = "recovery"
+
+// Recover requeues the work of the Broadway servers that stopped while
+// running it. Instances left deploying or deleting without a server holding
+// their lock are marked as failed, and their running job is queued again, or
+// a new job is queued for them. Running jobs of other unlocked instances are
+// marked as failed.
+func (js *JobService) Recover(ctx context.Context) error {
+	running, err := job.List(ctx, js.store, js.Cfg.EtcdPath, job.StateRunning)
+	if err != nil {
+		return err
+	}
+	jobs := map[string]*job.Job{} // the running jobs by instance
+	for _, j := range running {
+		jobs[j.PlaybookID+"/"+j.InstanceID] = j
+	}
+
+	stuck, err := instance.Find(ctx, js.store, instance.Query{
+		Path:     js.Cfg.EtcdPath + "/instances",
+		Statuses: []instance.Status{instance.StatusDeploying, instance.StatusDeleting},
+	})
+	if err != nil {
+		return err
+	}
+	for _, i := range stuck {
+		key := i.PlaybookID + "/" + i.ID
+		if err := js.recover(ctx, i, jobs[key]); err != nil {
+			return err
+		}
+		delete(jobs, key)
+	}
+	for _, j := range jobs {
+		// A job that just started may not have locked its instance yet
+		if time.Since(time.Unix(j.Started, 0)) < lockTTL(js.Cfg) {
+			continue
+		}
+		i := &instance.Instance{PlaybookID: j.PlaybookID, ID: j.InstanceID}
+		if err := js.recover(ctx, i, j); err != nil {
+			return err
+		}
+	}
+	js.wake()
+	return nil
+}
+
+// recover requeues the interrupted work on i and its running job j, which
+// may be nil, unless a server holds the lock of i
+func (js *JobService) recover(ctx context.Context, i *instance.Instance, j *job.Job) error {
+	l := instanceLock(js.Cfg, js.store, i)
+	err := l.Acquire(ctx)
+	if _, ok := err.(*lock.HeldError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := l.Release(context.Background()); err != nil {
+			glog.Errorf("Failed to release the lock of %s/%s: %s", i.PlaybookID, i.ID, err)
+		}
+	}()
+
+	if i.Status != instance.StatusDeploying && i.Status != instance.StatusDeleting {
+		glog.Warningf("Job %s was interrupted", j.ID)
+		j.State = job.StateFailed
+		j.Error = "the server running the job stopped"
+		j.Finished = time.Now().Unix()
+		return job.Save(ctx, js.store, js.Cfg.EtcdPath, j)
+	}
+
+	if j == nil {
+		t := job.TypeDeploy
+		if i.Status == instance.StatusDeleting {
+			t = job.TypeStop
+		}
+		j = job.New(t, i.PlaybookID, i.ID, recoveryAuthor)
+	}
+	glog.Warningf("Requeuing job %s: %s %s/%s was interrupted while %s", j.ID, j.Type, i.PlaybookID, i.ID, i.Status)
+	j.State = job.StateQueued
+	j.Started = 0
+	j.Report("Requeued: the server running the job stopped")
+
+	// The instance isn't deploying or deleting anymore, so the job can
+	// change it again
+	i.Status = instance.StatusError
+	if err := instance.Save(ctx, js.store, i); err != nil {
+		return err
+	}
+	return job.Save(ctx, js.store, js.Cfg.EtcdPath, j)
+}
+
+// execute does what a job asks to an instance
+func (js *JobService) execute(ctx context.Context, j *job.Job, progress deployment.ProgressFunc) error {
+	ds := js.deployments()
+	is := NewInstanceService(js.Cfg, js.store, ds.playbooks)
+	i, err := is.Show(ctx, j.PlaybookID, j.InstanceID)
+	if err != nil {
+		return err
+	}
+	ds.Progress = progress
+
+	switch j.Type {
+	case job.TypeDeploy:
+		return ds.DeployAndNotify(ctx, i, j.Author)
+	case job.TypeRollback:
+		return ds.Rollback(ctx, i, j.Revision, j.Author)
+	case job.TypeStop:
+		if err := ds.StopAndNotify(ctx, i); err != nil {
+			return err
+		}
+		i.Status = instance.StatusNew
+		_, err := is.Update(ctx, i)
+		return err
+	case job.TypeDelete:
+		if err := ds.StopAndNotify(ctx, i); err != nil {
+			return err
+		}
+		return is.Delete(ctx, i)
+	}
+	return fmt.Errorf("broadway/services: unknown job type %s", j.Type)
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/namely/broadway/pkg/deployment"
+	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/job"
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitFor polls cond until it holds, for up to 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestJobServiceRun(t *testing.T) {
+	mem := store.NewMemory()
+	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestJobServiceRun"}
+	i.Path = instance.Path{RootPath: ServicesTestCfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
+	assert.Nil(t, instance.Save(ctx, mem, i))
+
+	js := NewJobService(ServicesTestCfg, mem, nil)
+	var mu sync.Mutex
+	running, most := 0, 0
+	count := func(n int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		running += n
+		if running > most {
+			most = running
+		}
+		return running
+	}
+	release := make(chan struct{})
+	js.run = func(ctx context.Context, j *job.Job, progress deployment.ProgressFunc) error {
+		count(1)
+		defer count(-1)
+		progress("Deploying step 1 of 1")
+		<-release
+		if j.Type == job.TypeStop {
+			return errors.New("boom")
+		}
+		return nil
+	}
+
+	err := js.Enqueue(ctx, job.New(job.TypeDeploy, "helloplaybook", "missing", "test"))
+	assert.Equal(t, instance.NotFoundError(ServicesTestCfg.EtcdPath+"/instances/helloplaybook/missing"), err)
+
+	jobs := []*job.Job{
+		job.New(job.TypeDeploy, i.PlaybookID, i.ID, "test"),
+		job.New(job.TypeDeploy, i.PlaybookID, i.ID, "test"),
+		job.New(job.TypeStop, i.PlaybookID, i.ID, "test"),
+	}
+	for _, j := range jobs {
+		assert.Nil(t, js.Enqueue(ctx, j))
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go js.Run(runCtx, 2)
+	waitFor(t, "two running jobs", func() bool { return count(0) == 2 })
+	first, err := js.Show(ctx, jobs[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, job.StateRunning, first.State)
+	assert.Equal(t, []string{"Deploying step 1 of 1"}, first.Progress)
+
+	close(release)
+	for _, j := range jobs {
+		waitFor(t, "job "+j.ID, func() bool {
+			j, err := js.Show(ctx, j.ID)
+			return err == nil && j.Done()
+		})
+	}
+	assert.Equal(t, 2, most, "no more than two jobs should run at once")
+
+	for n, expected := range []job.State{job.StateSucceeded, job.StateSucceeded, job.StateFailed} {
+		j, _ := js.Show(ctx, jobs[n].ID)
+		assert.Equal(t, expected, j.State, string(j.Type))
+		assert.NotZero(t, j.Finished)
+	}
+	stop, _ := js.Show(ctx, jobs[2].ID)
+	assert.Equal(t, "boom", stop.Error)
+}
+
+func TestJobServiceDrain(t *testing.T) {
+	mem := store.NewMemory()
+	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestJobServiceDrain"}
+	i.Path = instance.Path{RootPath: ServicesTestCfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
+	assert.Nil(t, instance.Save(ctx, mem, i))
+
+	js := NewJobService(ServicesTestCfg, mem, nil)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	js.run = func(ctx context.Context, j *job.Job, progress deployment.ProgressFunc) error {
+		close(started)
+		<-release
+		return ctx.Err()
+	}
+	j := job.New(job.TypeDeploy, i.PlaybookID, i.ID, "test")
+	assert.Nil(t, js.Enqueue(ctx, j))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		js.Run(runCtx, 1)
+		close(stopped)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-stopped:
+		t.Fatal("Run should wait for the running jobs")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+
+	j, err := js.Show(ctx, j.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, job.StateSucceeded, j.State, "running jobs shouldn't be canceled")
+}
+
+func TestJobServiceExpire(t *testing.T) {
+	mem := store.NewMemory()
+	js := NewJobService(ServicesTestCfg, mem, nil)
+	old := job.New(job.TypeDeploy, "helloplaybook", "TestJobServiceExpire", "test")
+	old.State, old.Finished = job.StateSucceeded, time.Now().Add(-48*time.Hour).Unix()
+	assert.Nil(t, job.Save(ctx, mem, ServicesTestCfg.EtcdPath, old))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go js.Run(runCtx, 1)
+	waitFor(t, "the old job to be deleted", func() bool {
+		_, err := js.Show(ctx, old.ID)
+		return err == job.NotFoundError(old.ID)
+	})
+}
+
+func TestJobServiceRecover(t *testing.T) {
+	mem := store.NewMemory()
+	js := NewJobService(ServicesTestCfg, mem, nil)
+	save := func(ID string, status instance.Status) *instance.Instance {
+		i := &instance.Instance{PlaybookID: "helloplaybook", ID: ID, Status: status}
+		i.Path = instance.Path{RootPath: ServicesTestCfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
+		assert.Nil(t, instance.Save(ctx, mem, i))
+		return i
+	}
+	running := func(i *instance.Instance, typ job.Type, started time.Time) *job.Job {
+		j := job.New(typ, i.PlaybookID, i.ID, "test")
+		j.State = job.StateRunning
+		j.Started = started.Unix()
+		assert.Nil(t, job.Save(ctx, mem, ServicesTestCfg.EtcdPath, j))
+		return j
+	}
+	long := time.Now().Add(-time.Hour)
+
+	deploying := save("deploying", instance.StatusDeploying)
+	interrupted := running(deploying, job.TypeRollback, long)
+	deleting := save("deleting", instance.StatusDeleting)
+	locked := save("locked", instance.StatusDeploying)
+	lockedJob := running(locked, job.TypeDeploy, long)
+	l := instanceLock(ServicesTestCfg, mem, locked)
+	assert.Nil(t, l.Acquire(ctx))
+	deployed := save("deployed", instance.StatusDeployed)
+	lost := running(deployed, job.TypeDeploy, long)
+	starting := running(save("starting", instance.StatusNew), job.TypeDeploy, time.Now())
+
+	assert.Nil(t, js.Recover(ctx))
+
+	status := func(i *instance.Instance) instance.Status {
+		i, err := instance.FindByPath(ctx, mem, i.Path)
+		assert.Nil(t, err)
+		return i.Status
+	}
+	state := func(j *job.Job) *job.Job {
+		j, err := js.Show(ctx, j.ID)
+		assert.Nil(t, err)
+		return j
+	}
+	assert.Equal(t, instance.StatusError, status(deploying))
+	assert.Equal(t, job.StateQueued, state(interrupted).State, "an interrupted job should be requeued")
+	assert.Equal(t, job.TypeRollback, state(interrupted).Type)
+	assert.Equal(t, instance.StatusError, status(deleting))
+	assert.Equal(t, instance.StatusDeploying, status(locked), "a locked instance is being deployed")
+	assert.Equal(t, job.StateRunning, state(lockedJob).State)
+	assert.Equal(t, job.StateFailed, state(lost).State, "a job whose instance isn't locked was lost")
+	assert.Equal(t, instance.StatusDeployed, status(deployed))
+	assert.Equal(t, job.StateRunning, state(starting).State, "a job may not have locked its instance yet")
+
+	queued, err := job.List(ctx, mem, ServicesTestCfg.EtcdPath, job.StateQueued)
+	assert.Nil(t, err)
+	if assert.Len(t, queued, 2) {
+		stop := queued[0]
+		if stop.ID == interrupted.ID {
+			stop = queued[1]
+		}
+		assert.Equal(t, job.TypeStop, stop.Type, "a deleting instance should be stopped again")
+		assert.Equal(t, "deleting", stop.InstanceID)
+		assert.Equal(t, recoveryAuthor, stop.Author)
+	}
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"github.com/golang/glog"
+	"github.com/namely/broadway/pkg/deployment"
+	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/lock"
+)
+
+// errStatusChanged stops a reconciliation when the status of an instance
+// changed while its objects were read from the cluster
+var errStatusChanged = errors.New("broadway/services: the status of the instance changed")
+
+// reconciledStatus returns the status of an instance according to the
+// changes deploying it would make: deployed when its objects are live, new
+// when none of them exist, and error when some of them are missing. Objects
+// that differ from the manifests are expected once the vars of a deployed
+// instance change, so they don't make it an error.
+func reconciledStatus(stored instance.Status, changes []deployment.Change) instance.Status {
+	if len(changes) == 0 {
+		return stored
+	}
+	created, updated := 0, 0
+	for _, c := range changes {
+		switch c.Action {
+		case deployment.ChangeCreate:
+			created++
+		case deployment.ChangeUpdate:
+			updated++
+		}
+	}
+	switch {
+	case created == len(changes):
+		return instance.StatusNew
+	case created > 0:
+		return instance.StatusError
+	case updated > 0 && stored != instance.StatusDeployed:
+		return instance.StatusError
+	}
+	return instance.StatusDeployed
+}
+
+// Reconcile fixes the status of an instance from its objects in the cluster,
+// unless the instance is being deployed or stopped. It returns the instance
+// with its new status.
+func (d *DeploymentService) Reconcile(ctx context.Context, playbookID, ID string) (*instance.Instance, error) {
+	return d.reconcile(ctx, playbookID, ID, false, false)
+}
+
+// Reset clears the status of an instance left deploying or deleting by a
+// server that stopped. The status is reconciled from the cluster, and set to
+// error when the cluster can't be read. An instance whose lock is held is
+// only reset with force, which breaks the lock: it is meant for locks left by
+// a server that is gone.
+func (d *DeploymentService) Reset(ctx context.Context, playbookID, ID string, force bool) (*instance.Instance, error) {
+	return d.reconcile(ctx, playbookID, ID, true, force)
+}
+
+// reconcile doesn't take the lock of the instance, so that deploys aren't
+// held up while the cluster is read. It skips locked instances, and the
+// status is only changed if no deploy or stop changed the instance meanwhile.
+func (d *DeploymentService) reconcile(ctx context.Context, playbookID, ID string, reset, force bool) (*instance.Instance, error) {
+	l := instanceLock(d.Cfg, d.store, &instance.Instance{PlaybookID: playbookID, ID: ID})
+	if err := l.Check(ctx); err != nil {
+		if _, ok := err.(*lock.HeldError); !ok || !force {
+			return nil, err
+		}
+		glog.Warningf("Breaking the lock of %s/%s: %s", playbookID, ID, err)
+		if err := l.Break(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	i, err := instance.FindByPath(ctx, d.store, instance.Path{RootPath: d.Cfg.EtcdPath, PlaybookID: playbookID, ID: ID})
+	if err != nil {
+		return nil, err
+	}
+	changes, err := d.plan(i)
+	status := reconciledStatus(i.Status, changes)
+	if err != nil {
+		if !reset {
+			return nil, err
+		}
+		glog.Warningf("Resetting %s/%s without reading its cluster: %s", playbookID, ID, err)
+		status = instance.StatusError
+	}
+	if status == i.Status {
+		return i, nil
+	}
+
+	glog.Infof("Reconciling the status of %s/%s from %q to %q", playbookID, ID, i.Status, status)
+	stored := i.Status
+	err = instance.ChangeStatus(ctx, d.store, i, status, func(s instance.Status) error {
+		if s != stored {
+			return errStatusChanged
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// ReconcileInstances reconciles the status of every instance. Instances that
+// can't be reconciled are logged and skipped.
+func (d *DeploymentService) ReconcileInstances(ctx context.Context) error {
+	instances, err := instance.Find(ctx, d.store, instance.Query{Path: d.Cfg.EtcdPath + "/instances"})
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		_, err := d.Reconcile(ctx, i.PlaybookID, i.ID)
+		switch err.(type) {
+		case nil, *lock.HeldError:
+		default:
+			glog.Errorf("Failed to reconcile %s/%s: %s", i.PlaybookID, i.ID, err)
+		}
+	}
+	return nil
+}
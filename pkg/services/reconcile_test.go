@@ -0,0 +1,114 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/namely/broadway/pkg/deployment"
+	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/lock"
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconciledStatus(t *testing.T) {
+	change := func(actions ...deployment.ChangeAction) []deployment.Change {
+		changes := []deployment.Change{}
+		for _, a := range actions {
+			changes = append(changes, deployment.Change{Kind: "Service", Name: "web", Action: a})
+		}
+		return changes
+	}
+	cases := []struct {
+		Scenario string
+		Stored   instance.Status
+		Changes  []deployment.Change
+		Expected instance.Status
+	}{
+		{"live objects", instance.StatusDeploying, change(deployment.ChangeUnchanged, deployment.ChangeUnchanged), instance.StatusDeployed},
+		{"no objects", instance.StatusDeleting, change(deployment.ChangeCreate, deployment.ChangeCreate), instance.StatusNew},
+		{"missing objects", instance.StatusDeployed, change(deployment.ChangeUnchanged, deployment.ChangeCreate), instance.StatusError},
+		{"changed vars", instance.StatusDeployed, change(deployment.ChangeUpdate, deployment.ChangeUnchanged), instance.StatusDeployed},
+		{"interrupted update", instance.StatusDeploying, change(deployment.ChangeUpdate, deployment.ChangeUnchanged), instance.StatusError},
+		{"live objects of a failed deploy", instance.StatusError, change(deployment.ChangeUnchanged), instance.StatusDeployed},
+		{"no manifests", instance.StatusDeploying, change(), instance.StatusDeploying},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.Expected, reconciledStatus(c.Stored, c.Changes), c.Scenario)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	mem := store.NewMemory()
+	save := func(ID string, status instance.Status) {
+		i := &instance.Instance{PlaybookID: "helloplaybook", ID: ID, Status: status}
+		i.Path = instance.Path{RootPath: ServicesTestCfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
+		assert.Nil(t, instance.Save(ctx, mem, i))
+	}
+	save("live", instance.StatusDeploying)
+	save("unreachable", instance.StatusDeleting)
+	save("locked", instance.StatusDeploying)
+	l := instanceLock(ServicesTestCfg, mem, &instance.Instance{PlaybookID: "helloplaybook", ID: "locked"})
+	assert.Nil(t, l.Acquire(ctx))
+
+	ds := NewDeploymentService(ServicesTestCfg, mem, nil, nil)
+	unreachable := errors.New("the cluster is unreachable")
+	ds.plan = func(i *instance.Instance) ([]deployment.Change, error) {
+		if i.ID == "unreachable" {
+			return nil, unreachable
+		}
+		return []deployment.Change{{Kind: "Service", Name: i.ID, Action: deployment.ChangeUnchanged}}, nil
+	}
+	assert.Nil(t, ds.ReconcileInstances(ctx))
+
+	status := func(ID string) instance.Status {
+		i, err := NewInstanceService(ServicesTestCfg, mem, deployment.AllPlaybooks).Show(ctx, "helloplaybook", ID)
+		assert.Nil(t, err)
+		return i.Status
+	}
+	assert.Equal(t, instance.StatusDeployed, status("live"))
+	assert.Equal(t, instance.StatusDeleting, status("unreachable"), "an instance whose cluster can't be read should be left alone")
+	assert.Equal(t, instance.StatusDeploying, status("locked"), "a locked instance is being deployed")
+
+	_, err := ds.Reconcile(ctx, "helloplaybook", "unreachable")
+	assert.Equal(t, unreachable, err)
+	i, err := ds.Reset(ctx, "helloplaybook", "unreachable", false)
+	assert.Nil(t, err)
+	assert.Equal(t, instance.StatusError, i.Status, "a reset should clear the status anyway")
+	assert.Equal(t, instance.StatusError, status("unreachable"))
+
+	_, err = ds.Reset(ctx, "helloplaybook", "locked", false)
+	assert.IsType(t, &lock.HeldError{}, err)
+	_, err = ds.Reset(ctx, "helloplaybook", "missing", false)
+	assert.IsType(t, instance.NotFoundError(""), err)
+
+	i, err = ds.Reset(ctx, "helloplaybook", "locked", true)
+	assert.Nil(t, err)
+	assert.Equal(t, instance.StatusDeployed, i.Status, "a forced reset should clear the status of a locked instance")
+	assert.Equal(t, lock.ErrLost, l.Refresh(ctx), "a forced reset should break the lock")
+}
+
+func TestReconcileDoesntLock(t *testing.T) {
+	mem := store.NewMemory()
+	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "TestReconcileDoesntLock", Status: instance.StatusDeployed}
+	i.Path = instance.Path{RootPath: ServicesTestCfg.EtcdPath, PlaybookID: i.PlaybookID, ID: i.ID}
+	assert.Nil(t, instance.Save(ctx, mem, i))
+
+	ds := NewDeploymentService(ServicesTestCfg, mem, nil, nil)
+	l := instanceLock(ServicesTestCfg, mem, i)
+	ds.plan = func(*instance.Instance) ([]deployment.Change, error) {
+		assert.Nil(t, l.Acquire(ctx), "the instance shouldn't be locked while its cluster is read")
+		// A deploy starts while the cluster is read
+		deploying := *i
+		assert.Nil(t, instance.ChangeStatus(ctx, mem, &deploying, instance.StatusDeploying, func(instance.Status) error { return nil }))
+		return []deployment.Change{
+			{Kind: "Service", Name: "web", Action: deployment.ChangeUnchanged},
+			{Kind: "Pod", Name: "web", Action: deployment.ChangeCreate},
+		}, nil
+	}
+	_, err := ds.Reconcile(ctx, i.PlaybookID, i.ID)
+	assert.Equal(t, errStatusChanged, err, "a deploy started meanwhile should win")
+	found, err := NewInstanceService(ServicesTestCfg, mem, deployment.AllPlaybooks).Show(ctx, i.PlaybookID, i.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, instance.StatusDeploying, found.Status)
+}
@@ -1,7 +1,9 @@
 package services
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -9,41 +11,111 @@ import (
 	"github.com/namely/broadway/pkg/cfg"
 	"github.com/namely/broadway/pkg/deployment"
 	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/job"
 )
 
 // SlackCommand represents a user command that came in from Slack
 type SlackCommand interface {
-	Execute() (string, error)
+	Execute(ctx context.Context) (string, error)
 }
 
 type deployCommand struct {
+	pID  string
+	ID   string
+	user string
+	is   *InstanceService
+	js   *JobService
+	Cfg  cfg.Type
+}
+
+func (c *deployCommand) Execute(ctx context.Context) (string, error) {
+	i, err := c.is.Show(ctx, c.pID, c.ID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to deploy instance %s/%s: Instance not found", c.pID, c.ID)
+		glog.Error(msg)
+		return msg, err
+	}
+
+	if err := c.js.Enqueue(ctx, job.New(job.TypeDeploy, i.PlaybookID, i.ID, c.user)); err != nil {
+		msg := fmt.Sprintf("Failed to deploy instance %s/%s: %s", i.PlaybookID, i.ID, err)
+		glog.Error(msg)
+		return msg, err
+	}
+	return fmt.Sprintf("Started deployment of %s/%s", i.PlaybookID, i.ID), nil
+}
+
+// InvalidRollback represents an error for invalid rollback syntax
+type InvalidRollback struct{}
+
+func (e *InvalidRollback) Error() string {
+	return "Syntax error, example: rollback playbook1 instance10 3"
+}
+
+type rollbackCommand struct {
+	pID      string
+	ID       string
+	revision string
+	user     string
+	is       *InstanceService
+	js       *JobService
+}
+
+func (c *rollbackCommand) Execute(ctx context.Context) (string, error) {
+	number, err := strconv.Atoi(c.revision)
+	if err != nil || number < 1 {
+		return commandHints, &InvalidRollback{}
+	}
+	i, err := c.is.Show(ctx, c.pID, c.ID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to roll back instance %s/%s: Instance not found", c.pID, c.ID)
+		glog.Error(msg)
+		return msg, err
+	}
+
+	j := job.New(job.TypeRollback, i.PlaybookID, i.ID, c.user)
+	j.Revision = number
+	if err := c.js.Enqueue(ctx, j); err != nil {
+		msg := fmt.Sprintf("Failed to roll back instance %s/%s: %s", i.PlaybookID, i.ID, err)
+		glog.Error(msg)
+		return msg, err
+	}
+	return fmt.Sprintf("Started rollback of %s/%s to revision %d", i.PlaybookID, i.ID, number), nil
+}
+
+type planCommand struct {
 	pID string
 	ID  string
 	is  *InstanceService
 	ds  *DeploymentService
-	Cfg cfg.Type
 }
 
-func (c *deployCommand) Execute() (string, error) {
-	i, err := c.is.Show(c.pID, c.ID)
+func (c *planCommand) Execute(ctx context.Context) (string, error) {
+	i, err := c.is.Show(ctx, c.pID, c.ID)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to deploy instance %s/%s: Instance not found", c.pID, c.ID)
+		msg := fmt.Sprintf("Failed to plan instance %s/%s: Instance not found", c.pID, c.ID)
 		glog.Error(msg)
 		return msg, err
 	}
 
-	go func() {
-		glog.Infof("Asynchronously deploying %s/%s...", i.PlaybookID, i.ID)
-		err := c.ds.DeployAndNotify(i)
-		if err != nil {
-			glog.Errorf("Slack command failed to deploy instance %s/%s:\n%s\n", i.PlaybookID, i.ID, err)
-			return
-		}
-		glog.Infof("Slack command successfully deployed instance %s/%s", i.PlaybookID, i.ID)
-		return
-	}()
+	changes, err := c.ds.Plan(i)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to plan instance %s/%s: %s", c.pID, c.ID, err)
+		glog.Error(msg)
+		return msg, err
+	}
+	return fmtPlan(i, changes), nil
+}
 
-	return fmt.Sprintf("Started deployment of %s/%s", i.PlaybookID, i.ID), nil
+func fmtPlan(i *instance.Instance, changes []deployment.Change) string {
+	msg := fmt.Sprintf("Deploying %s/%s would:\n", i.PlaybookID, i.ID)
+	for _, c := range changes {
+		msg += fmt.Sprintf("  - %s %s %s", c.Action, c.Kind, wrapQuotes(c.Name))
+		if len(c.Differences) > 0 {
+			msg += fmt.Sprintf(" (%s)", strings.Join(c.Differences, ", "))
+		}
+		msg += "\n"
+	}
+	return msg
 }
 
 // InvalidSetVar error presentation for invalid setvar syntax
@@ -66,17 +138,21 @@ type setvarCommand struct {
 	is        *InstanceService
 }
 
-func (c *setvarCommand) Execute() (string, error) {
+func (c *setvarCommand) Execute(ctx context.Context) (string, error) {
 	var commandMsg string
 	if len(c.args) < 4 {
 		return commandHints, &InvalidSetVar{}
 	}
 	kvs := c.args[3:] // from e.g. "setvar foo bar var1=val1 var2=val2"
-	i, err := c.is.Show(c.args[1], c.args[2])
+	i, err := c.is.Show(ctx, c.args[1], c.args[2])
 	if err != nil {
 		glog.Warningf("Cannot setvars for not found instance %s/%s\n", c.args[1], c.args[2])
 		return "", err
 	}
+	stored := make(map[string]string, len(i.Vars))
+	for k, v := range i.Vars {
+		stored[k] = v
+	}
 	for _, kv := range kvs {
 		tmp := strings.SplitN(kv, "=", 2)
 		if len(tmp) != 2 {
@@ -90,7 +166,12 @@ func (c *setvarCommand) Execute() (string, error) {
 			return fmt.Sprintf("Playbook %s does not define those variables", i.PlaybookID), &InvalidSetVar{}
 		}
 	}
-	_, err = c.is.Update(i)
+	if p, ok := c.playbooks[i.PlaybookID]; ok {
+		if err := prepareVars(p, i.Vars, stored); err != nil {
+			return err.Error(), err
+		}
+	}
+	_, err = c.is.Update(ctx, i)
 	if err != nil {
 		glog.Errorf("Failed to save instance %s/%s with new vars\n", c.args[1], c.args[2])
 		return "", err
@@ -100,11 +181,8 @@ func (c *setvarCommand) Execute() (string, error) {
 
 func (c *setvarCommand) playbookContainsVar(playbookID, name string) bool {
 	if p, ok := c.playbooks[playbookID]; ok {
-		for _, playbookVar := range p.Vars {
-			if playbookVar == name {
-				return true
-			}
-		}
+		_, ok = p.Var(name)
+		return ok
 	}
 	return false
 }
@@ -113,14 +191,16 @@ func (c *setvarCommand) playbookContainsVar(playbookID, name string) bool {
 const commandHints = `
 */bw deploy myPlaybookID myInstanceID*: Deploy an instance
 */bw info myPlaybookID myInstanceID*: Display the age and playbook variables of an instance
+*/bw plan myPlaybookID myInstanceID*: Show what deploying an instance would change
 */bw stop myPlaybookID myInstanceID*: Stop an instance
+*/bw rollback myPlaybookID myInstanceID revision*: Redeploy an instance with the vars of an earlier revision
 */bw &lt;setvar|setvars&gt; myPlaybookID myInstanceID var1=val1 ...* : Set one or more playbook variables for an instance
 `
 
 // Help slack command
 type helpCommand struct{}
 
-func (c *helpCommand) Execute() (string, error) {
+func (c *helpCommand) Execute(ctx context.Context) (string, error) {
 	return commandHints, nil
 }
 
@@ -133,58 +213,47 @@ func (e *InvalidDelete) Error() string {
 
 // Stop slack command
 type stopCommand struct {
-	pID string
-	ID  string
-	is  *InstanceService
-	Cfg cfg.Type
-	ds  *DeploymentService
+	pID  string
+	ID   string
+	user string
+	is   *InstanceService
+	Cfg  cfg.Type
+	js   *JobService
 }
 
-func (c *stopCommand) Execute() (string, error) {
-	i, err := c.is.Show(c.pID, c.ID)
+func (c *stopCommand) Execute(ctx context.Context) (string, error) {
+	i, err := c.is.Show(ctx, c.pID, c.ID)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to stop instance %s/%s: Instance not found", c.pID, c.ID)
 		glog.Error(msg)
 		return msg, err
 	}
 
-	go func() {
-		glog.Infof("Asynchronously stopping %s/%s...", i.PlaybookID, i.ID)
-
-		if err := c.ds.StopAndNotify(i); err != nil {
-			glog.Errorf("Slack command failed to stop instance %s/%s:\n%s\n", i.PlaybookID, i.ID, err)
-			return
-		}
-
-		i.Status = instance.StatusNew
-		if _, err := c.is.Update(i); err != nil {
-			glog.Errorf("Slack command failed to stop instance %s/%s:\n%s\n", i.PlaybookID, i.ID, err)
-			return
-		}
-
-		glog.Infof("Slack command successfully stopped instance %s/%s", i.PlaybookID, i.ID)
-		return
-	}()
-
+	if err := c.js.Enqueue(ctx, job.New(job.TypeStop, i.PlaybookID, i.ID, c.user)); err != nil {
+		msg := fmt.Sprintf("Failed to stop instance %s/%s: %s", i.PlaybookID, i.ID, err)
+		glog.Error(msg)
+		return msg, err
+	}
 	return fmt.Sprintf("Stopping instance: %s/%s", i.PlaybookID, i.ID), nil
 }
 
 // Info slack command returns info about the instance
 type infoCommand struct {
-	pID string
-	ID  string
-	is  *InstanceService
+	pID       string
+	ID        string
+	is        *InstanceService
+	playbooks map[string]*deployment.Playbook
 }
 
-func (c *infoCommand) Execute() (string, error) {
-	i, err := c.is.Show(c.pID, c.ID)
+func (c *infoCommand) Execute(ctx context.Context) (string, error) {
+	i, err := c.is.Show(ctx, c.pID, c.ID)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to retrieve info for %s/%s: Instance not found", c.pID, c.ID)
 		glog.Error(msg)
 		return msg, err
 	}
 	vv := varSlice{}
-	for k, val := range i.Vars {
+	for k, val := range redactVars(c.playbooks[i.PlaybookID], i.Vars) {
 		v := varKV{
 			k: k,
 			v: val,
@@ -222,8 +291,9 @@ func fmtAge(d0 int64) string {
 	return fmt.Sprintf("%ds", int(age.Seconds()))
 }
 
-// BuildSlackCommand takes a string and some context and creates a SlackCommand
-func BuildSlackCommand(cfg cfg.Type, payload string, ds *DeploymentService, is *InstanceService, playbooks map[string]*deployment.Playbook) SlackCommand {
+// BuildSlackCommand takes a string sent by user and some context and creates a
+// SlackCommand
+func BuildSlackCommand(cfg cfg.Type, payload, user string, ds *DeploymentService, is *InstanceService, js *JobService, playbooks map[string]*deployment.Playbook) SlackCommand {
 	terms := strings.Split(payload, " ")
 	switch terms[0] {
 	case "setvar", "setvars": // setvar foo bar var1=val1 var2=val2
@@ -233,22 +303,33 @@ func BuildSlackCommand(cfg cfg.Type, payload string, ds *DeploymentService, is *
 			return &helpCommand{}
 		}
 		return &deployCommand{
-			pID: terms[1],
-			ID:  terms[2],
-			is:  is,
-			ds:  ds,
-			Cfg: cfg,
+			pID:  terms[1],
+			ID:   terms[2],
+			user: user,
+			is:   is,
+			js:   js,
+			Cfg:  cfg,
+		}
+	case "rollback":
+		if len(terms) < 4 {
+			return &helpCommand{}
 		}
+		return &rollbackCommand{pID: terms[1], ID: terms[2], revision: terms[3], user: user, is: is, js: js}
 	case "stop":
 		if len(terms) < 3 {
 			return &helpCommand{}
 		}
-		return &stopCommand{pID: terms[1], ID: terms[2], is: is, ds: ds, Cfg: cfg}
+		return &stopCommand{pID: terms[1], ID: terms[2], user: user, is: is, js: js, Cfg: cfg}
 	case "info":
 		if len(terms) < 3 {
 			return &helpCommand{}
 		}
-		return &infoCommand{pID: terms[1], ID: terms[2], is: is}
+		return &infoCommand{pID: terms[1], ID: terms[2], is: is, playbooks: playbooks}
+	case "plan":
+		if len(terms) < 3 {
+			return &helpCommand{}
+		}
+		return &planCommand{pID: terms[1], ID: terms[2], is: is, ds: ds}
 	default:
 		return &helpCommand{}
 	}
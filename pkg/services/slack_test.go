@@ -32,7 +32,7 @@ func TestDeployExecute(t *testing.T) {
 	nt := newNotificationTestHelper()
 	ds := NewDeploymentService(testutils.TestCfg, etcdstore.New(), testPlaybooks, testManifests)
 	defer nt.Close()
-	is := NewInstanceService(testutils.TestCfg, etcdstore.New())
+	is := NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
 	testcases := []struct {
 		Scenario    string
 		Arguments   string
@@ -52,13 +52,13 @@ func TestDeployExecute(t *testing.T) {
 	}
 
 	for _, testcase := range testcases {
-		_, err := is.CreateOrUpdate(testcase.Instance)
+		_, err := is.CreateOrUpdate(ctx, testcase.Instance)
 		if err != nil {
 			t.Log(err)
 		}
-		command := BuildSlackCommand(testutils.TestCfg, testcase.Arguments, ds, is, testcase.Playbooks)
+		command := BuildSlackCommand(testutils.TestCfg, testcase.Arguments, "test", ds, is, newTestJobService(ds), testcase.Playbooks)
 
-		msg, err := command.Execute()
+		msg, err := command.Execute(ctx)
 		assert.Equal(t, testcase.ExpectedMsg, msg, testcase.Scenario)
 		assert.Equal(t, testcase.E, err, testcase.Scenario)
 	}
@@ -69,11 +69,11 @@ func TestSetvarExecute(t *testing.T) {
 	defer nt.Close()
 
 	ds := NewDeploymentService(testutils.TestCfg, etcdstore.New(), testPlaybooks, testManifests)
-	is := NewInstanceService(testutils.TestCfg, etcdstore.New())
+	is := NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
 	tPlaybooks := map[string]*deployment.Playbook{
 		"helloplaybook": {
 			ID:   "helloplaybook",
-			Vars: []string{"word", "bird"},
+			Vars: []deployment.Var{{Name: "word"}, {Name: "bird"}},
 		},
 	}
 	testcases := []struct {
@@ -179,17 +179,17 @@ func TestSetvarExecute(t *testing.T) {
 	}
 
 	for _, testcase := range testcases {
-		_, err := is.CreateOrUpdate(testcase.Instance)
+		_, err := is.CreateOrUpdate(ctx, testcase.Instance)
 		if err != nil {
 			t.Fatal(err)
 		}
-		command := BuildSlackCommand(testutils.TestCfg, testcase.Arguments, ds, is, testcase.Playbooks)
+		command := BuildSlackCommand(testutils.TestCfg, testcase.Arguments, "test", ds, is, newTestJobService(ds), testcase.Playbooks)
 
-		msg, err := command.Execute()
+		msg, err := command.Execute(ctx)
 		assert.Equal(t, testcase.ExpectedMsg, msg, testcase.Scenario)
 		assert.Equal(t, testcase.ExpectedErr, err, testcase.Scenario)
 
-		updatedInstance, err := is.Show(testcase.Instance.PlaybookID, testcase.Instance.ID)
+		updatedInstance, err := is.Show(ctx, testcase.Instance.PlaybookID, testcase.Instance.ID)
 		assert.Nil(t, err)
 		assert.Equal(t, testcase.ExpectedVars, updatedInstance.Vars, testcase.Scenario)
 	}
@@ -228,24 +228,26 @@ func TestStop(t *testing.T) {
 			nil,
 		},
 	}
-	is := NewInstanceService(testutils.TestCfg, etcdstore.New())
+	is := NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
 	ds := NewDeploymentService(testutils.TestCfg, etcdstore.New(), testPlaybooks, testManifests)
 	for _, testcase := range testcases {
-		_, err := is.CreateOrUpdate(testcase.Instance)
+		_, err := is.CreateOrUpdate(ctx, testcase.Instance)
 		if err != nil {
 			t.Log(err)
 		}
 		command := BuildSlackCommand(
 			testutils.TestCfg,
 			testcase.Args,
+			"test",
 			ds,
 			is,
+			newTestJobService(ds),
 			map[string]*deployment.Playbook{
 				"helloplaybook": {ID: "randomapp"},
 			},
 		)
 
-		msg, err := command.Execute()
+		msg, err := command.Execute(ctx)
 		assert.Equal(t, testcase.ExpectedErr, err, testcase.Scenario)
 		assert.Equal(t, testcase.ExpectedMsg, msg, testcase.Scenario)
 		// Wait for Kubernetes to destroy the pod so we can recreate and destroy it in future test cases:
@@ -273,11 +275,11 @@ func TestHelpExecute(t *testing.T) {
 			nil,
 		},
 	}
-	is := NewInstanceService(testutils.TestCfg, etcdstore.New())
+	is := NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
 	ds := NewDeploymentService(testutils.TestCfg, etcdstore.New(), testPlaybooks, testManifests)
 	for _, testcase := range testcases {
-		command := BuildSlackCommand(testutils.TestCfg, testcase.Args, ds, is, nil)
-		msg, err := command.Execute()
+		command := BuildSlackCommand(testutils.TestCfg, testcase.Args, "test", ds, is, newTestJobService(ds), nil)
+		msg, err := command.Execute(ctx)
 		assert.Equal(t, testcase.ExpectedErr, err, testcase.Scenario)
 		assert.Equal(t, testcase.ExpectedMsg, msg, testcase.Scenario)
 	}
@@ -325,26 +327,76 @@ Vars:
 			instance.NotFoundError("instances//"),
 		},
 	}
-	is := NewInstanceService(testutils.TestCfg, etcdstore.New())
+	is := NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
 	ds := NewDeploymentService(testutils.TestCfg, etcdstore.New(), testPlaybooks, testManifests)
 	for _, testcase := range testcases {
-		_, err := is.CreateOrUpdate(testcase.Instance)
+		_, err := is.CreateOrUpdate(ctx, testcase.Instance)
 		if err != nil {
 			t.Log(err)
 		}
 		command := BuildSlackCommand(
 			testutils.TestCfg,
 			testcase.Args,
+			"test",
 			ds,
 			is,
+			newTestJobService(ds),
 			map[string]*deployment.Playbook{
 				"helloplaybook": {ID: "showinfo"},
 			},
 		)
 		// CreateOrUpdate always resets instance.Created so we can't mock it:
 		time.Sleep(3 * time.Second)
-		msg, err := command.Execute()
+		msg, err := command.Execute(ctx)
 		assert.IsType(t, testcase.ExpectedErr, err, testcase.Scenario)
 		assert.Equal(t, testcase.ExpectedMsg, msg, testcase.Scenario)
 	}
 }
+
+func TestRollbackExecute(t *testing.T) {
+	testcases := []struct {
+		Scenario    string
+		Args        string
+		ExpectedMsg string
+		ExpectedErr error
+	}{
+		{
+			"Fails when the revision is missing",
+			"rollback helloplaybook randomid",
+			commandHints,
+			nil,
+		},
+		{
+			"Fails when the revision is not a number",
+			"rollback helloplaybook randomid latest",
+			commandHints,
+			&InvalidRollback{},
+		},
+		{
+			"Fails when the revision is not positive",
+			"rollback helloplaybook randomid 0",
+			commandHints,
+			&InvalidRollback{},
+		},
+	}
+	is := NewInstanceService(testutils.TestCfg, etcdstore.New(), deployment.AllPlaybooks)
+	ds := NewDeploymentService(testutils.TestCfg, etcdstore.New(), testPlaybooks, testManifests)
+	for _, testcase := range testcases {
+		command := BuildSlackCommand(testutils.TestCfg, testcase.Args, "test", ds, is, newTestJobService(ds), nil)
+		msg, err := command.Execute(ctx)
+		assert.Equal(t, testcase.ExpectedErr, err, testcase.Scenario)
+		assert.Equal(t, testcase.ExpectedMsg, msg, testcase.Scenario)
+	}
+}
+
+func TestFmtPlan(t *testing.T) {
+	i := &instance.Instance{PlaybookID: "helloplaybook", ID: "plan"}
+	changes := []deployment.Change{
+		{Kind: "ReplicationController", Name: "web", Action: deployment.ChangeUpdate, Differences: []string{"container web image", "rc spec replicas"}},
+		{Kind: "Service", Name: "web", Action: deployment.ChangeUnchanged},
+	}
+	assert.Equal(t, `Deploying helloplaybook/plan would:
+  - update ReplicationController "web" (container web image, rc spec replicas)
+  - unchanged Service "web"
+`, fmtPlan(i, changes))
+}
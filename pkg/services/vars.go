@@ -0,0 +1,110 @@
+package services
+
+import (
+	"sort"
+
+	"github.com/namely/broadway/pkg/deployment"
+	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/secret"
+)
+
+// sealVars encrypts the values of the secret vars of a playbook in place
+func sealVars(pb *deployment.Playbook, vars map[string]string) error {
+	for name := range pb.SecretVars() {
+		v, ok := vars[name]
+		if !ok {
+			continue
+		}
+		sealed, err := secret.Seal(v)
+		if err != nil {
+			return err
+		}
+		vars[name] = sealed
+	}
+	return nil
+}
+
+// openVars returns a copy of the vars of an instance of a playbook with the
+// values of its secret vars decrypted. Other values are kept as they are, even
+// if they look encrypted, so that a user can't have Broadway decrypt a secret
+// by copying it into another var.
+func openVars(pb *deployment.Playbook, vars map[string]string) (map[string]string, error) {
+	opened := make(map[string]string, len(vars))
+	for k, v := range vars {
+		opened[k] = v
+	}
+	for name := range pb.SecretVars() {
+		v, ok := vars[name]
+		if !ok {
+			continue
+		}
+		o, err := secret.Open(v)
+		if err != nil {
+			return nil, err
+		}
+		opened[name] = o
+	}
+	return opened, nil
+}
+
+// redactVars returns a copy of the vars of an instance of a playbook with the
+// values of secret vars masked. Vars declared secret are masked even if they
+// were saved before being declared so. pb is nil when the playbook is
+// missing.
+func redactVars(pb *deployment.Playbook, vars map[string]string) map[string]string {
+	redacted := secret.Redact(vars)
+	if pb != nil {
+		for name := range pb.SecretVars() {
+			if redacted[name] != "" {
+				redacted[name] = secret.Mask
+			}
+		}
+	}
+	return redacted
+}
+
+// Redact returns a copy of an instance of one of playbooks with the values of
+// its secret vars masked, to be shown to users
+func Redact(playbooks map[string]*deployment.Playbook, i *instance.Instance) *instance.Instance {
+	if i == nil {
+		return nil
+	}
+	r := *i
+	r.Vars = redactVars(playbooks[i.PlaybookID], i.Vars)
+	return &r
+}
+
+// RedactRevision returns a copy of a revision of an instance of one of
+// playbooks with the values of its secret vars masked, to be shown to users
+func RedactRevision(playbooks map[string]*deployment.Playbook, r *instance.Revision) *instance.Revision {
+	c := *r
+	c.Vars = redactVars(playbooks[r.PlaybookID], r.Vars)
+	return &c
+}
+
+// prepareVars checks the vars of an instance of a playbook, with their secret
+// values decrypted, then encrypts the values of its secret vars in place.
+// stored holds the vars the instance was saved with: encrypted values are
+// only accepted when they were stored for the same var already, since sealing
+// leaves them as they are.
+func prepareVars(pb *deployment.Playbook, vars, stored map[string]string) error {
+	e := &deployment.VarsError{PlaybookID: pb.ID}
+	for name, v := range vars {
+		if secret.IsSealed(v) && v != stored[name] {
+			e.Violations = append(e.Violations, deployment.Violation{Var: name, Value: secret.Mask, Message: "can't be set to an encrypted value"})
+		}
+	}
+	if len(e.Violations) > 0 {
+		sort.Slice(e.Violations, func(a, b int) bool { return e.Violations[a].Var < e.Violations[b].Var })
+		return e
+	}
+
+	opened, err := openVars(pb, vars)
+	if err != nil {
+		return err
+	}
+	if err := pb.ValidateVars(opened); err != nil {
+		return err
+	}
+	return sealVars(pb, vars)
+}
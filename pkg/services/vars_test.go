@@ -0,0 +1,75 @@
+package services
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/namely/broadway/pkg/cfg"
+	"github.com/namely/broadway/pkg/deployment"
+	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/secret"
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretVars(t *testing.T) {
+	nt := newNotificationTestHelper()
+	defer nt.Close()
+	defer func(pbs map[string]*deployment.Playbook) { deployment.AllPlaybooks = pbs }(deployment.AllPlaybooks)
+	deployment.AllPlaybooks = map[string]*deployment.Playbook{
+		"vault": {ID: "vault", Vars: []deployment.Var{
+			{Name: "version"},
+			{Name: "password", Secret: true, Pattern: "[a-z0-9]+"},
+		}},
+	}
+	defer secret.Setup(cfg.Type{})
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	assert.Nil(t, secret.Setup(cfg.Type{SecretKey: key}))
+
+	mem := store.NewMemory()
+	is := NewInstanceService(ServicesTestCfg, mem, deployment.AllPlaybooks)
+	i, err := is.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "vault", ID: "1", Vars: map[string]string{"version": "v1", "password": "hunter2"}})
+	assert.Nil(t, err)
+	stored, err := is.Show(ctx, "vault", "1")
+	assert.Nil(t, err)
+	assert.True(t, secret.IsSealed(stored.Vars["password"]), "secret vars should be stored encrypted")
+	assert.Equal(t, "v1", stored.Vars["version"])
+
+	assert.Equal(t, map[string]string{"version": "v1", "password": secret.Mask}, Redact(deployment.AllPlaybooks, i).Vars)
+	assert.Equal(t, secret.Mask, varMap(deployment.AllPlaybooks["vault"], i)["password"], "messages should mask secret vars")
+	vars, err := manifestVars(deployment.AllPlaybooks["vault"], i)
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", vars["password"], "manifests should be rendered with the secret")
+
+	_, err = is.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "vault", ID: "1", Vars: map[string]string{"version": "v2", "password": secret.Mask}})
+	assert.Nil(t, err)
+	stored, err = is.Show(ctx, "vault", "1")
+	assert.Nil(t, err)
+	vars, err = manifestVars(deployment.AllPlaybooks["vault"], stored)
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", vars["password"], "a masked value sent back should keep the secret")
+
+	_, err = is.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "vault", ID: "1", Vars: map[string]string{"password": "Hunter 2"}})
+	assert.Equal(t, &deployment.VarsError{PlaybookID: "vault", Violations: []deployment.Violation{
+		{Var: "password", Value: secret.Mask, Message: "must match [a-z0-9]+"},
+	}}, err, "violations should mask secret values")
+
+	sealed := stored.Vars["password"]
+	_, err = is.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "vault", ID: "1", Vars: map[string]string{"version": sealed}})
+	assert.Equal(t, &deployment.VarsError{PlaybookID: "vault", Violations: []deployment.Violation{
+		{Var: "version", Value: secret.Mask, Message: "can't be set to an encrypted value"},
+	}}, err, "a secret copied into another var should be rejected")
+	_, err = is.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "vault", ID: "2", Vars: map[string]string{"password": sealed}})
+	assert.IsType(t, &deployment.VarsError{}, err, "a secret copied from another instance should be rejected")
+	_, err = is.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "vault", ID: "1", Vars: map[string]string{"password": sealed}})
+	assert.Nil(t, err, "the stored value of a var may be sent back")
+
+	stored.Vars["version"] = sealed
+	vars, err = manifestVars(deployment.AllPlaybooks["vault"], stored)
+	assert.Nil(t, err)
+	assert.Equal(t, sealed, vars["version"], "only secret vars should be decrypted")
+
+	assert.Nil(t, secret.Setup(cfg.Type{}))
+	_, err = is.CreateOrUpdate(ctx, &instance.Instance{PlaybookID: "vault", ID: "2", Vars: map[string]string{"password": "hunter2"}})
+	assert.Equal(t, secret.ErrNoKey, err)
+}
@@ -0,0 +1,425 @@
+// Package etcd3store implements store.Store on the etcd v3 API. It talks to the
+// JSON gateway etcd serves next to its gRPC API, on the same client port. The
+// gateway is served under /v3 since etcd 3.4, /v3beta in etcd 3.3 and /v3alpha
+// in etcd 3.2; earlier versions are not supported.
+//
+// The gateway is used instead of the gRPC client on purpose: clientv3 and its
+// gRPC dependencies aren't vendored with the release of etcd Broadway builds
+// with. The gateway serves the same API, so keys are still attached to leases
+// and compare-and-swaps are transactions, run by etcd itself.
+package etcd3store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/namely/broadway/pkg/store"
+)
+
+// Store is a store.Store keeping its values in etcd v3. Keys are paths like
+// in the v2 store: "a/b" and "/a/b/" name the same key, and a key holds the
+// keys under it.
+type Store struct {
+	endpoints []string
+	prefix    string // the path of the gateway on the endpoints
+	client    *http.Client
+	streams   *http.Client // answers streamed until they're canceled
+}
+
+// DefaultPrefix is the path of the gateway since etcd 3.4
+const DefaultPrefix = "/v3"
+
+// New instantiates and returns a Store using the etcd v3 endpoints, whose
+// gateway is served under prefix, or DefaultPrefix if prefix is empty
+func New(endpoints []string, prefix string) *Store {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return &Store{
+		endpoints: endpoints,
+		prefix:    "/" + strings.Trim(prefix, "/"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		streams:   &http.Client{},
+	}
+}
+
+// LeaseID identifies a lease granted by etcd
+type LeaseID int64
+
+// Error is an error answered by the etcd gateway
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("broadway/etcd3store: %s (code %d)", e.Message, e.Code)
+}
+
+// number decodes the int64 fields the gateway encodes as strings
+type number int64
+
+func (n *number) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*n = number(v)
+	return err
+}
+
+type keyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision number `json:"mod_revision"`
+}
+
+type rangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type rangeResponse struct {
+	Kvs []keyValue `json:"kvs"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,omitempty"`
+}
+
+type compare struct {
+	Target      string `json:"target"`
+	Result      string `json:"result"`
+	Key         []byte `json:"key"`
+	ModRevision int64  `json:"mod_revision"`
+}
+
+type requestOp struct {
+	Put         *putRequest   `json:"request_put,omitempty"`
+	DeleteRange *rangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare,omitempty"`
+	Success []requestOp `json:"success,omitempty"`
+	Failure []requestOp `json:"failure,omitempty"`
+}
+
+type txnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type leaseRequest struct {
+	TTL int64   `json:"TTL,omitempty"`
+	ID  LeaseID `json:"ID,omitempty"`
+}
+
+type leaseResponse struct {
+	ID number `json:"ID"`
+}
+
+type watchRequest struct {
+	Create watchCreateRequest `json:"create_request"`
+}
+
+type watchCreateRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	PrevKV   bool   `json:"prev_kv"`
+}
+
+type watchResponse struct {
+	Result struct {
+		Created  bool         `json:"created"`
+		Canceled bool         `json:"canceled"`
+		Events   []watchEvent `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Code    int    `json:"grpc_code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type watchEvent struct {
+	Type   string    `json:"type"`
+	KV     keyValue  `json:"kv"`
+	PrevKV *keyValue `json:"prev_kv"`
+}
+
+func (e watchEvent) event() store.Event {
+	event := store.Event{Type: store.EventPut, Key: string(e.KV.Key), Value: string(e.KV.Value)}
+	if e.Type == "DELETE" {
+		event = store.Event{Type: store.EventDelete, Key: string(e.KV.Key)}
+	}
+	if e.PrevKV != nil {
+		event.PrevValue = string(e.PrevKV.Value)
+	}
+	return event
+}
+
+// call posts a request to the gateway and decodes its answer
+func (s *Store) call(ctx context.Context, method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := s.post(ctx, s.client, method, body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// post sends a request to the gateway, trying the endpoints in order until
+// one of them answers. Members answering a server error, such as those
+// without a leader, are skipped too. Another answer that isn't OK is returned
+// as an *Error.
+func (s *Store) post(ctx context.Context, client *http.Client, method string, body []byte) (*http.Response, error) {
+	if len(s.endpoints) == 0 {
+		return nil, fmt.Errorf("broadway/etcd3store: no endpoints configured")
+	}
+	var err error
+	for _, endpoint := range s.endpoints {
+		var hr *http.Request
+		hr, err = http.NewRequest("POST", strings.TrimRight(endpoint, "/")+s.prefix+"/"+method, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		hr.Header.Set("Content-Type", "application/json")
+		var r *http.Response
+		r, err = client.Do(hr.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if r.StatusCode != http.StatusOK {
+			e := &Error{Code: r.StatusCode}
+			json.NewDecoder(r.Body).Decode(e)
+			r.Body.Close()
+			if r.StatusCode >= http.StatusInternalServerError {
+				err = e
+				continue
+			}
+			return nil, e
+		}
+		return r, nil
+	}
+	return nil, store.Unavailable(ctx, err)
+}
+
+// cleanKey turns a path into the key it names
+func cleanKey(p string) []byte {
+	return []byte(path.Clean("/" + p))
+}
+
+// under returns the range of the keys held by key
+func under(key []byte) (prefix, end []byte) {
+	prefix = append(append([]byte{}, key...), '/')
+	if string(key) == "/" {
+		prefix = key
+	}
+	end = append([]byte{}, prefix...)
+	end[len(end)-1]++
+	return prefix, end
+}
+
+// SetValue sets the string value for a string key. The key may include
+// '/' path separators.
+func (s *Store) SetValue(ctx context.Context, path, value string) error {
+	return s.call(ctx, "kv/put", putRequest{Key: cleanKey(path), Value: []byte(value)}, &struct{}{})
+}
+
+// SetValueTTL sets the value of a key for ttl. The key is deleted when its
+// lease expires.
+func (s *Store) SetValueTTL(ctx context.Context, path, value string, ttl time.Duration) error {
+	lease, err := s.Grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	return s.SetValueLease(ctx, path, value, lease)
+}
+
+// SetValueLease sets the value of a key attached to a lease. The key is
+// deleted when the lease expires or is revoked.
+func (s *Store) SetValueLease(ctx context.Context, path, value string, lease LeaseID) error {
+	req := putRequest{Key: cleanKey(path), Value: []byte(value), Lease: int64(lease)}
+	return s.call(ctx, "kv/put", req, &struct{}{})
+}
+
+// Grant creates a lease expiring after ttl, rounded up to seconds, unless it's
+// kept alive
+func (s *Store) Grant(ctx context.Context, ttl time.Duration) (LeaseID, error) {
+	var resp leaseResponse
+	err := s.call(ctx, "lease/grant", leaseRequest{TTL: int64((ttl + time.Second - 1) / time.Second)}, &resp)
+	return LeaseID(resp.ID), err
+}
+
+// KeepAlive renews a lease for its ttl
+func (s *Store) KeepAlive(ctx context.Context, lease LeaseID) error {
+	return s.call(ctx, "lease/keepalive", leaseRequest{ID: lease}, &struct{}{})
+}
+
+// Revoke ends a lease and deletes the keys attached to it
+func (s *Store) Revoke(ctx context.Context, lease LeaseID) error {
+	return s.call(ctx, "lease/revoke", leaseRequest{ID: lease}, &struct{}{})
+}
+
+// Value retrieves the string value for a string key.
+func (s *Store) Value(ctx context.Context, path string) (string, error) {
+	var resp rangeResponse
+	if err := s.call(ctx, "kv/range", rangeRequest{Key: cleanKey(path)}, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", store.ErrNotFound
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// VersionedValue retrieves the value of a key and the revision of its last
+// change
+func (s *Store) VersionedValue(ctx context.Context, path string) (string, uint64, error) {
+	var resp rangeResponse
+	if err := s.call(ctx, "kv/range", rangeRequest{Key: cleanKey(path)}, &resp); err != nil {
+		return "", 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", 0, nil
+	}
+	return string(resp.Kvs[0].Value), uint64(resp.Kvs[0].ModRevision), nil
+}
+
+// CompareAndSwap sets the value of a key in a transaction if it wasn't changed
+// since the revision version. A missing key has revision 0.
+func (s *Store) CompareAndSwap(ctx context.Context, path, value string, version uint64) error {
+	return s.compareAndSwap(ctx, path, value, version, 0)
+}
+
+// CompareAndSwapTTL is CompareAndSwap for a key attached to a new lease
+// expiring after ttl
+func (s *Store) CompareAndSwapTTL(ctx context.Context, path, value string, version uint64, ttl time.Duration) error {
+	lease, err := s.Grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	return s.compareAndSwap(ctx, path, value, version, lease)
+}
+
+func (s *Store) compareAndSwap(ctx context.Context, path, value string, version uint64, lease LeaseID) error {
+	key := cleanKey(path)
+	req := txnRequest{
+		Compare: []compare{{Target: "MOD", Result: "EQUAL", Key: key, ModRevision: int64(version)}},
+		Success: []requestOp{{Put: &putRequest{Key: key, Value: []byte(value), Lease: int64(lease)}}},
+	}
+	var resp txnResponse
+	if err := s.call(ctx, "kv/txn", req, &resp); err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return store.ErrConflict
+	}
+	return nil
+}
+
+// Values finds all leaf nodes under the given key. It strips any leading path
+// components from the keys and returns a key/value map. For example, given keys
+// "animals/flea" and "animals/cats/egyptian", Values("animals") would return
+// {"flea" : "...", "egyptian": "..."}
+func (s *Store) Values(ctx context.Context, path string) (map[string]string, error) {
+	values := map[string]string{}
+	prefix, end := under(cleanKey(path))
+	var resp rangeResponse
+	if err := s.call(ctx, "kv/range", rangeRequest{Key: prefix, RangeEnd: end}, &resp); err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		values[key[strings.LastIndex(key, "/")+1:]] = string(kv.Value)
+	}
+	return values, nil
+}
+
+// Delete removes the specified key and the keys under it in one transaction
+func (s *Store) Delete(ctx context.Context, path string) error {
+	key := cleanKey(path)
+	prefix, end := under(key)
+	req := txnRequest{Success: []requestOp{
+		{DeleteRange: &rangeRequest{Key: key}},
+		{DeleteRange: &rangeRequest{Key: prefix, RangeEnd: end}},
+	}}
+	return s.call(ctx, "kv/txn", req, &txnResponse{})
+}
+
+// Watch reports the changes made to a key and the keys under it
+func (s *Store) Watch(ctx context.Context, prefix string) (<-chan store.Event, error) {
+	key := cleanKey(prefix)
+	keys, end := under(key)
+	body, err := json.Marshal(watchRequest{watchCreateRequest{Key: key, RangeEnd: end, PrevKV: true}})
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.post(ctx, s.streams, "watch", body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The watch is created before Watch returns, so that no change made
+	// afterwards is missed
+	answers := json.NewDecoder(r.Body)
+	next := func() (watchResponse, error) {
+		var resp watchResponse
+		if err := answers.Decode(&resp); err != nil {
+			return resp, store.Unavailable(ctx, err)
+		}
+		if resp.Error != nil {
+			return resp, &Error{Code: resp.Error.Code, Message: resp.Error.Message}
+		}
+		return resp, nil
+	}
+	if _, err := next(); err != nil {
+		r.Body.Close()
+		return nil, err
+	}
+
+	events := make(chan store.Event)
+	go func() {
+		defer close(events)
+		defer r.Body.Close()
+		for {
+			resp, err := next()
+			if err != nil {
+				if ctx.Err() == nil {
+					glog.Warningf("broadway/etcd3store: watching %s failed: %s", prefix, err)
+				}
+				return
+			}
+			if resp.Result.Canceled {
+				return
+			}
+			for _, e := range resp.Result.Events {
+				// The range of the watch also holds keys like "/a-b" next to
+				// the keys under "/a"
+				k := string(e.KV.Key)
+				if k != string(key) && !strings.HasPrefix(k, string(keys)) {
+					continue
+				}
+				select {
+				case events <- e.event():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
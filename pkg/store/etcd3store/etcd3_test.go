@@ -0,0 +1,371 @@
+package etcd3store
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/namely/broadway/pkg/store"
+	"github.com/namely/broadway/pkg/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGateway answers the etcd v3 gateway calls made by Store, keeping the
+// keys in memory
+type fakeGateway struct {
+	sync.Mutex
+	kvs      map[string]fakeKV
+	revision int64
+	leases   int64
+	watchers map[chan fakeEvent]rangeRequest
+}
+
+type fakeKV struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+	Lease       int64  `json:"-"`
+}
+
+type fakeEvent struct {
+	Type   string  `json:"type,omitempty"`
+	KV     fakeKV  `json:"kv"`
+	PrevKV *fakeKV `json:"prev_kv,omitempty"`
+}
+
+func newFakeGateway() *fakeGateway {
+	return &fakeGateway{kvs: map[string]fakeKV{}, watchers: map[chan fakeEvent]rangeRequest{}}
+}
+
+func (r rangeRequest) has(key string) bool {
+	return key == string(r.Key) || (r.RangeEnd != nil && key >= string(r.Key) && key < string(r.RangeEnd))
+}
+
+func (g *fakeGateway) keys(r rangeRequest) []string {
+	var keys []string
+	for key := range g.kvs {
+		if r.has(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (g *fakeGateway) apply(op requestOp) {
+	g.revision++
+	if op.Put != nil {
+		key := string(op.Put.Key)
+		e := fakeEvent{KV: fakeKV{op.Put.Key, op.Put.Value, g.revision, op.Put.Lease}}
+		if prev, ok := g.kvs[key]; ok {
+			e.PrevKV = &prev
+		}
+		g.kvs[key] = e.KV
+		g.notify(e)
+	}
+	if op.DeleteRange != nil {
+		for _, key := range g.keys(*op.DeleteRange) {
+			prev := g.kvs[key]
+			delete(g.kvs, key)
+			g.notify(fakeEvent{Type: "DELETE", KV: fakeKV{Key: prev.Key, ModRevision: g.revision}, PrevKV: &prev})
+		}
+	}
+}
+
+func (g *fakeGateway) notify(e fakeEvent) {
+	for ch, r := range g.watchers {
+		if r.has(string(e.KV.Key)) {
+			ch <- e
+		}
+	}
+}
+
+// watch streams the events of a watch until the request is canceled
+func (g *fakeGateway) watch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Create rangeRequest `json:"create_request"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	ch := make(chan fakeEvent, 64)
+	g.Lock()
+	g.watchers[ch] = req.Create
+	g.Unlock()
+	defer func() {
+		g.Lock()
+		delete(g.watchers, ch)
+		g.Unlock()
+	}()
+
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]interface{}{"result": map[string]bool{"created": true}})
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case e := <-ch:
+			enc.Encode(map[string]interface{}{"result": map[string][]fakeEvent{"events": {e}}})
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v3/watch" {
+		g.watch(w, r)
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	var resp interface{}
+	switch r.URL.Path {
+	case "/v3/kv/put":
+		var req putRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		g.apply(requestOp{Put: &req})
+		resp = map[string]string{}
+	case "/v3/kv/range":
+		var req rangeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		kvs := []fakeKV{}
+		for _, key := range g.keys(req) {
+			kvs = append(kvs, g.kvs[key])
+		}
+		resp = map[string][]fakeKV{"kvs": kvs}
+	case "/v3/kv/txn":
+		var req txnRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		succeeded := true
+		for _, c := range req.Compare {
+			succeeded = succeeded && g.kvs[string(c.Key)].ModRevision == c.ModRevision
+		}
+		ops := req.Success
+		if !succeeded {
+			ops = req.Failure
+		}
+		for _, op := range ops {
+			g.apply(op)
+		}
+		resp = map[string]bool{"succeeded": succeeded}
+	case "/v3/lease/grant":
+		g.leases++
+		resp = map[string]string{"ID": strconv.FormatInt(g.leases, 10)}
+	case "/v3/lease/revoke":
+		var req leaseRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		for key, kv := range g.kvs {
+			if kv.Lease == int64(req.ID) {
+				g.apply(requestOp{DeleteRange: &rangeRequest{Key: []byte(key)}})
+			}
+		}
+		resp = map[string]string{}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Not Found", "code": 5})
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+var ctx = context.Background()
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func() store.Store {
+		return New([]string{httptest.NewServer(newFakeGateway()).URL}, "")
+	})
+}
+
+func TestEndpoints(t *testing.T) {
+	g := httptest.NewServer(newFakeGateway())
+	defer g.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	s := New([]string{down.URL, g.URL}, "")
+	assert.Nil(t, s.SetValue(ctx, "/a", "A"), "an endpoint that's down should be skipped")
+	v, err := s.Value(ctx, "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "A", v)
+
+	s = New([]string{down.URL}, "")
+	err = s.SetValue(ctx, "/a", "A")
+	assert.IsType(t, &store.UnavailableError{}, err)
+
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+	err = New([]string{g.URL}, "").SetValue(expired, "/a", "A")
+	assert.IsType(t, &store.TimeoutError{}, err)
+
+	s = New([]string{g.URL + "/missing"}, "")
+	err = s.SetValue(ctx, "/a", "A")
+	assert.Equal(t, &Error{Code: 5, Message: "Not Found"}, err)
+
+	leaderless := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "etcdserver: no leader", "code": 14})
+	}))
+	defer leaderless.Close()
+	s = New([]string{leaderless.URL, g.URL}, "")
+	assert.Nil(t, s.SetValue(ctx, "/a", "A"), "a member without a leader should be skipped")
+	err = New([]string{leaderless.URL}, "").SetValue(ctx, "/a", "A")
+	assert.Equal(t, &store.UnavailableError{Err: &Error{Code: 14, Message: "etcdserver: no leader"}}, err)
+}
+
+func TestPrefix(t *testing.T) {
+	gateway := newFakeGateway()
+	// an etcd 3.3 gateway
+	g := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v3beta/") {
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = "/v3/" + strings.TrimPrefix(r.URL.Path, "/v3beta/")
+		gateway.ServeHTTP(w, r)
+	}))
+	defer g.Close()
+
+	s := New([]string{g.URL}, "v3beta/")
+	assert.Nil(t, s.SetValue(ctx, "/a", "A"))
+	v, err := s.Value(ctx, "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "A", v)
+	assert.NotNil(t, New([]string{g.URL}, "").SetValue(ctx, "/a", "A"), "the default prefix shouldn't be served")
+}
+
+func TestLeases(t *testing.T) {
+	g := httptest.NewServer(newFakeGateway())
+	defer g.Close()
+	s := New([]string{g.URL}, "")
+
+	lease, err := s.Grant(ctx, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, LeaseID(1), lease)
+	assert.Nil(t, s.SetValueLease(ctx, "/leased", "A", lease))
+	assert.Nil(t, s.SetValueTTL(ctx, "/ttl", "B", time.Minute))
+
+	assert.Nil(t, s.Revoke(ctx, lease))
+	_, err = s.Value(ctx, "/leased")
+	assert.Equal(t, store.ErrNotFound, err, "revoking a lease should delete its keys")
+	v, err := s.Value(ctx, "/ttl")
+	assert.Nil(t, err)
+	assert.Equal(t, "B", v, "other leases should be kept")
+}
+
+func TestCompareAndSwapTTL(t *testing.T) {
+	g := httptest.NewServer(newFakeGateway())
+	defer g.Close()
+	s := New([]string{g.URL}, "")
+
+	assert.Nil(t, s.CompareAndSwapTTL(ctx, "/lock", "A", 0, time.Minute))
+	assert.Equal(t, store.ErrConflict, s.CompareAndSwapTTL(ctx, "/lock", "B", 0, time.Minute))
+	_, version, err := s.VersionedValue(ctx, "/lock")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CompareAndSwapTTL(ctx, "/lock", "B", version, time.Minute))
+
+	assert.Nil(t, s.Revoke(ctx, LeaseID(1)))
+	v, err := s.Value(ctx, "/lock")
+	assert.Nil(t, err)
+	assert.Equal(t, "B", v, "a swapped key should move to the new lease")
+	assert.Nil(t, s.Revoke(ctx, LeaseID(3)))
+	_, err = s.Value(ctx, "/lock")
+	assert.Equal(t, store.ErrNotFound, err, "the key should expire with its lease")
+}
+
+func TestUnder(t *testing.T) {
+	cases := []struct {
+		Key    string
+		Prefix string
+		End    string
+	}{
+		{"/broadway", "/broadway/", "/broadway0"},
+		{"/", "/", "0"},
+	}
+	for _, c := range cases {
+		prefix, end := under([]byte(c.Key))
+		assert.Equal(t, c.Prefix, string(prefix), c.Key)
+		assert.Equal(t, c.End, string(end), c.Key)
+	}
+}
+
+// etcdStore returns a Store on the etcd listed by ETCD3_ENDPOINTS, whose
+// gateway is served under ETCD3_PREFIX. Tests against a real etcd are skipped
+// when ETCD3_ENDPOINTS isn't set.
+func etcdStore(t *testing.T) *Store {
+	endpoints := os.Getenv("ETCD3_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD3_ENDPOINTS is not set")
+	}
+	return New(strings.Split(endpoints, ","), os.Getenv("ETCD3_PREFIX"))
+}
+
+func TestEtcdConformance(t *testing.T) {
+	s := etcdStore(t)
+	storetest.Run(t, func() store.Store { return s })
+}
+
+func TestEtcdLeases(t *testing.T) {
+	s := etcdStore(t)
+	defer s.Delete(ctx, "/broadway-etcd3-test")
+
+	lease, err := s.Grant(ctx, time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, s.SetValueLease(ctx, "/broadway-etcd3-test/leased", "A", lease))
+	assert.Nil(t, s.KeepAlive(ctx, lease))
+	assert.Nil(t, s.SetValueTTL(ctx, "/broadway-etcd3-test/ttl", "B", 2*time.Second))
+
+	assert.Nil(t, s.Revoke(ctx, lease))
+	_, err = s.Value(ctx, "/broadway-etcd3-test/leased")
+	assert.Equal(t, store.ErrNotFound, err, "revoking a lease should delete its keys")
+
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		_, err = s.Value(ctx, "/broadway-etcd3-test/ttl")
+		if err != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	assert.Equal(t, store.ErrNotFound, err, "a key should expire with its lease")
+}
+
+func TestEtcdCompareAndSwap(t *testing.T) {
+	s := etcdStore(t)
+	defer s.Delete(ctx, "/broadway-etcd3-test")
+	s.Delete(ctx, "/broadway-etcd3-test")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for n := 0; n < cap(errs); n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errs <- s.CompareAndSwapTTL(ctx, "/broadway-etcd3-test/lock", strconv.Itoa(n), 0, time.Minute)
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+
+	swapped := 0
+	for err := range errs {
+		if err == nil {
+			swapped++
+			continue
+		}
+		assert.Equal(t, store.ErrConflict, err)
+	}
+	assert.Equal(t, 1, swapped, "only one of concurrent swaps of a missing key should succeed")
+
+	v, version, err := s.VersionedValue(ctx, "/broadway-etcd3-test/lock")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CompareAndSwap(ctx, "/broadway-etcd3-test/lock", v+"+", version))
+	assert.Equal(t, store.ErrConflict, s.CompareAndSwap(ctx, "/broadway-etcd3-test/lock", v, version),
+		"a swap with a stale version should conflict")
+}
@@ -1,13 +1,14 @@
 package etcdstore
 
 import (
+	"context"
 	"strings"
+	"time"
 
 	etcdclient "github.com/coreos/etcd/client"
 	"github.com/golang/glog"
 	"github.com/namely/broadway/pkg/cfg"
 	"github.com/namely/broadway/pkg/store"
-	"golang.org/x/net/context"
 )
 
 var api etcdclient.KeysAPI
@@ -35,37 +36,83 @@ func New() store.Store {
 
 // SetValue sets the string value for a string key. The key may include
 // '/' path separators.
-func (*etcdStore) SetValue(path, value string) error {
-	_, err := api.Set(context.Background(), path, value, nil)
-	return err
+func (*etcdStore) SetValue(ctx context.Context, path, value string) error {
+	_, err := api.Set(ctx, path, value, nil)
+	return storeError(ctx, err)
 }
 
 // Value retrieves the string value for a string key.
-func (*etcdStore) Value(path string) string {
-	resp, err := api.Get(context.Background(), path, nil)
-	if err == nil && resp.Node != nil {
-		return resp.Node.Value
+func (*etcdStore) Value(ctx context.Context, path string) (string, error) {
+	resp, err := api.Get(ctx, path, nil)
+	if err != nil {
+		return "", storeError(ctx, err)
+	}
+	return resp.Node.Value, nil
+}
+
+// VersionedValue retrieves the value of a key and the index of its last
+// change
+func (*etcdStore) VersionedValue(ctx context.Context, path string) (string, uint64, error) {
+	resp, err := api.Get(ctx, path, nil)
+	if etcdclient.IsKeyNotFound(err) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, storeError(ctx, err)
 	}
-	return ""
+	return resp.Node.Value, resp.Node.ModifiedIndex, nil
+}
+
+// CompareAndSwap sets the value of a key if it wasn't changed since the index
+// version
+func (*etcdStore) CompareAndSwap(ctx context.Context, path, value string, version uint64) error {
+	opts := &etcdclient.SetOptions{PrevIndex: version}
+	if version == 0 {
+		opts = &etcdclient.SetOptions{PrevExist: etcdclient.PrevNoExist}
+	}
+	_, err := api.Set(ctx, path, value, opts)
+	if e, ok := err.(etcdclient.Error); ok &&
+		(e.Code == etcdclient.ErrorCodeTestFailed || e.Code == etcdclient.ErrorCodeNodeExist) {
+		return store.ErrConflict
+	}
+	return storeError(ctx, err)
+}
+
+// CompareAndSwapTTL is CompareAndSwap for a key expiring after ttl, rounded
+// up to seconds
+func (*etcdStore) CompareAndSwapTTL(ctx context.Context, path, value string, version uint64, ttl time.Duration) error {
+	opts := &etcdclient.SetOptions{PrevIndex: version, TTL: roundTTL(ttl)}
+	if version == 0 {
+		opts = &etcdclient.SetOptions{PrevExist: etcdclient.PrevNoExist, TTL: roundTTL(ttl)}
+	}
+	_, err := api.Set(ctx, path, value, opts)
+	if e, ok := err.(etcdclient.Error); ok &&
+		(e.Code == etcdclient.ErrorCodeTestFailed || e.Code == etcdclient.ErrorCodeNodeExist) {
+		return store.ErrConflict
+	}
+	return storeError(ctx, err)
+}
+
+// roundTTL rounds ttl up to the seconds etcd counts
+func roundTTL(ttl time.Duration) time.Duration {
+	return (ttl + time.Second - 1) / time.Second * time.Second
 }
 
 // Values finds all leaf nodes under the given key. It strips any leading path
 // components from the keys and returns a key/value map. For example, given keys
 // "animals/flea" and "animals/cats/egyptian", Values("animals") would return
 // {"flea" : "...", "egyptian": "..."}
-func (*etcdStore) Values(path string) (values map[string]string) {
-	values = map[string]string{}
-	resp, err := api.Get(context.Background(), path, &etcdclient.GetOptions{Recursive: true})
-	if err != nil {
-		glog.Warningf("Ignoring error getting values: %s. Error: %s", path, err.Error())
-		return values
+func (*etcdStore) Values(ctx context.Context, path string) (map[string]string, error) {
+	values := map[string]string{}
+	resp, err := api.Get(ctx, path, &etcdclient.GetOptions{Recursive: true})
+	if etcdclient.IsKeyNotFound(err) {
+		return values, nil
 	}
-	if resp.Node != nil && len(resp.Node.Nodes) > 0 {
-		valueFromNode(resp.Node.Nodes, values)
-	} else {
-		glog.Error("No values found here: " + path)
+	if err != nil {
+		return nil, storeError(ctx, err)
 	}
-	return values
+	valueFromNode(resp.Node.Nodes, values)
+	return values, nil
 }
 
 func valueFromNode(nodes []*etcdclient.Node, values map[string]string) {
@@ -78,10 +125,114 @@ func valueFromNode(nodes []*etcdclient.Node, values map[string]string) {
 	}
 }
 
+// Walk calls fn with the full key and the value of every leaf node under path
+func Walk(ctx context.Context, path string, fn func(key, value string) error) error {
+	resp, err := api.Get(ctx, path, &etcdclient.GetOptions{Recursive: true})
+	if etcdclient.IsKeyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return storeError(ctx, err)
+	}
+	return walkNode(resp.Node, fn)
+}
+
+func walkNode(node *etcdclient.Node, fn func(key, value string) error) error {
+	if !node.Dir {
+		return fn(node.Key, node.Value)
+	}
+	for _, n := range node.Nodes {
+		if err := walkNode(n, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Delete removes the specified key and its value from the store
-func (*etcdStore) Delete(path string) error {
-	_, err := api.Delete(context.Background(), path, &etcdclient.DeleteOptions{Recursive: true})
-	return err
+func (*etcdStore) Delete(ctx context.Context, path string) error {
+	_, err := api.Delete(ctx, path, &etcdclient.DeleteOptions{Recursive: true})
+	if etcdclient.IsKeyNotFound(err) {
+		return nil
+	}
+	return storeError(ctx, err)
+}
+
+// Watch reports the changes made to a key and the keys under it. Deleting a
+// directory is reported as one event for it.
+func (*etcdStore) Watch(ctx context.Context, prefix string) (<-chan store.Event, error) {
+	// Changes are watched after the current index, so that none made once
+	// Watch returns is missed
+	var index uint64
+	resp, err := api.Get(ctx, prefix, nil)
+	if e, ok := err.(etcdclient.Error); ok && e.Code == etcdclient.ErrorCodeKeyNotFound {
+		index, err = e.Index, nil
+	} else if err == nil {
+		index = resp.Index
+	}
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+
+	watcher := api.Watcher(prefix, &etcdclient.WatcherOptions{AfterIndex: index, Recursive: true})
+	events := make(chan store.Event)
+	go func() {
+		defer close(events)
+		for {
+			resp, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					glog.Warningf("broadway/etcdstore: watching %s failed: %s", prefix, err)
+				}
+				return
+			}
+			e, ok := event(resp)
+			if !ok {
+				continue
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// event returns the store event for a watch response, if it changed a value
+func event(resp *etcdclient.Response) (store.Event, bool) {
+	e := store.Event{Key: resp.Node.Key}
+	if resp.PrevNode != nil {
+		e.PrevValue = resp.PrevNode.Value
+	}
+	switch resp.Action {
+	case "set", "create", "update", "compareAndSwap":
+		if resp.Node.Dir {
+			return e, false
+		}
+		e.Type = store.EventPut
+		e.Value = resp.Node.Value
+	case "delete", "compareAndDelete", "expire":
+		e.Type = store.EventDelete
+	default:
+		return e, false
+	}
+	return e, true
+}
+
+// storeError turns the errors of the etcd client into the ones of the store
+func storeError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if etcdclient.IsKeyNotFound(err) {
+		return store.ErrNotFound
+	}
+	if _, ok := err.(etcdclient.Error); ok {
+		return err
+	}
+	return store.Unavailable(ctx, err)
 }
 
 // lastKeyItem returns the last path element in a slash-separated key path
@@ -1,60 +1,141 @@
 package etcdstore
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	etcdclient "github.com/coreos/etcd/client"
+	"github.com/namely/broadway/pkg/store"
+	"github.com/namely/broadway/pkg/store/storetest"
 	"github.com/namely/broadway/pkg/testutils"
 	"github.com/stretchr/testify/assert"
 )
 
+var ctx = context.Background()
+
 func init() {
 	Setup(testutils.TestCfg)
 }
 
 func TestValue(t *testing.T) {
 	s := New()
-	err := s.SetValue("/testing/a", "val")
+	err := s.SetValue(ctx, "/testing/a", "val")
 	assert.Nil(t, err)
 
-	val := s.Value("/testing/a")
+	val, err := s.Value(ctx, "/testing/a")
+	assert.Nil(t, err)
 	assert.Equal(t, "val", val)
 
-	err = s.SetValue("/testing/a", "ok")
+	err = s.SetValue(ctx, "/testing/a", "ok")
 	assert.Nil(t, err)
 
-	val = s.Value("/testing/a")
+	val, err = s.Value(ctx, "/testing/a")
+	assert.Nil(t, err)
 	assert.Equal(t, "ok", val)
 
-	val = s.Value("/testing/empty")
-	assert.Equal(t, "", val)
+	_, err = s.Value(ctx, "/testing/empty")
+	assert.Equal(t, store.ErrNotFound, err)
 }
 
 func TestValues(t *testing.T) {
 	s := New()
-	err := s.SetValue("/testing/vv/a", "A")
+	err := s.SetValue(ctx, "/testing/vv/a", "A")
 	assert.Nil(t, err)
-	err = s.SetValue("/testing/vv/b", "B")
+	err = s.SetValue(ctx, "/testing/vv/b", "B")
 	assert.Nil(t, err)
-	err = s.SetValue("/testing/vv/c", "C")
+	err = s.SetValue(ctx, "/testing/vv/c", "C")
 	assert.Nil(t, err)
 
-	values := s.Values("/testing/vv")
+	values, err := s.Values(ctx, "/testing/vv")
+	assert.Nil(t, err)
 	assert.Len(t, values, 3)
 	assert.Equal(t, "A", values["a"])
 	assert.Equal(t, "B", values["b"])
 	assert.Equal(t, "C", values["c"])
 
-	values = s.Values("/testing/oooo")
+	values, err = s.Values(ctx, "/testing/oooo")
+	assert.Nil(t, err)
 	assert.Len(t, values, 0)
 }
 
 func TestDelete(t *testing.T) {
 	s := New()
-	err := s.SetValue("/testd", "A")
+	err := s.SetValue(ctx, "/testd", "A")
 	assert.Nil(t, err)
 
-	err = s.Delete("/testd")
+	err = s.Delete(ctx, "/testd")
 	assert.Nil(t, err)
 
-	assert.Equal(t, "", s.Value("/testd"))
+	_, err = s.Value(ctx, "/testd")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, New)
+}
+
+func TestStoreError(t *testing.T) {
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+	down := &etcdclient.ClusterError{Errors: []error{errors.New("connection refused")}}
+	failed := etcdclient.Error{Code: etcdclient.ErrorCodeNotFile}
+
+	cases := []struct {
+		Scenario string
+		Ctx      context.Context
+		Err      error
+		Expected error
+	}{
+		{"a missing key", ctx, etcdclient.Error{Code: etcdclient.ErrorCodeKeyNotFound}, store.ErrNotFound},
+		{"a failed request", ctx, failed, failed},
+		{"an unreachable cluster", ctx, down, &store.UnavailableError{Err: down}},
+		{"a deadline", expired, down, &store.TimeoutError{Err: down}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.Expected, storeError(c.Ctx, c.Err), c.Scenario)
+	}
+}
+
+func TestEvent(t *testing.T) {
+	prev := &etcdclient.Node{Key: "/a", Value: "old"}
+	cases := []struct {
+		Scenario string
+		Resp     *etcdclient.Response
+		Expected store.Event
+		Ok       bool
+	}{
+		{
+			"a new key",
+			&etcdclient.Response{Action: "create", Node: &etcdclient.Node{Key: "/a", Value: "new"}},
+			store.Event{Type: store.EventPut, Key: "/a", Value: "new"},
+			true,
+		},
+		{
+			"a swapped key",
+			&etcdclient.Response{Action: "compareAndSwap", Node: &etcdclient.Node{Key: "/a", Value: "new"}, PrevNode: prev},
+			store.Event{Type: store.EventPut, Key: "/a", Value: "new", PrevValue: "old"},
+			true,
+		},
+		{
+			"an expired key",
+			&etcdclient.Response{Action: "expire", Node: &etcdclient.Node{Key: "/a"}, PrevNode: prev},
+			store.Event{Type: store.EventDelete, Key: "/a", PrevValue: "old"},
+			true,
+		},
+		{
+			"a new directory",
+			&etcdclient.Response{Action: "set", Node: &etcdclient.Node{Key: "/a", Dir: true}},
+			store.Event{},
+			false,
+		},
+	}
+	for _, c := range cases {
+		e, ok := event(c.Resp)
+		assert.Equal(t, c.Ok, ok, c.Scenario)
+		if ok {
+			assert.Equal(t, c.Expected, e, c.Scenario)
+		}
+	}
 }
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"sync"
+)
+
+// fanoutBuffer is the number of events a watcher may fall behind
+const fanoutBuffer = 64
+
+// Fanout sends the events of a store to its watchers, for stores without a
+// watch API of their own. A watcher falling too far behind is closed rather
+// than blocking the writers of the store. The zero value is ready to use.
+type Fanout struct {
+	sync.Mutex
+	watchers map[chan Event]string
+}
+
+// Watch returns a channel receiving the events sent for prefix and the keys
+// under it, until ctx is done
+func (f *Fanout) Watch(ctx context.Context, prefix string) <-chan Event {
+	f.Lock()
+	defer f.Unlock()
+	if f.watchers == nil {
+		f.watchers = map[chan Event]string{}
+	}
+	ch := make(chan Event, fanoutBuffer)
+	f.watchers[ch] = cleanKey(prefix)
+	go func() {
+		<-ctx.Done()
+		f.Lock()
+		defer f.Unlock()
+		f.remove(ch)
+	}()
+	return ch
+}
+
+// Send reports an event to the watchers of its key
+func (f *Fanout) Send(e Event) {
+	f.Lock()
+	defer f.Unlock()
+	for ch, prefix := range f.watchers {
+		if e.Key != prefix && !under(e.Key, prefix) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			f.remove(ch)
+		}
+	}
+}
+
+// remove closes a watcher unless it was already. The caller holds the lock.
+func (f *Fanout) remove(ch chan Event) {
+	if _, ok := f.watchers[ch]; ok {
+		delete(f.watchers, ch)
+		close(ch)
+	}
+}
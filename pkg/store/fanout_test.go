@@ -0,0 +1,29 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanoutSlowWatcher(t *testing.T) {
+	var f store.Fanout
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	slow := f.Watch(wctx, "/a")
+
+	for i := 0; i < 100; i++ {
+		f.Send(store.Event{Type: store.EventPut, Key: "/a/b"})
+	}
+	received := 0
+	for range slow {
+		received++
+	}
+	assert.True(t, received < 100, "a watcher falling behind should be closed")
+
+	fast := f.Watch(wctx, "/a")
+	f.Send(store.Event{Type: store.EventPut, Key: "/a"})
+	assert.Equal(t, store.Event{Type: store.EventPut, Key: "/a"}, <-fast)
+}
@@ -1,42 +1,206 @@
 package store
 
-import "sync"
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
 
-type memoryStore struct {
+// MemoryStore is a Store keeping its values in memory. Keys are paths like in
+// etcd: "a/b" and "/a/b/" name the same key, and a key holds the keys under
+// it. A MemoryStore created with NewMemoryFile saves a snapshot of its values
+// after every change.
+type MemoryStore struct {
 	sync.Mutex
-	store map[string]string
+	store    map[string]string
+	versions map[string]uint64 // the index of the last change of each key
+	index    uint64            // counts the changes made to the store
+	filename string
+	watchers Fanout
 }
 
 // NewMemory instantiates and returns a Store using the in-memory driver
-func NewMemory() Store {
-	return &memoryStore{store: map[string]string{}}
+func NewMemory() *MemoryStore {
+	return &MemoryStore{store: map[string]string{}, versions: map[string]uint64{}}
+}
+
+// NewMemoryFile returns an in-memory Store persisted to filename. Values saved
+// in filename by an earlier MemoryStore are loaded.
+func NewMemoryFile(filename string) (*MemoryStore, error) {
+	s := NewMemory()
+	f, err := os.Open(filename)
+	if err == nil {
+		defer f.Close()
+		if err := s.Load(f); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.filename = filename
+	return s, nil
+}
+
+// cleanKey turns a path into the key it names
+func cleanKey(p string) string {
+	return path.Clean("/" + p)
 }
 
 // SetValue sets the string value for a string key. The key may include
 // '/' path separators.
-func (s *memoryStore) SetValue(path, value string) error {
+func (s *MemoryStore) SetValue(ctx context.Context, path, value string) error {
 	s.Lock()
-	s.store[path] = value
-	s.Unlock()
-	return nil
+	defer s.Unlock()
+	s.set(cleanKey(path), value)
+	return s.save()
+}
+
+// set changes a key and gives it a new version. The caller holds the lock.
+func (s *MemoryStore) set(key, value string) {
+	prev := s.store[key]
+	s.index++
+	s.store[key] = value
+	s.versions[key] = s.index
+	s.watchers.Send(Event{Type: EventPut, Key: key, Value: value, PrevValue: prev})
+}
+
+// remove deletes a key. The caller holds the lock.
+func (s *MemoryStore) remove(key string) {
+	prev := s.store[key]
+	delete(s.store, key)
+	delete(s.versions, key)
+	s.watchers.Send(Event{Type: EventDelete, Key: key, PrevValue: prev})
 }
 
 // Value retrieves the string value for a string key.
-func (s *memoryStore) Value(path string) string {
+func (s *MemoryStore) Value(ctx context.Context, path string) (string, error) {
 	s.Lock()
 	defer s.Unlock()
-	return s.store[path]
+	value, ok := s.store[cleanKey(path)]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+// VersionedValue retrieves the value of a key and the version it has
+func (s *MemoryStore) VersionedValue(ctx context.Context, path string) (string, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	key := cleanKey(path)
+	return s.store[key], s.versions[key], nil
+}
+
+// CompareAndSwap sets the value of a key unless it changed since version
+func (s *MemoryStore) CompareAndSwap(ctx context.Context, path, value string, version uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	key := cleanKey(path)
+	if s.versions[key] != version {
+		return ErrConflict
+	}
+	s.set(key, value)
+	return s.save()
 }
 
 // Values finds all leaf nodes under the given key. It strips any leading path
 // components from the keys and returns a key/value map. For example, given keys
 // "animals/flea" and "animals/cats/egyptian", Values("animals") would return
 // {"flea" : "...", "egyptian": "..."}
-func (s *memoryStore) Values(path string) map[string]string {
-	return s.store
+func (s *MemoryStore) Values(ctx context.Context, path string) (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	values := map[string]string{}
+	for key, value := range s.store {
+		if under(key, cleanKey(path)) {
+			values[key[strings.LastIndex(key, "/")+1:]] = value
+		}
+	}
+	return values, nil
+}
+
+// Delete removes the specified key and its value from the store, along with
+// every key under it
+func (s *MemoryStore) Delete(ctx context.Context, path string) error {
+	s.Lock()
+	defer s.Unlock()
+	dir := cleanKey(path)
+	for key := range s.store {
+		if key == dir || under(key, dir) {
+			s.remove(key)
+		}
+	}
+	return s.save()
+}
+
+// Watch reports the changes made to a key and the keys under it
+func (s *MemoryStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.watchers.Watch(ctx, prefix), nil
+}
+
+// under tells whether key is below the key dir
+func under(key, dir string) bool {
+	return strings.HasPrefix(key, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// Snapshot writes the values of the store to w as a JSON object
+func (s *MemoryStore) Snapshot(w io.Writer) error {
+	s.Lock()
+	defer s.Unlock()
+	return json.NewEncoder(w).Encode(s.store)
+}
+
+// Load replaces the values of the store with a snapshot read from r
+func (s *MemoryStore) Load(r io.Reader) error {
+	values := map[string]string{}
+	if err := json.NewDecoder(r).Decode(&values); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	loaded := map[string]string{}
+	for key, value := range values {
+		loaded[cleanKey(key)] = value
+	}
+	for key := range s.store {
+		if _, ok := loaded[key]; !ok {
+			s.remove(key)
+		}
+	}
+	for key, value := range loaded {
+		s.set(key, value)
+	}
+	return s.save()
 }
 
-// Delete removes the specified key and its value from the store
-func (s *memoryStore) Delete(path string) error {
-	return nil
+// save writes a snapshot to the store's file, if it has one. The snapshot
+// replaces the file only once it is complete. The caller holds the lock.
+func (s *MemoryStore) save() error {
+	if s.filename == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.store)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.filename)
 }
@@ -0,0 +1,64 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/namely/broadway/pkg/store"
+	"github.com/namely/broadway/pkg/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+func TestMemoryConformance(t *testing.T) {
+	storetest.Run(t, func() store.Store { return store.NewMemory() })
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	s := store.NewMemory()
+	s.SetValue(ctx, "/broadway/instances/web/1", "one")
+	s.SetValue(ctx, "broadway/instances/web/2/", "two")
+
+	var b bytes.Buffer
+	assert.Nil(t, s.Snapshot(&b))
+	assert.Equal(t, `{"/broadway/instances/web/1":"one","/broadway/instances/web/2":"two"}`+"\n", b.String())
+
+	loaded := store.NewMemory()
+	loaded.SetValue(ctx, "/stale", "gone")
+	assert.Nil(t, loaded.Load(&b))
+	values, _ := s.Values(ctx, "/")
+	loadedValues, _ := loaded.Values(ctx, "/")
+	assert.Equal(t, values, loadedValues)
+	_, err := loaded.Value(ctx, "/stale")
+	assert.Equal(t, store.ErrNotFound, err, "loading should replace the values")
+}
+
+func TestMemoryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "store.json")
+
+	s, err := store.NewMemoryFile(filename)
+	assert.Nil(t, err, "a missing file should start an empty store")
+	s.SetValue(ctx, "/broadway/instances/web/1", "one")
+	s.SetValue(ctx, "/broadway/instances/web/2", "two")
+	s.Delete(ctx, "/broadway/instances/web/2")
+
+	reopened, err := store.NewMemoryFile(filename)
+	assert.Nil(t, err)
+	values, err := reopened.Values(ctx, "/broadway")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"1": "one"}, values)
+
+	ioutil.WriteFile(filename, []byte("{"), 0600)
+	_, err = store.NewMemoryFile(filename)
+	assert.NotNil(t, err, "a corrupt file should not be loaded")
+}
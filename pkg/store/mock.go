@@ -1,29 +1,50 @@
 package store
 
+import "context"
+
 // FakeStore mock for the store
 type FakeStore struct {
 	MockSetValue func(path, value string) error
-	MockValue    func(path string) string
-	MockValues   func(path string) map[string]string
+	MockValue    func(path string) (string, error)
+	MockValues   func(path string) (map[string]string, error)
 	MockDelete   func(path string) error
+
+	MockVersionedValue func(path string) (string, uint64, error)
+	MockCompareAndSwap func(path, value string, version uint64) error
+	MockWatch          func(prefix string) (<-chan Event, error)
 }
 
 // SetValue mocked implementation
-func (fs *FakeStore) SetValue(path, value string) error {
+func (fs *FakeStore) SetValue(ctx context.Context, path, value string) error {
 	return fs.MockSetValue(path, value)
 }
 
 // Value mocked implementation
-func (fs *FakeStore) Value(path string) string {
+func (fs *FakeStore) Value(ctx context.Context, path string) (string, error) {
 	return fs.MockValue(path)
 }
 
 // Values mocked implementation
-func (fs *FakeStore) Values(path string) map[string]string {
+func (fs *FakeStore) Values(ctx context.Context, path string) (map[string]string, error) {
 	return fs.MockValues(path)
 }
 
 // Delete mocked implementation
-func (fs *FakeStore) Delete(path string) error {
+func (fs *FakeStore) Delete(ctx context.Context, path string) error {
 	return fs.MockDelete(path)
 }
+
+// VersionedValue mocked implementation
+func (fs *FakeStore) VersionedValue(ctx context.Context, path string) (string, uint64, error) {
+	return fs.MockVersionedValue(path)
+}
+
+// CompareAndSwap mocked implementation
+func (fs *FakeStore) CompareAndSwap(ctx context.Context, path, value string, version uint64) error {
+	return fs.MockCompareAndSwap(path, value, version)
+}
+
+// Watch mocked implementation
+func (fs *FakeStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return fs.MockWatch(prefix)
+}
@@ -0,0 +1,81 @@
+package sqlstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/store"
+	"github.com/namely/broadway/pkg/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+func newSQLite(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "sqlstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(SQLite, filepath.Join(dir, "broadway.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func() store.Store {
+		return newSQLite(t)
+	})
+}
+
+func TestFindInstances(t *testing.T) {
+	s := newSQLite(t)
+	instances := []*instance.Instance{
+		{PlaybookID: "hello", ID: "1", Status: instance.StatusDeployed, Created: 10, ExpiredAt: 20,
+			Vars: map[string]string{"owner": "ann"}},
+		{PlaybookID: "hello", ID: "2", Status: instance.StatusDeployed, Created: 20, ExpiredAt: 0,
+			Vars: map[string]string{"owner": "bob"}},
+		{PlaybookID: "hello", ID: "3", Status: instance.StatusError, Created: 30, ExpiredAt: 20,
+			Vars: map[string]string{"owner": "ann"}},
+		{PlaybookID: "other", ID: "4", Status: instance.StatusDeployed, Created: 40, ExpiredAt: 20},
+	}
+	for _, i := range instances {
+		i.Path = instance.Path{RootPath: "/sqltest", PlaybookID: i.PlaybookID, ID: i.ID}
+		assert.Nil(t, instance.Save(ctx, s, i))
+	}
+	assert.Nil(t, s.SetValue(ctx, "/sqltest/instances/hello/5", "malformed"))
+
+	cases := []struct {
+		Name  string
+		Query instance.Query
+		IDs   []string
+	}{
+		{"playbook", instance.Query{Path: "/sqltest/instances/hello"}, []string{"1", "2", "3"}},
+		{"status", instance.Query{Path: "/sqltest/instances", Statuses: []instance.Status{instance.StatusError}}, []string{"3"}},
+		{"expired", instance.Query{Path: "/sqltest/instances", ExpiredBefore: 20}, []string{"1", "3", "4"}},
+		{"created", instance.Query{Path: "/sqltest/instances", CreatedAfter: 20, CreatedBefore: 30}, []string{"2", "3"}},
+		{"owner", instance.Query{Path: "/sqltest/instances", Vars: map[string]string{"owner": "ann"}}, []string{"1", "3"}},
+	}
+	for _, c := range cases {
+		found, err := s.FindInstances(ctx, c.Query)
+		assert.Nil(t, err, c.Name)
+		ids := []string{}
+		for _, i := range found {
+			ids = append(ids, i.ID)
+			assert.True(t, c.Query.Match(i), c.Name)
+		}
+		assert.Equal(t, c.IDs, ids, c.Name)
+	}
+
+	assert.Nil(t, s.Delete(ctx, "/sqltest/instances/hello"))
+	found, err := s.FindInstances(ctx, instance.Query{Path: "/sqltest/instances"})
+	assert.Nil(t, err)
+	assert.Len(t, found, 1, "deleted instances should not be found")
+}
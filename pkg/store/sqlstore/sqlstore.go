@@ -0,0 +1,431 @@
+// Package sqlstore implements store.Store on a SQL database. Values are kept in
+// a key/value table, and instances and revisions are also written to tables
+// of their own, so that instances can be selected by the database.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/namely/broadway/pkg/instance"
+	"github.com/namely/broadway/pkg/store"
+)
+
+// Dialect names the SQL database a Store talks to. It is also the name of the
+// database/sql driver opening it.
+type Dialect string
+
+const (
+	// SQLite keeps the data in a local file
+	SQLite Dialect = "sqlite3"
+	// Postgres keeps the data in a PostgreSQL database
+	Postgres Dialect = "postgres"
+)
+
+// Store is a store.Store keeping its values in a SQL database. Keys are paths
+// like in etcd: "a/b" and "/a/b/" name the same key, and a key holds the keys
+// under it. Watch only reports the changes made through the Store, and not
+// the ones of other processes sharing the database.
+type Store struct {
+	db       *sql.DB
+	dialect  Dialect
+	watchers store.Fanout
+}
+
+// Open connects to the database named by dsn, and creates the tables of the
+// store if they are missing. The driver of the dialect must be linked in the
+// binary.
+func Open(dialect Dialect, dsn string) (*Store, error) {
+	db, err := sql.Open(string(dialect), dsn)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, dialect)
+}
+
+// New returns a Store using an open database, and creates the tables of the
+// store if they are missing
+func New(db *sql.DB, dialect Dialect) (*Store, error) {
+	if dialect != SQLite && dialect != Postgres {
+		return nil, fmt.Errorf("broadway/sqlstore: unknown dialect %s", dialect)
+	}
+	if dialect == SQLite {
+		// SQLite locks the whole file while writing
+		db.SetMaxOpenConns(1)
+	}
+	s := &Store{db: db, dialect: dialect}
+	for _, stmt := range s.schema() {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) schema() []string {
+	serial := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	// Keys are selected by ranges, which need them sorted byte by byte. SQLite
+	// compares text that way, but Postgres follows the collation of the
+	// database unless told otherwise.
+	key := "TEXT"
+	if s.dialect == Postgres {
+		serial = "BIGSERIAL PRIMARY KEY"
+		key = `TEXT COLLATE "C"`
+	}
+	return []string{
+		`CREATE TABLE IF NOT EXISTS kv (
+			key ` + key + ` PRIMARY KEY,
+			value TEXT NOT NULL,
+			version BIGINT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS kv_index (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			n BIGINT NOT NULL)`,
+		`INSERT INTO kv_index (id, n) VALUES (1, 0) ON CONFLICT (id) DO NOTHING`,
+		`CREATE TABLE IF NOT EXISTS instances (
+			key ` + key + ` PRIMARY KEY,
+			playbook_id TEXT NOT NULL,
+			id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			expired_at BIGINT NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS instances_status ON instances (status, expired_at)`,
+		`CREATE INDEX IF NOT EXISTS instances_created ON instances (created)`,
+		`CREATE TABLE IF NOT EXISTS instance_vars (
+			key ` + key + ` NOT NULL,
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (key, name))`,
+		`CREATE INDEX IF NOT EXISTS instance_vars_value ON instance_vars (name, value)`,
+		`CREATE TABLE IF NOT EXISTS revisions (
+			key ` + key + ` PRIMARY KEY,
+			playbook_id TEXT NOT NULL,
+			instance_id TEXT NOT NULL,
+			number INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			author TEXT NOT NULL,
+			started BIGINT NOT NULL,
+			finished BIGINT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS audit_events (
+			id ` + serial + `,
+			key ` + key + ` NOT NULL,
+			action TEXT NOT NULL,
+			status TEXT NOT NULL,
+			at BIGINT NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS audit_events_key ON audit_events (key, at)`,
+	}
+}
+
+// rebind turns the ? placeholders of a query into the ones of the dialect
+func (s *Store) rebind(query string) string {
+	if s.dialect != Postgres {
+		return query
+	}
+	n := 0
+	return placeholder.ReplaceAllStringFunc(query, func(string) string {
+		n++
+		return "$" + strconv.Itoa(n)
+	})
+}
+
+func (s *Store) exec(tx *sql.Tx, query string, args ...interface{}) error {
+	_, err := tx.Exec(s.rebind(query), args...)
+	return err
+}
+
+// cleanKey turns a path into the key it names
+func cleanKey(p string) string {
+	return path.Clean("/" + p)
+}
+
+// under returns the range of the keys held by key
+func under(key string) (prefix, end string) {
+	prefix = key + "/"
+	if key == "/" {
+		prefix = key
+	}
+	return prefix, prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+}
+
+var (
+	placeholder = regexp.MustCompile(`\?`)
+	instanceKey = regexp.MustCompile(`/instances/[^/]+/[^/]+$`)
+	revisionKey = regexp.MustCompile(`/revisions/[^/]+/[^/]+/[0-9]+$`)
+)
+
+// update runs fn in a transaction bumping the index of the store, which
+// serializes the writers. fn gets the new index, and returns the changes it
+// made for the watchers of the store.
+func (s *Store) update(ctx context.Context, fn func(tx *sql.Tx, index int64) ([]store.Event, error)) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storeError(ctx, err)
+	}
+	var index int64
+	var events []store.Event
+	err = s.exec(tx, `UPDATE kv_index SET n = n + 1 WHERE id = 1`)
+	if err == nil {
+		err = tx.QueryRow(`SELECT n FROM kv_index WHERE id = 1`).Scan(&index)
+	}
+	if err == nil {
+		events, err = fn(tx, index)
+	}
+	if err != nil {
+		tx.Rollback()
+		return storeError(ctx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return storeError(ctx, err)
+	}
+	for _, e := range events {
+		s.watchers.Send(e)
+	}
+	return nil
+}
+
+// storeError turns the errors reaching the database into the ones of the store
+func storeError(ctx context.Context, err error) error {
+	if err == nil || err == store.ErrConflict {
+		return err
+	}
+	if _, ok := err.(net.Error); ok || err == driver.ErrBadConn || ctx.Err() != nil {
+		return store.Unavailable(ctx, err)
+	}
+	return err
+}
+
+// set writes a key and the rows decoded from its value
+func (s *Store) set(tx *sql.Tx, key, value string, index int64) ([]store.Event, error) {
+	e := store.Event{Type: store.EventPut, Key: key, Value: value}
+	err := tx.QueryRow(s.rebind(`SELECT value FROM kv WHERE key = ?`), key).Scan(&e.PrevValue)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	err = s.exec(tx, `INSERT INTO kv (key, value, version) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, version = excluded.version`,
+		key, value, index)
+	if err == nil && instanceKey.MatchString(key) {
+		err = s.setInstance(tx, key, value)
+	} else if err == nil && revisionKey.MatchString(key) {
+		err = s.setRevision(tx, key, value)
+	}
+	return []store.Event{e}, err
+}
+
+func (s *Store) setInstance(tx *sql.Tx, key, value string) error {
+	if err := s.exec(tx, `DELETE FROM instance_vars WHERE key = ?`, key); err != nil {
+		return err
+	}
+	i := &instance.Instance{}
+	if err := json.Unmarshal([]byte(value), i); err != nil {
+		glog.Warningf("Not indexing the malformed instance %s: %s", key, err)
+		return s.exec(tx, `DELETE FROM instances WHERE key = ?`, key)
+	}
+	err := s.exec(tx, `INSERT INTO instances (key, playbook_id, id, status, created, expired_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET playbook_id = excluded.playbook_id, id = excluded.id,
+			status = excluded.status, created = excluded.created, expired_at = excluded.expired_at`,
+		key, i.PlaybookID, i.ID, string(i.Status), i.Created, i.ExpiredAt)
+	if err != nil {
+		return err
+	}
+	for name, v := range i.Vars {
+		if err := s.exec(tx, `INSERT INTO instance_vars (key, name, value) VALUES (?, ?, ?)`, key, name, v); err != nil {
+			return err
+		}
+	}
+	return s.exec(tx, `INSERT INTO audit_events (key, action, status, at) VALUES (?, ?, ?, ?)`,
+		key, "set", string(i.Status), time.Now().Unix())
+}
+
+func (s *Store) setRevision(tx *sql.Tx, key, value string) error {
+	r := &instance.Revision{}
+	if err := json.Unmarshal([]byte(value), r); err != nil {
+		glog.Warningf("Not indexing the malformed revision %s: %s", key, err)
+		return s.exec(tx, `DELETE FROM revisions WHERE key = ?`, key)
+	}
+	return s.exec(tx, `INSERT INTO revisions (key, playbook_id, instance_id, number, status, author, started, finished)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET playbook_id = excluded.playbook_id, instance_id = excluded.instance_id,
+			number = excluded.number, status = excluded.status, author = excluded.author,
+			started = excluded.started, finished = excluded.finished`,
+		key, r.PlaybookID, r.InstanceID, r.Number, string(r.Status), r.Author, r.Started, r.Finished)
+}
+
+// SetValue sets the string value for a string key. The key may include
+// '/' path separators.
+func (s *Store) SetValue(ctx context.Context, path, value string) error {
+	return s.update(ctx, func(tx *sql.Tx, index int64) ([]store.Event, error) {
+		return s.set(tx, cleanKey(path), value, index)
+	})
+}
+
+// Value retrieves the string value for a string key.
+func (s *Store) Value(ctx context.Context, path string) (string, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT value FROM kv WHERE key = ?`), cleanKey(path)).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", store.ErrNotFound
+	}
+	return value, storeError(ctx, err)
+}
+
+// VersionedValue retrieves the value of a key and the index of its last
+// change
+func (s *Store) VersionedValue(ctx context.Context, path string) (string, uint64, error) {
+	var value string
+	var version int64
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT value, version FROM kv WHERE key = ?`), cleanKey(path)).Scan(&value, &version)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	return value, uint64(version), storeError(ctx, err)
+}
+
+// CompareAndSwap sets the value of a key in a transaction if it wasn't changed
+// since the index version
+func (s *Store) CompareAndSwap(ctx context.Context, path, value string, version uint64) error {
+	key := cleanKey(path)
+	return s.update(ctx, func(tx *sql.Tx, index int64) ([]store.Event, error) {
+		var current int64
+		err := tx.QueryRow(s.rebind(`SELECT version FROM kv WHERE key = ?`), key).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if uint64(current) != version {
+			return nil, store.ErrConflict
+		}
+		return s.set(tx, key, value, index)
+	})
+}
+
+// Values finds all leaf nodes under the given key. It strips any leading path
+// components from the keys and returns a key/value map. For example, given keys
+// "animals/flea" and "animals/cats/egyptian", Values("animals") would return
+// {"flea" : "...", "egyptian": "..."}
+func (s *Store) Values(ctx context.Context, path string) (map[string]string, error) {
+	values := map[string]string{}
+	prefix, end := under(cleanKey(path))
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT key, value FROM kv WHERE key >= ? AND key < ?`), prefix, end)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, storeError(ctx, err)
+		}
+		values[key[strings.LastIndex(key, "/")+1:]] = value
+	}
+	return values, storeError(ctx, rows.Err())
+}
+
+// Delete removes the specified key and the keys under it
+func (s *Store) Delete(ctx context.Context, path string) error {
+	key := cleanKey(path)
+	prefix, end := under(key)
+	return s.update(ctx, func(tx *sql.Tx, index int64) ([]store.Event, error) {
+		events, err := s.deleted(tx, key, prefix, end)
+		if err != nil {
+			return nil, err
+		}
+		err = s.exec(tx, `INSERT INTO audit_events (key, action, status, at)
+			SELECT key, CAST(? AS TEXT), status, CAST(? AS BIGINT) FROM instances WHERE key = ? OR (key >= ? AND key < ?)`,
+			"delete", time.Now().Unix(), key, prefix, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range []string{"kv", "instances", "instance_vars", "revisions"} {
+			err := s.exec(tx, `DELETE FROM `+table+` WHERE key = ? OR (key >= ? AND key < ?)`, key, prefix, end)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return events, nil
+	})
+}
+
+// deleted returns the events for deleting a key and the keys under it
+func (s *Store) deleted(tx *sql.Tx, key, prefix, end string) ([]store.Event, error) {
+	rows, err := tx.Query(s.rebind(`SELECT key, value FROM kv WHERE key = ? OR (key >= ? AND key < ?)`), key, prefix, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []store.Event
+	for rows.Next() {
+		e := store.Event{Type: store.EventDelete}
+		if err := rows.Scan(&e.Key, &e.PrevValue); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Watch reports the changes made through the Store to a key and the keys
+// under it
+func (s *Store) Watch(ctx context.Context, prefix string) (<-chan store.Event, error) {
+	return s.watchers.Watch(ctx, prefix), nil
+}
+
+// FindInstances selects instances with the database
+func (s *Store) FindInstances(ctx context.Context, q instance.Query) ([]*instance.Instance, error) {
+	prefix, end := under(cleanKey(q.Path))
+	query := `SELECT kv.value FROM instances JOIN kv ON kv.key = instances.key
+		WHERE instances.key >= ? AND instances.key < ?`
+	args := []interface{}{prefix, end}
+	if len(q.Statuses) > 0 {
+		query += ` AND instances.status IN (?` + strings.Repeat(`, ?`, len(q.Statuses)-1) + `)`
+		for _, status := range q.Statuses {
+			args = append(args, string(status))
+		}
+	}
+	if q.ExpiredBefore != 0 {
+		query += ` AND instances.expired_at != 0 AND instances.expired_at <= ?`
+		args = append(args, q.ExpiredBefore)
+	}
+	if q.CreatedAfter != 0 {
+		query += ` AND instances.created >= ?`
+		args = append(args, q.CreatedAfter)
+	}
+	if q.CreatedBefore != 0 {
+		query += ` AND instances.created <= ?`
+		args = append(args, q.CreatedBefore)
+	}
+	for name, value := range q.Vars {
+		query += ` AND EXISTS (SELECT 1 FROM instance_vars v
+			WHERE v.key = instances.key AND v.name = ? AND v.value = ?)`
+		args = append(args, name, value)
+	}
+	query += ` ORDER BY instances.key`
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	defer rows.Close()
+	instances := []*instance.Instance{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, storeError(ctx, err)
+		}
+		i := &instance.Instance{}
+		if err := json.Unmarshal([]byte(value), i); err != nil {
+			return nil, instance.ErrMalformedSaveData
+		}
+		instances = append(instances, i)
+	}
+	return instances, storeError(ctx, rows.Err())
+}
@@ -0,0 +1,68 @@
+package sqlstore
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebind(t *testing.T) {
+	query := `SELECT value FROM kv WHERE key >= ? AND key < ?`
+	assert.Equal(t, query, (&Store{dialect: SQLite}).rebind(query))
+	assert.Equal(t, `SELECT value FROM kv WHERE key >= $1 AND key < $2`, (&Store{dialect: Postgres}).rebind(query))
+}
+
+func TestUnder(t *testing.T) {
+	cases := []struct {
+		Key    string
+		Prefix string
+		End    string
+	}{
+		{"/broadway", "/broadway/", "/broadway0"},
+		{"/", "/", "0"},
+	}
+	for _, c := range cases {
+		prefix, end := under(c.Key)
+		assert.Equal(t, c.Prefix, prefix, c.Key)
+		assert.Equal(t, c.End, end, c.Key)
+	}
+}
+
+func TestSchemaKeys(t *testing.T) {
+	key := regexp.MustCompile(`\n\s*key ([^,]*),`)
+	keys := 0
+	for _, stmt := range (&Store{dialect: Postgres}).schema() {
+		for _, m := range key.FindAllStringSubmatch(stmt, -1) {
+			assert.Contains(t, m[1], `COLLATE "C"`, "Postgres keys should sort byte by byte: "+stmt)
+			keys++
+		}
+	}
+	assert.Equal(t, 5, keys)
+	for _, stmt := range (&Store{dialect: SQLite}).schema() {
+		assert.NotContains(t, stmt, "COLLATE", "SQLite sorts text byte by byte already")
+	}
+}
+
+func TestIndexedKeys(t *testing.T) {
+	cases := []struct {
+		Key      string
+		Instance bool
+		Revision bool
+	}{
+		{"/broadway/instances/hello/pr1", true, false},
+		{"/broadway/instances/hello", false, false},
+		{"/broadway/revisions/hello/pr1/3", false, true},
+		{"/broadway/revisions/hello/pr1", false, false},
+		{"/broadway/locks/hello", false, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.Instance, instanceKey.MatchString(c.Key), c.Key)
+		assert.Equal(t, c.Revision, revisionKey.MatchString(c.Key), c.Key)
+	}
+}
+
+func TestUnknownDialect(t *testing.T) {
+	_, err := New(nil, Dialect("mysql"))
+	assert.EqualError(t, err, "broadway/sqlstore: unknown dialect mysql")
+}
@@ -1,9 +1,88 @@
 package store
 
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrConflict is returned by CompareAndSwap when the value changed since it
+// was read
+var ErrConflict = errors.New("broadway/store: the value was changed by another writer")
+
+// ErrNotFound is returned by Value when the key doesn't exist
+var ErrNotFound = errors.New("broadway/store: the key was not found")
+
+// UnavailableError is returned when the store can't be reached
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("broadway/store: the store is unavailable: %s", e.Err)
+}
+
+// TimeoutError is returned when the store didn't answer before the deadline
+// of the context
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("broadway/store: the store timed out: %s", e.Err)
+}
+
+// Unavailable wraps an error reaching a store in a TimeoutError when the
+// deadline of ctx passed, and in an UnavailableError otherwise
+func Unavailable(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded || err == context.DeadlineExceeded {
+		return &TimeoutError{err}
+	}
+	if ctx.Err() == context.Canceled {
+		return ctx.Err()
+	}
+	return &UnavailableError{err}
+}
+
+// EventType tells how a key changed
+type EventType string
+
+const (
+	// EventPut reports that a key was set
+	EventPut EventType = "put"
+	// EventDelete reports that a key was deleted
+	EventDelete EventType = "delete"
+)
+
+// Event is a change to a key reported by Store.Watch
+type Event struct {
+	Type      EventType
+	Key       string
+	Value     string // the new value, empty when the key was deleted
+	PrevValue string // the value before the change, empty for a new key
+}
+
 // Store declares an interface for a key/value store
 type Store interface {
-	SetValue(path, value string) error
-	Value(path string) string
-	Values(path string) map[string]string
-	Delete(path string) error
+	SetValue(ctx context.Context, path, value string) error
+	// Value returns ErrNotFound when the key doesn't exist
+	Value(ctx context.Context, path string) (string, error)
+	// Values returns no values when the key doesn't exist
+	Values(ctx context.Context, path string) (map[string]string, error)
+	// Delete removes a key and the keys under it. Deleting a missing key
+	// isn't an error.
+	Delete(ctx context.Context, path string) error
+
+	// VersionedValue returns the value of a key and its version. A missing
+	// key has an empty value and version 0.
+	VersionedValue(ctx context.Context, path string) (string, uint64, error)
+	// CompareAndSwap sets the value of a key if its version is still version,
+	// and returns ErrConflict otherwise. Version 0 requires a missing key.
+	CompareAndSwap(ctx context.Context, path, value string, version uint64) error
+
+	// Watch reports the changes made to a key and the keys under it after
+	// Watch returns. The channel is closed when ctx is done or the watch
+	// fails, and watchers should then watch again. Deleting a key may be
+	// reported as one event for it, without events for the keys under it.
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
 }
@@ -0,0 +1,171 @@
+// Package storetest holds the tests every store.Store implementation must pass
+package storetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/namely/broadway/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// root holds every key the tests write, so stores sharing their data with
+// other tests can be used
+const root = "/storetest"
+
+var ctx = context.Background()
+
+// Run runs the conformance tests against stores made by newStore
+func Run(t *testing.T, newStore func() store.Store) {
+	tests := []struct {
+		Name string
+		Test func(*testing.T, store.Store)
+	}{
+		{"Value", testValue},
+		{"Values", testValues},
+		{"Delete", testDelete},
+		{"DeleteRecursive", testDeleteRecursive},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"Watch", testWatch},
+	}
+	for _, test := range tests {
+		s := newStore()
+		s.Delete(ctx, root)
+		t.Run(test.Name, func(t *testing.T) { test.Test(t, s) })
+		s.Delete(ctx, root)
+	}
+}
+
+// value returns the value of a key, or "" when it's missing
+func value(t *testing.T, s store.Store, path string) string {
+	v, err := s.Value(ctx, path)
+	if err == store.ErrNotFound {
+		return ""
+	}
+	assert.Nil(t, err, path)
+	return v
+}
+
+// values returns the values under a key
+func values(t *testing.T, s store.Store, path string) map[string]string {
+	v, err := s.Values(ctx, path)
+	assert.Nil(t, err, path)
+	return v
+}
+
+func testValue(t *testing.T, s store.Store) {
+	assert.Nil(t, s.SetValue(ctx, root+"/a", "val"))
+	assert.Equal(t, "val", value(t, s, root+"/a"))
+
+	assert.Nil(t, s.SetValue(ctx, root+"/a", "ok"))
+	assert.Equal(t, "ok", value(t, s, root+"/a"), "a value should be replaced")
+
+	_, err := s.Value(ctx, root+"/empty")
+	assert.Equal(t, store.ErrNotFound, err, "a missing key should not be found")
+}
+
+func testValues(t *testing.T, s store.Store) {
+	assert.Nil(t, s.SetValue(ctx, root+"/vv/a", "A"))
+	assert.Nil(t, s.SetValue(ctx, root+"/vv/b", "B"))
+	assert.Nil(t, s.SetValue(ctx, root+"/vv/nested/c", "C"))
+	assert.Nil(t, s.SetValue(ctx, root+"/vvx/d", "D"))
+
+	vv := values(t, s, root+"/vv")
+	assert.Equal(t, map[string]string{"a": "A", "b": "B", "c": "C"}, vv,
+		"leaves under the key should be listed by their last path element")
+	assert.Equal(t, vv, values(t, s, root+"/vv/"), "a trailing slash should not matter")
+
+	assert.Len(t, values(t, s, root+"/oooo"), 0, "a missing key should have no values")
+}
+
+func testDelete(t *testing.T, s store.Store) {
+	assert.Nil(t, s.SetValue(ctx, root+"/d", "A"))
+	assert.Nil(t, s.SetValue(ctx, root+"/dd", "B"))
+
+	assert.Nil(t, s.Delete(ctx, root+"/d"))
+	assert.Equal(t, "", value(t, s, root+"/d"))
+	assert.Equal(t, "B", value(t, s, root+"/dd"), "keys sharing a prefix should be kept")
+
+	assert.Nil(t, s.Delete(ctx, root+"/d"), "deleting a missing key should not fail")
+}
+
+func testDeleteRecursive(t *testing.T, s store.Store) {
+	assert.Nil(t, s.SetValue(ctx, root+"/tree/a", "A"))
+	assert.Nil(t, s.SetValue(ctx, root+"/tree/sub/b", "B"))
+	assert.Nil(t, s.SetValue(ctx, root+"/treetop", "C"))
+
+	assert.Nil(t, s.Delete(ctx, root+"/tree"))
+	assert.Len(t, values(t, s, root+"/tree"), 0, "keys under the deleted key should be removed")
+	assert.Equal(t, "", value(t, s, root+"/tree/sub/b"))
+	assert.Equal(t, "C", value(t, s, root+"/treetop"))
+}
+
+func testCompareAndSwap(t *testing.T, s store.Store) {
+	v, version, err := s.VersionedValue(ctx, root+"/cas")
+	assert.Nil(t, err)
+	assert.Equal(t, "", v)
+	assert.Equal(t, uint64(0), version, "a missing key should have version 0")
+
+	assert.Nil(t, s.CompareAndSwap(ctx, root+"/cas", "A", 0), "a missing key should be created")
+	assert.Equal(t, store.ErrConflict, s.CompareAndSwap(ctx, root+"/cas", "B", 0), "an existing key should not be created")
+
+	v, version, err = s.VersionedValue(ctx, root+"/cas")
+	assert.Nil(t, err)
+	assert.Equal(t, "A", v)
+	assert.NotEqual(t, uint64(0), version)
+
+	assert.Nil(t, s.CompareAndSwap(ctx, root+"/cas", "B", version))
+	assert.Equal(t, store.ErrConflict, s.CompareAndSwap(ctx, root+"/cas", "C", version), "a stale version should conflict")
+	assert.Equal(t, "B", value(t, s, root+"/cas"))
+
+	assert.Nil(t, s.SetValue(ctx, root+"/cas", "D"))
+	_, changed, _ := s.VersionedValue(ctx, root+"/cas")
+	assert.NotEqual(t, version, changed, "setting a value should change its version")
+}
+
+// next returns the next event of a watch
+func next(t *testing.T, events <-chan store.Event) store.Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Error("no event was received")
+		return store.Event{}
+	}
+}
+
+func testWatch(t *testing.T, s store.Store) {
+	wctx, cancel := context.WithCancel(ctx)
+	events, err := s.Watch(wctx, root+"/w")
+	if !assert.Nil(t, err) {
+		cancel()
+		return
+	}
+
+	assert.Nil(t, s.SetValue(ctx, root+"/w/a", "1"))
+	assert.Nil(t, s.SetValue(ctx, root+"/wx", "x"))
+	assert.Nil(t, s.SetValue(ctx, root+"/w/a", "2"))
+	assert.Nil(t, s.Delete(ctx, root+"/w/a"))
+	expected := []store.Event{
+		{Type: store.EventPut, Key: root + "/w/a", Value: "1"},
+		{Type: store.EventPut, Key: root + "/w/a", Value: "2", PrevValue: "1"},
+		{Type: store.EventDelete, Key: root + "/w/a", PrevValue: "2"},
+	}
+	for _, e := range expected {
+		assert.Equal(t, e, next(t, events), "keys outside the prefix should not be reported")
+	}
+
+	cancel()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("the watch should end with its context")
+			return
+		}
+	}
+}